@@ -170,7 +170,7 @@ func (b *Backups) SeparateBackupsByAge(countNew uint) (newBackups Backups, oldBa
 	}
 
 	if newBackups.Len() <= 0 && oldBackups.Len() > 0 {
-		panic("No new backups, only old. Not sane! ")
+		return newBackups, oldBackups, errors.New("No new backups, only old. Not sane! ")
 	}
 	return newBackups, oldBackups, nil
 }
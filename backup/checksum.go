@@ -0,0 +1,106 @@
+// Package backup - checksum module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ChecksumSuffix is appended to the name of an object to get the name of its checksum file
+	ChecksumSuffix = ".sha256"
+
+	// Prefix of the line that holds the logical checksum in a checksum file
+	logicalChecksumPrefix = "# logical sha256: "
+)
+
+// Checksums are the hex encoded sha256 sums of an object.
+// Stored is the sum of the data as it is stored (compressed and maybe encrypted),
+// Logical is the sum of the original data before compression and encryption
+type Checksums struct {
+	Stored  string `json:"stored,omitempty"`
+	Logical string `json:"logical,omitempty"`
+}
+
+// Empty returns true if no checksum is known, e.g. for objects written by older versions
+func (c Checksums) Empty() bool {
+	return c.Stored == "" && c.Logical == ""
+}
+
+// Verify compares the sums that were computed while reading the object with the expected ones.
+// Sums that are empty, because they are not known or were not computed, are not checked
+func (c Checksums) Verify(name string, stored string, logical string) error {
+	if c.Stored != "" && stored != "" && c.Stored != stored {
+		return &CorruptObjectError{Name: name, Kind: "stored", Expected: c.Stored, Actual: stored}
+	}
+	if c.Logical != "" && logical != "" && c.Logical != logical {
+		return &CorruptObjectError{Name: name, Kind: "logical", Expected: c.Logical, Actual: logical}
+	}
+	return nil
+}
+
+// Marshal returns the content of a checksum file for the named object.
+// The first line can be checked with "sha256sum -c"
+func (c Checksums) Marshal(name string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s  %s\n", c.Stored, name)
+	if c.Logical != "" {
+		fmt.Fprintf(&buf, "%s%s\n", logicalChecksumPrefix, c.Logical)
+	}
+	return buf.Bytes()
+}
+
+// ParseChecksums parses the content of a checksum file
+func ParseChecksums(data []byte) (c Checksums, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, logicalChecksumPrefix):
+			c.Logical = strings.TrimPrefix(line, logicalChecksumPrefix)
+		case c.Stored == "":
+			c.Stored = strings.Fields(line)[0]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return c, err
+	}
+	if c.Stored == "" {
+		return c, fmt.Errorf("No checksum found")
+	}
+	return c, nil
+}
+
+// CorruptObjectError is returned if the data of an object does not match its checksum
+type CorruptObjectError struct {
+	Name     string
+	Kind     string // "stored" or "logical"
+	Expected string
+	Actual   string
+}
+
+func (e *CorruptObjectError) Error() string {
+	return fmt.Sprintf("corrupt object %s: %s sha256 is %s, expected %s", e.Name, e.Kind, e.Actual, e.Expected)
+}
@@ -0,0 +1,112 @@
+// Package backup - chunk module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const (
+	// chunkInfix separates the object (backup or tablespace) and the number in the name of a chunk object
+	chunkInfix = ".chunk."
+)
+
+// chunkObject identifies a chunk object (without extension) and extracts the backup name, the tablespace OID (if any) and the number
+var chunkObject = regexp.MustCompile(`^(.+?)(` + regexp.QuoteMeta(tablespaceInfix) + `([0-9]+))?` + regexp.QuoteMeta(chunkInfix) + `([0-9]+)$`)
+
+// Chunk is an additional tar archive of a backup or of one of its tablespaces.
+// Backups that are uploaded in parallel are split into chunks, they are extracted to the same place as their object
+type Chunk struct {
+	// Tablespace is the OID of the tablespace, empty for chunks of the backup itself
+	Tablespace string
+	Number     int
+	Name       string
+	Extension  string
+	// Path is also used for alternative backup paths (e.g. bucket in S3)
+	Path string
+	Size int64
+}
+
+// ChunkObjectName returns the name of chunk number of the object (a backup or a tablespace object)
+func ChunkObjectName(objectName string, number int) string {
+	return objectName + chunkInfix + strconv.Itoa(number)
+}
+
+// ParseChunkObject returns the backup, the tablespace (empty for the backup itself) and the number of a chunk object,
+// ok is false for other objects
+func ParseChunkObject(name string) (backupName string, oid string, number int, ok bool) {
+	match := chunkObject.FindStringSubmatch(name)
+	if match == nil {
+		return "", "", 0, false
+	}
+	number, err := strconv.Atoi(match[4])
+	if err != nil {
+		return "", "", 0, false
+	}
+	return match[1], match[3], number, true
+}
+
+// AddChunk attaches the chunk to its backup, it returns false if the backup is not in the list
+func (b *Backups) AddChunk(chunk Chunk) bool {
+	backupName, oid, number, ok := ParseChunkObject(chunk.Name)
+	if !ok {
+		return false
+	}
+	chunk.Tablespace = oid
+	chunk.Number = number
+	for i := range b.Backup {
+		if b.Backup[i].Name == backupName {
+			chunks := append(b.Backup[i].Chunks, chunk)
+			sort.Slice(chunks, func(x, y int) bool {
+				if chunks[x].Tablespace != chunks[y].Tablespace {
+					return chunks[x].Tablespace < chunks[y].Tablespace
+				}
+				return chunks[x].Number < chunks[y].Number
+			})
+			b.Backup[i].Chunks = chunks
+			return true
+		}
+	}
+	return false
+}
+
+// ChunkBackups returns the chunks of the backup (or of the tablespace returned by TablespaceBackup) as backups, so they can be read like one
+func (b *Backup) ChunkBackups() (chunks []*Backup) {
+	for _, chunk := range b.Chunks {
+		if chunk.Tablespace != "" {
+			continue
+		}
+		chunkBackup := *b
+		chunkBackup.Name = chunk.Name
+		chunkBackup.Extension = chunk.Extension
+		chunkBackup.Path = chunk.Path
+		chunkBackup.Size = chunk.Size
+		chunkBackup.Tablespaces = nil
+		chunkBackup.Chunks = nil
+		chunkBackup.Index = nil
+		chunkBackup.Meta = nil
+		chunkBackup.Manifest = nil
+		chunks = append(chunks, &chunkBackup)
+	}
+	return chunks
+}
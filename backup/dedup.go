@@ -0,0 +1,171 @@
+// Package backup - dedup module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+const (
+	// DedupIndexVersion is the version of the format of dedup index objects
+	DedupIndexVersion = 1
+	// DedupExtension is the extension of the objects of deduplicated backups, they list the chunks of the object
+	DedupExtension = ".dedup"
+	// DedupPrefix is the prefix of all chunks of deduplicated backups in the repository
+	DedupPrefix = "dedup"
+	// DedupChunkPrefix is the prefix of the chunk objects, they are stored below it by their sha256
+	DedupChunkPrefix = DedupPrefix + "/chunks/"
+)
+
+var (
+	// dedupChunkKey identifies a chunk object and extracts its hash
+	dedupChunkKey = regexp.MustCompile(`^` + regexp.QuoteMeta(DedupChunkPrefix) + `[0-9a-f]{2}/([0-9a-f]{64})$`)
+	// gear has a random value for every byte, it is the same for every run so the chunks are the same
+	gear [256]uint64
+)
+
+func init() {
+	// splitmix64 with a fixed seed
+	seed := uint64(0x7067676c61736b75)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Object is an object of the repository, e.g. a chunk of a deduplicated backup
+type Object struct {
+	Key  string
+	Size int64
+}
+
+// DedupIndex lists the chunks of an object of a deduplicated backup in order.
+// It is stored instead of the data (compressed and encrypted like it), the chunks are shared by all backups
+type DedupIndex struct {
+	Version int    `json:"version"`
+	Object  string `json:"object"`
+	// Size is the size of the data of the object
+	Size   int64      `json:"size"`
+	Chunks []DedupRef `json:"chunks"`
+}
+
+// DedupRef references a chunk by the sha256 of its data
+type DedupRef struct {
+	Hash string `json:"sha256"`
+	Size int64  `json:"size"`
+}
+
+// ParseDedupIndex parses a stored dedup index
+func ParseDedupIndex(data []byte) (index DedupIndex, err error) {
+	if err = json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("Invalid dedup index: %v", err)
+	}
+	if index.Version > DedupIndexVersion {
+		return index, fmt.Errorf("Dedup index has version %d, this version of pgGlaskugel supports up to %d", index.Version, DedupIndexVersion)
+	}
+	return index, nil
+}
+
+// DedupChunkKey returns the key of the chunk with the given sha256 (as hex).
+// The first two characters of the hash are a directory, so no directory gets too large
+func DedupChunkKey(hash string) string {
+	return DedupChunkPrefix + hash[:2] + "/" + hash
+}
+
+// ParseDedupChunkKey returns the hash of a chunk object, ok is false for other objects
+func ParseDedupChunkKey(key string) (hash string, ok bool) {
+	match := dedupChunkKey.FindStringSubmatch(key)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// Chunker splits a stream into content-defined chunks with a gear hash (like FastCDC).
+// The boundaries only depend on the data before them, so unchanged data gives the same chunks
+// even if data was inserted or removed in front of it
+type Chunker struct {
+	r    io.Reader
+	buf  []byte
+	min  int
+	max  int
+	mask uint64
+	eof  bool
+}
+
+// NewChunker returns a Chunker for r that makes chunks of average bytes on average (at least a quarter, at most four times as much)
+func NewChunker(r io.Reader, average int) *Chunker {
+	bits := uint(0)
+	for 1<<(bits+1) <= average {
+		bits++
+	}
+	if bits == 0 {
+		bits = 1
+	}
+	c := &Chunker{r: r, min: average / 4, max: average * 4}
+	// The high bits of the hash depend on the last 64 bytes, the low bits only on the last few
+	c.mask = (uint64(1)<<bits - 1) << (64 - bits)
+	c.buf = make([]byte, 0, c.max)
+	return c
+}
+
+// Next returns the next chunk, io.EOF after the last one
+func (c *Chunker) Next() (chunk []byte, err error) {
+	for !c.eof && len(c.buf) < c.max {
+		n, err := c.r.Read(c.buf[len(c.buf):c.max])
+		c.buf = c.buf[:len(c.buf)+n]
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+
+	cut := len(c.buf)
+	if cut > c.min {
+		start := c.min - 64
+		if start < 0 {
+			start = 0
+		}
+		var hash uint64
+		for i := start; i < len(c.buf); i++ {
+			hash = hash<<1 + gear[c.buf[i]]
+			if i+1 >= c.min && hash&c.mask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+
+	chunk = make([]byte, cut)
+	copy(chunk, c.buf[:cut])
+	c.buf = c.buf[:copy(c.buf, c.buf[cut:])]
+	return chunk, nil
+}
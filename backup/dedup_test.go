@@ -0,0 +1,108 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// chunks splits data with a Chunker and returns the chunks
+func chunks(t *testing.T, data []byte, average int) (result [][]byte) {
+	c := NewChunker(bytes.NewReader(data), average)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return result
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, chunk)
+	}
+}
+
+func TestChunker(t *testing.T) {
+	const average = 4096
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	result := chunks(t, data, average)
+	if !bytes.Equal(bytes.Join(result, nil), data) {
+		t.Fatal("chunks do not add up to the data")
+	}
+	for i, chunk := range result {
+		if len(chunk) > 4*average || len(chunk) < average/4 && i < len(result)-1 {
+			t.Errorf("chunk %d has %d bytes", i, len(chunk))
+		}
+	}
+	if n := len(result); n < len(data)/average/2 || n > len(data)/average*2 {
+		t.Errorf("%d chunks for %d bytes with an average of %d", n, len(data), average)
+	}
+
+	// Data in front only changes the chunks at the start
+	hashes := make(map[[sha256.Size]byte]bool)
+	for _, chunk := range result {
+		hashes[sha256.Sum256(chunk)] = true
+	}
+	shifted := chunks(t, append([]byte("inserted in front"), data...), average)
+	shared := 0
+	for _, chunk := range shifted {
+		if hashes[sha256.Sum256(chunk)] {
+			shared++
+		}
+	}
+	if shared < len(result)-2 {
+		t.Errorf("only %d of %d chunks are shared after an insert in front", shared, len(result))
+	}
+
+	for _, data := range [][]byte{nil, []byte("small")} {
+		if result := chunks(t, data, average); !bytes.Equal(bytes.Join(result, nil), data) || len(result) > 1 {
+			t.Errorf("%q is split into %d chunks", data, len(result))
+		}
+	}
+}
+
+func TestDedupChunkKey(t *testing.T) {
+	sum := sha256.Sum256([]byte("chunk"))
+	hash := hex.EncodeToString(sum[:])
+	key := DedupChunkKey(hash)
+	if key != DedupChunkPrefix+hash[:2]+"/"+hash {
+		t.Errorf("key is %s", key)
+	}
+	if parsed, ok := ParseDedupChunkKey(key); !ok || parsed != hash {
+		t.Errorf("parsed %q (%t) from %s", parsed, ok, key)
+	}
+	for _, key := range []string{
+		DedupChunkPrefix + hash,
+		DedupChunkPrefix + "00/" + hash[:63],
+		DedupChunkPrefix + hash[:2] + "/" + hash + ".tmp",
+		"basebackup/" + hash[:2] + "/" + hash,
+	} {
+		if _, ok := ParseDedupChunkKey(key); ok {
+			t.Errorf("%s is taken for a chunk", key)
+		}
+	}
+}
@@ -23,12 +23,25 @@ package backup
 import (
 	"errors"
 	"regexp"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 )
 
+// ClusterName returns the name of the cluster the backup was taken from
+func (b *Backup) ClusterName() (clusterName string) {
+	if i := strings.LastIndex(b.Name, "@"); i >= 0 {
+		return b.Name[:i]
+	}
+	return ""
+}
+
 // IsSane returns true if the backup seams sane
 func (b *Backup) IsSane() (sane bool) {
+	// A deduplicated backup only stores the index of its chunks, it is small
+	if b.Extension == DedupExtension {
+		return b.Size > 0
+	}
 	if b.Size < SaneBackupMinSize {
 		return false
 	}
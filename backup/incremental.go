@@ -0,0 +1,167 @@
+// Package backup - incremental module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+const (
+	// IncrementalSuffix is appended to the name of a relation file in an incremental or differential backup.
+	// The entry only holds the pages that changed since the parent, the rest is taken from the parent
+	IncrementalSuffix = ".pgglaskugel-incr"
+
+	// incrementalHeaderSize is the size of magic, file size, block size and block count
+	incrementalHeaderSize = 8 + 8 + 4 + 4
+)
+
+var (
+	// incrementalMagic starts every incremental file
+	incrementalMagic = []byte("PGKINC01")
+	// relationFile matches the main fork of a relation and its segments, only their page LSNs are reliable
+	relationFile = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+)
+
+// IsRelationFile returns true if the file (base name) is the main fork of a relation or a segment of it
+func IsRelationFile(name string) bool {
+	return relationFile.MatchString(name)
+}
+
+// ChangedBlocks reads the relation file from r and returns the blocks with a page LSN at or after since.
+// New pages (LSN 0) are always included. order is the byte order of the cluster
+func ChangedBlocks(r io.Reader, blockSize int, since uint64, order binary.ByteOrder) (blocks []uint32, size int64, err error) {
+	page := make([]byte, blockSize)
+	reader := bufio.NewReaderSize(r, 16*blockSize)
+	for block := uint32(0); ; block++ {
+		n, err := io.ReadFull(reader, page)
+		if err == io.EOF {
+			return blocks, size, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			// The file was truncated while it was read, the WAL replay truncates it as well
+			return blocks, size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		size += int64(n)
+		lsn := uint64(order.Uint32(page[0:4]))<<32 | uint64(order.Uint32(page[4:8]))
+		if lsn == 0 || lsn >= since {
+			blocks = append(blocks, block)
+		}
+	}
+}
+
+// IncrementalSize returns the size of an incremental file with the given number of blocks
+func IncrementalSize(blocks int, blockSize int) int64 {
+	return incrementalHeaderSize + int64(blocks)*(4+int64(blockSize))
+}
+
+// WriteIncremental writes the blocks of file as incremental file to w, size is the size of the relation file.
+// Exactly IncrementalSize bytes are written, blocks that can not be read anymore are written as zeros
+func WriteIncremental(w io.Writer, file io.ReaderAt, size int64, blockSize int, blocks []uint32) (err error) {
+	header := make([]byte, incrementalHeaderSize+4*len(blocks))
+	copy(header, incrementalMagic)
+	binary.BigEndian.PutUint64(header[8:], uint64(size))
+	binary.BigEndian.PutUint32(header[16:], uint32(blockSize))
+	binary.BigEndian.PutUint32(header[20:], uint32(len(blocks)))
+	for i, block := range blocks {
+		binary.BigEndian.PutUint32(header[incrementalHeaderSize+4*i:], block)
+	}
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	page := make([]byte, blockSize)
+	for _, block := range blocks {
+		n, err := file.ReadAt(page, int64(block)*int64(blockSize))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// The file was truncated meanwhile, the WAL replay truncates it as well
+		for i := n; i < blockSize; i++ {
+			page[i] = 0
+		}
+		if _, err = w.Write(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IncrementalFileSize returns the size of the relation file from the header of an incremental file
+func IncrementalFileSize(header []byte) (size int64, ok bool) {
+	if len(header) < incrementalHeaderSize || !bytes.Equal(header[:8], incrementalMagic) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(header[8:])), true
+}
+
+// IncrementalTarget is the restored relation file an incremental file is applied to
+type IncrementalTarget interface {
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// ApplyIncremental reads an incremental file from r and writes its blocks into the relation file target.
+// The relation file has to contain the data of the parent backup, it is truncated (or extended) to its new size
+func ApplyIncremental(target IncrementalTarget, r io.Reader) (err error) {
+	header := make([]byte, incrementalHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("Invalid incremental file: %v", err)
+	}
+	if !bytes.Equal(header[:8], incrementalMagic) {
+		return errors.New("Invalid incremental file: wrong magic")
+	}
+	size := int64(binary.BigEndian.Uint64(header[8:]))
+	blockSize := int64(binary.BigEndian.Uint32(header[16:]))
+	count := binary.BigEndian.Uint32(header[20:])
+	if blockSize == 0 || size%blockSize != 0 || int64(count) > size/blockSize {
+		return fmt.Errorf("Invalid incremental file: %d blocks of %d bytes for %d bytes", count, blockSize, size)
+	}
+	numbers := make([]byte, 4*int64(count))
+	if _, err = io.ReadFull(r, numbers); err != nil {
+		return fmt.Errorf("Invalid incremental file: %v", err)
+	}
+	// The new size first, so the file does not keep pages the relation does not have anymore
+	if err = target.Truncate(size); err != nil {
+		return err
+	}
+	page := make([]byte, blockSize)
+	for i := int64(0); i < int64(count); i++ {
+		block := int64(binary.BigEndian.Uint32(numbers[4*i:]))
+		if (block+1)*blockSize > size {
+			return fmt.Errorf("Invalid incremental file: block %d is after the end", block)
+		}
+		if _, err = io.ReadFull(r, page); err != nil {
+			return fmt.Errorf("Invalid incremental file: %v", err)
+		}
+		if _, err = target.WriteAt(page, block*blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testBlockSize = 64
+
+// relation is an in-memory relation file
+type relation struct{ data []byte }
+
+func (r *relation) WriteAt(p []byte, off int64) (int, error) {
+	if end := off + int64(len(p)); end > int64(len(r.data)) {
+		r.data = append(r.data, make([]byte, end-int64(len(r.data)))...)
+	}
+	return copy(r.data[off:], p), nil
+}
+
+func (r *relation) Truncate(size int64) error {
+	if size > int64(len(r.data)) {
+		r.data = append(r.data, make([]byte, size-int64(len(r.data)))...)
+	}
+	r.data = r.data[:size]
+	return nil
+}
+
+// testPages returns a relation file with one page per LSN, every page is filled with its LSN
+func testPages(lsns ...uint64) []byte {
+	data := make([]byte, 0, len(lsns)*testBlockSize)
+	for _, lsn := range lsns {
+		page := bytes.Repeat([]byte{byte(lsn)}, testBlockSize)
+		binary.LittleEndian.PutUint32(page[0:], uint32(lsn>>32))
+		binary.LittleEndian.PutUint32(page[4:], uint32(lsn))
+		data = append(data, page...)
+	}
+	return data
+}
+
+func TestApplyIncrementalRoundTrip(t *testing.T) {
+	parent := testPages(10, 10, 10, 10)
+	tests := []struct {
+		name   string
+		child  []byte
+		blocks []uint32
+	}{
+		{"unchanged", testPages(10, 10, 10, 10), nil},
+		{"changed", testPages(10, 20, 10, 30), []uint32{1, 3}},
+		// New pages without LSN are always taken
+		{"extended", testPages(10, 10, 10, 10, 20, 0), []uint32{4, 5}},
+		{"truncated", testPages(10, 20), []uint32{1}},
+		{"emptied", nil, nil},
+	}
+	for _, test := range tests {
+		blocks, size, err := ChangedBlocks(bytes.NewReader(test.child), testBlockSize, 15, binary.LittleEndian)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(blocks, test.blocks) || size != int64(len(test.child)) {
+			t.Errorf("%s: changed blocks are %v of %d bytes, expected %v", test.name, blocks, size, test.blocks)
+		}
+
+		incremental := new(bytes.Buffer)
+		if err = WriteIncremental(incremental, bytes.NewReader(test.child), size, testBlockSize, blocks); err != nil {
+			t.Fatal(err)
+		}
+		if int64(incremental.Len()) != IncrementalSize(len(blocks), testBlockSize) {
+			t.Errorf("%s: incremental file has %d bytes, expected %d", test.name, incremental.Len(), IncrementalSize(len(blocks), testBlockSize))
+		}
+		if fileSize, ok := IncrementalFileSize(incremental.Bytes()); !ok || fileSize != size {
+			t.Errorf("%s: size from the header is %d (%t), expected %d", test.name, fileSize, ok, size)
+		}
+
+		target := &relation{append([]byte(nil), parent...)}
+		if err = ApplyIncremental(target, incremental); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !bytes.Equal(target.data, test.child) {
+			t.Errorf("%s: applied relation differs from the child", test.name)
+		}
+	}
+}
+
+func TestApplyIncrementalInvalid(t *testing.T) {
+	valid := new(bytes.Buffer)
+	child := testPages(10, 20)
+	if err := WriteIncremental(valid, bytes.NewReader(child), int64(len(child)), testBlockSize, []uint32{1}); err != nil {
+		t.Fatal(err)
+	}
+	data := valid.Bytes()
+
+	wrongMagic := append([]byte("PGKINC99"), data[8:]...)
+	afterEnd := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(afterEnd[incrementalHeaderSize:], 2)
+	tooMany := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(tooMany[20:], 3)
+	oddSize := append([]byte(nil), data...)
+	binary.BigEndian.PutUint64(oddSize[8:], uint64(len(child)+1))
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "Invalid incremental file: EOF"},
+		{"wrong magic", wrongMagic, "wrong magic"},
+		{"block after the end", afterEnd, "block 2 is after the end"},
+		{"more blocks than pages", tooMany, "3 blocks of 64 bytes"},
+		{"size not a multiple of the block size", oddSize, "for 129 bytes"},
+		{"truncated page", data[:len(data)-1], "unexpected EOF"},
+	}
+	for _, test := range tests {
+		err := ApplyIncremental(&relation{testPages(10, 10)}, bytes.NewReader(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error is %v, expected %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package backup - index module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// IndexVersion is the version of the index format
+	IndexVersion = 1
+
+	// Types of the entries in the index
+	IndexFile     = "file"
+	IndexDir      = "dir"
+	IndexSymlink  = "symlink"
+	IndexHardlink = "hardlink"
+
+	// indexSuffix is appended to the backup name for the name of the index object
+	indexSuffix = ".index"
+)
+
+// indexObject identifies an index object (without extension) and extracts the backup name
+var indexObject = regexp.MustCompile(`^(.+)` + regexp.QuoteMeta(indexSuffix) + `$`)
+
+// Index lists every entry of a backup and its tablespaces with the checksums of the files.
+// It is stored as its own object next to the backup, so the files can be compared or listed without reading the backup
+type Index struct {
+	Version int          `json:"version"`
+	Backup  string       `json:"backup"`
+	Files   []IndexEntry `json:"files"`
+}
+
+// IndexEntry is an entry of the tar archive of the backup or of one of its tablespaces
+type IndexEntry struct {
+	// Name is the cleaned path in the tar archive
+	Name string `json:"name"`
+	// Tablespace is the OID of the tablespace, empty for entries of the backup itself
+	Tablespace string    `json:"tablespace,omitempty"`
+	Type       string    `json:"type"`
+	Mode       int64     `json:"mode"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	Link       string    `json:"link,omitempty"`
+	Sha256     string    `json:"sha256,omitempty"`
+	// RelationSize is the size of the relation file after an incremental entry is applied
+	RelationSize int64 `json:"relation_size,omitempty"`
+}
+
+// IndexObjectName returns the name of the object that stores the index of the backup
+func IndexObjectName(backupName string) string {
+	return backupName + indexSuffix
+}
+
+// ParseIndexObject returns the backup of an index object, ok is false for other objects
+func ParseIndexObject(name string) (backupName string, ok bool) {
+	match := indexObject.FindStringSubmatch(name)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// IsBackupPart returns true for objects that belong to a backup: its tablespaces, its chunks, its index, its metadata and its manifest
+func IsBackupPart(name string) bool {
+	if _, _, ok := ParseTablespaceObject(name); ok {
+		return true
+	}
+	if _, _, _, ok := ParseChunkObject(name); ok {
+		return true
+	}
+	if _, ok := ParseIndexObject(name); ok {
+		return true
+	}
+	if _, ok := ParseMetaObject(name); ok {
+		return true
+	}
+	_, ok := ParseManifestObject(name)
+	return ok
+}
+
+// AddPart attaches a part (given as backup) to its backup, it returns false if the backup is not in the list
+func (b *Backups) AddPart(part Backup) bool {
+	if _, oid, ok := ParseTablespaceObject(part.Name); ok {
+		return b.AddTablespace(Tablespace{OID: oid, Name: part.Name, Extension: part.Extension, Path: part.Path, Size: part.Size})
+	}
+	if _, _, _, ok := ParseChunkObject(part.Name); ok {
+		return b.AddChunk(Chunk{Name: part.Name, Extension: part.Extension, Path: part.Path, Size: part.Size})
+	}
+	backupName, isIndex := ParseIndexObject(part.Name)
+	metaOf, isMeta := ParseMetaObject(part.Name)
+	manifestOf, isManifest := ParseManifestObject(part.Name)
+	switch {
+	case isMeta:
+		backupName = metaOf
+	case isManifest:
+		backupName = manifestOf
+	case !isIndex:
+		return false
+	}
+	for i := range b.Backup {
+		if b.Backup[i].Name == backupName {
+			p := part
+			switch {
+			case isIndex:
+				b.Backup[i].Index = &p
+			case isMeta:
+				b.Backup[i].Meta = &p
+			default:
+				b.Backup[i].Manifest = &p
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Parts returns the objects that belong to the backup (as backups), they are deleted with it
+func (b *Backup) Parts() (parts []Backup) {
+	for _, ts := range b.Tablespaces {
+		parts = append(parts, *b.TablespaceBackup(ts))
+	}
+	for _, chunk := range b.Chunks {
+		parts = append(parts, Backup{Name: chunk.Name, Extension: chunk.Extension, Path: chunk.Path, Size: chunk.Size, StorageType: b.StorageType})
+	}
+	if b.Index != nil {
+		parts = append(parts, *b.Index)
+	}
+	if b.Meta != nil {
+		parts = append(parts, *b.Meta)
+	}
+	if b.Manifest != nil {
+		parts = append(parts, *b.Manifest)
+	}
+	return parts
+}
+
+// IndexTar reads the tar archive from r and returns its entries, tablespace is set in every entry.
+// The content of the files in capture (by cleaned name) is copied into their buffers, e.g. for the backup_label.
+// The archive is not read after its end
+func IndexTar(r io.Reader, tablespace string, capture map[string]*bytes.Buffer) (entries []IndexEntry, err error) {
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, fmt.Errorf("Invalid tar archive: %v", err)
+		}
+		entry := IndexEntry{
+			Name:       path.Clean(strings.TrimPrefix(header.Name, "./")),
+			Tablespace: tablespace,
+			Mode:       header.Mode,
+			ModTime:    header.ModTime,
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			entry.Type = IndexDir
+		case tar.TypeReg, tar.TypeRegA:
+			entry.Type = IndexFile
+			sum := sha256.New()
+			var w io.Writer = sum
+			if buf, ok := capture[entry.Name]; ok {
+				w = io.MultiWriter(sum, buf)
+			}
+			var incremental *headerWriter
+			if strings.HasSuffix(entry.Name, IncrementalSuffix) {
+				incremental = &headerWriter{}
+				w = io.MultiWriter(w, incremental)
+			}
+			if entry.Size, err = io.Copy(w, tarReader); err != nil {
+				return entries, fmt.Errorf("Can not read %s: %v", header.Name, err)
+			}
+			entry.Sha256 = hex.EncodeToString(sum.Sum(nil))
+			if incremental != nil {
+				entry.RelationSize, _ = IncrementalFileSize(incremental.header)
+			}
+		case tar.TypeSymlink:
+			entry.Type = IndexSymlink
+			entry.Link = header.Linkname
+		case tar.TypeLink:
+			entry.Type = IndexHardlink
+			entry.Link = path.Clean(strings.TrimPrefix(header.Linkname, "./"))
+		default:
+			// Restore skips other types as well
+			continue
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// headerWriter keeps the header of an incremental file and discards the rest
+type headerWriter struct {
+	header []byte
+}
+
+func (w *headerWriter) Write(p []byte) (n int, err error) {
+	if missing := incrementalHeaderSize - len(w.header); missing > 0 {
+		if missing > len(p) {
+			missing = len(p)
+		}
+		w.header = append(w.header, p[:missing]...)
+	}
+	return len(p), nil
+}
+
+// ParseIndex parses a stored index
+func ParseIndex(data []byte) (index Index, err error) {
+	if err = json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("Invalid index: %v", err)
+	}
+	if index.Version > IndexVersion {
+		return index, fmt.Errorf("Index version %d is not supported, update pgglaskugel", index.Version)
+	}
+	return index, nil
+}
+
+// Tablespace returns the entries of the backup itself (oid is empty) or of the tablespace oid
+func (i *Index) Tablespace(oid string) (entries []IndexEntry) {
+	for _, e := range i.Files {
+		if e.Tablespace == oid {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
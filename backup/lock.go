@@ -0,0 +1,76 @@
+// Package backup - lock module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// LockShared can be held by many holders at the same time
+	LockShared = LockMode("shared")
+	// LockExclusive can only be held by one holder and excludes shared holders
+	LockExclusive = LockMode("exclusive")
+
+	// LockPrefix is the prefix (or sub directory) for lock objects in the storage.
+	// It is not below a cluster prefix on purpose: the dedup chunks and the repository metadata
+	// are shared by all clusters, so a lock has to exclude the commands of every cluster
+	LockPrefix = "locks"
+)
+
+// LockMode is the mode a lock is held in
+type LockMode string
+
+// Lock is held by one holder on a named resource in the storage
+// Every holder writes its own lock object and refreshes it (heartbeat) before it expires
+type Lock struct {
+	Name    string    `json:"name"`
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Mode    LockMode  `json:"mode"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// Key returns the name of the lock object in the storage
+func (l *Lock) Key() string {
+	return l.Name + "/" + l.ID + ".json"
+}
+
+// Expired returns if the holder did not refresh the lock in time
+func (l *Lock) Expired(now time.Time) bool {
+	return now.After(l.Expires)
+}
+
+// ConflictsWith returns if both locks can not be held at the same time
+func (l *Lock) ConflictsWith(other Lock) bool {
+	if l.Name != other.Name || l.ID == other.ID {
+		return false
+	}
+	return l.Mode == LockExclusive || other.Mode == LockExclusive
+}
+
+// String returns a short description of the lock holder
+func (l Lock) String() string {
+	return fmt.Sprintf("%s lock %q held by %s since %s (expires %s)",
+		l.Mode, l.Name, l.Owner, l.Created.Format(time.RFC3339), l.Expires.Format(time.RFC3339))
+}
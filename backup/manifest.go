@@ -0,0 +1,128 @@
+// Package backup - manifest module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+const (
+	// ManifestFile is the name of the backup manifest written by pg_basebackup (PostgreSQL 13+)
+	ManifestFile = "backup_manifest"
+
+	// The manifest checksum covers everything before this line
+	manifestChecksumLine = "\n\"Manifest-Checksum\""
+
+	// manifestSuffix is appended to the backup name for the name of the object that stores the manifest
+	manifestSuffix = ".manifest"
+)
+
+// manifestObject identifies a manifest object (without extension) and extracts the backup name
+var manifestObject = regexp.MustCompile(`^(.+)` + regexp.QuoteMeta(manifestSuffix) + `$`)
+
+// Manifest is the backup manifest of a basebackup, it lists all files with their checksums
+type Manifest struct {
+	Version  int                `json:"PostgreSQL-Backup-Manifest-Version"`
+	Files    []ManifestFileInfo `json:"Files"`
+	Wal      []ManifestWalRange `json:"WAL-Ranges"`
+	Checksum string             `json:"Manifest-Checksum"`
+}
+
+// ManifestWalRange is a range of WAL on one timeline that is needed to restore the backup
+type ManifestWalRange struct {
+	Timeline int    `json:"Timeline"`
+	StartLSN string `json:"Start-LSN"`
+	EndLSN   string `json:"End-LSN"`
+}
+
+// ManifestFileInfo describes one file in the backup manifest
+type ManifestFileInfo struct {
+	Path        string `json:"Path"`
+	EncodedPath string `json:"Encoded-Path"`
+	Size        int64  `json:"Size"`
+	Algorithm   string `json:"Checksum-Algorithm"`
+	Checksum    string `json:"Checksum"`
+}
+
+// Name returns the path of the file, paths that are not valid UTF-8 are hex encoded in the manifest
+func (f ManifestFileInfo) Name() string {
+	if f.EncodedPath != "" {
+		if decoded, err := hex.DecodeString(f.EncodedPath); err == nil {
+			return string(decoded)
+		}
+	}
+	return f.Path
+}
+
+// ManifestObjectName returns the name of the object that stores the manifest of the backup.
+// pg_basebackup writes the manifest next to the tar files if it does not stream the backup
+func ManifestObjectName(backupName string) string {
+	return backupName + manifestSuffix
+}
+
+// ParseManifestObject returns the backup of a manifest object, ok is false for other objects
+func ParseManifestObject(name string) (backupName string, ok bool) {
+	match := manifestObject.FindStringSubmatch(name)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// Start returns the start LSN and the timeline of the backup from the WAL ranges
+func (m *Manifest) Start() (startLSN string, timeline string, err error) {
+	var start uint64
+	for _, r := range m.Wal {
+		lsn, err := ParseLSN(r.StartLSN)
+		if err != nil {
+			return "", "", err
+		}
+		if startLSN == "" || lsn < start {
+			start, startLSN, timeline = lsn, r.StartLSN, strconv.Itoa(r.Timeline)
+		}
+	}
+	if startLSN == "" {
+		return "", "", fmt.Errorf("Backup manifest has no WAL ranges")
+	}
+	return startLSN, timeline, nil
+}
+
+// ParseManifest parses a backup manifest and checks the checksum of the manifest itself
+func ParseManifest(data []byte) (m Manifest, err error) {
+	if err = json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("Invalid backup manifest: %v", err)
+	}
+	end := bytes.Index(data, []byte(manifestChecksumLine))
+	if end < 0 || m.Checksum == "" {
+		return m, fmt.Errorf("Backup manifest has no checksum")
+	}
+	sum := sha256.Sum256(data[:end+1])
+	if actual := hex.EncodeToString(sum[:]); actual != m.Checksum {
+		return m, &CorruptObjectError{Name: ManifestFile, Kind: "manifest", Expected: m.Checksum, Actual: actual}
+	}
+	return m, nil
+}
@@ -0,0 +1,164 @@
+// Package backup - meta module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MetaVersion is the version of the metadata format
+	MetaVersion = 1
+
+	// Types of backups
+	BackupTypeFull         = "full"
+	BackupTypeIncremental  = "incremental"
+	BackupTypeDifferential = "differential"
+
+	// Methods to take a backup
+	MethodPgBasebackup = "pg_basebackup"
+	MethodNative       = "native"
+
+	// metaSuffix is appended to the backup name for the name of the metadata object
+	metaSuffix = ".meta"
+)
+
+var (
+	// metaObject identifies a metadata object (without extension) and extracts the backup name
+	metaObject = regexp.MustCompile(`^(.+)` + regexp.QuoteMeta(metaSuffix) + `$`)
+	// labelStartLSN finds the start LSN in a backup_label
+	labelStartLSN = regexp.MustCompile(`(?m)^START WAL LOCATION: ([0-9A-Fa-f]+/[0-9A-Fa-f]+) `)
+	// labelTimeline finds the start timeline in a backup_label
+	labelTimeline = regexp.MustCompile(`(?m)^START TIMELINE: ([0-9]+)`)
+)
+
+// Meta describes how a backup was taken, it is stored as its own object next to the backup.
+// Backups of older versions have no metadata, they are full backups taken with pg_basebackup
+type Meta struct {
+	Version int    `json:"version"`
+	Backup  string `json:"backup"`
+	Type    string `json:"type"`
+	// Parent is the backup an incremental or differential backup is based on
+	Parent   string `json:"parent,omitempty"`
+	Method   string `json:"method"`
+	StartLSN string `json:"start_lsn"`
+	Timeline string `json:"timeline,omitempty"`
+	// BlockSize is the size of the pages in incremental files
+	BlockSize int `json:"block_size,omitempty"`
+	// SystemID is the system identifier of the cluster, parent and child have to be from the same cluster
+	SystemID string `json:"system_id,omitempty"`
+	// Source is the server the backup was taken from
+	Source *Source `json:"source,omitempty"`
+}
+
+// Source is the server a backup was taken from
+type Source struct {
+	// Host is the address of the server, the host name of the backup host for connections over a unix socket
+	Host string `json:"host"`
+	Port int    `json:"port,omitempty"`
+	// ClusterName is the cluster_name setting of the server
+	ClusterName string `json:"cluster_name,omitempty"`
+	// Standby is set for backups taken from a hot standby
+	Standby bool `json:"standby"`
+	// Version is the server_version_num of the server
+	Version int `json:"version,omitempty"`
+}
+
+// String returns the server as host:port and its role
+func (s Source) String() string {
+	role := "primary"
+	if s.Standby {
+		role = "standby"
+	}
+	if s.Port == 0 {
+		return fmt.Sprintf("%s (%s)", s.Host, role)
+	}
+	return fmt.Sprintf("%s:%d (%s)", s.Host, s.Port, role)
+}
+
+// MetaObjectName returns the name of the object that stores the metadata of the backup
+func MetaObjectName(backupName string) string {
+	return backupName + metaSuffix
+}
+
+// ParseMetaObject returns the backup of a metadata object, ok is false for other objects
+func ParseMetaObject(name string) (backupName string, ok bool) {
+	match := metaObject.FindStringSubmatch(name)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+// ParseMeta parses stored metadata
+func ParseMeta(data []byte) (meta Meta, err error) {
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("Invalid backup metadata: %v", err)
+	}
+	if meta.Version > MetaVersion {
+		return meta, fmt.Errorf("Metadata version %d is not supported, update pgglaskugel", meta.Version)
+	}
+	return meta, nil
+}
+
+// LegacyMeta returns the metadata of a backup without stored metadata
+func LegacyMeta(backupName string) Meta {
+	return Meta{Version: MetaVersion, Backup: backupName, Type: BackupTypeFull, Method: MethodPgBasebackup}
+}
+
+// ParseLabelStart returns start LSN and timeline from a backup_label
+func ParseLabelStart(label []byte) (startLSN string, timeline string, err error) {
+	match := labelStartLSN.FindSubmatch(label)
+	if match == nil {
+		return "", "", fmt.Errorf("Can not find START WAL LOCATION in %s", "backup_label")
+	}
+	startLSN = string(match[1])
+	if match = labelTimeline.FindSubmatch(label); match != nil {
+		timeline = string(match[1])
+	}
+	return startLSN, timeline, nil
+}
+
+// ParseLSN parses an LSN like 16/B374D848
+func ParseLSN(lsn string) (pos uint64, err error) {
+	parts := strings.Split(lsn, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid LSN: %q", lsn)
+	}
+	high, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid LSN %q: %v", lsn, err)
+	}
+	low, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid LSN %q: %v", lsn, err)
+	}
+	return high<<32 | low, nil
+}
+
+// FormatLSN formats an LSN like PostgreSQL does
+func FormatLSN(pos uint64) string {
+	return fmt.Sprintf("%X/%X", pos>>32, uint32(pos))
+}
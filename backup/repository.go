@@ -0,0 +1,175 @@
+// Package backup - repository module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// RepositoryVersion is the version of the layout of the repository written by this version of pgGlaskugel.
+	// Repositories without metadata have version 0
+	RepositoryVersion = 2
+	// RepositoryObject is the key of the metadata object of the repository
+	RepositoryObject = "repository.json"
+	// ClusterPrefix is the prefix of the objects of all clusters, every cluster has its own prefix below it
+	ClusterPrefix = "clusters"
+
+	// CodecZstd compresses the objects with zstd
+	CodecZstd = "zstd"
+
+	// Encryption modes of the repository
+	EncryptionNone = "none"
+	EncryptionGPG  = "gpg"
+)
+
+// Repository describes how the objects of the repository are written, it is stored as RepositoryObject
+type Repository struct {
+	Version int `json:"version"`
+	// SystemID is the system identifier of the only cluster of a repository with format version 1
+	SystemID   string    `json:"system_id,omitempty"`
+	Codec      string    `json:"codec"`
+	Encryption string    `json:"encryption"`
+	Created    time.Time `json:"created"`
+	// Clusters are the clusters with backups or WAL files in the repository
+	Clusters []Cluster `json:"clusters,omitempty"`
+}
+
+// Cluster is a cluster in the repository, its objects are stored below its prefix.
+// A new cluster with the name of an old one (e.g. after initdb) gets its own prefix
+type Cluster struct {
+	Name     string    `json:"name"`
+	SystemID string    `json:"system_id"`
+	Created  time.Time `json:"created"`
+}
+
+// NewRepository returns the metadata of a new repository in the current layout
+func NewRepository(encryption string) Repository {
+	return Repository{
+		Version:    RepositoryVersion,
+		Codec:      CodecZstd,
+		Encryption: encryption,
+		Created:    time.Now().UTC(),
+	}
+}
+
+// Prefix returns the prefix of the objects of the cluster
+func (c Cluster) Prefix() string {
+	return ClusterPrefix + "/" + c.Name + "-" + c.SystemID + "/"
+}
+
+// ParseClusterPrefix returns the cluster of an object key below ClusterPrefix, only Name and SystemID are set.
+// ok is false if the key is not below the prefix of a cluster
+func ParseClusterPrefix(key string) (cluster Cluster, ok bool) {
+	if !strings.HasPrefix(key, ClusterPrefix+"/") {
+		return cluster, false
+	}
+	dir := strings.TrimPrefix(key, ClusterPrefix+"/")
+	end := strings.Index(dir, "/")
+	if end < 0 {
+		return cluster, false
+	}
+	dir = dir[:end]
+	// The system identifier is a number, the name may contain dashes
+	sep := strings.LastIndex(dir, "-")
+	if sep <= 0 || sep == len(dir)-1 {
+		return cluster, false
+	}
+	cluster.Name, cluster.SystemID = dir[:sep], dir[sep+1:]
+	return cluster, CheckClusterName(cluster.Name) == nil
+}
+
+// String returns the name and the system identifier of the cluster
+func (c Cluster) String() string {
+	return c.Name + " (system identifier " + c.SystemID + ")"
+}
+
+// CheckClusterName returns an error if the name can not be part of a prefix
+func CheckClusterName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("Invalid cluster name %q, it must not be empty or contain slashes", name)
+	}
+	return nil
+}
+
+// ClustersNamed returns the clusters with the name, the newest last
+func (r Repository) ClustersNamed(name string) (clusters []Cluster) {
+	for _, c := range r.Clusters {
+		if c.Name == name {
+			clusters = append(clusters, c)
+		}
+	}
+	return clusters
+}
+
+// AddCluster adds the cluster if it is not in the repository yet, added is false if it is
+func (r *Repository) AddCluster(name string, systemID string) (cluster Cluster, added bool) {
+	for _, c := range r.Clusters {
+		if c.Name == name && c.SystemID == systemID {
+			return c, false
+		}
+	}
+	cluster = Cluster{Name: name, SystemID: systemID, Created: time.Now().UTC()}
+	r.Clusters = append(r.Clusters, cluster)
+	return cluster, true
+}
+
+// ParseRepository parses the metadata of a repository
+func ParseRepository(data []byte) (repo Repository, err error) {
+	if err = json.Unmarshal(data, &repo); err != nil {
+		return repo, fmt.Errorf("Invalid repository metadata %s: %v", RepositoryObject, err)
+	}
+	return repo, nil
+}
+
+// CheckSystemID returns an error if the repository belongs to another cluster than the one with systemID.
+// Only repositories with format version 1 belong to one cluster, later versions keep every cluster below its
+// own prefix. An empty systemID (not known) is not checked
+func (r Repository) CheckSystemID(systemID string) error {
+	if r.SystemID != "" && systemID != "" && r.SystemID != systemID {
+		return fmt.Errorf("The repository belongs to the cluster with system identifier %s, this cluster has %s", r.SystemID, systemID)
+	}
+	return nil
+}
+
+// Check returns an error if the repository can not be used with the given encryption mode
+// by the cluster with systemID (empty if it is not known)
+func (r Repository) Check(encryption string, systemID string) error {
+	if r.Version > RepositoryVersion {
+		return fmt.Errorf("The repository has format version %d, this version of pgGlaskugel supports up to %d", r.Version, RepositoryVersion)
+	}
+	if err := r.CheckSystemID(systemID); err != nil {
+		return err
+	}
+	if r.Version < RepositoryVersion {
+		return fmt.Errorf("The repository has the old format version %d, run 'pgglaskugel repo upgrade' first", r.Version)
+	}
+	if r.Codec != CodecZstd {
+		return fmt.Errorf("The repository uses the codec %q, only %s is supported", r.Codec, CodecZstd)
+	}
+	if r.Encryption != encryption {
+		return fmt.Errorf("The repository uses the encryption %q, but the configuration uses %q", r.Encryption, encryption)
+	}
+	return nil
+}
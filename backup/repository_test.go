@@ -0,0 +1,83 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRepositoryCheck(t *testing.T) {
+	current := NewRepository(EncryptionNone)
+	v1 := current
+	v1.Version = 1
+	v1.SystemID = "6400000000000000001"
+
+	tests := []struct {
+		name       string
+		repo       Repository
+		encryption string
+		systemID   string
+		err        string
+	}{
+		{"current", current, EncryptionNone, "6400000000000000002", ""},
+		{"unknown system identifier", current, EncryptionNone, "", ""},
+		{"newer version", Repository{Version: RepositoryVersion + 1, Codec: CodecZstd, Encryption: EncryptionNone}, EncryptionNone, "", "supports up to"},
+		{"older version", v1, EncryptionNone, "6400000000000000001", "repo upgrade"},
+		{"older version of another cluster", v1, EncryptionNone, "6400000000000000002", "belongs to the cluster"},
+		{"older version, unknown system identifier", v1, EncryptionNone, "", "repo upgrade"},
+		{"other codec", Repository{Version: RepositoryVersion, Codec: "gzip", Encryption: EncryptionNone}, EncryptionNone, "", "codec"},
+		{"other encryption", current, EncryptionGPG, "", "encryption"},
+	}
+	for _, test := range tests {
+		err := test.repo.Check(test.encryption, test.systemID)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestParseClusterPrefix(t *testing.T) {
+	tests := []struct {
+		key     string
+		cluster Cluster
+		ok      bool
+	}{
+		{"clusters/main-6400000000000000001/basebackup/main@2017-01-02T03:04:05Z.zst", Cluster{Name: "main", SystemID: "6400000000000000001"}, true},
+		{"clusters/my-db-6400000000000000001/wal/000000010000000000000001.zst", Cluster{Name: "my-db", SystemID: "6400000000000000001"}, true},
+		{"clusters/main-6400000000000000001", Cluster{}, false},
+		{"clusters/main/wal/000000010000000000000001.zst", Cluster{}, false},
+		{"clusters/main-/wal/000000010000000000000001.zst", Cluster{}, false},
+		{"basebackup/main@2017-01-02T03:04:05Z.zst", Cluster{}, false},
+	}
+	for _, test := range tests {
+		cluster, ok := ParseClusterPrefix(test.key)
+		if ok != test.ok || (ok && (cluster.Name != test.cluster.Name || cluster.SystemID != test.cluster.SystemID)) {
+			t.Errorf("%s: got %v (%t), expected %v (%t)", test.key, cluster, ok, test.cluster, test.ok)
+		}
+	}
+}
@@ -37,6 +37,8 @@ const (
 
 	// MaxWalSize maximum size a WAL can have
 	MaxWalSize = int64(16777216)
+	// WalSegmentsPerID - number of WAL segments per log id (with 16MB segments)
+	WalSegmentsPerID = uint64(0x100000000 / MaxWalSize)
 	// MinArchiveSize minimal size for files to archive
 	MinArchiveSize = int64(100)
 	// RegFullWal - name of a WAL file
@@ -87,6 +89,16 @@ type Backup struct {
 	StartWalLocation string
 	StorageType      string
 	Backups          *Backups
+	// Tablespaces are stored as separate objects that belong to the backup
+	Tablespaces []Tablespace
+	// Chunks are additional tar archives of the backup and its tablespaces (backups uploaded in parallel)
+	Chunks []Chunk
+	// Index is the stored index of the backup, nil if the backup has none
+	Index *Backup
+	// Meta is the stored metadata of the backup, nil if the backup has none
+	Meta *Backup
+	// Manifest is the backup manifest stored next to the backup, nil if it is in the backup or there is none
+	Manifest *Backup
 }
 
 // Backups represents an array of "Backup"
@@ -110,6 +122,14 @@ type Wal struct {
 // WalType represents different types of WAL
 type WalType uint8
 
+// WalRange is a continuous range of WAL files in one timeline
+type WalRange struct {
+	Timeline string
+	First    string
+	Last     string
+	Count    uint64
+}
+
 // Archive is a struct to represent an WAL archive
 type Archive struct {
 	WalFiles    []Wal
@@ -0,0 +1,160 @@
+// Package backup - tablespace module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// TablespaceMapFile lists the tablespaces of a tar backup as "OID path" lines
+	TablespaceMapFile = "tablespace_map"
+	// TablespaceDir is the directory in pg_data with a symlink to every tablespace
+	TablespaceDir = "pg_tblspc"
+
+	// tablespaceInfix separates the backup name and the OID in the name of a tablespace object
+	tablespaceInfix = ".tblspc."
+)
+
+// tablespaceObject identifies a tablespace object (without extension) and extracts backup name and OID
+var tablespaceObject = regexp.MustCompile(`^(.+)` + regexp.QuoteMeta(tablespaceInfix) + `([0-9]+)$`)
+
+// Tablespace is a tablespace in a backup, it is stored as its own object next to the backup
+type Tablespace struct {
+	OID       string
+	Name      string
+	Extension string
+	// Path is also used for alternative backup paths (e.g. bucket in S3)
+	Path string
+	Size int64
+}
+
+// TablespaceObjectName returns the name of the object that stores the tablespace oid of the backup
+func TablespaceObjectName(backupName string, oid string) string {
+	return backupName + tablespaceInfix + oid
+}
+
+// ParseTablespaceObject returns the backup and the OID of a tablespace object, ok is false for other objects
+func ParseTablespaceObject(name string) (backupName string, oid string, ok bool) {
+	match := tablespaceObject.FindStringSubmatch(name)
+	if match == nil {
+		return "", "", false
+	}
+	return match[1], match[2], true
+}
+
+// AddTablespace attaches the tablespace to its backup, it returns false if the backup is not in the list
+func (b *Backups) AddTablespace(ts Tablespace) bool {
+	backupName, _, ok := ParseTablespaceObject(ts.Name)
+	if !ok {
+		return false
+	}
+	for i := range b.Backup {
+		if b.Backup[i].Name == backupName {
+			b.Backup[i].Tablespaces = append(b.Backup[i].Tablespaces, ts)
+			sort.Slice(b.Backup[i].Tablespaces, func(x, y int) bool {
+				return b.Backup[i].Tablespaces[x].OID < b.Backup[i].Tablespaces[y].OID
+			})
+			return true
+		}
+	}
+	return false
+}
+
+// TablespaceBackup returns the tablespace as a backup, so it can be read like one
+func (b *Backup) TablespaceBackup(ts Tablespace) *Backup {
+	tsBackup := *b
+	tsBackup.Name = ts.Name
+	tsBackup.Extension = ts.Extension
+	tsBackup.Path = ts.Path
+	tsBackup.Size = ts.Size
+	tsBackup.Tablespaces = nil
+	// The chunks of the tablespace are the chunks of its backup
+	tsBackup.Chunks = nil
+	for _, chunk := range b.Chunks {
+		if chunk.Tablespace == ts.OID {
+			chunk.Tablespace = ""
+			tsBackup.Chunks = append(tsBackup.Chunks, chunk)
+		}
+	}
+	tsBackup.Index = nil
+	tsBackup.Meta = nil
+	tsBackup.Manifest = nil
+	return &tsBackup
+}
+
+// ParseTablespaceMap parses a tablespace_map file and returns the path of every tablespace by OID
+// PostgreSQL escapes newlines and backslashes in the path with a backslash
+func ParseTablespaceMap(data []byte) (locations map[string]string, err error) {
+	locations = make(map[string]string)
+	var line bytes.Buffer
+	escaped := false
+	addLine := func() error {
+		if line.Len() == 0 {
+			return nil
+		}
+		parts := strings.SplitN(line.String(), " ", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("Invalid line in %s: %q", TablespaceMapFile, line.String())
+		}
+		locations[parts[0]] = parts[1]
+		line.Reset()
+		return nil
+	}
+	for _, c := range data {
+		switch {
+		case escaped:
+			line.WriteByte(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '\n':
+			if err = addLine(); err != nil {
+				return nil, err
+			}
+		default:
+			line.WriteByte(c)
+		}
+	}
+	if err = addLine(); err != nil {
+		return nil, err
+	}
+	return locations, nil
+}
+
+// MarshalTablespaceMap returns the tablespace_map file for the tablespace locations by OID
+func MarshalTablespaceMap(locations map[string]string) []byte {
+	oids := make([]string, 0, len(locations))
+	for oid := range locations {
+		oids = append(oids, oid)
+	}
+	sort.Strings(oids)
+	var buf bytes.Buffer
+	escaper := strings.NewReplacer("\\", "\\\\", "\n", "\\\n")
+	for _, oid := range oids {
+		fmt.Fprintf(&buf, "%s %s\n", oid, escaper.Replace(locations[oid]))
+	}
+	return buf.Bytes()
+}
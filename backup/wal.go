@@ -25,6 +25,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"strconv"
 	"text/tabwriter"
 
 	log "github.com/Sirupsen/logrus"
@@ -108,6 +109,25 @@ func (w *Wal) Counter() (counter string) {
 	return counter
 }
 
+// Segment returns the position of the WAL file in its timeline as number
+func (w *Wal) Segment() (segment uint64, err error) {
+	counter := w.Counter()
+	logID, err := strconv.ParseUint(counter[:8], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	seg, err := strconv.ParseUint(counter[8:], 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	return logID*WalSegmentsPerID + seg, nil
+}
+
+// WalName returns the name of the WAL file at the given position in the timeline
+func WalName(timeline string, segment uint64) (name string) {
+	return fmt.Sprintf("%s%08X%08X", timeline, segment/WalSegmentsPerID, segment%WalSegmentsPerID)
+}
+
 // OlderThan returns if *Wal is older than newWal
 func (w *Wal) OlderThan(newWal Wal) (isOlderThan bool) {
 	if newWal.Name > w.Name {
@@ -170,6 +190,99 @@ func (a *Archive) String() (archive string) {
 	return buf.String()
 }
 
+// Ranges returns the continuous ranges of WAL files in the archive, ordered by timeline and position
+func (a *Archive) Ranges() (ranges []WalRange) {
+	a.SortAsc()
+	var current *WalRange
+	var last uint64
+	for _, wal := range a.WalFiles {
+		if wal.Type != WalWal {
+			continue
+		}
+		segment, err := wal.Segment()
+		if err != nil {
+			log.Warn("Can not get position of WAL file ", wal.Name, ": ", err)
+			continue
+		}
+		timeline := wal.Timeline()
+		if current != nil && current.Timeline == timeline && segment == last {
+			// Same WAL file with another extension
+			continue
+		}
+		if current != nil && current.Timeline == timeline && segment == last+1 {
+			current.Last = wal.Name
+			current.Count++
+			last = segment
+			continue
+		}
+		ranges = append(ranges, WalRange{Timeline: timeline, First: wal.Name, Last: wal.Name, Count: 1})
+		current = &ranges[len(ranges)-1]
+		last = segment
+	}
+	return ranges
+}
+
+// Gaps returns the missing WAL files between the ranges of the same timeline
+// A new timeline does not start with a gap, it branches off an older one
+func (a *Archive) Gaps() (gaps []WalRange) {
+	ranges := a.Ranges()
+	for i := 1; i < len(ranges); i++ {
+		before, after := ranges[i-1], ranges[i]
+		if before.Timeline != after.Timeline {
+			continue
+		}
+		lastWal := Wal{Name: before.Last}
+		nextWal := Wal{Name: after.First}
+		// The names were already parsed in Ranges()
+		lastSegment, _ := lastWal.Segment()
+		nextSegment, _ := nextWal.Segment()
+		gaps = append(gaps, WalRange{
+			Timeline: before.Timeline,
+			First:    WalName(before.Timeline, lastSegment+1),
+			Last:     WalName(before.Timeline, nextSegment-1),
+			Count:    nextSegment - lastSegment - 1,
+		})
+	}
+	return gaps
+}
+
+// Chain returns the continuous range of WAL files that starts with (or contains) the WAL file start
+// and the gaps that follow later in the same timeline. Without start in the archive an error is returned
+func (a *Archive) Chain(start string) (chain WalRange, gaps []WalRange, err error) {
+	startWal := Wal{Name: start}
+	if !startWal.SaneName() {
+		return chain, nil, errors.New("Not a WAL file: " + start)
+	}
+	startSegment, err := startWal.Segment()
+	if err != nil {
+		return chain, nil, err
+	}
+	timeline := startWal.Timeline()
+	found := false
+	for _, r := range a.Ranges() {
+		if r.Timeline != timeline {
+			continue
+		}
+		first := Wal{Name: r.First}
+		last := Wal{Name: r.Last}
+		firstSegment, _ := first.Segment()
+		lastSegment, _ := last.Segment()
+		if startSegment >= firstSegment && startSegment <= lastSegment {
+			chain = WalRange{Timeline: timeline, First: start, Last: r.Last, Count: lastSegment - startSegment + 1}
+			found = true
+		}
+	}
+	if !found {
+		return chain, nil, errors.New("WAL file " + start + " is not archived")
+	}
+	for _, gap := range a.Gaps() {
+		if gap.Timeline == timeline && gap.First > start {
+			gaps = append(gaps, gap)
+		}
+	}
+	return chain, gaps, nil
+}
+
 // Archive implements sort.Interface based on Backup.Created
 func (a *Archive) Len() int           { return len(a.WalFiles) }
 func (a *Archive) Swap(i, j int)      { (a.WalFiles)[i], (a.WalFiles)[j] = (a.WalFiles)[j], (a.WalFiles)[i] }
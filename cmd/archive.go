@@ -22,6 +22,7 @@ package cmd
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -30,6 +31,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/metrics"
 	storage "github.com/xxorde/pgglaskugel/storage"
 
 	"github.com/spf13/cobra"
@@ -44,9 +46,18 @@ var (
 		Long: `This command archives given WAL file(s). This command can be used as an archive_command. The command to recover is "recover". 
 	Example: archive_command = "` + myName + ` archive %p"`,
 		Run: func(cmd *cobra.Command, args []string) {
+			// Failed calls are counted and timed here, log.Fatal skips the end of this function
+			onFatal(func() {
+				metrics.WalArchiveFailures.Inc()
+				metrics.WalArchiveDuration.ObserveSince(startTime)
+			})
 			if len(args) < 1 {
 				log.Fatal("No WAL file was defined!")
 			}
+			// In a shared repository the WAL files are stored below the prefix of the cluster
+			if err := registerLocalCluster(); err != nil {
+				log.Fatal(err)
+			}
 
 			// Counter for WAL files
 			count := 0
@@ -54,23 +65,39 @@ var (
 			// WaitGroup for workers
 			var wg sync.WaitGroup
 
+			// Partial WAL files are discarded on SIGINT or SIGTERM
+			ctx, stop := interruptContext()
+			defer stop()
+			errs := make(chan error, len(args))
+
 			// Iterate over every WAL file
 			for _, walSource := range args {
 				walName := filepath.Base(walSource)
 
-				f, err := os.Open(walSource)
+				// The lock is held until the worker of this WAL file is done
+				unlock, err := lockLocal(lockClassArchive, walName)
 				if err != nil {
-					log.Error("Can not open WAL file")
-					log.Fatal(err)
+					errs <- err
+					continue
 				}
 
-				walReader := io.ReadCloser(f)
+				f, err := os.Open(walSource)
+				if err != nil {
+					unlock()
+					errs <- fmt.Errorf("Can not open WAL file: %v", err)
+					continue
+				}
 
 				// Add one worker to our waiting group (for waiting later)
 				wg.Add(1)
 
 				// Start worker
-				go compressEncryptStream(&walReader, walName, storeWalStream, &wg)
+				go func(walFile *os.File, walName string, unlock func()) {
+					defer wg.Done()
+					defer unlock()
+					defer walFile.Close()
+					errs <- compressEncryptStream(ctx, walFile, walName, storeWalStream)
+				}(f, walName, unlock)
 
 				count++
 			}
@@ -78,6 +105,22 @@ var (
 			// Wait for workers to finish
 			//(WAIT FOR THE WORKER FIRST OR WE CAN LOOSE DATA)
 			wg.Wait()
+			close(errs)
+
+			// PostgreSQL retries the WAL files if the archive command fails
+			failed := 0
+			for err := range errs {
+				if err != nil {
+					log.Error(err)
+					failed++
+				}
+			}
+			metrics.WalArchived.Add(float64(len(args) - failed))
+			if failed > 0 {
+				metrics.WalArchiveFailedFiles.Add(float64(failed))
+				log.Fatalf("%d of %d WAL file(s) could not be archived", failed, len(args))
+			}
+			metrics.WalArchiveDuration.ObserveSince(startTime)
 
 			elapsed := time.Since(startTime)
 			log.Info("Archived ", count, " WAL file(s) in ", elapsed)
@@ -110,8 +153,8 @@ func testWalSource(walSource string) (err error) {
 }
 
 // storeWalStream takes a stream and persists it with the configured method
-func storeWalStream(input *io.Reader, name string) {
-	storage.WriteStream(viper.GetViper(), input, name, "archive")
+func storeWalStream(input *io.Reader, name string, logicalSum func() string) (err error) {
+	return storage.WriteStream(viper.GetViper(), input, name, "archive", logicalSum)
 }
 
 func init() {
@@ -0,0 +1,348 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"text/tabwriter"
+
+	log "github.com/Sirupsen/logrus"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+var (
+	// backupLsCmd represents the backup-ls command
+	backupLsCmd = &cobra.Command{
+		Use:   "backup-ls BACKUP",
+		Short: "Lists the files in a backup",
+		Long: `Lists the entries of a backup with mode, size and modification time.
+	The list is read from the index of the backup, backups without index are read completely.
+	Files of tablespaces are shown below pg_tblspc/OID. --pattern limits the list to the matching entries.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) != 1 {
+				log.Fatal("Exactly one backup is needed: ", args)
+			}
+			if err := runBackupLs(args[0], viper.GetString("backup-ls-pattern")); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	// backupExtractCmd represents the backup-extract command
+	backupExtractCmd = &cobra.Command{
+		Use:   "backup-extract BACKUP PATH...",
+		Short: "Extracts single files from a backup",
+		Long: `Extracts the entries of a backup that match one of the paths into the directory given with --to.
+	A path is a pattern like in backup-ls, the content of matching directories is extracted as well.
+	With an index the backup is only read up to the last matching entry and the extracted files are
+	checked against the checksums in the index, backups without index are read completely.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if len(args) < 2 {
+				log.Fatal("A backup and at least one path are needed: ", args)
+			}
+			if err := runBackupExtract(args[0], args[1:], viper.GetString("backup-extract-to")); err != nil {
+				log.Fatal(err)
+			}
+			printDone()
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(backupLsCmd)
+	RootCmd.AddCommand(backupExtractCmd)
+	backupLsCmd.PersistentFlags().String("pattern", "", "Only list entries that match the pattern (e.g. 'base/*' or '*.conf'), matching directories include their content")
+	backupExtractCmd.PersistentFlags().String("to", "", "The directory to extract to")
+
+	// Bind flags to viper
+	bindSetting("backup-ls-pattern", backupLsCmd.PersistentFlags().Lookup("pattern"))
+	bindSetting("backup-extract-to", backupExtractCmd.PersistentFlags().Lookup("to"))
+}
+
+// entryPath returns the path of the entry in the cluster, files of tablespaces are below pg_tblspc/OID
+func entryPath(tablespace string, name string) string {
+	if tablespace == "" {
+		return name
+	}
+	return path.Join(backup.TablespaceDir, tablespace, name)
+}
+
+// matchEntry returns true if the path or one of its parent directories matches one of the patterns
+func matchEntry(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		pattern = path.Clean(pattern)
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// findBackup returns the named backup of this cluster
+func findBackup(backupName string) (b *backup.Backup, err error) {
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	return backups.Find(backupName)
+}
+
+// backupObjects returns the objects of the backup (the backup, its tablespaces and their chunks)
+// and the tablespace every object belongs to, empty for the backup itself
+func backupObjects(b *backup.Backup) (objects []*backup.Backup, oids []string) {
+	add := func(object *backup.Backup, oid string) {
+		objects = append(objects, object)
+		oids = append(oids, oid)
+		for _, chunk := range object.ChunkBackups() {
+			objects = append(objects, chunk)
+			oids = append(oids, oid)
+		}
+	}
+	add(b, "")
+	for _, ts := range b.Tablespaces {
+		add(b.TablespaceBackup(ts), ts.OID)
+	}
+	return objects, oids
+}
+
+// backupEntries returns the entries of the backup and its tablespaces from the index,
+// backups without index are read completely
+func backupEntries(b *backup.Backup) (entries []backup.IndexEntry, err error) {
+	if b.Index != nil {
+		index, err := loadIndex(b)
+		if err == nil {
+			return index.Files, nil
+		}
+		log.Warn("Can not use the index, the backup is read completely: ", err)
+	}
+
+	objects, oids := backupObjects(b)
+	for i, object := range objects {
+		reader, err := openBackup(object)
+		if err != nil {
+			return nil, err
+		}
+		objectEntries, indexErr := backup.IndexTar(reader, oids[i], nil)
+		closeErr := reader.Close()
+		if _, err = reader.Verify(); err != nil {
+			return nil, err
+		}
+		if indexErr != nil {
+			return nil, indexErr
+		}
+		if closeErr != nil {
+			return nil, closeErr
+		}
+		entries = append(entries, objectEntries...)
+	}
+	return entries, nil
+}
+
+// runBackupLs lists the entries of the backup that match the pattern, all entries if it is empty
+func runBackupLs(backupName string, pattern string) (err error) {
+	// Cleanup must not delete the backup while it is read
+	lock, err := acquireStorageLock(backup.LockShared, "backup-ls")
+	if err != nil {
+		return err
+	}
+	defer releaseStorageLock(lock, &err)
+
+	b, err := findBackup(backupName)
+	if err != nil {
+		return err
+	}
+	entries, err := backupEntries(b)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(w, "MODE\tSIZE\tMODIFIED\tNAME")
+	var count, size int64
+	for _, e := range entries {
+		name := entryPath(e.Tablespace, e.Name)
+		if pattern != "" && !matchEntry([]string{pattern}, name) {
+			continue
+		}
+		if e.Link != "" {
+			name += " -> " + e.Link
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", entryMode(e), e.Size, e.ModTime.Format("2006-01-02 15:04:05"), name)
+		count++
+		size += e.Size
+	}
+	fmt.Fprintf(w, "\nTotal: %d entries, %s\n", count, humanize.Bytes(uint64(size)))
+	return w.Flush()
+}
+
+// entryMode returns the type and permissions of the entry like ls does
+func entryMode(e backup.IndexEntry) string {
+	kind := "-"
+	switch e.Type {
+	case backup.IndexDir:
+		kind = "d"
+	case backup.IndexSymlink:
+		kind = "l"
+	case backup.IndexHardlink:
+		kind = "h"
+	}
+	return kind + os.FileMode(e.Mode).Perm().String()[1:]
+}
+
+// runBackupExtract extracts the entries of the backup that match one of the patterns to the directory
+func runBackupExtract(backupName string, patterns []string, to string) (err error) {
+	if to == "" {
+		return errors.New("The directory to extract to is not set, use --to")
+	}
+	// Cleanup must not delete the backup while it is read
+	lock, err := acquireStorageLock(backup.LockShared, "backup-extract")
+	if err != nil {
+		return err
+	}
+	defer releaseStorageLock(lock, &err)
+
+	b, err := findBackup(backupName)
+	if err != nil {
+		return err
+	}
+
+	// With an index only the objects with matching entries are read, up to the last match
+	var index *backup.Index
+	if b.Index != nil {
+		loaded, err := loadIndex(b)
+		if err != nil {
+			log.Warn("Can not use the index, the backup is read completely: ", err)
+		} else {
+			index = &loaded
+		}
+	}
+
+	if err = os.MkdirAll(to, 0700); err != nil {
+		return err
+	}
+	var extracted int64
+	objects, oids := backupObjects(b)
+	// The matches that are not extracted yet per tablespace, the chunks of a tablespace share them
+	remaining := make(map[string]int64)
+	for i, object := range objects {
+		oid := oids[i]
+		include := func(name string) bool { return matchEntry(patterns, entryPath(oid, filepath.ToSlash(name))) }
+		if index != nil {
+			matches, counted := remaining[oid]
+			if !counted {
+				for _, e := range index.Tablespace(oid) {
+					if include(e.Name) {
+						matches++
+					}
+				}
+				remaining[oid] = matches
+			}
+			if matches == 0 {
+				continue
+			}
+		}
+		count, err := extractEntries(object, filepath.Join(to, filepath.FromSlash(entryPath(oid, "."))), include, remaining[oid])
+		extracted += count
+		if index != nil {
+			remaining[oid] -= count
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if extracted == 0 {
+		return errors.New("No entries of " + backupName + " match")
+	}
+	if index != nil {
+		if err = verifyExtracted(to, index, patterns); err != nil {
+			return err
+		}
+	}
+	log.Infof("Extracted %d entries to %s", extracted, to)
+	return nil
+}
+
+// extractEntries extracts the included entries of the backup (or tablespace) to dir.
+// If limit is set, the backup is only read until limit entries are extracted, the checksums of the backup are not checked then
+func extractEntries(b *backup.Backup, dir string, include func(string) bool, limit int64) (count int64, err error) {
+	// A symlink to the tablespace (extracted with pg_tblspc/OID) must not be followed
+	if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err = os.Remove(dir); err != nil {
+			return 0, err
+		}
+	}
+
+	extractor := util.NewExtractor(dir)
+	extractor.Include = include
+	extractor.Limit = limit
+	reader, err := openBackup(b)
+	if err != nil {
+		return 0, err
+	}
+	extractErr := extractor.Extract(reader)
+	if extractErr == nil && limit > 0 && extractor.Files() >= limit {
+		log.Debug("All matching entries of ", b.Name, " are extracted, stop reading")
+		reader.Abort()
+		return extractor.Files(), nil
+	}
+	closeErr := reader.Close()
+	verified, err := reader.Verify()
+	if err != nil {
+		return extractor.Files(), err
+	}
+	if extractErr != nil {
+		return extractor.Files(), extractErr
+	}
+	if closeErr != nil {
+		return extractor.Files(), closeErr
+	}
+	if !verified {
+		log.Warn("No checksums stored for ", b.Name, ", extracted data can not be verified")
+	}
+	return extractor.Files(), nil
+}
+
+// verifyExtracted compares the extracted files with the checksums in the index
+func verifyExtracted(to string, index *backup.Index, patterns []string) (err error) {
+	for _, e := range index.Files {
+		name := entryPath(e.Tablespace, e.Name)
+		if e.Type != backup.IndexFile || !matchEntry(patterns, name) {
+			continue
+		}
+		sum, err := util.HashFile(filepath.Join(to, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		if sum != e.Sha256 {
+			return &backup.CorruptObjectError{Name: name, Kind: "file", Expected: e.Sha256, Actual: sum}
+		}
+	}
+	log.Info("Checksums of the extracted files verified")
+	return nil
+}
@@ -0,0 +1,209 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+// backupReader reads the decrypted and inflated data of a basebackup from the storage.
+// The checksums of the stored and the inflated data are computed on the way
+type backupReader struct {
+	backup      *backup.Backup
+	stored      *util.HashReader
+	logical     *util.HashReader
+	gpgCmd      *exec.Cmd
+	inflateCmd  *exec.Cmd
+	inflateDone chan struct{}
+	sourceDone  sync.WaitGroup
+	// dedup reads the data of a deduplicated object from its chunks
+	dedup *dedupReader
+}
+
+// openBackup starts to read the backup from the storage, the reader has to be closed.
+// The data of deduplicated backups is read from their chunks
+func openBackup(b *backup.Backup) (r *backupReader, err error) {
+	if b.Extension == backup.DedupExtension {
+		index, err := readDedupIndex(b)
+		if err != nil {
+			return nil, err
+		}
+		return &backupReader{backup: b, dedup: newDedupReader(index)}, nil
+	}
+	return openObject(b)
+}
+
+// openObject starts to read the stored object of the backup, the reader has to be closed
+func openObject(b *backup.Backup) (r *backupReader, err error) {
+	r = &backupReader{backup: b, inflateDone: make(chan struct{})}
+
+	// Command to inflate the data stream
+	// Read from stdin and write do stdout
+	r.inflateCmd = exec.Command(cmdZstd, "-d", "--stdout", "-")
+	inflateStdout, err := r.inflateCmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.New("Can not attach pipe to inflation process, " + err.Error())
+	}
+	inflateStderror, err := r.inflateCmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Start getBasebackup in new go-routine, it provides the data until sourceDone
+	var dataStream io.Reader
+	var sourceStart sync.WaitGroup
+	sourceStart.Add(1)
+	r.sourceDone.Add(1)
+	sourceErr := make(chan error, 1)
+	b.StorageType = viper.GetString("backup_to")
+	go func() {
+		sourceErr <- storage.GetBasebackup(viper.GetViper(), b, &dataStream, &sourceStart, &r.sourceDone)
+	}()
+	sourceStart.Wait()
+	// Without a stream the backup could not be opened
+	if dataStream == nil {
+		return nil, <-sourceErr
+	}
+
+	// Tell the backup source that we are finished if something fails from here on
+	defer func() {
+		if err != nil {
+			r.sourceDone.Done()
+		}
+	}()
+	r.stored = util.NewHashReader(dataStream)
+
+	// If encryption is used, pipe data through decryption before inflation
+	if viper.GetBool("encrypt") {
+		log.Debug("Backup will be decrypted")
+		r.gpgCmd = exec.Command(cmdGpg, "--decrypt", "-o", "-")
+		r.gpgCmd.Stdin = r.stored
+		r.inflateCmd.Stdin, err = r.gpgCmd.StdoutPipe()
+		if err != nil {
+			return nil, errors.New("Can not attach pipe to gpg process, " + err.Error())
+		}
+		gpgStderror, err := r.gpgCmd.StderrPipe()
+		if err != nil {
+			return nil, err
+		}
+		go util.WatchOutput(gpgStderror, log.Info, nil)
+		if err = r.gpgCmd.Start(); err != nil {
+			return nil, errors.New("gpg failed on startup, " + err.Error())
+		}
+		log.Debug("gpg started")
+	} else {
+		r.inflateCmd.Stdin = r.stored
+	}
+
+	go util.WatchOutput(inflateStderror, log.Info, r.inflateDone)
+	if err = r.inflateCmd.Start(); err != nil {
+		if r.gpgCmd != nil {
+			r.gpgCmd.Process.Kill()
+			r.gpgCmd.Wait()
+		}
+		return nil, errors.New("zstd failed on startup, " + err.Error())
+	}
+	log.Debug("Inflation started")
+
+	r.logical = util.NewHashReader(inflateStdout)
+	return r, nil
+}
+
+// Read reads the inflated data
+func (r *backupReader) Read(p []byte) (n int, err error) {
+	if r.dedup != nil {
+		return r.dedup.Read(p)
+	}
+	return r.logical.Read(p)
+}
+
+// Close reads the rest of the data, so the checksums are complete, and waits for all processes
+// If a process failed, the rest of the stored data is still read so Verify can tell if it is corrupt
+func (r *backupReader) Close() (err error) {
+	if r.dedup != nil {
+		_, err = io.Copy(ioutil.Discard, r.dedup)
+		r.dedup.Close()
+		return err
+	}
+	defer r.sourceDone.Done()
+	defer io.Copy(ioutil.Discard, r.stored)
+	_, err = io.Copy(ioutil.Discard, r.logical)
+
+	// Wait for output watchers to finish
+	// If the Cmd.Wait() is called while another process is reading
+	// from Stdout / Stderr this is a race condition.
+	<-r.inflateDone
+	if waitErr := r.inflateCmd.Wait(); waitErr != nil {
+		return errors.New("inflateCmd failed after startup, " + waitErr.Error())
+	}
+	if r.gpgCmd != nil {
+		if waitErr := r.gpgCmd.Wait(); waitErr != nil {
+			return errors.New("gpg failed after startup, " + waitErr.Error())
+		}
+	}
+	return err
+}
+
+// Abort stops reading before the end of the backup, the processes are killed.
+// The checksums are incomplete afterwards, Verify must not be used
+func (r *backupReader) Abort() {
+	if r.dedup != nil {
+		r.dedup.Close()
+		return
+	}
+	defer r.sourceDone.Done()
+	r.inflateCmd.Process.Kill()
+	if r.gpgCmd != nil {
+		r.gpgCmd.Process.Kill()
+	}
+	<-r.inflateDone
+	r.inflateCmd.Wait()
+	if r.gpgCmd != nil {
+		r.gpgCmd.Wait()
+	}
+}
+
+// Verify compares the checksums of the data with the stored checksums, the reader has to be closed first.
+// Backups without stored checksums are not verified, the chunks of deduplicated backups are verified while they are read
+func (r *backupReader) Verify() (verified bool, err error) {
+	if r.dedup != nil {
+		return true, nil
+	}
+	name := r.backup.Name + r.backup.Extension
+	sums, err := storage.GetChecksums(viper.GetViper(), name, "basebackup")
+	if err != nil {
+		return false, err
+	}
+	if sums.Empty() {
+		return false, nil
+	}
+	return true, sums.Verify(name, r.stored.Sum(), r.logical.Sum())
+}
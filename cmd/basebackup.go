@@ -21,12 +21,23 @@
 package cmd
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
-	"sync"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/metrics"
 	storage "github.com/xxorde/pgglaskugel/storage"
 	util "github.com/xxorde/pgglaskugel/util"
 
@@ -40,56 +51,218 @@ const (
 )
 
 var (
+	// Stored size of the basebackup and its tablespaces, added up when the streams are persisted
+	backupSize int64
+
 	basebackupCmd = &cobra.Command{
 		Use:   "basebackup",
 		Short: "Creates a new basebackup from the database",
-		Long:  `Creates a new basebackup from the database with the given method.`,
+		Long: `Creates a new basebackup from the database with the given method.
+	Full backups are taken with pg_basebackup, with --method native the files of the cluster are read
+	directly and stored in parallel chunks by --jobs workers, so it has to run on the database host.
+	Incremental (--type incremental) and differential (--type differential) backups only store what
+	changed since the start of their parent: the newest backup for an incremental, the newest full backup
+	for a differential backup. They are taken with pg_basebackup --incremental on PostgreSQL 17+ with
+	summarize_wal, with the native method otherwise.`,
+		Annotations: map[string]string{annotationWritesRepository: ""},
 		Run: func(cmd *cobra.Command, args []string) {
-			log.Info("Perform basebackup")
-			// Get time, name and path for basebackup
-			backupTime := startTime.Format(backup.BackupTimeFormat)
-			backupName := clusterName + "@" + backupTime
-			log.Info("Create new basebackup: ", backupName)
-
-			// WaitGroup for workers
-			var wg sync.WaitGroup
-
-			conString := viper.GetString("connection")
-			log.Debug("conString: ", conString)
-
-			// Command to use pg_basebackup
-			// Tar format, set backupName as label, make fast checkpoints, return output on standardout
-			backupCmd := exec.Command("pg_basebackup", "--dbname", conString, "--format=tar", "--label", backupName, "--checkpoint", "fast", "--pgdata", "-")
-			if viper.GetBool("no-standalone") == false {
-				// Set command to include WAL files so the backup is usable without an archive
-				backupCmd = exec.Command("pg_basebackup", "--dbname", conString, "--format=tar", "--label", backupName, "--checkpoint", "fast", "--pgdata", "-", "-X", "fetch")
+			onFatal(func() { metrics.BasebackupFailures.Inc() })
+			if err := runBasebackup(); err != nil {
+				log.Fatal(err)
 			}
-			log.Debug("backupCmd: ", backupCmd)
+			printDone()
+		},
+	}
+)
 
-			// attach pipe to the command
-			backupStdout, err := backupCmd.StdoutPipe()
-			if err != nil {
-				log.Fatal("Can not attach pipe to backup process, ", err)
-			}
+// runBasebackup creates a new basebackup and stores it in the configured backend
+func runBasebackup() (err error) {
+	log.Info("Perform basebackup")
+	unlock, err := lockLocal(lockClassBackup, "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Cleanup must not delete WAL files while the backup is running
+	lock, err := acquireStorageLock(backup.LockShared, "basebackup")
+	if err != nil {
+		return err
+	}
+	defer releaseStorageLock(lock, &err)
+	backupStart := time.Now()
 
-			// Watch output on stderror
-			backupDone := make(chan struct{}) // Channel to wait for WatchOutput
-			backupStderror, err := backupCmd.StderrPipe()
-			util.Check(err)
-			go util.WatchOutput(backupStderror, log.Info, backupDone)
+	// Get time, name and path for basebackup
+	backupTime := backupStart.Format(backup.BackupTimeFormat)
+	backupName := clusterName + "@" + backupTime
+	log.Info("Create new basebackup: ", backupName)
 
-			// Add one worker to our waiting group (for waiting later)
-			wg.Add(1)
+	// Stop pg_basebackup and discard the partial backup on SIGINT or SIGTERM,
+	// or if the storage lock is lost and cleanup could delete the WAL files
+	interrupted, stop := interruptContext()
+	defer stop()
+	ctx, cancel := storageLockContext(interrupted, lock)
+	defer cancel()
 
-			// Start worker
-			go compressEncryptStream(&backupStdout, backupName, storeBackupStream, &wg)
+	conString := viper.GetString("connection")
+	log.Debug("conString: ", conString)
 
-			// Start backup process (in the background)
-			if err := backupCmd.Start(); err != nil {
-				log.Fatal("pg_basebackup failed on startup, ", err)
+	backupType := viper.GetString("backup-type")
+	if viper.GetBool("incremental") {
+		if backupType != backup.BackupTypeFull && backupType != backup.BackupTypeIncremental {
+			return errors.New("--incremental can not be combined with --type " + backupType)
+		}
+		backupType = backup.BackupTypeIncremental
+	}
+	method := viper.GetString("method")
+	if method != backup.MethodPgBasebackup && method != backup.MethodNative {
+		return fmt.Errorf("Unknown backup method %q, use %s or %s", method, backup.MethodPgBasebackup, backup.MethodNative)
+	}
+	if err = checkRepoFormat(); err != nil {
+		return err
+	}
+	// Chunks of deduplicated backups may have been deleted by cleanup since the last backup
+	dedupChunks.reset()
+	// A hot standby is backed up like the primary, only the WAL switch at the end needs the primary
+	source, err := backupSource(conString)
+	if err != nil {
+		return err
+	}
+	log.Info("Backup is taken from ", source)
+	if err = registerDatabaseCluster(conString); err != nil {
+		return err
+	}
+	var primary *primaryCluster
+	if source.Standby {
+		if primary, err = prepareStandbyBackup(conString); err != nil {
+			return err
+		}
+		if primary != nil {
+			defer primary.Close()
+		}
+	}
+
+	backupSize = 0
+	switch backupType {
+	case backup.BackupTypeFull:
+		if method == backup.MethodNative {
+			err = nativeBasebackup(ctx, backupName, backupType, source)
+		} else {
+			err = fullBasebackup(ctx, backupName, conString, source)
+		}
+	case backup.BackupTypeIncremental, backup.BackupTypeDifferential:
+		// pg_basebackup is only used if the cluster supports incremental backups
+		if method == backup.MethodPgBasebackup {
+			if method, err = incrementalMethod(conString); err != nil {
+				return err
 			}
-			log.Info("Backup was started")
+		}
+		if method == backup.MethodPgBasebackup {
+			err = pgIncrementalBasebackup(ctx, backupName, backupType, conString, source)
+		} else {
+			err = nativeBasebackup(ctx, backupName, backupType, source)
+		}
+	default:
+		return fmt.Errorf("Unknown backup type %q, use %s, %s or %s", backupType, backup.BackupTypeFull, backup.BackupTypeIncremental, backup.BackupTypeDifferential)
+	}
+	if interrupted.Err() != nil {
+		return errors.New("Basebackup was cancelled, " + backupName + " was discarded")
+	}
+	if err != nil {
+		return err
+	}
+	// The last WAL segment of the backup is only archived after the primary switched to the next one
+	if primary != nil {
+		if err = primary.switchWal(); err != nil {
+			log.Warn("Can not switch the WAL on the primary: ", err)
+		}
+	}
+
+	metrics.BasebackupLastSuccess.SetToCurrentTime()
+	metrics.BasebackupDuration.Set(time.Since(backupStart).Seconds())
+	metrics.BasebackupSize.Set(float64(backupSize))
+	log.Info("Basebackup ", backupName, " done in ", time.Since(backupStart))
+	return nil
+}
+
+// fullBasebackup takes a full backup with pg_basebackup
+func fullBasebackup(ctx context.Context, backupName string, conString string, source backup.Source) (err error) {
+	backupArgs := pgBasebackupArgs(backupName, conString)
+
+	// pg_basebackup can only write a single tablespace to standard out
+	tablespaces, err := countTablespaces(conString)
+	if err != nil {
+		log.Warn("Can not get the tablespaces of the cluster, assume there are none: ", err)
+	}
+	var label []byte
+	if tablespaces > 0 {
+		log.Infof("Cluster has %d tablespace(s), every tablespace is stored as its own object", tablespaces)
+		label, err = stagedBasebackup(ctx, backupName, backupArgs, nil)
+	} else {
+		label, err = streamedBasebackup(ctx, backupName, backupArgs)
+	}
+	if err != nil {
+		return err
+	}
+	// The start of the backup is needed for incremental backups based on it
+	storeFullMeta(ctx, backupName, label, conString, source)
+	return nil
+}
+
+// pgBasebackupArgs returns the arguments for pg_basebackup without the destination
+func pgBasebackupArgs(backupName string, conString string) []string {
+	// Tar format, set backupName as label, make fast checkpoints
+	backupArgs := []string{"--dbname", conString, "--format=tar", "--label", backupName, "--checkpoint", "fast"}
+	if viper.GetBool("no-standalone") == false {
+		// Set command to include WAL files so the backup is usable without an archive
+		backupArgs = append(backupArgs, "-X", "fetch")
+	}
+	return backupArgs
+}
+
+// streamedBasebackup streams the backup from pg_basebackup into the storage, it is only possible without tablespaces.
+// The backup_label of the backup is returned
+func streamedBasebackup(ctx context.Context, backupName string, backupArgs []string) (label []byte, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	// Return output on standardout
+	backupCmd := exec.CommandContext(ctx, cmdBasebackup, append(backupArgs, "--pgdata", "-")...)
+	log.Debug("backupCmd: ", backupCmd)
+
+	// attach pipe to the command
+	backupStdout, err := backupCmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.New("Can not attach pipe to backup process, " + err.Error())
+	}
+
+	// Watch output on stderror
+	backupDone := make(chan struct{}) // Channel to wait for WatchOutput
+	backupStderror, err := backupCmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	go util.WatchOutput(backupStderror, log.Info, backupDone)
+
+	// Start backup process (in the background)
+	if err := backupCmd.Start(); err != nil {
+		return nil, errors.New("pg_basebackup failed on startup, " + err.Error())
+	}
+	log.Info("Backup was started")
+
+	// Killing pg_basebackup does not close the pipes if a child process still holds them,
+	// close them on cancellation so the chain does not wait forever
+	go func() {
+		<-ctx.Done()
+		backupStdout.Close()
+		backupStderror.Close()
+	}()
+
+	// The backup is only complete if pg_basebackup succeeds,
+	// otherwise the storage backend reads an error and discards the backup
+	backupStream := &util.WaitReader{
+		Reader: backupStdout,
+		Wait: func() error {
 			// Wait for output watchers to finish
 			// If the Cmd.Wait() is called while another process is reading
 			// from Stdout / Stderr this is a race condition.
@@ -97,33 +270,226 @@ var (
 			log.Debug("Wait for <-backupDone")
 			<-backupDone
 
-			// Wait for workers to finish
-			//(WAIT FOR THE WORKER FIRST OR WE CAN LOOSE DATA)
-			log.Debug("Wait for wg.Wait()")
-			wg.Wait()
-
-			// Wait for backup to finish
-			// If there is still data in the output pipe it can be lost!
 			log.Debug("Wait for backupCmd.Wait()")
-			err = backupCmd.Wait()
-			if err != nil {
-				log.Fatal("pg_basebackup failed after startup, ", err)
+			if err := backupCmd.Wait(); err != nil {
+				return errors.New("pg_basebackup failed after startup, " + err.Error())
 			}
 			log.Debug("backupCmd done")
-
-			printDone()
+			return nil
 		},
 	}
-)
+
+	indexer := newTarIndexer(backupStream, "")
+	err = storeBackupData(ctx, indexer, backupName)
+	if err != nil {
+		// Stop pg_basebackup if it is still running
+		cancel()
+	}
+	if waitErr := backupStream.Close(); err == nil {
+		err = waitErr
+	}
+	entries, indexErr := indexer.Close()
+	if err != nil {
+		return nil, err
+	}
+	if indexErr != nil {
+		log.Warn("Backup is stored without index: ", indexErr)
+	} else {
+		storeIndexOf(ctx, backupName, entries)
+	}
+	// Incremental backups based on this one need the manifest, a copy avoids reading the whole backup
+	if manifest := indexer.File(backup.ManifestFile); manifest != nil {
+		if err = storeManifest(ctx, backupName, manifest); err != nil {
+			log.Warn("Can not store a copy of the manifest: ", err)
+		}
+	}
+	return indexer.File("backup_label"), nil
+}
+
+// storeIndexOf stores the index of the stored backup, the backup is usable without it, so errors are only logged
+func storeIndexOf(ctx context.Context, backupName string, entries []backup.IndexEntry) {
+	if err := storeIndex(ctx, backupName, entries); err != nil {
+		log.Warn("Backup is stored without index: ", err)
+	}
+}
+
+// stagedBasebackup lets pg_basebackup write one tar file per tablespace into a staging directory
+// and stores them afterwards. The tablespaces are stored first, so the backup is only visible when it is complete.
+// An incremental backup passes its metadata, it is completed from the manifest and stored before everything else.
+// The backup_label of the backup is returned
+func stagedBasebackup(ctx context.Context, backupName string, backupArgs []string, meta *backup.Meta) (label []byte, err error) {
+	staging, err := ioutil.TempDir(viper.GetString("staging_dir"), "pgglaskugel-basebackup-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := os.RemoveAll(staging); err != nil {
+			log.Warn("Can not remove staging directory: ", err)
+		}
+	}()
+
+	backupCmd := exec.CommandContext(ctx, cmdBasebackup, append(backupArgs, "--pgdata", staging)...)
+	log.Debug("backupCmd: ", backupCmd)
+	backupDone := make(chan struct{}) // Channel to wait for WatchOutput
+	backupStderror, err := backupCmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	go util.WatchOutput(backupStderror, log.Info, backupDone)
+	if err := backupCmd.Start(); err != nil {
+		return nil, errors.New("pg_basebackup failed on startup, " + err.Error())
+	}
+	log.Info("Backup was started, staging directory is ", staging)
+	<-backupDone
+	if err = backupCmd.Wait(); err != nil {
+		return nil, errors.New("pg_basebackup failed after startup, " + err.Error())
+	}
+
+	// pg_basebackup writes base.tar, <OID>.tar for every tablespace and backup_manifest (PostgreSQL 13+)
+	files, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return nil, err
+	}
+	var oids []string
+	baseFound := false
+	var manifest []byte
+	for _, f := range files {
+		oid := strings.TrimSuffix(f.Name(), ".tar")
+		switch {
+		case f.Name() == "base.tar":
+			baseFound = true
+		case f.Name() == backup.ManifestFile:
+			if manifest, err = ioutil.ReadFile(filepath.Join(staging, f.Name())); err != nil {
+				return nil, err
+			}
+		case oid+".tar" == f.Name() && isOID(oid):
+			oids = append(oids, oid)
+		default:
+			return nil, errors.New("Unexpected file from pg_basebackup: " + f.Name())
+		}
+	}
+	if !baseFound {
+		return nil, errors.New("pg_basebackup did not write base.tar")
+	}
+
+	var stored []string
+	defer func() {
+		if err != nil && len(stored) > 0 {
+			log.Warn("Backup failed, the following objects are left in the storage: ", strings.Join(stored, ", "))
+		}
+	}()
+	if meta != nil {
+		if manifest == nil {
+			return nil, errors.New("pg_basebackup did not write " + backup.ManifestFile)
+		}
+		m, err := backup.ParseManifest(manifest)
+		if err != nil {
+			return nil, err
+		}
+		if meta.StartLSN, meta.Timeline, err = m.Start(); err != nil {
+			return nil, err
+		}
+		if err = storeMeta(ctx, *meta); err != nil {
+			return nil, err
+		}
+		stored = append(stored, backup.MetaObjectName(backupName))
+	}
+
+	// An incomplete index is not stored, files missing in it would be removed by a delta restore
+	var index []backup.IndexEntry
+	complete := true
+	for _, oid := range oids {
+		name := backup.TablespaceObjectName(backupName, oid)
+		log.Info("Store tablespace ", oid, " as ", name)
+		entries, _, indexed, err := storeStagedFile(ctx, filepath.Join(staging, oid+".tar"), name, oid)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, name)
+		index = append(index, entries...)
+		complete = complete && indexed
+	}
+	// The manifest is not in the tar files, restore and incremental backups need it
+	if manifest != nil {
+		if err = storeManifest(ctx, backupName, manifest); err != nil {
+			return nil, err
+		}
+		stored = append(stored, backup.ManifestObjectName(backupName))
+	}
+	entries, label, indexed, err := storeStagedFile(ctx, filepath.Join(staging, "base.tar"), backupName, "")
+	if err != nil {
+		return nil, err
+	}
+	if complete && indexed {
+		storeIndexOf(ctx, backupName, append(entries, index...))
+	}
+	return label, nil
+}
+
+// isOID returns true if name is an OID
+func isOID(name string) bool {
+	_, err := strconv.ParseUint(name, 10, 32)
+	return err == nil
+}
+
+// storeStagedFile compresses, encrypts (if configured) and stores the file as name.
+// The returned index entries belong to the tablespace oid (empty for the backup itself), indexed is false if indexing failed.
+// label is the backup_label in the file (only for the backup itself)
+func storeStagedFile(ctx context.Context, path string, name string, oid string) (entries []backup.IndexEntry, label []byte, indexed bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer file.Close()
+	indexer := newTarIndexer(file, oid)
+	err = storeBackupData(ctx, indexer, name)
+	entries, indexErr := indexer.Close()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if indexErr != nil {
+		log.Warn("Backup is stored without index, can not index ", path, ": ", indexErr)
+		return nil, indexer.File("backup_label"), false, nil
+	}
+	return entries, indexer.File("backup_label"), true, nil
+}
+
+// countTablespaces returns the number of user defined tablespaces of the cluster
+func countTablespaces(conString string) (count int, err error) {
+	db, err := sql.Open("postgres", conString)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	err = db.QueryRow("SELECT count(*) FROM pg_tablespace WHERE spcname NOT IN ('pg_default', 'pg_global')").Scan(&count)
+	return count, err
+}
 
 // handleBackupStream takes a stream and persists it with the configured method
-func storeBackupStream(input *io.Reader, name string) {
-	storage.WriteStream(viper.GetViper(), input, name, "basebackup")
+func storeBackupStream(input *io.Reader, name string, logicalSum func() string) (err error) {
+	counter := &util.CountingReader{Reader: *input}
+	var stream io.Reader = counter
+	err = storage.WriteStream(viper.GetViper(), &stream, name, "basebackup", logicalSum)
+	// Objects of a backup are stored in parallel
+	atomic.AddInt64(&backupSize, counter.Count())
+	return err
 }
 
 func init() {
 	RootCmd.AddCommand(basebackupCmd)
 	basebackupCmd.PersistentFlags().Bool("no-standalone", false, "Do not include WAL files in backup. If set all needed WAL files need to be available via the Archive! If set to false the archive is still needed for 'point in time recovery'!")
+	basebackupCmd.PersistentFlags().String("type", backup.BackupTypeFull, "Type of the backup: full, incremental (based on the newest backup) or differential (based on the newest full backup)")
+	basebackupCmd.PersistentFlags().Bool("incremental", false, "Take an incremental backup, short for --type incremental")
+	basebackupCmd.PersistentFlags().String("method", backup.MethodPgBasebackup, "How the backup is taken: pg_basebackup or native (reads the files of the cluster and stores them in parallel chunks)")
+	basebackupCmd.PersistentFlags().Int("native_chunk_size_mb", 64, "Size of the files packed into one chunk by the native method, 0 stores every file as its own object")
+	basebackupCmd.PersistentFlags().String("primary-connection", "", "Connection string to the primary for backups from a standby, the primary switches the WAL at the end so the last WAL segment is archived")
+	basebackupCmd.PersistentFlags().String("staging_dir", "", "Directory for the tar files of clusters with tablespaces, they can not be streamed. The temporary directory of the system if empty")
 	// Bind flags to viper
-	viper.BindPFlag("no-standalone", basebackupCmd.PersistentFlags().Lookup("no-standalone"))
+	bindSetting("no-standalone", basebackupCmd.PersistentFlags().Lookup("no-standalone"))
+	bindSetting("backup-type", basebackupCmd.PersistentFlags().Lookup("type"))
+	bindSetting("incremental", basebackupCmd.PersistentFlags().Lookup("incremental"))
+	bindSetting("method", basebackupCmd.PersistentFlags().Lookup("method"))
+	bindSetting("native_chunk_size_mb", basebackupCmd.PersistentFlags().Lookup("native_chunk_size_mb"))
+	bindSetting("primary-connection", basebackupCmd.PersistentFlags().Lookup("primary-connection"))
+	bindSetting("staging_dir", basebackupCmd.PersistentFlags().Lookup("staging_dir"))
 }
@@ -21,7 +21,8 @@
 package cmd
 
 import (
-	"os"
+	"errors"
+	"fmt"
 	"strconv"
 
 	"github.com/spf13/cobra"
@@ -29,6 +30,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/metrics"
 	"github.com/xxorde/pgglaskugel/storage"
 	util "github.com/xxorde/pgglaskugel/util"
 )
@@ -38,113 +40,194 @@ var cleanupCmd = &cobra.Command{
 	Use:   "cleanup",
 	Short: "Deletes backups and WAL files enforcing an retention policy",
 	Long: `Enforces your retention policy by deleting backups and WAL files.
+	Use --all-clusters to enforce it for every cluster section of the config file.
 	Use with care.`,
+	Annotations: map[string]string{annotationWritesRepository: ""},
 	Run: func(cmd *cobra.Command, args []string) {
-		backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
-
-		retain := uint(viper.GetInt("retain"))
-		if retain <= 0 {
-			log.Fatal("retain has to be 1 or higher! retain is: ", retain)
-		}
-
-		keep, discard, err := backups.SeparateBackupsByAge(retain)
+		err := forEachConfiguredCluster(cmd, func() error {
+			return runCleanup(viper.GetBool("force-delete"), viper.GetBool("dry-run"))
+		})
 		if err != nil {
-			log.Error(err)
-		}
-
-		// Are all backups we want to keep sane?
-		if keep.IsSane() != true {
-			log.Warn("Not all backups to keep are sane, will only count sane backups for retention policy")
-			log.Warn("The following backups will not count for retention policy: ", keep.Insane())
-
-			// Keep only the sane backups
-			// Not sane backups are not deleted, but they are not taken into account for retention policy
-			// In sane backups will be deleted when too old
-			keep = keep.Sane()
-		}
-
-		// Check if we have less backups than we want to keep
-		if uint(keep.Len()) < retain {
-			log.Warn("Not enough backups for retention policy!")
-		}
-
-		// Do we have backups to keep?
-		if keep.Len() >= 1 {
-			log.Info("Keep the following backups:", keep.String())
-		} else {
-			log.Info("No backups will be left!")
-		}
-
-		// Show backups to delete, or exit if none
-		if discard.Len() >= 1 {
-			log.Info("DELETE the following backups: ", discard.String())
-		} else {
-			log.Info("No backups will be removed!")
-			os.Exit(0)
-		}
-
-		// The user must confirm deletion or set force-delete
-		confirmDelete := viper.GetBool("force-delete")
-		if confirmDelete != true {
-			var err error
-			confirmDelete, err = util.AnswerConfirmation("If you want to continue please type \"yes\" (Ctl-C to end):")
-			util.CheckError(err)
-		}
-		if confirmDelete != true {
-			log.Warn("Deletion was not confirmed, exiting now.")
-			os.Exit(1)
+			log.Fatal(err)
 		}
+		printDone()
+	},
+}
 
-		// Delete all backups in the "discard" set
-		count, err := storage.DeleteAll(viper.GetViper(), &discard)
+// runCleanup enforces the retention policy, the user has to confirm the deletion if force is not set
+// With dryRun nothing is deleted, only what would be deleted is shown
+func runCleanup(force bool, dryRun bool) (err error) {
+	unlock, err := lockLocal(lockClassCleanup, "")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Nobody may use backups or WAL files while they are deleted
+	mode := backup.LockExclusive
+	if dryRun {
+		mode = backup.LockShared
+	}
+	lock, err := acquireStorageLock(mode, "cleanup")
+	if err != nil {
+		return err
+	}
+	defer releaseStorageLock(lock, &err)
+
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+
+	retain := uint(viper.GetInt("retain"))
+	if retain <= 0 {
+		return fmt.Errorf("retain has to be 1 or higher! retain is: %d", retain)
+	}
+
+	keep, discard, err := backups.SeparateBackupsByAge(retain)
+	if err != nil {
+		log.Error(err)
+	}
+	// Incremental and differential backups need their parents, they are kept as well
+	if err = keepParents(&keep, &discard); err != nil {
+		return err
+	}
+	// All backups in keep are left after the deletion, even the not sane ones
+	left := backup.Backups{Backup: append([]backup.Backup{}, keep.Backup...)}
+
+	// Are all backups we want to keep sane?
+	if keep.IsSane() != true {
+		log.Warn("Not all backups to keep are sane, will only count sane backups for retention policy")
+		log.Warn("The following backups will not count for retention policy: ", keep.Insane())
+
+		// Keep only the sane backups
+		// Not sane backups are not deleted, but they are not taken into account for retention policy
+		// In sane backups will be deleted when too old
+		keep = keep.Sane()
+	}
+
+	// Check if we have less backups than we want to keep
+	if uint(keep.Len()) < retain {
+		log.Warn("Not enough backups for retention policy!")
+	}
+
+	// Do we have backups to keep?
+	if keep.Len() >= 1 {
+		log.Info("Keep the following backups:", keep.String())
+	} else {
+		log.Info("No backups will be left!")
+	}
+
+	// Show backups to delete, or return if none
+	if discard.Len() >= 1 {
+		log.Info("DELETE the following backups: ", discard.String())
+	} else {
+		log.Info("No backups will be removed!")
+		return cleanupDedup(dryRun, lock)
+	}
+
+	if dryRun {
+		oldWal, err := oldestNeededWal(&left)
 		if err != nil {
-			log.Fatal("DeleteAll()", err)
+			return err
 		}
-		log.Info(strconv.Itoa(count) + " backups were removed.")
-		backups = storage.GetMyBackups(viper.GetViper(), subDirWal)
-
-		// Show backups that are left
-		log.Info("Backups left: " + backups.String())
-
-		// Use oldest needed backup to determin oldest needed WAL file
-		oldestBackup := backups.OldestBackup()
-
-		// asign StorageType to oldestBackup
-		oldestBackup.StorageType = viper.GetString("backup_to")
-
-		oldestNeededWal, err := storage.GetStartWalLocation(viper.GetViper(), oldestBackup)
+		walArchive, err := storage.GetWals(viper.GetViper())
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-		if oldestNeededWal <= "" {
-			log.Fatal("Could not get oldest needed WAL file")
+		count := 0
+		for _, wal := range walArchive.WalFiles {
+			if wal.OlderThan(oldWal) {
+				count++
+			}
 		}
-		log.Debug("oldestNeededWal: ", oldestNeededWal)
-
-		// Create object to represent oldest needed WAL file
-		var oldWal backup.Wal
-		oldWal.Name = oldestNeededWal
-
-		// Get all WAL files
-		walArchive, err := storage.GetWals(viper.GetViper())
+		log.Infof("Dry run: %d backups and %d WAL files would be deleted", discard.Len(), count)
+		return cleanupDedup(dryRun, lock)
+	}
+
+	// The user must confirm deletion or set force-delete
+	confirmDelete := force
+	if confirmDelete != true {
+		var err error
+		confirmDelete, err = util.AnswerConfirmation("If you want to continue please type \"yes\" (Ctl-C to end):")
 		if err != nil {
-			log.Error(err)
+			return err
 		}
+	}
+	if confirmDelete != true {
+		return errors.New("Deletion was not confirmed")
+	}
+
+	// Nothing is deleted without the lock, others could use the backups and WAL files again
+	if err = lock.Err(); err != nil {
+		return err
+	}
+	// Delete all backups in the "discard" set
+	count, err := storage.DeleteAll(viper.GetViper(), &discard)
+	if err != nil {
+		return errors.New("DeleteAll() " + err.Error())
+	}
+	metrics.RetentionDeleted.Add(float64(count), "basebackup")
+	log.Info(strconv.Itoa(count) + " backups were removed.")
+	backups = storage.GetMyBackups(viper.GetViper(), subDirWal)
+
+	// Show backups that are left
+	log.Info("Backups left: " + backups.String())
+
+	oldWal, err := oldestNeededWal(&backups)
+	if err != nil {
+		return err
+	}
+
+	// Get all WAL files
+	walArchive, err := storage.GetWals(viper.GetViper())
+	if err != nil {
+		log.Error(err)
+	}
+
+	// Delete all WAL files that are older than oldestNeededWal
+	if err = lock.Err(); err != nil {
+		return err
+	}
+	count = storage.DeleteOldWal(viper.GetViper(), &walArchive, oldWal)
+	metrics.RetentionDeleted.Add(float64(count), "wal")
+	log.Infof("Deleted %d WAL files:", count)
+
+	// Chunks of deduplicated backups are deleted when no backup uses them anymore
+	return cleanupDedup(false, lock)
+}
 
-		// Delete all WAL files that are older than oldestNeededWal
-		count = storage.DeleteOldWal(viper.GetViper(), &walArchive, oldWal)
-		log.Infof("Deleted %d WAL files:", count)
-
-		printDone()
-	},
+// oldestNeededWal returns the oldest WAL file needed by the given backups
+func oldestNeededWal(backups *backup.Backups) (oldWal backup.Wal, err error) {
+	// Use oldest needed backup to determin oldest needed WAL file
+	oldestBackup := backups.OldestBackup()
+	if oldestBackup == nil {
+		return oldWal, errors.New("No backup left to determine the oldest needed WAL file")
+	}
+
+	// asign StorageType to oldestBackup
+	oldestBackup.StorageType = viper.GetString("backup_to")
+
+	oldestNeeded, err := storage.GetStartWalLocation(viper.GetViper(), oldestBackup)
+	if err != nil {
+		return oldWal, err
+	}
+	if oldestNeeded <= "" {
+		return oldWal, errors.New("Could not get oldest needed WAL file")
+	}
+	log.Debug("oldestNeededWal: ", oldestNeeded)
+
+	// Create object to represent oldest needed WAL file
+	oldWal.Name = oldestNeeded
+	return oldWal, nil
 }
 
 func init() {
 	RootCmd.AddCommand(cleanupCmd)
 	cleanupCmd.PersistentFlags().Uint("retain", 0, "Number of (new) backups to keep?")
 	cleanupCmd.PersistentFlags().Bool("force-delete", false, "Force the deletion of old backups, without asking!")
+	cleanupCmd.PersistentFlags().Bool("dry-run", false, "Only show what would be deleted")
+	addAllClustersFlag(cleanupCmd, "Enforce the retention policy of every cluster section of the config file")
 
 	// Bind flags to viper
-	viper.BindPFlag("retain", cleanupCmd.PersistentFlags().Lookup("retain"))
-	viper.BindPFlag("force-delete", cleanupCmd.PersistentFlags().Lookup("force-delete"))
+	bindSetting("retain", cleanupCmd.PersistentFlags().Lookup("retain"))
+	bindSetting("force-delete", cleanupCmd.PersistentFlags().Lookup("force-delete"))
+	bindSetting("dry-run", cleanupCmd.PersistentFlags().Lookup("dry-run"))
 }
@@ -0,0 +1,361 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+var (
+	// repository is the metadata of the repository, nil if it has none (older versions)
+	repository *backup.Repository
+	// currentCluster is the cluster the backups and WAL files are read from and written to,
+	// nil if the repository has no cluster prefixes or the cluster is not in it yet
+	currentCluster *backup.Cluster
+)
+
+// openRepository checks that the repository can be used with the configuration and selects the cluster.
+// Repositories without metadata (new ones or of older versions) are used in the layout without cluster
+// prefixes, so archive_command and restores keep working after an update. Commands that write backups
+// in the current layout (writes) refuse them until repo init or repo upgrade was run
+func openRepository(writes bool) error {
+	repository = nil
+	useCluster(nil)
+	repo, found, err := loadRepository()
+	if err != nil {
+		return fmt.Errorf("Can not read the metadata of the repository: %v", err)
+	}
+	if !found {
+		if writes {
+			return errors.New("The repository has no metadata, run 'pgglaskugel repo init' (new repository) or 'pgglaskugel repo upgrade' (repository of an older version)")
+		}
+		log.Warn("The repository has no metadata, it is used in the old layout. Run 'pgglaskugel repo init' (new repository) or 'pgglaskugel repo upgrade' (repository of an older version)")
+		return nil
+	}
+	if err = repo.Check(encryptionMode(), configuredSystemID()); err != nil {
+		return err
+	}
+	repository = &repo
+	cluster, err := selectCluster(repo)
+	if err != nil {
+		return err
+	}
+	if cluster == nil {
+		log.Warn("The cluster ", clusterName, " is not in the repository yet, it is added with its first basebackup or WAL file")
+		return nil
+	}
+	log.Debug("Using cluster ", cluster, " with prefix ", cluster.Prefix())
+	useCluster(cluster)
+	return nil
+}
+
+// useCluster scopes the backups and WAL files to the prefix of the cluster, nil uses the layout without prefixes
+func useCluster(cluster *backup.Cluster) {
+	prefix := ""
+	if cluster != nil {
+		prefix = cluster.Prefix()
+	}
+	currentCluster = cluster
+	viper.Set("cluster_prefix", prefix)
+	viper.Set("backupdir", filepath.Join(archiveDir, filepath.FromSlash(prefix), subDirBasebackup))
+	viper.Set("waldir", filepath.Join(archiveDir, filepath.FromSlash(prefix), subDirWal))
+}
+
+// selectCluster returns the cluster of the configuration: the one with system_identifier, the one of the local
+// data directory or the newest one with the cluster name. It is nil if the cluster is not in the repository yet
+func selectCluster(repo backup.Repository) (cluster *backup.Cluster, err error) {
+	if err = backup.CheckClusterName(clusterName); err != nil {
+		return nil, err
+	}
+	clusters := repo.ClustersNamed(clusterName)
+	id := viper.GetString("system_identifier")
+	if id == "" {
+		id = localSystemID()
+	}
+	for i := range clusters {
+		if clusters[i].SystemID == id {
+			return &clusters[i], nil
+		}
+	}
+	if viper.GetString("system_identifier") != "" || len(clusters) == 0 {
+		return nil, nil
+	}
+	if id != "" {
+		log.Warn("The local cluster has system identifier ", id, ", it is not in the repository yet. Using the newest cluster ", clusterName)
+	}
+	return &clusters[len(clusters)-1], nil
+}
+
+// configuredSystemID returns the system identifier of the configured cluster: system_identifier
+// or the one of the local data directory, empty if it is not known
+func configuredSystemID() string {
+	if id := viper.GetString("system_identifier"); id != "" {
+		return id
+	}
+	return localSystemID()
+}
+
+// localSystemID returns the system identifier of the cluster in pgdata or in the working directory
+// (the archive_command runs in the data directory), empty if there is none
+func localSystemID() string {
+	for _, dir := range []string{os.ExpandEnv(viper.GetString("pgdata")), "."} {
+		if id, err := systemIDFromPgData(dir); err == nil {
+			return strconv.FormatUint(id, 10)
+		}
+	}
+	return ""
+}
+
+// registerCluster adds the cluster with the system identifier to the repository if it is not in it yet
+// and scopes the backups and WAL files to it. Repositories without metadata have no clusters
+func registerCluster(systemID string) (err error) {
+	if repository == nil {
+		return nil
+	}
+	if configured := viper.GetString("system_identifier"); configured != "" && configured != systemID {
+		return fmt.Errorf("system_identifier is %s, but the cluster has system identifier %s", configured, systemID)
+	}
+	for _, c := range repository.ClustersNamed(clusterName) {
+		if c.SystemID == systemID {
+			useCluster(&c)
+			return nil
+		}
+	}
+
+	// Other clusters may have been added since the repository was opened, the metadata is read
+	// and written under the repository lock so no concurrent registration is lost
+	lock, err := acquireRepositoryLock("register-cluster")
+	if err != nil {
+		return err
+	}
+	defer releaseStorageLock(lock, &err)
+	repo, found, err := loadRepository()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("The metadata of the repository was removed")
+	}
+	cluster, added := repo.AddCluster(clusterName, systemID)
+	if added {
+		if err = storeRepository(repo); err != nil {
+			return err
+		}
+		log.Info("Added cluster ", cluster, " to the repository")
+	}
+	repository = &repo
+	useCluster(&cluster)
+	return nil
+}
+
+// registerDatabaseCluster registers the cluster of the database, the local data directory is used
+// if the system identifier can not be queried (PostgreSQL 9.6+ is needed)
+func registerDatabaseCluster(conString string) error {
+	if repository == nil {
+		return nil
+	}
+	id, err := clusterSystemID(conString)
+	if err != nil {
+		if id = localSystemID(); id == "" {
+			id = viper.GetString("system_identifier")
+		}
+		if id == "" {
+			return fmt.Errorf("Can not get the system identifier of the cluster, set pgdata or system_identifier: %v", err)
+		}
+	}
+	return registerCluster(id)
+}
+
+// registerLocalCluster registers the cluster of the local data directory, it is used by the archive_command
+func registerLocalCluster() error {
+	if repository == nil {
+		return nil
+	}
+	id := localSystemID()
+	if id == "" {
+		if currentCluster != nil {
+			return nil
+		}
+		if id = viper.GetString("system_identifier"); id == "" {
+			return fmt.Errorf("Can not find the system identifier of the cluster %s, set pgdata or system_identifier", clusterName)
+		}
+	}
+	return registerCluster(id)
+}
+
+// forEachCluster calls fn with the backups and WAL files scoped to every cluster of the repository,
+// the current cluster is used again afterwards. Without metadata fn is called once with nil
+func forEachCluster(fn func(cluster *backup.Cluster) error) (err error) {
+	current := currentCluster
+	defer useCluster(current)
+	repo, found, err := loadRepository()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fn(nil)
+	}
+	for i := range repo.Clusters {
+		useCluster(&repo.Clusters[i])
+		if err = fn(&repo.Clusters[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachStoredCluster calls fn with the backups and WAL files scoped to every cluster prefix in the storage
+// and once with nil for the objects outside of the cluster prefixes. Unlike forEachCluster it does not depend on
+// the metadata of the repository, so no cluster is missed that is not (or not anymore) in it
+func forEachStoredCluster(fn func(cluster *backup.Cluster) error) (err error) {
+	current := currentCluster
+	defer useCluster(current)
+	objects, err := storage.ListObjects(viper.GetViper(), backup.ClusterPrefix+"/")
+	if err != nil {
+		return err
+	}
+	useCluster(nil)
+	if err = fn(nil); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, object := range objects {
+		cluster, ok := backup.ParseClusterPrefix(object.Key)
+		if !ok {
+			log.Warn("Object outside of a cluster prefix: ", object.Key)
+			continue
+		}
+		if seen[cluster.Prefix()] {
+			continue
+		}
+		seen[cluster.Prefix()] = true
+		useCluster(&cluster)
+		if err = fn(&cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupClusterName returns the name of the cluster in the name of a backup (name@time)
+func backupClusterName(name string) string {
+	if i := strings.LastIndex(name, "@"); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// upgradeClusterPrefixes moves the backups and WAL files of a repository with format version 1 below the prefixes
+// of their clusters. The system identifiers are taken from the metadata of the backups, the WAL files belong to
+// the configured cluster
+func upgradeClusterPrefixes(repo *backup.Repository, dryRun bool) error {
+	useCluster(nil)
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	wals, err := storage.GetWals(viper.GetViper())
+	if err != nil {
+		return err
+	}
+
+	// The system identifier of the configured cluster is known even if its backups have no metadata
+	ids := make(map[string]string)
+	if id := viper.GetString("system_identifier"); id != "" {
+		ids[clusterName] = id
+	} else if repo.SystemID != "" {
+		ids[clusterName] = repo.SystemID
+	} else if id = localSystemID(); id != "" {
+		ids[clusterName] = id
+	} else if id, err = clusterSystemID(viper.GetString("connection")); err == nil {
+		ids[clusterName] = id
+	}
+	backups.SortDesc()
+	for i := range backups.Backup {
+		b := &backups.Backup[i]
+		b.StorageType = viper.GetString("backup_to")
+		name := backupClusterName(b.Name)
+		if ids[name] != "" || b.Meta == nil {
+			continue
+		}
+		meta, err := loadMeta(b)
+		if err != nil {
+			return fmt.Errorf("Can not read the metadata of %s: %v", b.Name, err)
+		}
+		ids[name] = meta.SystemID
+	}
+
+	// Nothing is moved before every system identifier is known
+	names := make(map[string]bool)
+	for _, b := range backups.Backup {
+		name := backupClusterName(b.Name)
+		names[name] = true
+		if ids[name] == "" {
+			return fmt.Errorf("The system identifier of cluster %s is unknown, run the upgrade with --cluster_name %s --system_identifier ID", name, name)
+		}
+	}
+	if len(wals.WalFiles) > 0 && ids[clusterName] == "" {
+		return fmt.Errorf("The system identifier of cluster %s is unknown, the WAL files belong to it. Set pgdata or system_identifier", clusterName)
+	}
+	if len(names) > 1 && len(wals.WalFiles) > 0 {
+		log.Warn("The repository has backups of ", len(names), " clusters, all WAL files are moved to cluster ", clusterName)
+	}
+
+	clusters := make(map[string]backup.Cluster)
+	for name := range names {
+		clusters[name], _ = repo.AddCluster(name, ids[name])
+	}
+	if len(wals.WalFiles) > 0 {
+		clusters[clusterName], _ = repo.AddCluster(clusterName, ids[clusterName])
+	}
+	repo.SystemID = ""
+
+	if dryRun {
+		for _, c := range clusters {
+			log.Info("Dry run: cluster ", c, " would get prefix ", c.Prefix())
+		}
+		log.Infof("Dry run: would move %d backups and %d WAL files", backups.Len(), len(wals.WalFiles))
+		return nil
+	}
+	for _, b := range backups.Backup {
+		prefix := clusters[backupClusterName(b.Name)].Prefix()
+		// The parts are moved first, the backup is only listed with all of them
+		for _, part := range append(b.Parts(), b) {
+			if err = storage.MoveToCluster(viper.GetViper(), part.Name+part.Extension, "basebackup", prefix); err != nil {
+				return fmt.Errorf("Can not move %s: %v", part.Name+part.Extension, err)
+			}
+		}
+	}
+	for _, w := range wals.WalFiles {
+		if err = storage.MoveToCluster(viper.GetViper(), w.Name+w.Extension, "archive", clusters[clusterName].Prefix()); err != nil {
+			return fmt.Errorf("Can not move %s: %v", w.Name+w.Extension, err)
+		}
+	}
+	log.Infof("Moved %d backups and %d WAL files below the prefixes of %d clusters", backups.Len(), len(wals.WalFiles), len(clusters))
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+// upgradedRepository creates a repository with the current format version that has the cluster main
+func upgradedRepository(t *testing.T) (dir string, restore func()) {
+	dir, restore = legacyRepository(t)
+	if err := runRepoUpgrade(false); err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	if err := openRepository(true); err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	return dir, restore
+}
+
+func TestRegisterClusterKeepsOtherClusters(t *testing.T) {
+	_, restore := upgradedRepository(t)
+	defer restore()
+	viper.Set("system_identifier", "")
+
+	// Another host registers its cluster after this one opened the repository
+	repo, _, err := loadRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo.AddCluster("other", "6400000000000000002")
+	if err = storeRepository(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = registerCluster("6400000000000000003"); err != nil {
+		t.Fatal(err)
+	}
+	repo, _, err = loadRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var clusters []string
+	for _, c := range repo.Clusters {
+		clusters = append(clusters, c.Name+"-"+c.SystemID)
+	}
+	sort.Strings(clusters)
+	want := []string{"main-6400000000000000001", "main-6400000000000000003", "other-6400000000000000002"}
+	if len(clusters) != len(want) {
+		t.Fatalf("clusters %v, expected %v", clusters, want)
+	}
+	for i := range want {
+		if clusters[i] != want[i] {
+			t.Errorf("clusters %v, expected %v", clusters, want)
+			break
+		}
+	}
+	if currentCluster == nil || currentCluster.SystemID != "6400000000000000003" {
+		t.Errorf("current cluster %v after the registration", currentCluster)
+	}
+}
+
+func TestForEachStoredCluster(t *testing.T) {
+	dir, restore := upgradedRepository(t)
+	defer restore()
+
+	// A cluster that is not in the metadata still has backups in the storage
+	path := filepath.Join(dir, backup.ClusterPrefix, "other-6400000000000000002", subDirBasebackup, "other@2017-01-02T03:04:05Z.zst")
+	if err := os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("data"), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	visited := make(map[string]int)
+	err := forEachStoredCluster(func(cluster *backup.Cluster) error {
+		name := ""
+		if cluster != nil {
+			name = cluster.Name + "-" + cluster.SystemID
+		}
+		backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+		visited[name] = backups.Len()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"": 0, "main-" + testSystemID: 1, "other-6400000000000000002": 1}
+	if len(visited) != len(want) {
+		t.Errorf("visited %v, expected %v", visited, want)
+	}
+	for name, backups := range want {
+		if got, ok := visited[name]; !ok || got != backups {
+			t.Errorf("cluster %q: visited %t with %d backups, expected %d", name, ok, got, backups)
+		}
+	}
+	if currentCluster == nil || currentCluster.SystemID != testSystemID {
+		t.Errorf("current cluster %v afterwards, expected the one of main", currentCluster)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+const (
+	// clustersKey is the key of the cluster sections in the config file
+	clustersKey = "clusters"
+	// allClustersFlag makes a command run for every cluster section of the config file
+	allClustersFlag = "all-clusters"
+)
+
+var (
+	// sectionGlobals are the global values of the keys the selected cluster section overrides
+	sectionGlobals = make(map[string]interface{})
+	// selectedSection is the name of the cluster section in use, empty if the global settings are used
+	selectedSection string
+)
+
+// configuredClusters returns the names of the cluster sections in the config file, sorted
+func configuredClusters() (names []string) {
+	for name := range viper.GetStringMap(clustersKey) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyClusterSection uses the settings of the cluster section over the global ones, flags given on the
+// command line are kept. The cluster name is the name of the section if it does not set one.
+// The settings of the previous section are undone, an empty name only uses the global settings
+func applyClusterSection(name string) error {
+	for key, value := range sectionGlobals {
+		viper.Set(key, value)
+	}
+	sectionGlobals = make(map[string]interface{})
+	selectedSection = ""
+	defer loadSettings()
+	if name == "" {
+		return nil
+	}
+
+	name = strings.ToLower(name)
+	if _, ok := viper.GetStringMap(clustersKey)[name]; !ok {
+		return fmt.Errorf("There is no cluster %s in the config file, configured clusters: %s", name, strings.Join(configuredClusters(), ", "))
+	}
+	// The map belongs to viper, it is copied before the cluster name is added
+	section := map[string]interface{}{"cluster_name": name}
+	for key, value := range viper.GetStringMap(clustersKey + "." + name) {
+		section[strings.ToLower(key)] = value
+	}
+	for key, value := range section {
+		if key == clustersKey || key == "cluster" {
+			return fmt.Errorf("The section of cluster %s can not set %s", name, key)
+		}
+		if settingFlagChanged(key) {
+			log.Debug("Flag ", key, " is used instead of the setting of cluster ", name)
+			continue
+		}
+		sectionGlobals[key] = viper.Get(key)
+		viper.Set(key, value)
+	}
+	selectedSection = name
+	log.Debug("Using the settings of cluster ", name)
+	return nil
+}
+
+// dropClusterSection undoes the settings of the selected cluster section, the global values come from
+// the config file (or flags, env and defaults) again instead of the values they had when it was applied
+func dropClusterSection() {
+	for key := range sectionGlobals {
+		viper.Set(key, nil)
+	}
+	sectionGlobals = make(map[string]interface{})
+	selectedSection = ""
+}
+
+// addAllClustersFlag adds --all-clusters to a command that can run for every cluster section of the config file
+func addAllClustersFlag(cmd *cobra.Command, usage string) {
+	cmd.PersistentFlags().Bool(allClustersFlag, false, usage)
+}
+
+// iteratesClusters returns true if the command runs once for every cluster section of the config file,
+// this is done with --all-clusters if no cluster is selected with --cluster
+func iteratesClusters(cmd *cobra.Command) bool {
+	all := cmd.Flag(allClustersFlag)
+	return all != nil && all.Changed && viper.GetString("cluster") == "" && len(configuredClusters()) > 0
+}
+
+// forEachConfiguredCluster calls fn with the settings of every cluster section if the command iterates over them,
+// otherwise once with the current settings. A failing cluster does not stop the others
+func forEachConfiguredCluster(cmd *cobra.Command, fn func() error) error {
+	if !iteratesClusters(cmd) {
+		return fn()
+	}
+	defer applyClusterSection("")
+	names := configuredClusters()
+	failed := 0
+	for _, name := range names {
+		log.Info("Cluster ", name)
+		err := applyClusterSection(name)
+		if err == nil {
+			err = storage.CheckBackend(viper.GetString("backup_to"))
+		}
+		if err == nil && needsRepository(cmd) {
+			err = openRepository(writesRepository(cmd))
+		}
+		if err == nil {
+			err = fn()
+		}
+		if err != nil {
+			log.Error("Cluster ", name, ": ", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d clusters failed", failed, len(names))
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIteratesClusters(t *testing.T) {
+	restore := setSettings(map[string]interface{}{
+		clustersKey: map[string]interface{}{"db1": map[string]interface{}{}, "db2": map[string]interface{}{}},
+		"cluster":   "",
+	})
+	defer restore()
+
+	tests := []struct {
+		flags   []string
+		iterate bool
+	}{
+		{nil, false},
+		// --all of verify selects the backups, not the clusters
+		{[]string{"all"}, false},
+		{[]string{allClustersFlag}, true},
+		{[]string{"all", allClustersFlag}, true},
+	}
+	for _, test := range tests {
+		for _, flag := range test.flags {
+			f := verifyCmd.Flag(flag)
+			f.Value.Set("true")
+			f.Changed = true
+		}
+		if iterate := iteratesClusters(verifyCmd); iterate != test.iterate {
+			t.Errorf("verify %v: iterates is %t, expected %t", test.flags, iterate, test.iterate)
+		}
+		for _, flag := range []string{"all", allClustersFlag} {
+			f := verifyCmd.Flag(flag)
+			f.Value.Set("false")
+			f.Changed = false
+		}
+	}
+
+	for _, cmd := range []string{"ls", "lswal", "status", "cleanup", "verify"} {
+		c, _, err := RootCmd.Find([]string{cmd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Flag(allClustersFlag) == nil {
+			t.Errorf("%s has no --%s", cmd, allClustersFlag)
+		}
+	}
+}
+
+func TestClusterStatus(t *testing.T) {
+	_, restore := legacyRepository(t)
+	defer restore()
+
+	created, _ := time.Parse(time.RFC3339, "2017-01-02T03:04:05Z")
+	status, err := clusterStatus(created.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Cluster: main\n",
+		"Backups: 1\n",
+		"Newest backup: main@2017-01-02T03:04:05Z (2 hours ago",
+		"WAL files: 1\n",
+		"WAL timeline 00000001: 000000010000000000000001 - 000000010000000000000001 (1 files)\n",
+	} {
+		if !strings.Contains(status, want) {
+			t.Errorf("status does not contain %q:\n%s", want, status)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+const (
+	// Types of the settings without a flag, the others have the type of their flag
+	settingTypeMap = "map"
+	// Value shown instead of a secret
+	maskedSecret = "********"
+)
+
+var (
+	// configOnlySettings are the settings that can only be set in the config file
+	configOnlySettings = map[string]string{
+		"clusters":            settingTypeMap,
+		"restore_command":     "string",
+		"s3_force_path_style": "bool",
+		"schedule":            settingTypeMap,
+	}
+	// settingFlags are the settings that can be set with a flag, keyed by their viper key.
+	// The flag may have another name than the setting (e.g. --type sets backup-type)
+	settingFlags = make(map[string]*pflag.Flag)
+	// secretSettings are not shown by config show
+	secretSettings = map[string]bool{
+		"api_token":     true,
+		"s3_access_key": true,
+		"s3_secret_key": true,
+	}
+	// regPassword finds the password in a connection string (key/value or URI)
+	regPassword = regexp.MustCompile(`(password\s*=\s*)('[^']*'|\S+)|(://[^:/@]+:)([^@]+)(@)`)
+)
+
+// configCmd groups the commands for the configuration
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Checks and shows the configuration",
+	Long:  `Commands to check the configuration and to show the settings in use.`,
+}
+
+// configValidateCmd checks the configuration
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Checks the configuration",
+	Long: `Checks the config file and the settings of every cluster section in it: unknown keys, values of the wrong type,
+	settings that can not work together (e.g. encrypt without a recipient) and paths that do not exist.
+	The exit code is 1 if a problem was found.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		problems := validateConfig()
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			log.Fatalf("Found %d problem(s) in the configuration", len(problems))
+		}
+		log.Info("The configuration is valid")
+		printDone()
+	},
+	Annotations: map[string]string{annotationNoRepository: ""},
+}
+
+// configShowCmd shows the settings in use
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Shows the settings in use and where they come from",
+	Long: `Shows every setting with its value and its source: default, file, env or flag.
+	Settings of the cluster section selected with --cluster come from "file (cluster NAME)".
+	Secrets (keys and passwords) are masked.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fmt.Print(showConfig())
+		printDone()
+	},
+	Annotations: map[string]string{annotationNoRepository: ""},
+}
+
+// bindSetting binds the flag to the setting key and records it in settingFlags
+func bindSetting(key string, flag *pflag.Flag) {
+	if flag == nil {
+		panic("No flag for setting " + key)
+	}
+	settingFlags[key] = flag
+	viper.BindPFlag(key, flag)
+}
+
+// settingTypes returns the type of every known setting, it is the type of the flag bound to it
+func settingTypes() map[string]string {
+	types := make(map[string]string)
+	for key, settingType := range configOnlySettings {
+		types[key] = settingType
+	}
+	for key, flag := range settingFlags {
+		types[key] = flag.Value.Type()
+	}
+	return types
+}
+
+// settingFlagChanged returns true if the setting is given with its flag on the command line
+func settingFlagChanged(key string) bool {
+	flag, ok := settingFlags[key]
+	return ok && flag.Changed
+}
+
+// checkSettingType returns an error if the value from the config file can not be used as settingType
+func checkSettingType(value interface{}, settingType string) error {
+	kind := reflect.ValueOf(value).Kind()
+	scalar := kind != reflect.Map && kind != reflect.Slice && kind != reflect.Invalid
+	text := fmt.Sprint(value)
+	var err error
+	switch settingType {
+	case settingTypeMap:
+		if kind != reflect.Map {
+			err = fmt.Errorf("is not a map")
+		}
+	case "stringArray", "stringSlice":
+		if kind != reflect.Slice && !scalar {
+			err = fmt.Errorf("is not a list")
+		}
+	case "bool":
+		if !scalar {
+			err = fmt.Errorf("is not a bool")
+		} else if _, err = strconv.ParseBool(text); err != nil {
+			err = fmt.Errorf("%q is not a bool", text)
+		}
+	case "int":
+		if _, err = strconv.Atoi(text); err != nil || !scalar {
+			err = fmt.Errorf("%q is not a number", text)
+		}
+	case "uint":
+		if _, err = strconv.ParseUint(text, 10, 0); err != nil || !scalar {
+			err = fmt.Errorf("%q is not a positive number", text)
+		}
+	case "duration":
+		if _, err = time.ParseDuration(text); err != nil || !scalar {
+			err = fmt.Errorf("%q is not a duration (e.g. 5m)", text)
+		}
+	default:
+		if !scalar {
+			err = fmt.Errorf("is not a %s", settingType)
+		}
+	}
+	return err
+}
+
+// validateConfig returns the problems of the configuration
+func validateConfig() (problems []string) {
+	types := settingTypes()
+	if file := viper.ConfigFileUsed(); file != "" {
+		problems = append(problems, validateConfigFile(file, types)...)
+	}
+
+	// With cluster sections the global settings are only their defaults, every section is checked
+	selected := selectedSection
+	defer applyClusterSection(selected)
+	sections := configuredClusters()
+	if len(sections) == 0 {
+		sections = []string{""}
+	}
+	for _, name := range sections {
+		prefix := ""
+		if name != "" {
+			prefix = "cluster " + name + ": "
+		}
+		if err := applyClusterSection(name); err != nil {
+			problems = append(problems, prefix+err.Error())
+			continue
+		}
+		for _, problem := range validateSettings() {
+			problems = append(problems, prefix+problem)
+		}
+	}
+	return problems
+}
+
+// validateConfigFile returns the unknown keys and the values of the wrong type in the config file
+func validateConfigFile(file string, types map[string]string) (problems []string) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return []string{fmt.Sprintf("Can not read the config file %s: %v", file, err)}
+	}
+	return validateConfigKeys(v, types)
+}
+
+// validateConfigKeys returns the unknown keys and the values of the wrong type in the config read by v
+func validateConfigKeys(v *viper.Viper, types map[string]string) (problems []string) {
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		setting := key
+		// Cluster sections have the same settings as the global ones, but no sections
+		if parts := strings.SplitN(key, ".", 3); parts[0] == clustersKey && len(parts) == 3 {
+			if setting = parts[2]; strings.SplitN(setting, ".", 2)[0] == clustersKey || setting == "cluster" {
+				problems = append(problems, fmt.Sprintf("%s: can not be set for a cluster", key))
+				continue
+			}
+		}
+		// The schedules are named by the user
+		if parts := strings.SplitN(setting, ".", 2); parts[0] == "schedule" && len(parts) == 2 {
+			if err := checkSettingType(v.Get(key), "string"); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+			}
+			continue
+		}
+		settingType, ok := types[setting]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: unknown key", key))
+			continue
+		}
+		if err := checkSettingType(v.Get(key), settingType); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	return problems
+}
+
+// validateSettings returns the settings in use that can not work together and the paths that do not exist
+func validateSettings() (problems []string) {
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	s3 := false
+	for _, key := range []string{"backup_to", "archive_to"} {
+		if err := storage.CheckBackend(viper.GetString(key)); err != nil {
+			problem("%s: %v", key, err)
+		}
+		s3 = s3 || viper.GetString(key) == "s3"
+	}
+	if s3 && viper.GetInt("s3_part_size_mb") < 5 {
+		problem("s3_part_size_mb: has to be at least 5, is: %d", viper.GetInt("s3_part_size_mb"))
+	}
+	if viper.GetBool("encrypt") {
+		recipients := 0
+		for _, recipient := range viper.GetStringSlice("recipient") {
+			if strings.TrimSpace(recipient) != "" {
+				recipients++
+			}
+		}
+		if recipients == 0 {
+			problem("encrypt: is set, but there is no recipient")
+		}
+	}
+	if err := checkRepoFormat(); err != nil {
+		problem("repo_format: %v", err)
+	}
+	if viper.GetInt("jobs") < 1 {
+		problem("jobs: has to be at least 1, is: %d", viper.GetInt("jobs"))
+	}
+	if viper.GetInt("retain") < 1 {
+		problem("retain: has to be at least 1, is: %d", viper.GetInt("retain"))
+	}
+	if viper.GetDuration("lock_ttl") <= 0 {
+		problem("lock_ttl: has to be longer than 0, is: %s", viper.GetDuration("lock_ttl"))
+	}
+	if (viper.GetString("api_tls_cert") == "") != (viper.GetString("api_tls_key") == "") {
+		problem("api_tls_cert and api_tls_key: have to be set together")
+	}
+	if id := viper.GetString("system_identifier"); id != "" {
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			problem("system_identifier: %q is not a system identifier", id)
+		}
+	}
+
+	// Paths
+	if viper.GetString("backup_to") == "file" || viper.GetString("archive_to") == "file" {
+		if err := checkDir(viper.GetString("archivedir")); err != nil {
+			problem("archivedir: %v", err)
+		}
+	}
+	if !viper.GetBool("pgdata-auto") {
+		if err := checkDir(os.ExpandEnv(viper.GetString("pgdata"))); err != nil {
+			problem("pgdata: %v", err)
+		}
+	}
+	// The directories of the lock files are created, the parents of temporary directories have to exist
+	for _, key := range []string{"staging_dir", "restore_test_dir"} {
+		if dir := viper.GetString(key); dir != "" {
+			if err := checkDir(dir); err != nil {
+				problem("%s: %v", key, err)
+			}
+		}
+	}
+	for _, key := range []string{"api_tls_cert", "api_tls_key"} {
+		if file := viper.GetString(key); file != "" {
+			if _, err := os.Stat(file); err != nil {
+				problem("%s: %v", key, err)
+			}
+		}
+	}
+	if !viper.GetBool("no_tool_check") {
+		tools := []string{"path_to_tar", "path_to_basebackup", "path_to_zstd", "path_to_zstdcat"}
+		if viper.GetBool("encrypt") {
+			tools = append(tools, "path_to_gpg")
+		}
+		for _, key := range tools {
+			if err := checkExecutable(viper.GetString(key)); err != nil {
+				problem("%s: %v", key, err)
+			}
+		}
+	}
+	return problems
+}
+
+// checkDir returns an error if dir is not an existing directory
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// checkExecutable returns an error if file is not an executable file
+func checkExecutable(file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", file)
+	}
+	return nil
+}
+
+// settingSource returns where the value of the setting in use comes from: default, file, env or flag
+func settingSource(key string) string {
+	if _, ok := sectionGlobals[key]; ok {
+		return "file (cluster " + selectedSection + ")"
+	}
+	if settingFlagChanged(key) {
+		return "flag"
+	}
+	if _, ok := os.LookupEnv(strings.ToUpper(key)); ok {
+		return "env"
+	}
+	if viper.InConfig(key) {
+		return "file"
+	}
+	return "default"
+}
+
+// maskSetting returns the value of the setting to show, secrets are masked
+func maskSetting(key string, value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	text := fmt.Sprint(value)
+	if secretSettings[key] && text != "" {
+		return maskedSecret
+	}
+	return regPassword.ReplaceAllString(text, "${1}${3}"+maskedSecret+"${5}")
+}
+
+// showConfig returns the settings in use with their sources
+func showConfig() string {
+	types := settingTypes()
+	keys := make([]string, 0, len(types))
+	for key := range types {
+		if key != clustersKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	buf := new(bytes.Buffer)
+	if file := viper.ConfigFileUsed(); file != "" {
+		fmt.Fprintln(buf, "Config file:", file)
+	}
+	if selectedSection != "" {
+		fmt.Fprintln(buf, "Cluster:", selectedSection)
+	}
+	w := tabwriter.NewWriter(buf, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, maskSetting(key, viper.Get(key)), settingSource(key))
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configShowCmd)
+}
@@ -0,0 +1,162 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// setSettings sets the settings, the returned function sets the values before again
+func setSettings(settings map[string]interface{}) (restore func()) {
+	old := make(map[string]interface{})
+	for key, value := range settings {
+		old[key] = viper.Get(key)
+		viper.Set(key, value)
+	}
+	return func() {
+		for key, value := range old {
+			viper.Set(key, value)
+		}
+	}
+}
+
+func TestSettingTypes(t *testing.T) {
+	types := settingTypes()
+	// Settings bound to flags with another name have the key of the setting
+	want := map[string]string{
+		"backup-type":          "string",
+		"verify-all":           "bool",
+		"ls-all-clusters":      "bool",
+		"repo-upgrade-dry-run": "bool",
+		"backup-ls-pattern":    "string",
+		"backup-extract-to":    "string",
+		"lock_ttl":             "duration",
+		"recipient":            "stringArray",
+		"schedule":             settingTypeMap,
+	}
+	for key, settingType := range want {
+		if types[key] != settingType {
+			t.Errorf("%s has type %q, expected %q", key, types[key], settingType)
+		}
+	}
+	for _, flag := range []string{"type", "pattern", "to", "all", "all-clusters", "config", "help"} {
+		if _, ok := types[flag]; ok {
+			t.Errorf("the flag name %s is a setting", flag)
+		}
+	}
+}
+
+func TestValidateConfigKeys(t *testing.T) {
+	tests := []struct {
+		config   string
+		problems []string
+	}{
+		{"backup-type: full\nretain: 3\nlock_ttl: 2m\n", nil},
+		{"type: full\n", []string{"type: unknown key"}},
+		{"retain: many\n", []string{"retain: \"many\" is not a positive number"}},
+		{"lock_ttl: 5\n", []string{"lock_ttl: \"5\" is not a duration (e.g. 5m)"}},
+		{"schedule:\n  cleanup: \"0 3 * * *\"\n", nil},
+		{"clusters:\n  main:\n    retain: 3\n    cluster: other\n", []string{"clusters.main.cluster: can not be set for a cluster"}},
+	}
+	for _, test := range tests {
+		v := viper.New()
+		v.SetConfigType("yaml")
+		if err := v.ReadConfig(strings.NewReader(test.config)); err != nil {
+			t.Fatal(err)
+		}
+		problems := validateConfigKeys(v, settingTypes())
+		if strings.Join(problems, "\n") != strings.Join(test.problems, "\n") {
+			t.Errorf("%q: problems %q, expected %q", test.config, problems, test.problems)
+		}
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	valid := map[string]interface{}{
+		"backup_to":         "file",
+		"archive_to":        "file",
+		"archivedir":        dir,
+		"pgdata":            dir,
+		"pgdata-auto":       false,
+		"encrypt":           false,
+		"repo_format":       repoFormatPlain,
+		"jobs":              2,
+		"retain":            3,
+		"lock_ttl":          "5m",
+		"api_tls_cert":      "",
+		"api_tls_key":       "",
+		"system_identifier": "",
+		"staging_dir":       "",
+		"restore_test_dir":  "",
+		"no_tool_check":     true,
+	}
+
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		problem  string
+	}{
+		{"valid", nil, ""},
+		{"unknown backend", map[string]interface{}{"backup_to": "tape"}, "backup_to: "},
+		{"encryption without recipient", map[string]interface{}{"encrypt": true, "recipient": []string{" "}}, "encrypt: is set, but there is no recipient"},
+		{"unknown format", map[string]interface{}{"repo_format": "zip"}, "repo_format: "},
+		{"no jobs", map[string]interface{}{"jobs": 0}, "jobs: has to be at least 1, is: 0"},
+		{"nothing retained", map[string]interface{}{"retain": 0}, "retain: has to be at least 1, is: 0"},
+		{"lock without ttl", map[string]interface{}{"lock_ttl": "0s"}, "lock_ttl: has to be longer than 0, is: 0s"},
+		{"certificate without key", map[string]interface{}{"api_tls_cert": filepath.Join(dir, "cert.pem")}, "api_tls_cert and api_tls_key: have to be set together"},
+		{"invalid system identifier", map[string]interface{}{"system_identifier": "main"}, "system_identifier: \"main\" is not a system identifier"},
+		{"missing archivedir", map[string]interface{}{"archivedir": filepath.Join(dir, "missing")}, "archivedir: "},
+		{"missing pgdata", map[string]interface{}{"pgdata": filepath.Join(dir, "missing")}, "pgdata: "},
+		{"missing tool", map[string]interface{}{"no_tool_check": false, "path_to_tar": filepath.Join(dir, "tar")}, "path_to_tar: "},
+	}
+	for _, test := range tests {
+		restoreValid := setSettings(valid)
+		restore := setSettings(test.settings)
+		problems := validateSettings()
+		restore()
+		restoreValid()
+
+		if test.problem == "" {
+			if len(problems) > 0 {
+				t.Errorf("%s: unexpected problems %q", test.name, problems)
+			}
+			continue
+		}
+		found := false
+		for _, problem := range problems {
+			found = found || strings.HasPrefix(problem, test.problem)
+		}
+		if !found {
+			t.Errorf("%s: problems %q, expected one starting with %q", test.name, problems, test.problem)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/metrics"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+// scheduledJob is a job the daemon runs on a cron schedule
+type scheduledJob struct {
+	name    string
+	run     func() error
+	running int32 // 1 while the job is running, runs of the same job never overlap
+}
+
+var (
+	// All jobs that can be scheduled, the key is used in the schedule configuration
+	daemonJobs = map[string]*scheduledJob{
+		"basebackup": {name: "basebackup", run: basebackupJob},
+		"cleanup":    {name: "cleanup", run: cleanupJob},
+		"verify":     {name: "verify", run: verifyJob},
+	}
+
+	// daemonCmd represents the daemon command
+	daemonCmd = &cobra.Command{
+		Use:   "daemon",
+		Short: "Runs basebackup, cleanup and verify on a schedule",
+		Long: `Keeps running and starts basebackup, cleanup and verify according to the schedule in the configuration.
+	Runs of the same job never overlap, failed runs are retried with an increasing delay.
+	Send SIGHUP to reload the configuration.
+	Example configuration:
+	schedule:
+	  basebackup: "0 1 * * *"
+	  cleanup: "30 3 * * *"
+	  verify: "@weekly"`,
+		Annotations: map[string]string{annotationLongRunning: "", annotationWritesRepository: ""},
+		Run: func(cmd *cobra.Command, args []string) {
+			runDaemon()
+			printDone()
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(daemonCmd)
+	rand.Seed(time.Now().UnixNano())
+
+	daemonCmd.PersistentFlags().Duration("schedule_jitter", 0, "Delay every scheduled run by a random duration up to this value")
+	daemonCmd.PersistentFlags().Int("schedule_retries", 3, "How often a failed run is retried")
+	daemonCmd.PersistentFlags().Duration("schedule_retry_delay", time.Minute, "Delay before the first retry, doubled for every further retry")
+
+	// Bind flags to viper
+	bindSetting("schedule_jitter", daemonCmd.PersistentFlags().Lookup("schedule_jitter"))
+	bindSetting("schedule_retries", daemonCmd.PersistentFlags().Lookup("schedule_retries"))
+	bindSetting("schedule_retry_delay", daemonCmd.PersistentFlags().Lookup("schedule_retry_delay"))
+}
+
+// runDaemon schedules the configured jobs until SIGINT or SIGTERM is received
+func runDaemon() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for {
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		if scheduleJobs(stop, &wg) == 0 {
+			log.Warn("No jobs are scheduled, please check the schedule in the configuration")
+		}
+
+		sig := <-signals
+		close(stop)
+		if sig != syscall.SIGHUP {
+			log.Info("Received ", sig, ", waiting for running jobs to finish")
+			wg.Wait()
+			return
+		}
+
+		// The jobs read the settings while they run, they are not changed under them
+		log.Info("Received SIGHUP, waiting for running jobs to finish before the configuration is reloaded")
+		wg.Wait()
+		if err := reloadConfig(); err != nil {
+			log.Error("Can not reload configuration, keep using the old one: ", err)
+		}
+	}
+}
+
+// scheduleJobs starts a loop for every job in the schedule and returns the number of scheduled jobs
+func scheduleJobs(stop chan struct{}, wg *sync.WaitGroup) (count int) {
+	jitter := viper.GetDuration("schedule_jitter")
+	for name, spec := range viper.GetStringMapString("schedule") {
+		job, ok := daemonJobs[name]
+		if !ok {
+			log.Error("Unknown job in schedule: ", name)
+			continue
+		}
+		if spec == "" {
+			continue
+		}
+		schedule, err := util.ParseCron(spec)
+		if err != nil {
+			log.Error("Can not schedule ", name, ": ", err)
+			continue
+		}
+		log.Infof("Scheduled %s: %s", name, schedule)
+		wg.Add(1)
+		go job.loop(schedule, jitter, stop, wg)
+		count++
+	}
+	return count
+}
+
+// loop runs the job on its schedule until stop is closed
+func (j *scheduledJob) loop(schedule *util.CronSchedule, jitter time.Duration, stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		next := schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Error("Schedule for ", j.name, " never matches: ", schedule)
+			return
+		}
+		if jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		log.Info("Next run of ", j.name, " at ", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		j.runWithRetries(stop)
+	}
+}
+
+// runWithRetries runs the job and retries failed runs with an exponential backoff
+func (j *scheduledJob) runWithRetries(stop chan struct{}) {
+	if !atomic.CompareAndSwapInt32(&j.running, 0, 1) {
+		log.Warn("Job ", j.name, " is still running, skip this run")
+		return
+	}
+	defer atomic.StoreInt32(&j.running, 0)
+
+	retries := viper.GetInt("schedule_retries")
+	delay := viper.GetDuration("schedule_retry_delay")
+	for attempt := 0; ; attempt++ {
+		log.Info("Start job ", j.name)
+		start := time.Now()
+		err := j.run()
+		if err == nil {
+			metrics.JobRuns.Inc(j.name, "success")
+			metrics.JobLastSuccess.SetToCurrentTime(j.name)
+			log.Info("Job ", j.name, " done in ", time.Since(start))
+			return
+		}
+		metrics.JobRuns.Inc(j.name, "failure")
+
+		if attempt >= retries {
+			log.Errorf("Job %s failed, giving up after %d attempts: %v", j.name, attempt+1, err)
+			return
+		}
+		wait := delay << uint(attempt)
+		log.Warnf("Job %s failed (attempt %d of %d), retry in %s: %v", j.name, attempt+1, retries+1, wait, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func basebackupJob() (err error) {
+	if err = runBasebackup(); err != nil {
+		metrics.BasebackupFailures.Inc()
+	}
+	return err
+}
+
+func cleanupJob() (err error) {
+	// Nobody can confirm the deletion, so it has to be forced in the configuration
+	if !viper.GetBool("force-delete") {
+		return errors.New("cleanup can only be scheduled with force-delete")
+	}
+	return runCleanup(true, false)
+}
+
+// verifyJob verifies all backups, see verify.go
+func verifyJob() (err error) {
+	results, err := runVerify("", true)
+	if err != nil {
+		return err
+	}
+	log.Info(verifySummary(results))
+	if failed := countFailed(results); failed > 0 {
+		return fmt.Errorf("%d of %d backup(s) failed the verification", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,468 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+const (
+	// repoFormatPlain stores every object of a backup as one compressed (and encrypted) stream
+	repoFormatPlain = "plain"
+	// repoFormatDedup splits the objects into content-defined chunks, every chunk is stored only once
+	repoFormatDedup = "dedup"
+)
+
+// checkRepoFormat checks the configured format of new backups
+func checkRepoFormat() error {
+	switch format := viper.GetString("repo_format"); format {
+	case repoFormatPlain:
+	case repoFormatDedup:
+		if viper.GetInt("dedup_chunk_size_kb") < 64 {
+			return fmt.Errorf("dedup_chunk_size_kb has to be at least 64, is: %d", viper.GetInt("dedup_chunk_size_kb"))
+		}
+	default:
+		return fmt.Errorf("Unknown repo_format %q, use %s or %s", format, repoFormatPlain, repoFormatDedup)
+	}
+	return nil
+}
+
+// storeBackupData stores the data of a backup object (the backup, a tablespace or a chunk of them) as name,
+// it is deduplicated if repo_format is dedup
+func storeBackupData(ctx context.Context, input io.Reader, name string) error {
+	if viper.GetString("repo_format") == repoFormatDedup {
+		return storeDedupStream(ctx, input, name)
+	}
+	return compressEncryptStream(ctx, input, name, storeBackupStream)
+}
+
+// dedupStore remembers the chunks in the repository, so every chunk is stored only once
+type dedupStore struct {
+	mutex  sync.Mutex
+	loaded bool
+	chunks map[string]bool
+}
+
+// dedupChunks are the chunks known to the running backup
+var dedupChunks dedupStore
+
+// reset forgets the known chunks, they are listed again on the next use
+func (s *dedupStore) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.loaded = false
+	s.chunks = nil
+}
+
+// claim returns true if the chunk is not in the repository yet, the caller has to store it then.
+// From now on the chunk counts as stored, so parallel writers do not store it again
+func (s *dedupStore) claim(hash string) (store bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.loaded {
+		objects, err := storage.ListObjects(viper.GetViper(), backup.DedupChunkPrefix)
+		if err != nil {
+			return false, err
+		}
+		s.chunks = make(map[string]bool, len(objects))
+		for _, object := range objects {
+			if hash, ok := backup.ParseDedupChunkKey(object.Key); ok {
+				s.chunks[hash] = true
+			}
+		}
+		s.loaded = true
+		log.Debugf("%d chunks are in the repository", len(s.chunks))
+	}
+	if s.chunks[hash] {
+		return false, nil
+	}
+	s.chunks[hash] = true
+	return true, nil
+}
+
+// forget removes a chunk that could not be stored
+func (s *dedupStore) forget(hash string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.chunks, hash)
+}
+
+// storeDedupStream splits the stream into content-defined chunks and stores the new ones in parallel.
+// The dedup index of the object is stored as name with the dedup extension after all chunks
+func storeDedupStream(ctx context.Context, input io.Reader, name string) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type newChunk struct {
+		hash string
+		data []byte
+	}
+	pending := make(chan newChunk)
+	var storeErr error
+	var failOnce sync.Once
+	var workers sync.WaitGroup
+	for i := 0; i < nativeJobs(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for chunk := range pending {
+				if err := storeDedupChunk(ctx, chunk.hash, chunk.data); err != nil {
+					dedupChunks.forget(chunk.hash)
+					failOnce.Do(func() {
+						storeErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	index := backup.DedupIndex{Version: backup.DedupIndexVersion, Object: name}
+	chunker := backup.NewChunker(input, viper.GetInt("dedup_chunk_size_kb")*1024)
+	stored := 0
+	for {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var data []byte
+		if data, err = chunker.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		index.Chunks = append(index.Chunks, backup.DedupRef{Hash: hash, Size: int64(len(data))})
+		index.Size += int64(len(data))
+
+		var store bool
+		if store, err = dedupChunks.claim(hash); err != nil {
+			break
+		}
+		if store {
+			pending <- newChunk{hash: hash, data: data}
+			stored++
+		}
+	}
+	close(pending)
+	workers.Wait()
+	if storeErr != nil {
+		return storeErr
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("%s has %d chunks, %d of them are new", name, len(index.Chunks), stored)
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return compressEncryptObject(ctx, bytes.NewReader(data), name+backup.DedupExtension, storeBackupStream)
+}
+
+// storeDedupChunk compresses, encrypts (if configured) and stores a chunk under its hash
+func storeDedupChunk(ctx context.Context, hash string, data []byte) error {
+	encoded, err := encodeChunk(ctx, data)
+	if err != nil {
+		return err
+	}
+	if err = storage.WriteObject(viper.GetViper(), backup.DedupChunkKey(hash), encoded); err != nil {
+		return err
+	}
+	atomic.AddInt64(&backupSize, int64(len(encoded)))
+	return nil
+}
+
+// filterData pipes data through the command and returns its output
+func filterData(ctx context.Context, data []byte, command string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stdin = bytes.NewReader(data)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v %s", filepath.Base(command), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// encodeChunk compresses and encrypts (if configured) a chunk like the other objects
+func encodeChunk(ctx context.Context, data []byte) (encoded []byte, err error) {
+	if encoded, err = filterData(ctx, data, cmdZstd, "-q", "--stdout", "-"); err != nil {
+		return nil, err
+	}
+	if viper.GetBool("encrypt") {
+		args := []string{"--encrypt", "-o", "-"}
+		for _, r := range viper.GetStringSlice("recipient") {
+			args = append(args, "--recipient", r)
+		}
+		return filterData(ctx, encoded, cmdGpg, args...)
+	}
+	return encoded, nil
+}
+
+// decodeChunk decrypts (if configured) and inflates a stored chunk
+func decodeChunk(ctx context.Context, encoded []byte) (data []byte, err error) {
+	if viper.GetBool("encrypt") {
+		if encoded, err = filterData(ctx, encoded, cmdGpg, "--decrypt", "-o", "-"); err != nil {
+			return nil, err
+		}
+	}
+	return filterData(ctx, encoded, cmdZstd, "-q", "-d", "--stdout", "-")
+}
+
+// readDedupChunk reads a chunk and checks it against its reference
+func readDedupChunk(ctx context.Context, ref backup.DedupRef) ([]byte, error) {
+	key := backup.DedupChunkKey(ref.Hash)
+	encoded, err := storage.ReadObject(viper.GetViper(), key)
+	if err != nil {
+		return nil, fmt.Errorf("Can not read chunk %s: %v", key, err)
+	}
+	data, err := decodeChunk(ctx, encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Can not decode chunk %s: %v", key, err)
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != ref.Size || hex.EncodeToString(sum[:]) != ref.Hash {
+		return nil, fmt.Errorf("Corrupt chunk %s, its data does not match its hash", key)
+	}
+	return data, nil
+}
+
+// readDedupIndex reads the dedup index of an object of a deduplicated backup
+func readDedupIndex(b *backup.Backup) (index backup.DedupIndex, err error) {
+	r, err := openObject(b)
+	if err != nil {
+		return index, err
+	}
+	data, err := ioutil.ReadAll(r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return index, err
+	}
+	if _, err = r.Verify(); err != nil {
+		return index, err
+	}
+	return backup.ParseDedupIndex(data)
+}
+
+// dedupReader reads the data of a deduplicated object from its chunks, the next chunks are fetched in parallel
+type dedupReader struct {
+	// fetched has a channel for every chunk in order, it gets the data of the chunk
+	fetched chan chan dedupResult
+	stop    chan struct{}
+	cancel  context.CancelFunc
+	fetches sync.WaitGroup
+	current []byte
+	err     error
+}
+
+// dedupResult is a fetched chunk
+type dedupResult struct {
+	data []byte
+	err  error
+}
+
+// newDedupReader starts to fetch the chunks of the index, the reader has to be closed
+func newDedupReader(index backup.DedupIndex) *dedupReader {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &dedupReader{
+		fetched: make(chan chan dedupResult, nativeJobs()),
+		stop:    make(chan struct{}),
+		cancel:  cancel,
+	}
+	r.fetches.Add(1)
+	go func() {
+		defer r.fetches.Done()
+		defer close(r.fetched)
+		for _, ref := range index.Chunks {
+			result := make(chan dedupResult, 1)
+			select {
+			case r.fetched <- result:
+			case <-r.stop:
+				return
+			}
+			r.fetches.Add(1)
+			go func(ref backup.DedupRef) {
+				defer r.fetches.Done()
+				data, err := readDedupChunk(ctx, ref)
+				result <- dedupResult{data: data, err: err}
+			}(ref)
+		}
+	}()
+	return r
+}
+
+// Read reads the data of the chunks in order
+func (r *dedupReader) Read(p []byte) (n int, err error) {
+	for len(r.current) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		result, ok := <-r.fetched
+		if !ok {
+			r.err = io.EOF
+			continue
+		}
+		fetched := <-result
+		r.current, r.err = fetched.data, fetched.err
+	}
+	n = copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
+
+// Close stops fetching chunks and waits for the running fetches
+func (r *dedupReader) Close() {
+	close(r.stop)
+	r.cancel()
+	for range r.fetched {
+	}
+	r.fetches.Wait()
+}
+
+// dedupUsage is the use of the chunks by the deduplicated backups
+type dedupUsage struct {
+	// refs counts the backups that reference a chunk
+	refs map[string]int
+	// sizes is the size of the data of every referenced chunk
+	sizes   map[string]int64
+	backups []dedupBackupUsage
+}
+
+// dedupBackupUsage is the use of the chunks by one backup
+type dedupBackupUsage struct {
+	name    string
+	logical int64
+	chunks  map[string]bool
+}
+
+// loadDedupUsage reads the dedup indexes of the backups of all clusters, chunks are shared between them.
+// The clusters are taken from the storage and not from the repository metadata, a chunk is never
+// taken for unused because a cluster is missing in the metadata
+func loadDedupUsage() (usage dedupUsage, err error) {
+	usage.refs = make(map[string]int)
+	usage.sizes = make(map[string]int64)
+	err = forEachStoredCluster(func(cluster *backup.Cluster) error {
+		backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+		return usage.add(&backups)
+	})
+	return usage, err
+}
+
+// add reads the dedup indexes of all objects of the backups
+func (usage *dedupUsage) add(backups *backup.Backups) error {
+	for i := range backups.Backup {
+		b := &backups.Backup[i]
+		b.StorageType = viper.GetString("backup_to")
+		used := dedupBackupUsage{name: b.Name, chunks: make(map[string]bool)}
+		objects, _ := backupObjects(b)
+		deduplicated := false
+		for _, object := range objects {
+			if object.Extension != backup.DedupExtension {
+				continue
+			}
+			deduplicated = true
+			index, err := readDedupIndex(object)
+			if err != nil {
+				return fmt.Errorf("Can not read the dedup index of %s: %v", object.Name, err)
+			}
+			used.logical += index.Size
+			for _, ref := range index.Chunks {
+				used.chunks[ref.Hash] = true
+				usage.sizes[ref.Hash] = ref.Size
+			}
+		}
+		if !deduplicated {
+			continue
+		}
+		for hash := range used.chunks {
+			usage.refs[hash]++
+		}
+		usage.backups = append(usage.backups, used)
+	}
+	return nil
+}
+
+// collectDedupGarbage deletes the chunks no backup references anymore, with dryRun they are only counted.
+// Nothing is deleted if a dedup index can not be read, deleting stops when the lock is lost
+func collectDedupGarbage(dryRun bool, lock *storage.HeldLock) (count int, size int64, err error) {
+	chunks, err := storage.ListObjects(viper.GetViper(), backup.DedupChunkPrefix)
+	if err != nil || len(chunks) == 0 {
+		return 0, 0, err
+	}
+	usage, err := loadDedupUsage()
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, chunk := range chunks {
+		hash, ok := backup.ParseDedupChunkKey(chunk.Key)
+		if !ok || usage.refs[hash] > 0 {
+			continue
+		}
+		if dryRun {
+			log.Debug("Would delete unused chunk ", chunk.Key)
+		} else if err = lock.Err(); err != nil {
+			return count, size, err
+		} else if err = storage.DeleteObject(viper.GetViper(), chunk.Key); err != nil {
+			return count, size, err
+		}
+		count++
+		size += chunk.Size
+	}
+	return count, size, nil
+}
+
+// cleanupDedup deletes the chunks of deduplicated backups that are not used anymore
+func cleanupDedup(dryRun bool, lock *storage.HeldLock) error {
+	count, size, err := collectDedupGarbage(dryRun, lock)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		log.Infof("Dry run: %d unused chunks (%s) would be deleted", count, humanize.Bytes(uint64(size)))
+	} else if count > 0 {
+		log.Infof("Deleted %d unused chunks (%s)", count, humanize.Bytes(uint64(size)))
+	}
+	return nil
+}
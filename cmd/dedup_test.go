@@ -0,0 +1,146 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+// storeDedupBackup stores data as deduplicated backup and returns the hashes of its chunks
+func storeDedupBackup(t *testing.T, name string, data []byte) map[string]bool {
+	if err := storeDedupStream(context.Background(), bytes.NewReader(data), name); err != nil {
+		t.Fatal(err)
+	}
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	b, err := backups.Find(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := readDedupIndex(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := make(map[string]bool)
+	for _, ref := range index.Chunks {
+		chunks[ref.Hash] = true
+	}
+	return chunks
+}
+
+func TestDedupGarbageCollection(t *testing.T) {
+	if _, err := exec.LookPath(cmdZstd); err != nil {
+		t.Skip(cmdZstd, " is not installed")
+	}
+	dir, restore := upgradedRepository(t)
+	defer restore()
+	defer setSettings(map[string]interface{}{"repo_format": repoFormatDedup, "dedup_chunk_size_kb": 64})()
+	dedupChunks.reset()
+	defer dedupChunks.reset()
+
+	// The second backup has data inserted in front and only shares the first half of the first one
+	random := rand.New(rand.NewSource(1))
+	first := make([]byte, 2<<20)
+	random.Read(first)
+	second := append(append([]byte("inserted"), first[:1<<20]...), make([]byte, 512<<10)...)
+	random.Read(second[len(second)-512<<10:])
+
+	firstChunks := storeDedupBackup(t, "main@2017-02-01T00:00:00Z", first)
+	secondChunks := storeDedupBackup(t, "main@2017-02-02T00:00:00Z", second)
+	onlyFirst := 0
+	for hash := range firstChunks {
+		if !secondChunks[hash] {
+			onlyFirst++
+		}
+	}
+	if onlyFirst == 0 || onlyFirst == len(firstChunks) {
+		t.Fatalf("%d of %d chunks of the first backup are not shared", onlyFirst, len(firstChunks))
+	}
+	chunkCount := func() int {
+		objects, err := storage.ListObjects(viper.GetViper(), backup.DedupChunkPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(objects)
+	}
+	stored := chunkCount()
+	if stored != len(firstChunks)+len(secondChunks)-(len(firstChunks)-onlyFirst) {
+		t.Errorf("%d chunks are stored, shared chunks are stored more than once", stored)
+	}
+
+	lock, err := acquireStorageLock(backup.LockExclusive, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	// Every chunk is referenced
+	if count, _, err := collectDedupGarbage(false, lock); err != nil || count != 0 {
+		t.Fatalf("%d chunks deleted (%v), all are in use", count, err)
+	}
+
+	// The chunks only the first backup used are garbage once it is deleted
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(info.Name(), "main@2017-02-01T00:00:00Z") {
+			err = os.Remove(path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _, err := collectDedupGarbage(true, lock); err != nil || count != onlyFirst || chunkCount() != stored {
+		t.Errorf("dry run counts %d chunks (%v), expected %d and nothing deleted", count, err, onlyFirst)
+	}
+	if count, _, err := collectDedupGarbage(false, lock); err != nil || count != onlyFirst {
+		t.Errorf("%d chunks deleted (%v), expected %d", count, err, onlyFirst)
+	}
+	if chunkCount() != len(secondChunks) {
+		t.Errorf("%d chunks are left, expected the %d of the second backup", chunkCount(), len(secondChunks))
+	}
+
+	// The second backup is still complete
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	b, err := backups.Find("main@2017-02-02T00:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := openBackup(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(data, second) {
+		t.Errorf("second backup differs after the garbage collection (%v)", err)
+	}
+}
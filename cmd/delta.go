@@ -0,0 +1,236 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+// deltaChain is a delta restore of a backup and the parents it needs (the full backup first).
+// Every file is compared with its content in the last backup of the chain that stores it completely,
+// incremental files of the later backups are applied on top of it as usual
+type deltaChain struct {
+	indexes    []backup.Index
+	trustMtime bool
+	// Per tablespace ("" for the backup itself): the step of the chain with the complete file by name
+	// and the function returned by prepareDelta, a tablespace is compared when it is restored the first time
+	base      map[string]map[string]int
+	unchanged map[string]func(name string) bool
+}
+
+// loadDeltaChain loads the indexes of all backups of the chain for a delta restore
+func loadDeltaChain(chain []*backup.Backup, trustMtime bool) (d *deltaChain, err error) {
+	d = &deltaChain{
+		trustMtime: trustMtime,
+		base:       make(map[string]map[string]int),
+		unchanged:  make(map[string]func(name string) bool),
+	}
+	for _, b := range chain {
+		index, err := loadIndex(b)
+		if err != nil {
+			return nil, fmt.Errorf("Delta restore needs the index of %s, %v", b.Name, err)
+		}
+		d.indexes = append(d.indexes, index)
+	}
+	return d, nil
+}
+
+// destination returns the function for util.Extractor.Skip for the given step of the chain.
+// The destination of the tablespace is compared with the chain (and cleaned up) on the first call.
+// It returns nil without a delta restore
+func (d *deltaChain) destination(dir string, tablespace string, step int) (skip func(name string) bool, err error) {
+	if d == nil {
+		return nil, nil
+	}
+	if _, ok := d.unchanged[tablespace]; !ok {
+		entries, base := d.expected(tablespace)
+		if d.unchanged[tablespace], err = prepareDelta(dir, entries, d.trustMtime); err != nil {
+			return nil, err
+		}
+		d.base[tablespace] = base
+	}
+	unchanged, base := d.unchanged[tablespace], d.base[tablespace]
+	return func(name string) bool {
+		// A file that is up to date is not written by its base step, nor changed by the steps before it
+		name = strings.TrimSuffix(name, backup.IncrementalSuffix)
+		k, ok := base[name]
+		return ok && step <= k && unchanged(name)
+	}, nil
+}
+
+// expected returns the index entries of the tablespace after the chain is restored: files with the entry
+// of the last step that stores them completely, everything else as in the last backup.
+// Files without a complete copy in the chain are left out, so they are always restored
+func (d *deltaChain) expected(tablespace string) (entries []backup.IndexEntry, base map[string]int) {
+	steps := make([]map[string]backup.IndexEntry, len(d.indexes))
+	for i := range d.indexes {
+		steps[i] = make(map[string]backup.IndexEntry)
+		for _, e := range d.indexes[i].Tablespace(tablespace) {
+			steps[i][e.Name] = e
+		}
+	}
+	base = make(map[string]int)
+	last := len(d.indexes) - 1
+	for _, e := range d.indexes[last].Tablespace(tablespace) {
+		name := strings.TrimSuffix(e.Name, backup.IncrementalSuffix)
+		if e.Type != backup.IndexFile {
+			entries = append(entries, e)
+			base[name] = last
+			continue
+		}
+		for k := last; k >= 0; k-- {
+			if full, ok := steps[k][name]; ok && full.Type == backup.IndexFile {
+				entries = append(entries, full)
+				base[name] = k
+				break
+			}
+		}
+	}
+	return entries, base
+}
+
+// prepareDelta compares dir with the index entries of the backup (or of a tablespace) before a delta restore.
+// Everything that is not in the backup or has another type is removed.
+// It returns a function for util.Extractor.Skip that is true for the files that are up to date
+func prepareDelta(dir string, entries []backup.IndexEntry, trustMtime bool) (skip func(name string) bool, err error) {
+	// A running cluster must not be changed
+	if exists, _ := util.Exists(filepath.Join(dir, "postmaster.pid")); exists {
+		return nil, errors.New(dir + " contains postmaster.pid, stop PostgreSQL (or remove the file if it is not running) before a delta restore")
+	}
+
+	byName := make(map[string]backup.IndexEntry, len(entries))
+	for _, e := range entries {
+		byName[filepath.FromSlash(e.Name)] = e
+	}
+	unchanged := make(map[string]bool)
+	var keptBytes int64
+	changed, removed := 0, 0
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil || name == "." {
+			return err
+		}
+		entry, ok := byName[name]
+		if !ok || !sameType(entry, info) {
+			log.Debug("Delta restore removes ", path)
+			removed++
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.Type != backup.IndexFile {
+			return nil
+		}
+		same, err := sameContent(path, info, entry, trustMtime)
+		if err != nil {
+			return err
+		}
+		if same {
+			unchanged[name] = true
+			keptBytes += info.Size()
+		} else {
+			changed++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Delta restore to %s: %d file(s) (%s) are up to date, %d differ, %d removed",
+		dir, len(unchanged), humanize.Bytes(uint64(keptBytes)), changed, removed)
+	return func(name string) bool { return unchanged[name] }, nil
+}
+
+// sameType returns true if the file on disk has the type of the index entry
+// Hard links are always replaced
+func sameType(entry backup.IndexEntry, info os.FileInfo) bool {
+	switch entry.Type {
+	case backup.IndexFile, backup.IndexHardlink:
+		return info.Mode().IsRegular()
+	case backup.IndexDir:
+		return info.IsDir()
+	case backup.IndexSymlink:
+		return info.Mode()&os.ModeSymlink != 0
+	}
+	return false
+}
+
+// sameContent returns true if the file has the content of the index entry.
+// Files with another size differ, with trustMtime files with the same size and modification time are the same,
+// otherwise the checksum is compared
+func sameContent(path string, info os.FileInfo, entry backup.IndexEntry, trustMtime bool) (same bool, err error) {
+	if info.Size() != entry.Size {
+		return false, nil
+	}
+	if trustMtime && info.ModTime().Unix() == entry.ModTime.Unix() {
+		return true, nil
+	}
+	sum, err := util.HashFile(path)
+	if err != nil {
+		return false, err
+	}
+	return sum == entry.Sha256, nil
+}
+
+// pruneRestored removes everything from dir that is not in restored (by name relative to dir),
+// it is used after the last backup of a chain was applied
+func pruneRestored(dir string, restored map[string]bool) (err error) {
+	removed := 0
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil || name == "." || restored[name] {
+			return err
+		}
+		log.Debug("Remove ", path, ", it is not in the backup")
+		removed++
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("Removed %d file(s) from %s that are not in the backup anymore", removed, dir)
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+func TestDeltaChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgglaskugel-delta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// sum writes content to a file of the destination and returns its checksum
+	sum := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		s, err := util.HashFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	file := func(name string, sha string) backup.IndexEntry {
+		return backup.IndexEntry{Name: name, Type: backup.IndexFile, Size: 2, Sha256: sha}
+	}
+	incremental := func(name string) backup.IndexEntry {
+		return backup.IndexEntry{Name: name + backup.IncrementalSuffix, Type: backup.IndexFile, Size: 100, Sha256: "patch"}
+	}
+
+	// Full backup with a and b, the incremental backup stores a completely and changes b, c is new
+	oldA := sum("a", "a0")
+	newA := sum("a", "a1")
+	b := sum("b", "b0")
+	sum("c", "c1")
+	sum("stale", "xx")
+	d := &deltaChain{
+		indexes: []backup.Index{
+			{Files: []backup.IndexEntry{file("a", oldA), file("b", b)}},
+			{Files: []backup.IndexEntry{file("a", newA), incremental("b"), incremental("c")}},
+		},
+		base:      make(map[string]map[string]int),
+		unchanged: make(map[string]func(name string) bool),
+	}
+
+	skipFull, err := d.destination(dir, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipIncremental, err := d.destination(dir, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		skip     func(string) bool
+		name     string
+		expected bool
+	}{
+		// a matches the incremental backup, neither backup writes it
+		{skipFull, "a", true},
+		{skipIncremental, "a", true},
+		// b matches the full backup, the incremental file is still applied
+		{skipFull, "b", true},
+		{skipIncremental, "b" + backup.IncrementalSuffix, false},
+		// c has no complete copy in the chain, it is always restored
+		{skipIncremental, "c" + backup.IncrementalSuffix, false},
+	}
+	for _, test := range tests {
+		if skip := test.skip(test.name); skip != test.expected {
+			t.Errorf("skip(%q) is %t, expected %t", test.name, skip, test.expected)
+		}
+	}
+
+	for name, expected := range map[string]bool{"a": true, "b": true, "c": false, "stale": false} {
+		if exists, _ := util.Exists(filepath.Join(dir, name)); exists != expected {
+			t.Errorf("%s exists is %t, expected %t", name, exists, expected)
+		}
+	}
+}
@@ -21,10 +21,12 @@
 package cmd
 
 import (
+	"path/filepath"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/metrics"
 	"github.com/xxorde/pgglaskugel/storage"
 
 	log "github.com/Sirupsen/logrus"
@@ -40,6 +42,10 @@ var fetchCmd = &cobra.Command{
 It is intended to use as an restore_command in the recovery.conf.
 	Example: restore_command = '` + myName + ` fetch %f %p'`,
 	Run: func(cmd *cobra.Command, args []string) {
+		onFatal(func() {
+			metrics.WalFetchFailures.Inc()
+			metrics.WalFetchDuration.ObserveSince(startTime)
+		})
 		if len(args) < 2 {
 			log.Fatal("Not enough arguments")
 		}
@@ -51,6 +57,7 @@ It is intended to use as an restore_command in the recovery.conf.
 		if err != nil {
 			log.Fatal("fetch failed ", err)
 		}
+		metrics.WalFetchDuration.ObserveSince(startTime)
 		elapsed := time.Since(startTime)
 		log.Info("Fetched WAL file in ", elapsed)
 	},
@@ -62,6 +69,16 @@ func init() {
 
 // fetchWal recovers a WAL file with the configured method
 func fetchWal(walTarget string, walName string) (err error) {
+	absTarget, err := filepath.Abs(walTarget)
+	if err != nil {
+		return err
+	}
+	unlock, err := lockLocal(lockClassFetch, absTarget)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	viper.SetDefault("waltarget", walTarget)
 	viper.SetDefault("walname", walName)
 	return storage.Fetch(viper.GetViper())
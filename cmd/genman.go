@@ -46,6 +46,7 @@ var (
 			cmd.Root().DisableAutoGenTag = true
 			doc.GenManTree(cmd.Root(), header, manDir)
 		},
+		Annotations: map[string]string{annotationNoRepository: ""},
 	}
 )
 
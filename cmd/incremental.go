@@ -0,0 +1,361 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+// storeMeta stores the metadata of the backup as its own object, compressed and encrypted like the backup
+func storeMeta(ctx context.Context, meta backup.Meta) (err error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return compressEncryptStream(ctx, bytes.NewReader(data), backup.MetaObjectName(meta.Backup), storeBackupStream)
+}
+
+// storeFullMeta stores the metadata of a full backup taken with pg_basebackup, the start comes from its backup_label.
+// The backup is usable without it (but can not be a parent), so errors are only logged
+func storeFullMeta(ctx context.Context, backupName string, label []byte, conString string, source backup.Source) {
+	if label == nil {
+		log.Warn("Backup is stored without metadata, it has no backup_label")
+		return
+	}
+	meta := backup.Meta{Version: backup.MetaVersion, Backup: backupName, Type: backup.BackupTypeFull, Method: backup.MethodPgBasebackup, Source: &source}
+	var err error
+	if meta.StartLSN, meta.Timeline, err = backup.ParseLabelStart(label); err != nil {
+		log.Warn("Backup is stored without metadata: ", err)
+		return
+	}
+	if meta.SystemID, err = clusterSystemID(conString); err != nil {
+		log.Warn("Can not get the system identifier of the cluster: ", err)
+	}
+	if err = storeMeta(ctx, meta); err != nil {
+		log.Warn("Backup is stored without metadata, it can not be the parent of incremental backups: ", err)
+	}
+}
+
+// storeManifest stores a copy of the backup manifest of the backup as its own object
+func storeManifest(ctx context.Context, backupName string, manifest []byte) (err error) {
+	return compressEncryptStream(ctx, bytes.NewReader(manifest), backup.ManifestObjectName(backupName), storeBackupStream)
+}
+
+// loadManifest returns the backup manifest of the backup, from its copy or (for backups without) from the backup itself
+func loadManifest(b *backup.Backup) (manifest []byte, err error) {
+	if b.Manifest != nil {
+		return readBackupPart(b.Manifest, "manifest of "+b.Name)
+	}
+	log.Info("Backup ", b.Name, " has no copy of its manifest, it is read from the backup")
+	reader, err := openBackup(b)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_, indexErr := backup.IndexTar(reader, "", map[string]*bytes.Buffer{backup.ManifestFile: &buf})
+	closeErr := reader.Close()
+	if _, err = reader.Verify(); err != nil {
+		return nil, err
+	}
+	if indexErr != nil {
+		return nil, indexErr
+	}
+	if closeErr != nil {
+		return nil, closeErr
+	}
+	if buf.Len() == 0 {
+		return nil, errors.New("Backup " + b.Name + " has no " + backup.ManifestFile + " (PostgreSQL 13+ is needed)")
+	}
+	return buf.Bytes(), nil
+}
+
+// loadMeta reads the metadata of the backup, backups without metadata are full backups
+func loadMeta(b *backup.Backup) (meta backup.Meta, err error) {
+	if b.Meta == nil {
+		return backup.LegacyMeta(b.Name), nil
+	}
+	data, err := readBackupPart(b.Meta, "metadata of "+b.Name)
+	if err != nil {
+		return meta, err
+	}
+	return backup.ParseMeta(data)
+}
+
+// clusterSystemID returns the system identifier of the cluster
+func clusterSystemID(conString string) (id string, err error) {
+	db, err := sql.Open("postgres", conString)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	err = db.QueryRow("SELECT system_identifier::text FROM pg_control_system()").Scan(&id)
+	return id, err
+}
+
+// selectParent returns the metadata of the parent for a new backup of backupType taken with method.
+// An incremental backup is based on the newest backup of the cluster, a differential backup on the newest full backup.
+// Chains do not mix methods: pg_combinebackup only combines backups of pg_basebackup
+// and pages can only be applied to a directory, not to the incremental files of pg_basebackup
+func selectParent(backups *backup.Backups, backupType string, method string) (parent backup.Meta, err error) {
+	backups.SortDesc()
+	for i := range backups.Backup {
+		b := &backups.Backup[i]
+		if b.ClusterName() != clusterName || b.Meta == nil {
+			continue
+		}
+		meta, err := loadMeta(b)
+		if err != nil {
+			log.Warn("Backup ", b.Name, " can not be the parent: ", err)
+			continue
+		}
+		if meta.StartLSN == "" {
+			continue
+		}
+		if backupType == backup.BackupTypeDifferential && meta.Type != backup.BackupTypeFull {
+			continue
+		}
+		if method == backup.MethodPgBasebackup && meta.Method != backup.MethodPgBasebackup {
+			continue
+		}
+		if method == backup.MethodNative && meta.Method == backup.MethodPgBasebackup && meta.Type != backup.BackupTypeFull {
+			continue
+		}
+		return meta, nil
+	}
+	return parent, fmt.Errorf("No backup with metadata found that can be the parent of a %s backup, take a full backup first", backupType)
+}
+
+// backupChain returns the backups needed to restore b and their metadata, starting with the full backup and ending with b
+func backupChain(backups *backup.Backups, b *backup.Backup) (chain []*backup.Backup, metas []backup.Meta, err error) {
+	for current := b; ; {
+		meta, err := loadMeta(current)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Can not read the metadata of %s: %v", current.Name, err)
+		}
+		chain = append([]*backup.Backup{current}, chain...)
+		metas = append([]backup.Meta{meta}, metas...)
+		if meta.Type == backup.BackupTypeFull {
+			return chain, metas, nil
+		}
+		if meta.Parent == "" {
+			return nil, nil, fmt.Errorf("%s backup %s has no parent", meta.Type, current.Name)
+		}
+		parent, err := backups.Find(meta.Parent)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Parent %s of %s is missing: %v", meta.Parent, current.Name, err)
+		}
+		if !parent.Created.Before(current.Created) {
+			return nil, nil, fmt.Errorf("Parent %s of %s is not older than its child", meta.Parent, current.Name)
+		}
+		current = parent
+	}
+}
+
+// keepParents moves the parents of the kept backups from discard to keep,
+// incremental and differential backups can not be restored without them
+func keepParents(keep *backup.Backups, discard *backup.Backups) (err error) {
+	// Both can share the array of all backups, they are changed independently here
+	keep.Backup = append([]backup.Backup{}, keep.Backup...)
+	discard.Backup = append([]backup.Backup{}, discard.Backup...)
+	// Moved parents are appended to keep, so their parents are kept as well
+	for i := 0; i < len(keep.Backup); i++ {
+		if keep.Backup[i].Meta == nil {
+			continue
+		}
+		name := keep.Backup[i].Name
+		meta, err := loadMeta(&keep.Backup[i])
+		if err != nil {
+			return fmt.Errorf("Can not read the metadata of %s, its parents are unknown: %v", name, err)
+		}
+		if meta.Parent == "" {
+			continue
+		}
+		for j := range discard.Backup {
+			if discard.Backup[j].Name == meta.Parent {
+				log.Info("Keep ", meta.Parent, ", ", name, " depends on it")
+				keep.Backup = append(keep.Backup, discard.Backup[j])
+				discard.Backup = append(discard.Backup[:j], discard.Backup[j+1:]...)
+				break
+			}
+		}
+	}
+	keep.Sort()
+	return nil
+}
+
+// incrementalMethod returns how incremental backups of the cluster are taken: with pg_basebackup --incremental
+// if the cluster supports it (PostgreSQL 17+ with summarize_wal), by reading the files otherwise
+func incrementalMethod(conString string) (method string, err error) {
+	db, err := sql.Open("postgres", conString)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	var version int
+	var summarizeWal sql.NullString
+	err = db.QueryRow("SELECT current_setting('server_version_num')::int, current_setting('summarize_wal', true)").Scan(&version, &summarizeWal)
+	if err != nil {
+		return "", err
+	}
+	if version >= 170000 {
+		if summarizeWal.String == "on" {
+			return backup.MethodPgBasebackup, nil
+		}
+		log.Info("summarize_wal is off, pg_basebackup can not take incremental backups, the files are read directly")
+	}
+	return backup.MethodNative, nil
+}
+
+// pgIncrementalBasebackup takes an incremental backup with pg_basebackup --incremental (PostgreSQL 17+),
+// based on the manifest of the parent. The backup is staged, its metadata is stored before the backup
+func pgIncrementalBasebackup(ctx context.Context, backupName string, backupType string, conString string, source backup.Source) (err error) {
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	parent, err := selectParent(&backups, backupType, backup.MethodPgBasebackup)
+	if err != nil {
+		return err
+	}
+	parentBackup, err := backups.Find(parent.Backup)
+	if err != nil {
+		return err
+	}
+	log.Info("Parent of the ", backupType, " backup is ", parent.Backup)
+	manifest, err := loadManifest(parentBackup)
+	if err != nil {
+		return fmt.Errorf("Can not get the manifest of the parent %s: %v", parent.Backup, err)
+	}
+	manifestFile, err := ioutil.TempFile(viper.GetString("staging_dir"), "pgglaskugel-manifest-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(manifestFile.Name())
+	_, err = manifestFile.Write(manifest)
+	if closeErr := manifestFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	meta := &backup.Meta{
+		Version:  backup.MetaVersion,
+		Backup:   backupName,
+		Type:     backupType,
+		Parent:   parent.Backup,
+		Method:   backup.MethodPgBasebackup,
+		SystemID: parent.SystemID,
+		Source:   &source,
+	}
+	backupArgs := append(pgBasebackupArgs(backupName, conString), "--incremental", manifestFile.Name())
+	_, err = stagedBasebackup(ctx, backupName, backupArgs, meta)
+	return err
+}
+
+// restoreCombined restores a chain of backups taken with pg_basebackup --incremental.
+// Every backup is extracted into a scratch directory, pg_combinebackup combines them into backupDestination
+func restoreCombined(chain []*backup.Backup, backupDestination string, opts restoreOptions) (err error) {
+	scratch, err := ioutil.TempDir(viper.GetString("staging_dir"), "pgglaskugel-combine-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(scratch); err != nil {
+			log.Warn("Can not remove scratch directory: ", err)
+		}
+	}()
+
+	var dirs, mappings []string
+	for i, b := range chain {
+		log.Infof("Extract %s (%d of %d)", b.Name, i+1, len(chain))
+		dir := filepath.Join(scratch, strconv.Itoa(i))
+		pgData := filepath.Join(dir, "data")
+		if err = os.MkdirAll(pgData, 0700); err != nil {
+			return err
+		}
+		if err = extractBackup(b, pgData, nil, restoreOptions{}); err != nil {
+			return err
+		}
+		// pg_combinebackup needs the manifest of every backup
+		if exists, _ := util.Exists(filepath.Join(pgData, backup.ManifestFile)); !exists {
+			manifest, err := loadManifest(b)
+			if err != nil {
+				return err
+			}
+			if err = ioutil.WriteFile(filepath.Join(pgData, backup.ManifestFile), manifest, 0600); err != nil {
+				return err
+			}
+		}
+		locations, _, err := tablespaceLocations(pgData)
+		if err != nil {
+			return err
+		}
+		scratchTablespaces := tablespaceMapping{baseDir: filepath.Join(dir, "tablespaces")}
+		if err = restoreTablespaces(b, pgData, restoreOptions{Tablespaces: scratchTablespaces}, nil, 0); err != nil {
+			return err
+		}
+		dirs = append(dirs, pgData)
+		if i < len(chain)-1 {
+			continue
+		}
+		// The tablespaces of the last backup are moved to their locations
+		for _, ts := range b.Tablespaces {
+			location := opts.Tablespaces.location(ts.OID, locations[ts.OID])
+			if location == "" {
+				return fmt.Errorf("Location of tablespace %s is unknown, use --tablespace-map %s=/new/path", ts.OID, ts.OID)
+			}
+			mappings = append(mappings, "--tablespace-mapping="+scratchTablespaces.location(ts.OID, "")+"="+location)
+		}
+	}
+
+	args := append([]string{"--output", backupDestination}, mappings...)
+	combineCmd := exec.Command(cmdCombinebackup, append(args, dirs...)...)
+	log.Info("Combine the chain with pg_combinebackup")
+	log.Debug("combineCmd: ", combineCmd)
+	if output, err := combineCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("pg_combinebackup failed: %v, %s", err, strings.TrimSpace(string(output)))
+	}
+	if viper.GetString("restore-owner") == "" {
+		return nil
+	}
+	// pg_combinebackup writes the files as the current user
+	return filepath.Walk(backupDestination, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return chownRestored(path)
+	})
+}
@@ -0,0 +1,122 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xxorde/pgglaskugel/backup"
+)
+
+// tarIndexer builds the index entries of a tar stream while the stream is read through it
+type tarIndexer struct {
+	io.Reader
+	pw      *io.PipeWriter
+	done    chan struct{}
+	entries []backup.IndexEntry
+	capture map[string]*bytes.Buffer
+	err     error
+}
+
+// newTarIndexer returns a reader that passes r through and indexes the tar archive on the way.
+// backup_label and backup_manifest of the backup itself (tablespace is empty) are kept, see File
+func newTarIndexer(r io.Reader, tablespace string) *tarIndexer {
+	pr, pw := io.Pipe()
+	i := &tarIndexer{Reader: io.TeeReader(r, pw), pw: pw, done: make(chan struct{})}
+	if tablespace == "" {
+		i.capture = map[string]*bytes.Buffer{"backup_label": &bytes.Buffer{}, backup.ManifestFile: &bytes.Buffer{}}
+	}
+	go func() {
+		defer close(i.done)
+		i.entries, i.err = backup.IndexTar(pr, tablespace, i.capture)
+		// The rest has to be read, otherwise the stream blocks
+		io.Copy(ioutil.Discard, pr)
+	}()
+	return i
+}
+
+// Close ends the indexing and returns the entries, the stream has to be read completely before
+func (i *tarIndexer) Close() (entries []backup.IndexEntry, err error) {
+	i.pw.Close()
+	<-i.done
+	return i.entries, i.err
+}
+
+// File returns the content of backup_label or backup_manifest found in the archive, nil if there was none.
+// It is only complete after Close
+func (i *tarIndexer) File(name string) []byte {
+	if buf := i.capture[name]; buf != nil && buf.Len() > 0 {
+		return buf.Bytes()
+	}
+	return nil
+}
+
+// storeIndex stores the index of the backup as its own object, compressed and encrypted like the backup
+func storeIndex(ctx context.Context, backupName string, entries []backup.IndexEntry) (err error) {
+	data, err := json.Marshal(backup.Index{Version: backup.IndexVersion, Backup: backupName, Files: entries})
+	if err != nil {
+		return err
+	}
+	return compressEncryptStream(ctx, bytes.NewReader(data), backup.IndexObjectName(backupName), storeBackupStream)
+}
+
+// loadIndex reads the index of the backup and verifies its checksums
+func loadIndex(b *backup.Backup) (index backup.Index, err error) {
+	if b.Index == nil {
+		return index, errors.New("Backup " + b.Name + " has no index")
+	}
+	data, err := readBackupPart(b.Index, "index of "+b.Name)
+	if err != nil {
+		return index, err
+	}
+	return backup.ParseIndex(data)
+}
+
+// readBackupPart reads a small part of a backup (like its index) completely and verifies its checksums,
+// what describes the part in messages
+func readBackupPart(part *backup.Backup, what string) (data []byte, err error) {
+	reader, err := openBackup(part)
+	if err != nil {
+		return nil, err
+	}
+	data, readErr := ioutil.ReadAll(reader)
+	closeErr := reader.Close()
+	verified, err := reader.Verify()
+	if err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	if closeErr != nil {
+		return nil, closeErr
+	}
+	if !verified {
+		log.Warn("No checksums stored for the ", what)
+	}
+	return data, nil
+}
@@ -0,0 +1,265 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// States of a job
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	// Number of finished jobs that are kept in the history
+	maxJobHistory = 100
+	// Number of jobs that can wait to be run
+	maxJobsPending = 32
+)
+
+// job is an asynchronous run of basebackup, cleanup, restore ...
+type job struct {
+	ID       string            `json:"id"`
+	Type     string            `json:"type"`
+	Args     map[string]string `json:"args,omitempty"`
+	State    string            `json:"state"`
+	Created  time.Time         `json:"created"`
+	Started  *time.Time        `json:"started,omitempty"`
+	Finished *time.Time        `json:"finished,omitempty"`
+	Error    string            `json:"error,omitempty"`
+
+	run func() error
+	log []string
+}
+
+// jobQueue runs jobs one after the other and keeps a short history.
+// It is also a logrus hook and collects the log of the running job.
+type jobQueue struct {
+	mu      sync.Mutex
+	jobs    []*job // oldest first
+	current *job
+	pending chan *job
+	closed  bool
+	done    chan struct{}
+}
+
+// newJobQueue creates a queue and starts the worker
+func newJobQueue() *jobQueue {
+	q := &jobQueue{
+		pending: make(chan *job, maxJobsPending),
+		done:    make(chan struct{}),
+	}
+	log.AddHook(q)
+	go q.worker()
+	return q
+}
+
+// submit adds a new job to the queue
+func (q *jobQueue) submit(jobType string, args map[string]string, run func() error) (j job, err error) {
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return j, err
+	}
+	newJob := &job{
+		ID:      hex.EncodeToString(id),
+		Type:    jobType,
+		Args:    args,
+		State:   jobQueued,
+		Created: time.Now(),
+		run:     run,
+	}
+
+	// The lock is released before logging, log entries end up in Fire
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return j, errors.New("Shutting down, no new jobs are accepted")
+	}
+	select {
+	case q.pending <- newJob:
+	default:
+		q.mu.Unlock()
+		return j, errors.New("Too many pending jobs")
+	}
+	q.jobs = append(q.jobs, newJob)
+	q.prune()
+	j = *newJob
+	q.mu.Unlock()
+
+	log.Info("Job ", j.ID, " (", jobType, ") queued")
+	return j, nil
+}
+
+// worker runs the pending jobs, every job takes its locks like the CLI does
+func (q *jobQueue) worker() {
+	defer close(q.done)
+	for j := range q.pending {
+		q.mu.Lock()
+		now := time.Now()
+		if q.closed {
+			j.Finished = &now
+			j.State = jobFailed
+			j.Error = "Cancelled by shutdown"
+			q.mu.Unlock()
+			continue
+		}
+		j.Started = &now
+		j.State = jobRunning
+		q.current = j
+		q.mu.Unlock()
+
+		log.Info("Job ", j.ID, " (", j.Type, ") started")
+		err := runJob(j)
+		if err != nil {
+			log.Error("Job ", j.ID, " (", j.Type, ") failed: ", err)
+		} else {
+			log.Info("Job ", j.ID, " (", j.Type, ") done")
+		}
+
+		q.mu.Lock()
+		finished := time.Now()
+		j.Finished = &finished
+		j.State = jobDone
+		if err != nil {
+			j.State = jobFailed
+			j.Error = err.Error()
+		}
+		q.current = nil
+		q.mu.Unlock()
+	}
+}
+
+// runJob runs a job and turns a panic into an error, a failing job must not stop the server
+func runJob(j *job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.run()
+}
+
+// shutdown cancels the queued jobs and waits for the running job
+func (q *jobQueue) shutdown() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.pending)
+	}
+	q.mu.Unlock()
+	<-q.done
+}
+
+// prune removes the oldest finished jobs if the history is too long
+func (q *jobQueue) prune() {
+	for len(q.jobs) > maxJobHistory {
+		i := 0
+		for i < len(q.jobs) && q.jobs[i].Finished == nil {
+			i++
+		}
+		if i == len(q.jobs) {
+			return
+		}
+		q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+	}
+}
+
+// list returns a copy of all jobs, the newest first
+func (q *jobQueue) list() (jobs []job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		jobs = append(jobs, *j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Created.After(jobs[b].Created) })
+	return jobs
+}
+
+// get returns a copy of the job with the given id
+func (q *jobQueue) get(id string) (j job, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if j.ID == id {
+			return *j, true
+		}
+	}
+	return j, false
+}
+
+// running returns a copy of the running job
+func (q *jobQueue) running() *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current == nil {
+		return nil
+	}
+	j := *q.current
+	return &j
+}
+
+// logLines returns the log lines of a job starting at line from
+func (q *jobQueue) logLines(id string, from int) (lines []string, finished bool, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if j.ID != id {
+			continue
+		}
+		if from < len(j.log) {
+			lines = append(lines, j.log[from:]...)
+		}
+		return lines, j.Finished != nil, true
+	}
+	return nil, false, false
+}
+
+// Levels implements logrus.Hook
+func (q *jobQueue) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook, log entries are added to the running job
+func (q *jobQueue) Fire(entry *log.Entry) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.current == nil {
+		return nil
+	}
+	line := fmt.Sprintf("%s %s %s", entry.Time.Format(time.RFC3339),
+		strings.ToUpper(entry.Level.String()), entry.Message)
+	for k, v := range entry.Data {
+		line += fmt.Sprintf(" %s=%v", k, v)
+	}
+	q.current.log = append(q.current.log, line)
+	return nil
+}
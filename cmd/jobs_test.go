@@ -0,0 +1,117 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitForJob polls the job until it is finished
+func waitForJob(t *testing.T, q *jobQueue, id string) job {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		j, ok := q.get(id)
+		if !ok {
+			t.Fatalf("job %s not found", id)
+		}
+		if j.Finished != nil {
+			return j
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return job{}
+}
+
+func getJSON(t *testing.T, url, token string, v interface{}) int {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestFailingJobKeepsServerUp(t *testing.T) {
+	s := &apiServer{token: "secret", jobs: newJobQueue()}
+	defer s.jobs.shutdown()
+	server := httptest.NewServer(s.routes())
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		run  func() error
+		err  string
+	}{
+		{"error", func() error { return errors.New("storage unavailable") }, "storage unavailable"},
+		{"panic", func() error { panic("broken backend") }, "panic: broken backend"},
+	}
+	for _, test := range tests {
+		submitted, err := s.jobs.submit("test", nil, test.run)
+		if err != nil {
+			t.Fatalf("%s: submit: %v", test.name, err)
+		}
+		waitForJob(t, s.jobs, submitted.ID)
+
+		var j job
+		if status := getJSON(t, server.URL+apiPrefix+"/jobs/"+submitted.ID, s.token, &j); status != http.StatusOK {
+			t.Fatalf("%s: GET job returned %d", test.name, status)
+		}
+		if j.State != jobFailed {
+			t.Errorf("%s: state is %q, want %q", test.name, j.State, jobFailed)
+		}
+		if j.Error != test.err {
+			t.Errorf("%s: error is %q, want %q", test.name, j.Error, test.err)
+		}
+	}
+
+	// The queue still runs jobs after the failures
+	ok, err := s.jobs.submit("test", nil, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := waitForJob(t, s.jobs, ok.ID); j.State != jobDone {
+		t.Errorf("state after failures is %q, want %q", j.State, jobDone)
+	}
+
+	var jobs []job
+	if status := getJSON(t, server.URL+apiPrefix+"/jobs", s.token, &jobs); status != http.StatusOK {
+		t.Fatalf("GET jobs returned %d", status)
+	}
+	if len(jobs) != 3 {
+		t.Errorf("%d jobs listed, want 3", len(jobs))
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+// Lock classes on this host, every command takes the classes it needs.
+// Commands in different classes do not block each other, e.g. a long
+// basebackup does not block cleanup, fetch or restore.
+const (
+	// lockClassBackup only one basebackup at a time
+	lockClassBackup = "backup"
+	// lockClassCleanup only one cleanup at a time
+	lockClassCleanup = "cleanup"
+	// lockClassRestore one restore per destination
+	lockClassRestore = "restore"
+	// lockClassArchive one archive per WAL file
+	lockClassArchive = "archive"
+	// lockClassFetch one fetch per target file
+	lockClassFetch = "fetch"
+	// lockClassSetup only one setup at a time
+	lockClassSetup = "setup"
+
+	// lockFileExt is the extension of the lock files
+	lockFileExt = ".pid"
+)
+
+// locksCmd represents the locks command
+var locksCmd = &cobra.Command{
+	Use:   "locks",
+	Short: "Shows the current lock holders",
+	Long: `Shows who holds which lock. Locks on this host are lock files in lock_dir,
+	holders that are not running anymore are shown as stale and are replaced by the next command.
+	Locks in the storage protect backups and WAL files across hosts.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := printLocks(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(locksCmd)
+}
+
+const (
+	// storageLockName is the lock in the storage that protects backups and WAL files
+	// Commands that need backups or WAL files hold it shared, cleanup holds it exclusive
+	storageLockName = "archive"
+	// repositoryLockName is the lock in the storage that serializes changes of the repository metadata,
+	// it is held exclusive only while the metadata is read, changed and written
+	repositoryLockName = "repository"
+	// repositoryLockWait is the shortest time to wait for the repository lock, it is only held for a moment
+	repositoryLockWait = 30 * time.Second
+)
+
+// acquireStorageLock takes the storage lock in the given mode for the command
+// The lock is in the storage itself, so it also protects against commands on other hosts
+func acquireStorageLock(mode backup.LockMode, command string) (lock *storage.HeldLock, err error) {
+	owner := fmt.Sprintf("%s on %s (pid %d)", command, hostname, os.Getpid())
+	return storage.AcquireLock(viper.GetViper(), storageLockName, mode, owner)
+}
+
+// acquireRepositoryLock takes the repository lock exclusive for the command
+func acquireRepositoryLock(command string) (lock *storage.HeldLock, err error) {
+	owner := fmt.Sprintf("%s on %s (pid %d)", command, hostname, os.Getpid())
+	wait := viper.GetDuration("lock_wait")
+	if wait < repositoryLockWait {
+		wait = repositoryLockWait
+	}
+	return storage.AcquireLockWait(viper.GetViper(), repositoryLockName, backup.LockExclusive, owner, wait)
+}
+
+// releaseStorageLock releases the storage lock, errors are only logged because the lock expires anyway
+// If the lock was lost while the command ran, err is set because the command was not protected
+func releaseStorageLock(lock *storage.HeldLock, err *error) {
+	lost := lock.Err()
+	if releaseErr := lock.Release(); releaseErr != nil {
+		log.Warn(releaseErr)
+	}
+	if lost != nil && *err == nil {
+		*err = lost
+	}
+}
+
+// storageLockContext returns a context that is cancelled with parent or when the storage lock is lost
+func storageLockContext(parent context.Context, lock *storage.HeldLock) (ctx context.Context, cancel context.CancelFunc) {
+	ctx, cancel = context.WithCancel(parent)
+	go func() {
+		select {
+		case <-lock.Context().Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// lockLocal takes the lock class on this host, resource narrows the class (e.g. to one restore destination)
+// The returned function releases the lock
+func lockLocal(class string, resource string) (unlock func(), err error) {
+	name := class
+	if resource != "" {
+		name += ":" + resource
+	}
+	lockFile := localLockPath(name)
+	log.Debug("Lock file is ", lockFile)
+	if err = util.WritePidFile(lockFile); err != nil {
+		return nil, fmt.Errorf("Can not lock %s: %v", name, err)
+	}
+	return func() {
+		if err := util.DeletePidFile(lockFile); err != nil {
+			log.Warn(err)
+		}
+	}, nil
+}
+
+// localLockDir returns the directory for the lock files, next to the pidfile by default
+func localLockDir() string {
+	if dir := viper.GetString("lock_dir"); dir != "" {
+		return dir
+	}
+	return filepath.Dir(viper.GetString("pidpath"))
+}
+
+// localLockPath returns the lock file for the named lock
+func localLockPath(name string) string {
+	return filepath.Join(localLockDir(), url.PathEscape(name)+lockFileExt)
+}
+
+// printLocks shows the holders of the locks on this host and in the storage
+func printLocks() (err error) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(w, "Locks on this host in", localLockDir())
+	fmt.Fprintln(w, "Lock\tPID\tState\tCommand")
+	files, err := ioutil.ReadDir(localLockDir())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), lockFileExt) {
+			continue
+		}
+		name, err := url.PathUnescape(strings.TrimSuffix(f.Name(), lockFileExt))
+		if err != nil {
+			name = f.Name()
+		}
+		pid, running, cmdline, err := util.PidFileHolder(filepath.Join(localLockDir(), f.Name()))
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		state := "running"
+		if !running {
+			state = "stale"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", name, pid, state, cmdline)
+	}
+	fmt.Fprintln(w)
+
+	var holders []backup.Lock
+	for _, name := range []string{storageLockName, repositoryLockName} {
+		locks, err := storage.GetLocks(viper.GetViper(), name)
+		if err != nil {
+			w.Flush()
+			return fmt.Errorf("Can not get the locks in the storage: %v", err)
+		}
+		holders = append(holders, locks...)
+	}
+	fmt.Fprintf(w, "Locks in the storage (%s)\n", viper.GetString("backup_to"))
+	fmt.Fprintln(w, "Lock\tMode\tOwner\tSince\tExpires")
+	now := time.Now()
+	for _, h := range holders {
+		expires := h.Expires.Format(time.RFC3339)
+		if h.Expired(now) {
+			expires += " (expired)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", h.Name, h.Mode, h.Owner, h.Created.Format(time.RFC3339), expires)
+	}
+	return w.Flush()
+}
@@ -21,8 +21,11 @@
 package cmd
 
 import (
+	"fmt"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
 	"github.com/xxorde/pgglaskugel/storage"
 
 	log "github.com/Sirupsen/logrus"
@@ -32,9 +35,21 @@ import (
 var lsCmd = &cobra.Command{
 	Use:   "ls",
 	Short: "Shows existing backups",
-	Long:  `Shows you all backups already made with meta information.`,
+	Long: `Shows you all backups already made with meta information.
+	In a shared repository only the backups of the cluster are shown. Use --all-clusters to show the backups
+	of every cluster section of the config file, or of every cluster in the repository if it has no sections.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		showBackups()
+		err := forEachConfiguredCluster(cmd, func() error {
+			// Without cluster sections all clusters are the ones in the repository
+			if viper.GetBool("ls-all-clusters") && !iteratesClusters(cmd) {
+				return showAllClusters()
+			}
+			showBackups()
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
 		printDone()
 	},
 }
@@ -44,6 +59,23 @@ func showBackups() {
 	log.Info(backups.String())
 }
 
+// showAllClusters shows the backups of every cluster in the repository
+func showAllClusters() error {
+	return forEachCluster(func(cluster *backup.Cluster) error {
+		backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+		if cluster == nil {
+			log.Info(backups.String())
+			return nil
+		}
+		log.Info(fmt.Sprintf("Cluster %s, prefix %s\n", cluster, cluster.Prefix()), backups.String())
+		return nil
+	})
+}
+
 func init() {
 	RootCmd.AddCommand(lsCmd)
+	addAllClustersFlag(lsCmd, "Show the backups of every cluster section of the config file (or in the repository)")
+
+	// Bind flags to viper
+	bindSetting("ls-all-clusters", lsCmd.PersistentFlags().Lookup(allClustersFlag))
 }
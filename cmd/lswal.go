@@ -31,21 +31,26 @@ import (
 var lswalCmd = &cobra.Command{
 	Use:   "lswal",
 	Short: "Show all WAL files in archive",
-	Long:  "Show a detailed list of the archived WAL files already backuped",
+	Long: `Show a detailed list of the archived WAL files already backuped.
+	Use --all-clusters to show them for every cluster section of the config file.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		showWals()
+		if err := forEachConfiguredCluster(cmd, showWals); err != nil {
+			log.Fatal(err)
+		}
 		printDone()
 	},
 }
 
-func showWals() {
+func showWals() error {
 	archive, err := storage.GetWals(viper.GetViper())
 	if err != nil {
-		log.Error(err)
+		return err
 	}
 	log.Info(archive.String())
+	return nil
 }
 
 func init() {
 	RootCmd.AddCommand(lswalCmd)
+	addAllClustersFlag(lswalCmd, "Show the WAL files of every cluster section of the config file")
 }
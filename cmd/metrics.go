@@ -0,0 +1,81 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/metrics"
+)
+
+const (
+	// Commands with this annotation keep running and expose their metrics via HTTP,
+	// all other commands write them to the metrics_textfile (if set)
+	annotationLongRunning = "long-running"
+)
+
+var (
+	// Functions that are called when the program ends with log.Fatal
+	fatalHooks []func()
+)
+
+func init() {
+	// log.Fatal ends the program without running deferred functions,
+	// so the metrics of failed runs are written from here
+	log.RegisterExitHandler(func() {
+		for _, hook := range fatalHooks {
+			hook()
+		}
+		writeMetricsTextfile()
+	})
+}
+
+// onFatal registers a function that is called if the program ends with log.Fatal
+func onFatal(hook func()) {
+	fatalHooks = append(fatalHooks, hook)
+}
+
+// startMetricsServer exposes the metrics via HTTP if metrics_listen is set
+func startMetricsServer() {
+	listen := viper.GetString("metrics_listen")
+	if listen == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	log.Info("Expose metrics on http://", listen, "/metrics")
+	go func() { log.Error(http.ListenAndServe(listen, mux)) }()
+}
+
+// writeMetricsTextfile writes the metrics for the textfile collector if metrics_textfile is set
+func writeMetricsTextfile() {
+	path := viper.GetString("metrics_textfile")
+	if path == "" {
+		return
+	}
+	if err := metrics.WriteTextfile(path); err != nil {
+		log.Warn("Can not write metrics to ", path, ": ", err)
+		return
+	}
+	log.Debug("Metrics written to ", path)
+}
@@ -0,0 +1,786 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+var (
+	// nativeExcludedContent are directories of the data directory that are backed up empty
+	nativeExcludedContent = map[string]bool{
+		"pg_wal": true, "pg_xlog": true, "pg_replslot": true, "pg_dynshmem": true, "pg_notify": true,
+		"pg_serial": true, "pg_snapshots": true, "pg_stat_tmp": true, "pg_subtrans": true,
+	}
+	// nativeExcludedFiles are files of the data directory that are not backed up,
+	// backup_label and tablespace_map of the backup are added at the end
+	nativeExcludedFiles = map[string]bool{
+		"postmaster.pid": true, "postmaster.opts": true, "backup_label": true, "backup_label.old": true,
+		"tablespace_map": true, "backup_manifest": true, "postgresql.auto.conf.tmp": true, "current_logfiles.tmp": true,
+	}
+	// nativeForkFile splits the name of a relation file into relfilenode, fork and segment
+	nativeForkFile = regexp.MustCompile(`^([0-9]+)(_[a-z]+)?(\.[0-9]+)?$`)
+	// nativeTempRelation matches files of temporary relations
+	nativeTempRelation = regexp.MustCompile(`^t[0-9]+_[0-9]+`)
+)
+
+// nativeTablespace is a tablespace of the cluster
+type nativeTablespace struct {
+	OID      string
+	Location string
+}
+
+// nativeDriver is the database/sql driver of the native sessions
+var nativeDriver = "postgres"
+
+// nativeSession is the session that keeps the cluster in backup mode.
+// A non-exclusive backup ends with the session, so start and stop run on the one dedicated connection conn.
+// It is never replaced, if it breaks stop fails and so does the backup
+type nativeSession struct {
+	db          *sql.DB
+	conn        *sql.Conn
+	ctx         context.Context
+	version     int
+	dataDir     string
+	blockSize   int
+	order       binary.ByteOrder
+	systemID    string
+	tablespaces []nativeTablespace
+}
+
+// openNativeSession connects to the cluster and reads what is needed to read its files
+func openNativeSession(ctx context.Context, conString string) (s *nativeSession, err error) {
+	db, err := sql.Open(nativeDriver, conString)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s = &nativeSession{db: db, conn: conn, ctx: ctx}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	err = conn.QueryRowContext(ctx, "SELECT current_setting('server_version_num')::int, current_setting('data_directory'), current_setting('block_size')::int").
+		Scan(&s.version, &s.dataDir, &s.blockSize)
+	if err != nil {
+		return nil, err
+	}
+	if s.version < 90600 {
+		return nil, fmt.Errorf("Reading the files needs PostgreSQL 9.6 or newer, the server is %d", s.version)
+	}
+	// The layout of the data directory and the exclusions are only known for the supported versions
+	if !isPgVersionSupported(s.version) {
+		return nil, fmt.Errorf("Reading the files of PostgreSQL %d is not supported, up to %d is", s.version, pgMaxVersion)
+	}
+	if err = conn.QueryRowContext(ctx, "SELECT system_identifier::text FROM pg_control_system()").Scan(&s.systemID); err != nil {
+		return nil, err
+	}
+	// The files are read directly, so the data directory has to be on this host
+	if _, s.order, err = readPgControl(s.dataDir); err != nil {
+		return nil, fmt.Errorf("Can not read the data directory %s, the backup has to run on the database host as a user that can read it: %v", s.dataDir, err)
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT oid::text, pg_tablespace_location(oid) FROM pg_tablespace WHERE spcname NOT IN ('pg_default', 'pg_global') ORDER BY oid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts nativeTablespace
+		if err = rows.Scan(&ts.OID, &ts.Location); err != nil {
+			return nil, err
+		}
+		s.tablespaces = append(s.tablespaces, ts)
+	}
+	return s, rows.Err()
+}
+
+// Close ends the session, a backup that is still running is aborted
+func (s *nativeSession) Close() {
+	if err := s.conn.Close(); err != nil {
+		log.Warn(err)
+	}
+	if err := s.db.Close(); err != nil {
+		log.Warn(err)
+	}
+}
+
+// backupStartQuery returns the query that starts a non-exclusive backup with a fast checkpoint on the server version.
+// PostgreSQL 15 renamed pg_start_backup to pg_backup_start and removed the exclusive mode
+func backupStartQuery(version int) string {
+	if version >= 150000 {
+		return "SELECT pg_backup_start($1, true)::text"
+	}
+	return "SELECT pg_start_backup($1, true, false)::text"
+}
+
+// backupStopQuery returns the query that stops a non-exclusive backup and waits for the WAL to be archived.
+// PostgreSQL 15 renamed pg_stop_backup to pg_backup_stop, 10 added wait_for_archive
+func backupStopQuery(version int) string {
+	switch {
+	case version >= 150000:
+		return "SELECT labelfile, spcmapfile FROM pg_backup_stop(true)"
+	case version >= 100000:
+		return "SELECT labelfile, spcmapfile FROM pg_stop_backup(false, true)"
+	}
+	return "SELECT labelfile, spcmapfile FROM pg_stop_backup(false)"
+}
+
+// start puts the cluster into (non-exclusive) backup mode with a fast checkpoint
+func (s *nativeSession) start(label string) (lsn string, timeline string, err error) {
+	if err = s.conn.QueryRowContext(s.ctx, backupStartQuery(s.version), label).Scan(&lsn); err != nil {
+		return "", "", fmt.Errorf("Can not start the backup: %v", err)
+	}
+	if err = s.conn.QueryRowContext(s.ctx, "SELECT timeline_id::text FROM pg_control_checkpoint()").Scan(&timeline); err != nil {
+		return "", "", err
+	}
+	return lsn, timeline, nil
+}
+
+// stop ends the backup mode and returns the backup_label and tablespace_map for the backup.
+// It waits until the WAL needed by the backup is archived. It runs on the connection that started the backup,
+// if that connection was lost the backup was aborted by the server and stop fails
+func (s *nativeSession) stop() (label []byte, spcmap []byte, err error) {
+	var labelFile, spcmapFile sql.NullString
+	if err = s.conn.QueryRowContext(s.ctx, backupStopQuery(s.version)).Scan(&labelFile, &spcmapFile); err != nil {
+		return nil, nil, fmt.Errorf("Can not stop the backup, the session that started it may be lost: %v", err)
+	}
+	return []byte(labelFile.String), []byte(spcmapFile.String), nil
+}
+
+// tablespaceDir returns the directory name of this version in the tablespaces, e.g. PG_16_
+func (s *nativeSession) tablespaceDir() string {
+	if s.version < 100000 {
+		return fmt.Sprintf("PG_%d.%d_", s.version/10000, s.version/100%100)
+	}
+	return fmt.Sprintf("PG_%d_", s.version/10000)
+}
+
+// nativeArchive writes the files of the cluster as tar archives.
+// With since set, relation files only contain the pages changed since this LSN
+type nativeArchive struct {
+	session *nativeSession
+	since   uint64
+	// parentFiles are the sizes of the files restored from the parent by tablespace and name.
+	// Only files in it can be stored incremental, the restore applies the pages to them
+	parentFiles map[string]int64
+	// chunkSize is the size of the files packed into one chunk, 0 stores every file as its own chunk
+	chunkSize int64
+	// initForks caches the unlogged relations (with init fork) per directory
+	initForks map[string]map[string]bool
+
+	// The statistics are updated by all workers
+	incrementalFiles int64
+	storedPages      int64
+	totalPages       int64
+}
+
+// nativeFile is an entry of the cluster that is written into the backup
+type nativeFile struct {
+	path     string
+	name     string
+	info     os.FileInfo
+	relation bool
+	// emptyDir is set for directories that are backed up without their content
+	emptyDir bool
+}
+
+// nativeObject is a tar archive of the backup: the backup itself, a tablespace or a chunk of them
+type nativeObject struct {
+	name string
+	// oid is the tablespace of the object, empty for the backup itself and its chunks
+	oid   string
+	files []nativeFile
+}
+
+// nativeBasebackup takes a backup by reading the files of the cluster.
+// Incremental and differential backups only store the pages of relations changed since the start of their parent
+func nativeBasebackup(ctx context.Context, backupName string, backupType string, source backup.Source) (err error) {
+	var parent backup.Meta
+	var since uint64
+	var parentFiles map[string]int64
+	if backupType != backup.BackupTypeFull {
+		backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+		if parent, err = selectParent(&backups, backupType, backup.MethodNative); err != nil {
+			return err
+		}
+		if since, err = backup.ParseLSN(parent.StartLSN); err != nil {
+			return err
+		}
+		if parentFiles, err = loadParentFiles(&backups, parent.Backup); err != nil {
+			return err
+		}
+		log.Info("Parent of the ", backupType, " backup is ", parent.Backup, ", pages changed since ", parent.StartLSN, " are stored")
+	}
+
+	session, err := openNativeSession(ctx, viper.GetString("connection"))
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	if parent.SystemID != "" && parent.SystemID != session.systemID {
+		return fmt.Errorf("Parent %s is from another cluster (system identifier %s, not %s)", parent.Backup, parent.SystemID, session.systemID)
+	}
+
+	startLSN, timeline, err := session.start(backupName)
+	if err != nil {
+		return err
+	}
+	log.Info("Backup was started at ", startLSN, " on timeline ", timeline)
+	if start, err := backup.ParseLSN(startLSN); err != nil || start < since {
+		return fmt.Errorf("Start %s of the backup is before the start of its parent %s", startLSN, parent.StartLSN)
+	}
+
+	// The metadata is stored first, the backup itself is only visible when it is complete
+	meta := backup.Meta{
+		Version:   backup.MetaVersion,
+		Backup:    backupName,
+		Type:      backupType,
+		Parent:    parent.Backup,
+		Method:    backup.MethodNative,
+		StartLSN:  startLSN,
+		Timeline:  timeline,
+		BlockSize: session.blockSize,
+		SystemID:  session.systemID,
+		Source:    &source,
+	}
+	var stored []string
+	defer func() {
+		if err != nil && len(stored) > 0 {
+			log.Warn("Backup failed, the following objects are left in the storage: ", strings.Join(stored, ", "))
+		}
+	}()
+	if err = storeMeta(ctx, meta); err != nil {
+		return err
+	}
+	stored = append(stored, backup.MetaObjectName(backupName))
+
+	archive := &nativeArchive{
+		session:     session,
+		since:       since,
+		parentFiles: parentFiles,
+		chunkSize:   int64(viper.GetInt("native_chunk_size_mb")) * 1024 * 1024,
+		initForks:   make(map[string]map[string]bool),
+	}
+
+	// The files are read in parallel as chunks, the objects with the directories are stored at the end.
+	// pg_control, backup_label and tablespace_map are added to the backup itself, it is only visible when it is complete
+	var objects []nativeObject
+	var chunks []nativeObject
+	for _, ts := range session.tablespaces {
+		files, err := archive.scanTablespace(ts.Location)
+		if err != nil {
+			return err
+		}
+		object, objectChunks := archive.pack(backup.TablespaceObjectName(backupName, ts.OID), ts.OID, files)
+		objects = append(objects, object)
+		chunks = append(chunks, objectChunks...)
+	}
+	files, err := archive.scan(session.dataDir, "", true)
+	if err != nil {
+		return err
+	}
+	base, baseChunks := archive.pack(backupName, "", files)
+	chunks = append(chunks, baseChunks...)
+	log.Infof("Store %d file(s) in %d chunk(s) with %d job(s)", len(files), len(chunks), nativeJobs())
+
+	// An incomplete index is not stored, files missing in it would be removed by a delta restore
+	index, complete, chunksStored, err := archive.storeParallel(ctx, chunks)
+	stored = append(stored, chunksStored...)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		log.Info("Store tablespace ", object.oid, " as ", object.name)
+		object := object
+		entries, indexed, err := archive.store(ctx, object.name, object.oid, func(tw *tar.Writer) error {
+			return archive.write(tw, object)
+		})
+		if err != nil {
+			return err
+		}
+		stored = append(stored, object.name)
+		index = append(index, entries...)
+		complete = complete && indexed
+	}
+	entries, indexed, err := archive.store(ctx, backupName, "", func(tw *tar.Writer) error {
+		if err := archive.write(tw, base); err != nil {
+			return err
+		}
+		return archive.finish(tw)
+	})
+	if err != nil {
+		return err
+	}
+	if complete && indexed {
+		storeIndexOf(ctx, backupName, append(entries, index...))
+	}
+	if since > 0 {
+		log.Infof("Stored %d of %d pages (%s) of %d relation files",
+			archive.storedPages, archive.totalPages, humanize.Bytes(uint64(archive.storedPages)*uint64(session.blockSize)), archive.incrementalFiles)
+	}
+	return nil
+}
+
+// loadParentFiles returns the sizes of the files the restore of the parent leaves, by parentFileKey.
+// The files of the parent are the ones in its index, the restore of a chain removes all others
+func loadParentFiles(backups *backup.Backups, name string) (files map[string]int64, err error) {
+	b, err := backups.Find(name)
+	if err != nil {
+		return nil, err
+	}
+	index, err := loadIndex(b)
+	if err != nil {
+		return nil, fmt.Errorf("The index of the parent %s is needed for an incremental backup, %v", name, err)
+	}
+	return parentFilesOf(index), nil
+}
+
+// parentFilesOf returns the sizes of the files in the index by parentFileKey
+func parentFilesOf(index backup.Index) (files map[string]int64) {
+	files = make(map[string]int64)
+	for _, e := range index.Files {
+		if e.Type != backup.IndexFile {
+			continue
+		}
+		if strings.HasSuffix(e.Name, backup.IncrementalSuffix) {
+			// Indexes of older versions do not have the size, these files are stored completely
+			if e.RelationSize == 0 {
+				continue
+			}
+			files[parentFileKey(e.Tablespace, strings.TrimSuffix(e.Name, backup.IncrementalSuffix))] = e.RelationSize
+			continue
+		}
+		files[parentFileKey(e.Tablespace, e.Name)] = e.Size
+	}
+	return files
+}
+
+// parentFileKey returns the key of a file in the parent files, oid is the tablespace (empty for the data directory)
+func parentFileKey(oid string, name string) string {
+	return oid + ":" + name
+}
+
+// nativeJobs returns the number of chunks that are stored in parallel
+func nativeJobs() int {
+	if jobs := viper.GetInt("jobs"); jobs > 0 {
+		return jobs
+	}
+	return 1
+}
+
+// pack splits the files of the object name into the object itself, with the directories and symlinks, and chunks with the files
+func (a *nativeArchive) pack(name string, oid string, files []nativeFile) (object nativeObject, chunks []nativeObject) {
+	object = nativeObject{name: name, oid: oid}
+	var size int64
+	for _, f := range files {
+		if f.emptyDir || !f.info.Mode().IsRegular() {
+			object.files = append(object.files, f)
+			continue
+		}
+		if len(chunks) == 0 || size >= a.chunkSize {
+			chunks = append(chunks, nativeObject{name: backup.ChunkObjectName(name, len(chunks)+1), oid: oid})
+			size = 0
+		}
+		last := &chunks[len(chunks)-1]
+		last.files = append(last.files, f)
+		size += f.info.Size()
+	}
+	return object, chunks
+}
+
+// storeParallel stores the chunks with one worker per job. The index entries of all chunks and the stored objects are returned,
+// complete is false if a chunk could not be indexed. The first error stops all workers
+func (a *nativeArchive) storeParallel(ctx context.Context, chunks []nativeObject) (index []backup.IndexEntry, complete bool, stored []string, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan nativeObject)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	complete = true
+	for i := 0; i < nativeJobs(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range queue {
+				log.Debug("Store chunk ", chunk.name, " with ", len(chunk.files), " file(s)")
+				chunk := chunk
+				entries, indexed, chunkErr := a.store(ctx, chunk.name, chunk.oid, func(tw *tar.Writer) error {
+					return a.write(tw, chunk)
+				})
+				mutex.Lock()
+				if chunkErr != nil {
+					if err == nil {
+						err = chunkErr
+						cancel()
+					}
+				} else {
+					stored = append(stored, chunk.name)
+					index = append(index, entries...)
+					complete = complete && indexed
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, chunk := range chunks {
+		select {
+		case queue <- chunk:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return index, complete, stored, err
+}
+
+// store writes the tar archive from fill into the storage as name, oid is the tablespace of the archive (empty for the backup itself)
+func (a *nativeArchive) store(ctx context.Context, name string, oid string, fill func(tw *tar.Writer) error) (entries []backup.IndexEntry, indexed bool, err error) {
+	pr, pw := io.Pipe()
+	var fillErr error
+	filled := make(chan struct{})
+	go func() {
+		defer close(filled)
+		tw := tar.NewWriter(pw)
+		if fillErr = fill(tw); fillErr == nil {
+			fillErr = tw.Close()
+		}
+		// The storage backend reads the error and discards the object
+		pw.CloseWithError(fillErr)
+	}()
+
+	indexer := newTarIndexer(pr, oid)
+	err = storeBackupData(ctx, indexer, name)
+	// Stop the writer if the storage stopped reading
+	pr.CloseWithError(errors.New("Storage of " + name + " stopped"))
+	<-filled
+	entries, indexErr := indexer.Close()
+	if fillErr != nil && err != nil {
+		return nil, false, fillErr
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if indexErr != nil {
+		log.Warn("Backup is stored without index, can not index ", name, ": ", indexErr)
+		return nil, false, nil
+	}
+	return entries, true, nil
+}
+
+// finish adds pg_control to the backup, like pg_basebackup as last file of the data directory.
+// The backup mode is ended afterwards and backup_label and tablespace_map are added
+func (a *nativeArchive) finish(tw *tar.Writer) (err error) {
+	control := filepath.Join("global", "pg_control")
+	file := filepath.Join(a.session.dataDir, control)
+	info, err := os.Lstat(file)
+	if err != nil {
+		return err
+	}
+	if err = a.addFile(tw, "", nativeFile{path: file, name: filepath.ToSlash(control), info: info}); err != nil {
+		return err
+	}
+
+	label, spcmap, err := a.session.stop()
+	if err != nil {
+		return err
+	}
+	log.Info("Backup was stopped")
+	if err = addContent(tw, "backup_label", label); err != nil {
+		return err
+	}
+	if len(spcmap) > 0 {
+		return addContent(tw, backup.TablespaceMapFile, spcmap)
+	}
+	return nil
+}
+
+// write writes the files of the object into the archive
+func (a *nativeArchive) write(tw *tar.Writer, object nativeObject) (err error) {
+	for _, f := range object.files {
+		if f.emptyDir {
+			// The directory is needed, its content is not
+			err = tw.WriteHeader(&tar.Header{Name: f.name + "/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: f.info.ModTime()})
+		} else {
+			err = a.addFile(tw, object.oid, f)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanTablespace returns the directory of this version in the tablespace at location, like pg_basebackup
+func (a *nativeArchive) scanTablespace(location string) (files []nativeFile, err error) {
+	entries, err := ioutil.ReadDir(location)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range entries {
+		if f.IsDir() && strings.HasPrefix(f.Name(), a.session.tablespaceDir()) {
+			tree, err := a.scan(filepath.Join(location, f.Name()), f.Name(), false)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, tree...)
+		}
+	}
+	return files, nil
+}
+
+// scan returns the entries of the directory root with prefix as name, base is set for the data directory itself
+func (a *nativeArchive) scan(root string, prefix string, base bool) (files []nativeFile, err error) {
+	err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		// Files of dropped relations disappear while they are read
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			if prefix == "" {
+				return nil
+			}
+			rel = ""
+		}
+		name := path.Join(prefix, rel)
+
+		excludeContent, exclude := a.excluded(file, rel, info, base)
+		if exclude {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if excludeContent {
+			files = append(files, nativeFile{path: file, name: name, info: info, emptyDir: true})
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Only the main fork of relations (in base, global and tablespaces) has reliable page LSNs
+		relation := !base || strings.HasPrefix(rel, "base/") || strings.HasPrefix(rel, "global/")
+		files = append(files, nativeFile{path: file, name: name, info: info, relation: relation})
+		return nil
+	})
+	return files, err
+}
+
+// excluded returns if the file is not backed up (exclude) or is backed up as empty directory (excludeContent),
+// following the rules of PostgreSQL for backups of the data directory
+func (a *nativeArchive) excluded(file string, rel string, info os.FileInfo, base bool) (excludeContent bool, exclude bool) {
+	baseName := path.Base(rel)
+	if base && !strings.Contains(rel, "/") {
+		if nativeExcludedContent[rel] {
+			return true, false
+		}
+		if nativeExcludedFiles[rel] {
+			return false, true
+		}
+	}
+	if base && rel == "global/pg_control" {
+		// It is added last
+		return false, true
+	}
+	if baseName == "pg_internal.init" || strings.HasPrefix(baseName, "pgsql_tmp") {
+		return false, true
+	}
+	if !info.Mode().IsRegular() {
+		return false, false
+	}
+	if nativeTempRelation.MatchString(baseName) {
+		return false, true
+	}
+	// Unlogged relations are restored from their init fork
+	match := nativeForkFile.FindStringSubmatch(baseName)
+	if match == nil || match[2] == "_init" {
+		return false, false
+	}
+	return false, a.unlogged(filepath.Dir(file), match[1])
+}
+
+// unlogged returns true if the relation in dir has an init fork
+func (a *nativeArchive) unlogged(dir string, relfilenode string) bool {
+	forks, ok := a.initForks[dir]
+	if !ok {
+		forks = make(map[string]bool)
+		if files, err := ioutil.ReadDir(dir); err == nil {
+			for _, f := range files {
+				if match := nativeForkFile.FindStringSubmatch(f.Name()); match != nil && match[2] == "_init" {
+					forks[match[1]] = true
+				}
+			}
+		}
+		a.initForks[dir] = forks
+	}
+	return forks[relfilenode]
+}
+
+// addFile writes the file of the tablespace oid into the archive, relation files are written incremental if the archive has a start LSN
+func (a *nativeArchive) addFile(tw *tar.Writer, oid string, nf nativeFile) (err error) {
+	file, name, info := nf.path, nf.name, nf.info
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(file); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if !info.Mode().IsRegular() {
+		return tw.WriteHeader(header)
+	}
+
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	blockSize := a.session.blockSize
+	parentSize, inParent := a.parentFiles[parentFileKey(oid, name)]
+	// A file that is new or shrank since the parent is not the file of the parent, e.g. it was created by
+	// copying the pages of another relation (CREATE DATABASE). Its pages can be older than the parent
+	if a.since > 0 && nf.relation && backup.IsRelationFile(path.Base(name)) && info.Size()%int64(blockSize) == 0 &&
+		inParent && info.Size() >= parentSize {
+		blocks, size, err := backup.ChangedBlocks(f, blockSize, a.since, a.session.order)
+		if err != nil {
+			return fmt.Errorf("Can not read %s: %v", file, err)
+		}
+		if !regrown(blocks, size, parentSize, blockSize) {
+			return a.addIncremental(tw, header, f, blocks, size)
+		}
+		// The file was replaced or shrank and grew again, it is stored completely
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+	// The file may change while it is read, exactly the size from the header is written.
+	// Missing data is filled with zeros, the WAL replay repairs the file like every other change during the backup
+	written, err := io.CopyN(tw, f, header.Size)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Can not read %s: %v", file, err)
+	}
+	_, err = io.CopyN(tw, zeroReader{}, header.Size-written)
+	return err
+}
+
+// regrown returns true if a page after the end of the file in the parent is older than the parent.
+// Pages appended since the parent are newer, the file must have been replaced or shrank and grew again
+func regrown(blocks []uint32, size int64, parentSize int64, blockSize int) bool {
+	first := uint32(parentSize / int64(blockSize))
+	appended := 0
+	for _, block := range blocks {
+		if block >= first {
+			appended++
+		}
+	}
+	return int64(appended) < size/int64(blockSize)-int64(first)
+}
+
+// addIncremental writes the changed blocks of the relation file f into the archive
+func (a *nativeArchive) addIncremental(tw *tar.Writer, header *tar.Header, f *os.File, blocks []uint32, size int64) (err error) {
+	blockSize := a.session.blockSize
+	atomic.AddInt64(&a.incrementalFiles, 1)
+	atomic.AddInt64(&a.storedPages, int64(len(blocks)))
+	atomic.AddInt64(&a.totalPages, size/int64(blockSize))
+	header.Name += backup.IncrementalSuffix
+	header.Size = backup.IncrementalSize(len(blocks), blockSize)
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+	return backup.WriteIncremental(tw, f, size, blockSize, blocks)
+}
+
+// addContent writes a file with the given content into the archive
+func addContent(tw *tar.Writer, name string, content []byte) (err error) {
+	header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600, Size: int64(len(content)), ModTime: time.Now()}
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, bytes.NewReader(content))
+	return err
+}
+
+// zeroReader reads zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (n int, err error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,354 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+const testBlockSize = 8192
+
+// testPage returns a page with the given LSN filled with fill
+func testPage(lsn uint64, fill byte) []byte {
+	page := bytes.Repeat([]byte{fill}, testBlockSize)
+	binary.LittleEndian.PutUint32(page[0:4], uint32(lsn>>32))
+	binary.LittleEndian.PutUint32(page[4:8], uint32(lsn))
+	return page
+}
+
+func writeRelation(t *testing.T, dir string, name string, pages ...[]byte) {
+	file := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, bytes.Join(pages, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// archiveRelations writes the relation files of dir as a tar archive like a native backup
+func archiveRelations(t *testing.T, dir string, names []string, since uint64, parentFiles map[string]int64) []byte {
+	a := &nativeArchive{
+		session:     &nativeSession{blockSize: testBlockSize, order: binary.LittleEndian},
+		since:       since,
+		parentFiles: parentFiles,
+	}
+	var object nativeObject
+	for _, name := range names {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		info, err := os.Lstat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		object.files = append(object.files, nativeFile{path: file, name: name, info: info, relation: true})
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := a.write(tw, object); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func extractArchive(t *testing.T, dir string, data []byte, incremental bool) {
+	extractor := util.NewExtractor(dir)
+	extractor.UID, extractor.GID = os.Getuid(), os.Getgid()
+	if incremental {
+		extractor.PatchSuffix = backup.IncrementalSuffix
+		extractor.Patch = func(file *os.File, r io.Reader) error {
+			return backup.ApplyIncremental(file, r)
+		}
+	}
+	if err := extractor.Extract(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNativeIncrementalRestore restores a parent and an incremental backup on top. Files that are new
+// or were replaced since the parent can have pages older than the parent, they must be stored completely
+func TestNativeIncrementalRestore(t *testing.T) {
+	src, err := ioutil.TempDir("", "pgglaskugel-native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "pgglaskugel-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+
+	const old, parentStart, changed = 0x10, 0x20, 0x30
+	writeRelation(t, src, "base/1/100", testPage(old, 'a'), testPage(old, 'b'))
+	writeRelation(t, src, "base/1/300", testPage(old, 'p'))
+	parent := archiveRelations(t, src, []string{"base/1/100", "base/1/300"}, 0, nil)
+	entries, err := backup.IndexTar(bytes.NewReader(parent), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentFiles := parentFilesOf(backup.Index{Files: entries})
+
+	// 100 is changed in place, 200 is new with old pages (e.g. CREATE DATABASE copied it),
+	// 300 was replaced by a copy that is larger, its first page is different but old as well
+	writeRelation(t, src, "base/1/100", testPage(old, 'a'), testPage(changed, 'c'))
+	writeRelation(t, src, "base/1/200", testPage(old, 'x'), testPage(old, 'y'))
+	writeRelation(t, src, "base/1/300", testPage(old, 'q'), testPage(old, 'r'))
+	names := []string{"base/1/100", "base/1/200", "base/1/300"}
+	incremental := archiveRelations(t, src, names, parentStart, parentFiles)
+
+	entries, err = backup.IndexTar(bytes.NewReader(incremental), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := make(map[string]backup.IndexEntry)
+	for _, e := range entries {
+		stored[e.Name] = e
+	}
+	if e, ok := stored["base/1/100"+backup.IncrementalSuffix]; !ok {
+		t.Error("the changed file is not stored incremental")
+	} else if e.RelationSize != 2*testBlockSize {
+		t.Errorf("relation size in the index is %d, want %d", e.RelationSize, 2*testBlockSize)
+	}
+	for _, name := range []string{"base/1/200", "base/1/300"} {
+		if _, ok := stored[name]; !ok {
+			t.Errorf("%s is not stored completely", name)
+		}
+	}
+
+	extractArchive(t, dest, parent, false)
+	extractArchive(t, dest, incremental, true)
+	for _, name := range names {
+		want, err := ioutil.ReadFile(filepath.Join(src, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("restored %s differs from the source", name)
+		}
+		if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name)+backup.IncrementalSuffix)); !os.IsNotExist(err) {
+			t.Errorf("incremental file of %s was extracted", name)
+		}
+	}
+}
+
+func TestParentFilesOf(t *testing.T) {
+	index := backup.Index{Files: []backup.IndexEntry{
+		{Name: "base/1/100", Type: backup.IndexFile, Size: 16384},
+		{Name: "base/1/200" + backup.IncrementalSuffix, Type: backup.IndexFile, Size: 8220, RelationSize: 24576},
+		// Written by an older version without the relation size
+		{Name: "base/1/300" + backup.IncrementalSuffix, Type: backup.IndexFile, Size: 8220},
+		{Name: "PG_16_1/5/400", Tablespace: "16384", Type: backup.IndexFile, Size: 8192},
+		{Name: "base/1", Type: backup.IndexDir},
+	}}
+	files := parentFilesOf(index)
+	want := map[string]int64{
+		parentFileKey("", "base/1/100"):         16384,
+		parentFileKey("", "base/1/200"):         24576,
+		parentFileKey("16384", "PG_16_1/5/400"): 8192,
+	}
+	if len(files) != len(want) {
+		t.Errorf("got %v, want %v", files, want)
+	}
+	for key, size := range want {
+		if files[key] != size {
+			t.Errorf("%s: size %d, want %d", strings.TrimPrefix(key, ":"), files[key], size)
+		}
+	}
+}
+
+func TestBackupQueries(t *testing.T) {
+	tests := []struct {
+		version int
+		start   string
+		stop    string
+	}{
+		{90624, "pg_start_backup($1, true, false)", "pg_stop_backup(false)"},
+		{100023, "pg_start_backup($1, true, false)", "pg_stop_backup(false, true)"},
+		{140013, "pg_start_backup($1, true, false)", "pg_stop_backup(false, true)"},
+		{150008, "pg_backup_start($1, true)", "pg_backup_stop(true)"},
+		{170002, "pg_backup_start($1, true)", "pg_backup_stop(true)"},
+	}
+	for _, test := range tests {
+		if start := backupStartQuery(test.version); !strings.Contains(start, test.start) {
+			t.Errorf("%d: start query %q, want %s", test.version, start, test.start)
+		}
+		if stop := backupStopQuery(test.version); !strings.Contains(stop, test.stop) {
+			t.Errorf("%d: stop query %q, want %s", test.version, stop, test.stop)
+		}
+	}
+}
+
+// fakeSessionDriver is a database/sql driver that answers the queries of a native session.
+// The connection that started the backup breaks afterwards if breakAfterStart is set
+type fakeSessionDriver struct {
+	dataDir         string
+	breakAfterStart bool
+	opened          int
+}
+
+type fakeSessionConn struct {
+	driver  *fakeSessionDriver
+	started bool
+	broken  bool
+}
+
+type fakeSessionStmt struct {
+	conn  *fakeSessionConn
+	query string
+}
+
+type fakeSessionRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (d *fakeSessionDriver) Open(name string) (driver.Conn, error) {
+	d.opened++
+	return &fakeSessionConn{driver: d}, nil
+}
+
+func (c *fakeSessionConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSessionStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeSessionConn) Close() error { return nil }
+
+func (c *fakeSessionConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+
+func (s *fakeSessionStmt) Close() error  { return nil }
+func (s *fakeSessionStmt) NumInput() int { return -1 }
+
+func (s *fakeSessionStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("no statements")
+}
+
+func (s *fakeSessionStmt) Query(args []driver.Value) (driver.Rows, error) {
+	c := s.conn
+	if c.broken {
+		return nil, driver.ErrBadConn
+	}
+	row := func(values ...driver.Value) *fakeSessionRows {
+		return &fakeSessionRows{columns: make([]string, len(values)), values: [][]driver.Value{values}}
+	}
+	switch {
+	case strings.Contains(s.query, "server_version_num"):
+		return row(int64(160000), c.driver.dataDir, int64(testBlockSize)), nil
+	case strings.Contains(s.query, "pg_control_system"):
+		return row("7000000000000000001"), nil
+	case strings.Contains(s.query, "pg_tablespace"):
+		return &fakeSessionRows{columns: []string{"oid", "location"}}, nil
+	case strings.Contains(s.query, "pg_backup_start"):
+		c.started = true
+		return row("0/2000028"), nil
+	case strings.Contains(s.query, "pg_control_checkpoint"):
+		c.broken = c.driver.breakAfterStart
+		return row("1"), nil
+	case strings.Contains(s.query, "pg_backup_stop"):
+		if !c.started {
+			return nil, errors.New("backup is not in progress")
+		}
+		return row("START WAL LOCATION: 0/2000028", ""), nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", s.query)
+}
+
+func (r *fakeSessionRows) Columns() []string { return r.columns }
+func (r *fakeSessionRows) Close() error      { return nil }
+
+func (r *fakeSessionRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+var fakeSession = &fakeSessionDriver{}
+
+func init() {
+	sql.Register("pgglaskugel-fake-session", fakeSession)
+}
+
+// TestNativeSessionConnection checks that the backup is stopped on the connection that started it
+// and fails if that connection is lost, instead of running on a new connection
+func TestNativeSessionConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "native-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	control := make([]byte, 12)
+	binary.LittleEndian.PutUint32(control[8:], 1300)
+	writeRelation(t, dir, "global/pg_control", control)
+
+	saved := nativeDriver
+	defer func() { nativeDriver = saved }()
+	nativeDriver = "pgglaskugel-fake-session"
+	fakeSession.dataDir = dir
+
+	for _, broken := range []bool{false, true} {
+		fakeSession.breakAfterStart = broken
+		fakeSession.opened = 0
+		session, err := openNativeSession(context.Background(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = session.start("test"); err != nil {
+			t.Fatal(err)
+		}
+		label, _, err := session.stop()
+		session.Close()
+		if broken {
+			if err == nil {
+				t.Error("the backup was stopped although the connection that started it was lost")
+			}
+		} else if err != nil || !strings.HasPrefix(string(label), "START WAL LOCATION") {
+			t.Errorf("stop returned %q, %v", label, err)
+		}
+		if fakeSession.opened != 1 {
+			t.Errorf("broken %t: %d connections were opened, the session must keep one", broken, fakeSession.opened)
+		}
+	}
+}
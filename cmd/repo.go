@@ -0,0 +1,404 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+const (
+	// Commands with this annotation do not use the repository, it is not checked for them
+	annotationNoRepository = "no-repository"
+	// Commands with this annotation write backups or delete objects, they need a repository with metadata
+	annotationWritesRepository = "writes-repository"
+)
+
+// repoCmd groups the commands for the backup repository
+var repoCmd = &cobra.Command{
+	Use:   "repo",
+	Short: "Manages the backup repository",
+	Long:  `Commands to inspect and maintain the repository the backups are stored in.`,
+}
+
+// repoInitCmd writes the metadata of a new repository
+var repoInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Initializes a new repository",
+	Long: `Writes the metadata of the repository (` + backup.RepositoryObject + `) to the backup storage: the format version,
+	the system identifier of the cluster, the codec, the encryption mode and the creation time.
+	Every command checks the metadata and refuses to use a repository it is not compatible with.
+	Repositories with backups of older versions are initialized with 'repo upgrade'.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runRepoInit(); err != nil {
+			log.Fatal(err)
+		}
+		printDone()
+	},
+	Annotations: map[string]string{annotationNoRepository: ""},
+}
+
+// repoUpgradeCmd migrates the repository to the current format
+var repoUpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Migrates the repository to the current format",
+	Long: `Migrates a repository written by an older version of pgGlaskugel in place, one format version at a time.
+	Use --dry-run to only show what would be done.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runRepoUpgrade(viper.GetBool("repo-upgrade-dry-run")); err != nil {
+			log.Fatal(err)
+		}
+		printDone()
+	},
+	Annotations: map[string]string{annotationNoRepository: ""},
+}
+
+// repoStatsCmd shows how much space the deduplication saves
+var repoStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Shows the size of the repository and the deduplication ratio",
+	Long: `Shows the logical size of the deduplicated backups, the size of their unique data and
+	the size of the stored chunks. The dedup ratio is the logical size divided by the unique data,
+	the compression ratio the unique data divided by the stored chunks.
+	For every backup the data only used by it is shown, it is freed when the backup is deleted.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		stats, err := runRepoStats()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(stats)
+		printDone()
+	},
+}
+
+// runRepoStats returns the statistics of the repository
+func runRepoStats() (stats string, err error) {
+	// Cleanup must not delete chunks while they are counted
+	lock, err := acquireStorageLock(backup.LockShared, "repo-stats")
+	if err != nil {
+		return "", err
+	}
+	defer releaseStorageLock(lock, &err)
+
+	usage, err := loadDedupUsage()
+	if err != nil {
+		return "", err
+	}
+	count := 0
+	err = forEachCluster(func(cluster *backup.Cluster) error {
+		backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+		count += backups.Len()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	chunks, err := storage.ListObjects(viper.GetViper(), backup.DedupChunkPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	var logical, unique, stored, unused int64
+	var chunkCount, unusedCount int
+	for _, b := range usage.backups {
+		logical += b.logical
+	}
+	for _, size := range usage.sizes {
+		unique += size
+	}
+	for _, chunk := range chunks {
+		hash, ok := backup.ParseDedupChunkKey(chunk.Key)
+		if !ok {
+			continue
+		}
+		chunkCount++
+		stored += chunk.Size
+		if usage.refs[hash] == 0 {
+			unusedCount++
+			unused += chunk.Size
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "Backups:\t%d (%d deduplicated)\n", count, len(usage.backups))
+	fmt.Fprintf(w, "Logical size:\t%s\n", humanize.Bytes(uint64(logical)))
+	fmt.Fprintf(w, "Unique data:\t%s\n", humanize.Bytes(uint64(unique)))
+	fmt.Fprintf(w, "Stored chunks:\t%d (%s)\n", chunkCount, humanize.Bytes(uint64(stored)))
+	fmt.Fprintf(w, "Unused chunks:\t%d (%s)\n", unusedCount, humanize.Bytes(uint64(unused)))
+	fmt.Fprintf(w, "Dedup ratio:\t%s\n", ratio(logical, unique))
+	fmt.Fprintf(w, "Compression ratio:\t%s\n", ratio(unique, stored-unused))
+	w.Flush()
+
+	if len(usage.backups) > 0 {
+		fmt.Fprintln(buf)
+		w = tabwriter.NewWriter(buf, 0, 0, 1, ' ', 0)
+		fmt.Fprintln(w, "BACKUP\tLOGICAL\tCHUNKS\tONLY IN BACKUP")
+		for _, b := range usage.backups {
+			var own int64
+			for hash := range b.chunks {
+				if usage.refs[hash] == 1 {
+					own += usage.sizes[hash]
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", b.name, humanize.Bytes(uint64(b.logical)), len(b.chunks), humanize.Bytes(uint64(own)))
+		}
+		w.Flush()
+	}
+	return buf.String(), nil
+}
+
+// ratio formats a / b as a factor
+func ratio(a int64, b int64) string {
+	if b <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2fx", float64(a)/float64(b))
+}
+
+// needsRepository returns true if the command uses the repository, it has to be compatible then
+func needsRepository(cmd *cobra.Command) bool {
+	if _, ok := cmd.Annotations[annotationNoRepository]; ok {
+		return false
+	}
+	// The help command of cobra has no annotations
+	return cmd.Name() != "help"
+}
+
+// writesRepository returns true if the command writes backups or deletes objects in the repository
+func writesRepository(cmd *cobra.Command) bool {
+	_, ok := cmd.Annotations[annotationWritesRepository]
+	return ok
+}
+
+// encryptionMode returns the encryption mode of the configuration
+func encryptionMode() string {
+	if viper.GetBool("encrypt") {
+		return backup.EncryptionGPG
+	}
+	return backup.EncryptionNone
+}
+
+// loadRepository reads the metadata of the repository, found is false if it has none
+func loadRepository() (repo backup.Repository, found bool, err error) {
+	objects, err := storage.ListObjects(viper.GetViper(), backup.RepositoryObject)
+	if err != nil {
+		return repo, false, err
+	}
+	for _, object := range objects {
+		if object.Key != backup.RepositoryObject {
+			continue
+		}
+		data, err := storage.ReadObject(viper.GetViper(), backup.RepositoryObject)
+		if err != nil {
+			return repo, false, err
+		}
+		repo, err = backup.ParseRepository(data)
+		return repo, err == nil, err
+	}
+	return repo, false, nil
+}
+
+// storeRepository writes the metadata of the repository
+func storeRepository(repo backup.Repository) error {
+	data, err := json.MarshalIndent(repo, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.WriteObject(viper.GetViper(), backup.RepositoryObject, append(data, '\n'))
+}
+
+// runRepoInit writes the metadata of a new repository
+func runRepoInit() (err error) {
+	lock, err := acquireStorageLock(backup.LockExclusive, "repo-init")
+	if err != nil {
+		return err
+	}
+	defer releaseStorageLock(lock, &err)
+
+	repo, found, err := loadRepository()
+	if err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("The repository is already initialized (format version %d, created %s)", repo.Version, repo.Created.Format(time.RFC3339))
+	}
+	if backups := storage.GetMyBackups(viper.GetViper(), subDirWal); backups.Len() > 0 {
+		return errors.New("The repository already has backups, use 'pgglaskugel repo upgrade' to add the metadata")
+	}
+
+	if err = backup.CheckClusterName(clusterName); err != nil {
+		return err
+	}
+	repo = backup.NewRepository(encryptionMode())
+	systemID, err := clusterSystemID(viper.GetString("connection"))
+	if err != nil {
+		systemID = localSystemID()
+	}
+	if systemID != "" {
+		cluster, _ := repo.AddCluster(clusterName, systemID)
+		log.Info("Added cluster ", cluster, " to the repository")
+	} else {
+		log.Warn("Can not get the system identifier of the cluster, it is added with its first basebackup or WAL file: ", err)
+	}
+	if err = storeRepository(repo); err != nil {
+		return err
+	}
+	log.Infof("Repository initialized: format version %d, codec %s, encryption %s", repo.Version, repo.Codec, repo.Encryption)
+	return nil
+}
+
+// repoUpgrade migrates the repository from format version from to the next one
+type repoUpgrade struct {
+	from        int
+	description string
+	run         func(repo *backup.Repository, dryRun bool) error
+}
+
+// repoUpgrades are all migrations in order
+var repoUpgrades = []repoUpgrade{
+	{from: 0, description: "record codec, encryption and system identifier in " + backup.RepositoryObject, run: upgradeUnversioned},
+	{from: 1, description: "move backups and WAL files below the prefixes of their clusters", run: upgradeClusterPrefixes},
+}
+
+// runRepoUpgrade migrates the repository to the current format version step by step, with dryRun nothing is changed
+func runRepoUpgrade(dryRun bool) (err error) {
+	mode := backup.LockExclusive
+	if dryRun {
+		mode = backup.LockShared
+	}
+	lock, err := acquireStorageLock(mode, "repo-upgrade")
+	if err != nil {
+		return err
+	}
+	defer releaseStorageLock(lock, &err)
+
+	repo, _, err := loadRepository()
+	if err != nil {
+		return err
+	}
+	if repo.Version > backup.RepositoryVersion {
+		return fmt.Errorf("The repository has format version %d, this version of pgGlaskugel supports up to %d", repo.Version, backup.RepositoryVersion)
+	}
+	if repo.Version == backup.RepositoryVersion {
+		log.Infof("The repository has the current format version %d, nothing to do", repo.Version)
+		return nil
+	}
+	// The backups and WAL files of a repository of another cluster would be moved to the wrong prefix
+	if err = repo.CheckSystemID(configuredSystemID()); err != nil {
+		return err
+	}
+
+	for _, upgrade := range repoUpgrades {
+		if upgrade.from != repo.Version {
+			continue
+		}
+		if dryRun {
+			log.Infof("Dry run: would upgrade from format version %d to %d: %s", upgrade.from, upgrade.from+1, upgrade.description)
+		} else {
+			log.Infof("Upgrade from format version %d to %d: %s", upgrade.from, upgrade.from+1, upgrade.description)
+		}
+		if err = upgrade.run(&repo, dryRun); err != nil {
+			return fmt.Errorf("Upgrade from format version %d failed: %v", upgrade.from, err)
+		}
+		repo.Version = upgrade.from + 1
+		// Every step is recorded, so an interrupted upgrade continues with the next one
+		if !dryRun {
+			if err = storeRepository(repo); err != nil {
+				return err
+			}
+		}
+	}
+	if dryRun {
+		log.Infof("Dry run: the repository would have format version %d", repo.Version)
+		return nil
+	}
+	log.Infof("The repository has format version %d now", repo.Version)
+	return nil
+}
+
+// upgradeUnversioned adds the metadata to a repository of an older version.
+// The configured encryption has to be able to read the existing backups, the system identifier is taken from their metadata
+func upgradeUnversioned(repo *backup.Repository, dryRun bool) error {
+	*repo = backup.NewRepository(encryptionMode())
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	if oldest := backups.OldestBackup(); oldest != nil && !oldest.Created.IsZero() {
+		repo.Created = oldest.Created.UTC()
+	}
+
+	// The newest backup with metadata or index shows if the configured encryption can read the backups
+	checked := false
+	backups.SortDesc()
+	for i := range backups.Backup {
+		b := &backups.Backup[i]
+		b.StorageType = viper.GetString("backup_to")
+		if b.Meta != nil {
+			meta, err := loadMeta(b)
+			if err != nil {
+				return fmt.Errorf("Can not read the metadata of %s with encryption %s: %v", b.Name, repo.Encryption, err)
+			}
+			checked = true
+			if meta.SystemID != "" {
+				repo.SystemID = meta.SystemID
+				break
+			}
+		} else if b.Index != nil && !checked {
+			if _, err := readBackupPart(b.Index, "index of "+b.Name); err != nil {
+				return fmt.Errorf("Can not read the index of %s with encryption %s: %v", b.Name, repo.Encryption, err)
+			}
+			checked = true
+		}
+	}
+	if !checked && backups.Len() > 0 {
+		log.Warn("No backup has metadata or an index, the encryption ", repo.Encryption, " is taken from the configuration unchecked")
+	}
+	if repo.SystemID == "" {
+		if id, err := clusterSystemID(viper.GetString("connection")); err == nil {
+			repo.SystemID = id
+		} else {
+			log.Warn("Can not get the system identifier of the cluster: ", err)
+		}
+	}
+	log.Infof("Codec %s, encryption %s, system identifier %q, created %s", repo.Codec, repo.Encryption, repo.SystemID, repo.Created.Format(time.RFC3339))
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(repoCmd)
+	repoCmd.AddCommand(repoStatsCmd)
+	repoCmd.AddCommand(repoInitCmd)
+	repoCmd.AddCommand(repoUpgradeCmd)
+	repoUpgradeCmd.PersistentFlags().Bool("dry-run", false, "Only show what would be done")
+
+	// Bind flags to viper
+	bindSetting("repo-upgrade-dry-run", repoUpgradeCmd.PersistentFlags().Lookup("dry-run"))
+}
@@ -0,0 +1,199 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+const (
+	testSystemID   = "6400000000000000001"
+	testBackupFile = "main@2017-01-02T03:04:05Z.zst"
+	testWalFile    = "000000010000000000000001.zst"
+)
+
+// legacyRepository creates a repository without metadata in the layout before format version 2
+// and configures it as the archivedir, the returned function restores the configuration
+func legacyRepository(t *testing.T) (dir string, restore func()) {
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{filepath.Join(subDirBasebackup, testBackupFile), filepath.Join(subDirWal, testWalFile)} {
+		path := filepath.Join(dir, file)
+		if err = os.MkdirAll(filepath.Dir(path), 0770); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte("data"), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	settings := map[string]interface{}{
+		"backup_to":         "file",
+		"archivedir":        dir,
+		"system_identifier": testSystemID,
+		"pgdata":            dir,
+		"connection":        "host=" + filepath.Join(dir, "nosocket") + " sslmode=disable",
+		"encrypt":           false,
+	}
+	old := make(map[string]interface{})
+	for key, value := range settings {
+		old[key] = viper.Get(key)
+		viper.Set(key, value)
+	}
+	oldArchiveDir, oldClusterName := archiveDir, clusterName
+	archiveDir, clusterName = dir, "main"
+	useCluster(nil)
+	return dir, func() {
+		for key, value := range old {
+			viper.Set(key, value)
+		}
+		archiveDir, clusterName = oldArchiveDir, oldClusterName
+		useCluster(nil)
+		repository = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func exists(t *testing.T, path string) bool {
+	_, err := os.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestRepoUpgradeSteps(t *testing.T) {
+	dir, restore := legacyRepository(t)
+	defer restore()
+
+	var repo backup.Repository
+	if err := upgradeUnversioned(&repo, false); err != nil {
+		t.Fatal(err)
+	}
+	if repo.Codec != backup.CodecZstd || repo.Encryption != backup.EncryptionNone {
+		t.Errorf("codec %q and encryption %q after the upgrade from version 0", repo.Codec, repo.Encryption)
+	}
+	if want := "2017-01-02T03:04:05Z"; repo.Created.Format(backup.BackupTimeFormat) != want {
+		t.Errorf("created %s, expected the time of the oldest backup %s", repo.Created.Format(backup.BackupTimeFormat), want)
+	}
+	repo.Version = 1
+
+	if err := upgradeClusterPrefixes(&repo, false); err != nil {
+		t.Fatal(err)
+	}
+	if repo.SystemID != "" {
+		t.Errorf("system identifier %q is still set after the upgrade from version 1", repo.SystemID)
+	}
+	clusters := repo.ClustersNamed("main")
+	if len(clusters) != 1 || clusters[0].SystemID != testSystemID {
+		t.Fatalf("clusters %v after the upgrade from version 1", repo.Clusters)
+	}
+	prefix := filepath.Join(dir, filepath.FromSlash(clusters[0].Prefix()))
+	for _, file := range []string{filepath.Join(subDirBasebackup, testBackupFile), filepath.Join(subDirWal, testWalFile)} {
+		if exists(t, filepath.Join(dir, file)) {
+			t.Errorf("%s was not moved", file)
+		}
+		if !exists(t, filepath.Join(prefix, file)) {
+			t.Errorf("%s is not below the prefix %s", file, clusters[0].Prefix())
+		}
+	}
+}
+
+func TestRunRepoUpgrade(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		systemID string
+		dryRun   bool
+		err      bool
+		upgraded bool
+	}{
+		{name: "without metadata", upgraded: true},
+		{name: "without metadata, dry run", dryRun: true},
+		{name: "version 1", version: 1, systemID: testSystemID, upgraded: true},
+		{name: "version 1 of another cluster", version: 1, systemID: "6400000000000000002", err: true},
+	}
+	for _, test := range tests {
+		func() {
+			dir, restore := legacyRepository(t)
+			defer restore()
+			if test.version > 0 {
+				repo := backup.NewRepository(backup.EncryptionNone)
+				repo.Version = test.version
+				repo.SystemID = test.systemID
+				if err := storeRepository(repo); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := runRepoUpgrade(test.dryRun)
+			if test.err != (err != nil) {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			repo, found, loadErr := loadRepository()
+			if loadErr != nil {
+				t.Fatal(loadErr)
+			}
+			upgraded := found && repo.Version == backup.RepositoryVersion
+			if upgraded != test.upgraded {
+				t.Errorf("%s: upgraded is %t, expected %t (metadata %t, version %d)", test.name, upgraded, test.upgraded, found, repo.Version)
+			}
+			// The files stay where they are unless the repository was upgraded
+			moved := !exists(t, filepath.Join(dir, subDirBasebackup, testBackupFile))
+			if moved != test.upgraded {
+				t.Errorf("%s: backup moved is %t, expected %t", test.name, moved, test.upgraded)
+			}
+			if test.upgraded {
+				if err = openRepository(true); err != nil {
+					t.Errorf("%s: can not open the upgraded repository: %v", test.name, err)
+				}
+			}
+		}()
+	}
+}
+
+func TestOpenRepositoryWithoutMetadata(t *testing.T) {
+	_, restore := legacyRepository(t)
+	defer restore()
+	if err := openRepository(true); err == nil {
+		t.Error("a repository without metadata was opened for writing")
+	}
+	// archive_command, fetch and restores keep working in the old layout
+	if err := openRepository(false); err != nil {
+		t.Errorf("a repository without metadata can not be read: %v", err)
+	}
+	if repository != nil || currentCluster != nil {
+		t.Errorf("repository %v and cluster %v in the old layout", repository, currentCluster)
+	}
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	if backups.Len() != 1 {
+		t.Errorf("%d backups in the old layout, expected 1", backups.Len())
+	}
+}
@@ -21,10 +21,15 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"os/exec"
-	"sync"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -32,6 +37,8 @@ import (
 	"os"
 
 	log "github.com/Sirupsen/logrus"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/xxorde/pgglaskugel/backup"
 	"github.com/xxorde/pgglaskugel/storage"
 	util "github.com/xxorde/pgglaskugel/util"
 )
@@ -41,12 +48,18 @@ var (
 	restoreCmd = &cobra.Command{
 		Use:   "restore [BACKUPNAME] [DESTINATION]",
 		Short: "Restore an existing backup to a given location",
-		Long:  `Restore an existing backup to a given location.`,
+		Long: `Restore an existing backup to a given location.
+	Tablespaces are restored to their original location, use --tablespace-map OID=/new/path
+	or /old/path=/new/path to restore them somewhere else. The symlinks in pg_tblspc and the
+	tablespace_map are changed to the new location.
+	With --standby --primary-conninfo the restored cluster becomes a standby of the primary,
+	the backup has to be from the same cluster as the primary.
+	With --delta only the files that differ from the backup are written, this needs the index of the backup
+	and of the backups it is based on. Backups taken with pg_basebackup --incremental can not be restored as delta.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			log.Debug("restore called")
 			backupName := viper.GetString("backup")
 			backupDestination := viper.GetString("restore-to")
-			writeRecoveryConf := viper.GetBool("write-recovery-conf")
 			force := viper.GetBool("force-restore")
 
 			// TODO This is not very robust, maybe we find a better way here
@@ -65,200 +78,411 @@ var (
 				log.Fatal("Too many arguments: ", args)
 			}
 
-			if backupName == "" {
-				log.Fatal("Backupname not set")
-			}
-
-			// If target directory does not exists ...
-			if exists, err := util.Exists(backupDestination); !exists || err != nil {
-				log.Info(backupDestination, " does not exists, create it")
-				err := os.MkdirAll(backupDestination, 0700)
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-
 			// If backup folder is not empty, ask what to do (and force is not set)
-			if empty, err := util.IsEmpty(backupDestination); (!empty || err != nil) && force != true {
-				force, err := util.AnswerConfirmation("Destination directory is not empty, continue anyway?")
+			// A delta restore expects existing data
+			if empty, err := util.IsEmpty(backupDestination); err == nil && !empty && force != true && !viper.GetBool("delta") {
+				force, err = util.AnswerConfirmation("Destination directory is not empty, continue anyway?")
 				if err != nil {
 					log.Error(err)
 				}
-				if force != true {
-					log.Fatal(backupDestination + " is not an empty directory, you need to use force")
-				}
 			}
 
-			log.Info("Going to restore backup '", backupName, "' to: ", backupDestination)
-			err := restoreBasebackup(backupDestination, backupName)
-			if err != nil {
+			if err := runRestore(backupName, backupDestination, force); err != nil {
 				log.Fatal(err)
 			}
-
-			if writeRecoveryConf {
-				// When no restore_command command set, set it
-				if viper.GetString("restore_command") == "" {
-					// Include config file in potential restore_command command
-					configOption := ""
-					if viper.ConfigFileUsed() != "" {
-						configOption = " --config " + viper.ConfigFileUsed()
-					}
-
-					// Preset restore_command
-					viper.Set("restore_command", myExecutable+configOption+" fetch %f %p")
-				}
-				restoreCommand := viper.GetString("restore_command")
-				recoveryConf := "# Created by " + myExecutable + "\nrestore_command = '" + restoreCommand + "'"
-
-				log.Info("Going to write recovery.conf to: ", backupDestination)
-				log.Debugf("Content recovery.conf: %s ", recoveryConf)
-				err = ioutil.WriteFile(backupDestination+"/recovery.conf", []byte(recoveryConf), 0600)
-				if err != nil {
-					panic(err)
-				}
-			}
-
 			printDone()
 		},
 	}
 )
 
-func restoreBasebackup(backupDestination string, backupName string) (err error) {
-	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
-	backup, err := backups.Find(backupName)
-	if err != nil {
-		log.Fatal(err)
+// restoreOptions control how a backup is restored
+type restoreOptions struct {
+	// Force allows to restore into directories that are not empty
+	Force bool
+	// Delta only rewrites the files that differ from the backup and removes files that are not in the backup
+	Delta bool
+	// TrustMtime lets a delta restore keep files with the same size and modification time without comparing the checksum
+	TrustMtime bool
+	// Tablespaces are restored to the locations from the mapping
+	Tablespaces tablespaceMapping
+	// Incremental applies the incremental files of the backup to the files restored from its parent
+	Incremental bool
+	// Prune removes everything that is not in the backup after the extraction
+	Prune bool
+}
+
+// runRestore restores the backup to backupDestination and writes the recovery settings (if configured).
+// A destination that is not empty is only used if force or delta is set.
+func runRestore(backupName string, backupDestination string, force bool) (err error) {
+	opts := restoreOptions{Force: force, Delta: viper.GetBool("delta"), TrustMtime: viper.GetBool("delta-trust-mtime")}
+	if opts.Tablespaces, err = parseTablespaceMapping(viper.GetStringSlice("tablespace-map")); err != nil {
+		return err
 	}
-	encrypt := viper.GetBool("encrypt")
-	var dataStream *io.Reader // Stream for the raw backup data
 
-	// Command to inflate the data stream
-	// Read from stdin and write do stdout
-	inflateCmd := exec.Command(cmdZstd, "-d", "--stdout", "-")
+	// Check the primary before the restore, so a wrong connection does not waste a restore
+	var primary *primaryCluster
+	if viper.GetBool("standby") {
+		if primary, err = connectPrimary(viper.GetString("primary-conninfo")); err != nil {
+			return err
+		}
+		defer primary.Close()
+	}
 
-	// Command to untar the uncompressed data stream
-	untarCmd := exec.Command("tar", "--extract", "--directory", backupDestination)
+	if err = restoreBackup(backupName, backupDestination, opts); err != nil {
+		return err
+	}
+	if primary != nil {
+		return configureStandby(backupDestination, primary, viper.GetString("slot"), viper.GetBool("create-slot"))
+	}
+	if viper.GetBool("write-recovery-conf") {
+		return writeRecoverySettings(backupDestination, map[string]string{"restore_command": restoreCommand()}, false)
+	}
+	return nil
+}
 
-	// Attach pipe to the inflation command
-	inflateStdout, err := inflateCmd.StdoutPipe()
+// restoreBackup takes the locks and restores the backup to backupDestination
+func restoreBackup(backupName string, backupDestination string, opts restoreOptions) (err error) {
+	if backupName == "" {
+		return errors.New("Backupname not set")
+	}
+
+	// Only one restore per destination
+	absDestination, err := filepath.Abs(backupDestination)
 	if err != nil {
-		log.Fatal("Can not attach pipe to backup process, ", err)
+		return err
 	}
+	unlock, err := lockLocal(lockClassRestore, absDestination)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	// Watch stderror of inflation
-	inflateDone := make(chan struct{}) // Channel to wait for WatchOutput
-	inflateStderror, err := inflateCmd.StderrPipe()
-	util.Check(err)
-	go util.WatchOutput(inflateStderror, log.Info, inflateDone)
+	// Cleanup must not delete the backup or WAL files while they are restored
+	lock, err := acquireStorageLock(backup.LockShared, "restore")
+	if err != nil {
+		return err
+	}
+	defer releaseStorageLock(lock, &err)
 
-	// Watch stderror of untar
-	untarDone := make(chan struct{}) // Channel to wait for WatchOutput
-	untarStderror, err := untarCmd.StderrPipe()
-	util.Check(err)
-	go util.WatchOutput(untarStderror, log.Info, untarDone)
+	// If target directory does not exists ...
+	if exists, err := util.Exists(backupDestination); !exists || err != nil {
+		log.Info(backupDestination, " does not exists, create it")
+		err := os.MkdirAll(backupDestination, 0700)
+		if err != nil {
+			return err
+		}
+	}
 
-	// Pipe the the inflated backup in untar
-	untarCmd.Stdin = inflateStdout
+	// If backup folder is not empty, force (or delta) is needed
+	if empty, err := util.IsEmpty(backupDestination); (!empty || err != nil) && !opts.Force && !opts.Delta {
+		return errors.New(backupDestination + " is not an empty directory, you need to use force or delta")
+	}
 
-	// If encryption is used, pipe data through decryption before inflation
-	// Command to decrypt the compressed data
-	gpgCmd := exec.Command(cmdGpg, "--decrypt", "-o", "-")
-	// TODO: Test if backup is encrypted
-	if encrypt {
-		log.Debug("Backup will be decrypted")
+	log.Info("Going to restore backup '", backupName, "' to: ", backupDestination)
+	return restoreBasebackup(backupDestination, backupName, opts)
+}
 
-		// Set the decryption output as input for inflation
-		inflateCmd.Stdin, err = gpgCmd.StdoutPipe()
-		if err != nil {
-			log.Fatal("Can not attach pipe to gpg process, ", err)
+// restoreCommand returns the configured restore_command or one that calls fetch
+func restoreCommand() string {
+	// When no restore_command command set, set it
+	if viper.GetString("restore_command") == "" {
+		// Include config file in potential restore_command command
+		configOption := ""
+		if viper.ConfigFileUsed() != "" {
+			configOption = " --config " + viper.ConfigFileUsed()
 		}
-		// Attach output of backup to stdin
-		dataStream = &gpgCmd.Stdin
-		// Watch output on stderror
-		gpgStderror, err := gpgCmd.StderrPipe()
-		util.Check(err)
-		go util.WatchOutput(gpgStderror, log.Info, nil)
-	} else {
-		log.Debug("Backup will not be encrypted")
-		// Encryption is not used, inflate data stream
-		dataStream = &inflateCmd.Stdin
+		if selectedSection != "" {
+			configOption += " --cluster " + selectedSection
+		}
+		// In a shared repository the WAL files are fetched from the cluster of the backup
+		if currentCluster != nil {
+			configOption += " --cluster_name " + currentCluster.Name + " --system_identifier " + currentCluster.SystemID
+		}
+
+		// Preset restore_command
+		viper.Set("restore_command", myExecutable+configOption+" fetch %f %p")
 	}
+	return viper.GetString("restore_command")
+}
 
-	// WaitGroups for workers
-	var wgRestoreStart sync.WaitGroup // Waiting group to wait for start
-	var wgRestoreDone sync.WaitGroup  // Waiting group to wait for end
+// writeRecoverySettings writes the recovery settings for the restored cluster in pgData.
+// PostgreSQL 12 and newer read them from postgresql.auto.conf and need a recovery.signal file
+// (standby.signal for a standby), older versions read them from recovery.conf (with standby_mode for a standby)
+func writeRecoverySettings(pgData string, settings map[string]string, standby bool) (err error) {
+	// The version is only used to choose the format, unsupported versions are fine here
+	majorVersion, _ := getMajorVersionFromPgData(pgData)
+	major, err := strconv.Atoi(strings.Split(majorVersion, ".")[0])
+	if err != nil {
+		return errors.New("Can not get the PostgreSQL version of " + pgData + ", " + err.Error())
+	}
+	if standby && major < 12 {
+		settings["standby_mode"] = "on"
+	}
 
-	// Add one to the waiting counter
-	wgRestoreStart.Add(1)
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	content := "# Created by " + myExecutable + "\n"
+	for _, key := range keys {
+		content += key + " = '" + strings.Replace(settings[key], "'", "''", -1) + "'\n"
+	}
 
-	// Add one worker to wait for finish
-	wgRestoreDone.Add(1)
+	if major < 12 {
+		log.Info("Going to write recovery.conf to: ", pgData)
+		log.Debugf("Content recovery.conf: %s ", content)
+		recoveryConf := filepath.Join(pgData, "recovery.conf")
+		if err = ioutil.WriteFile(recoveryConf, []byte(content), 0600); err != nil {
+			return err
+		}
+		return chownRestored(recoveryConf)
+	}
 
-	// asign StorageType to backup
-	backup.StorageType = viper.GetString("backup_to")
+	autoConf := filepath.Join(pgData, "postgresql.auto.conf")
+	log.Info("Going to add the recovery settings to: ", autoConf)
+	log.Debugf("Recovery settings: %s ", content)
+	file, err := os.OpenFile(autoConf, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.WriteString(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	signal := filepath.Join(pgData, "recovery.signal")
+	if standby {
+		signal = filepath.Join(pgData, "standby.signal")
+	}
+	if err = ioutil.WriteFile(signal, nil, 0600); err != nil {
+		return err
+	}
+	return chownRestored(autoConf, signal)
+}
 
-	// Start getBasebackup in new go-routine
-	go storage.GetBasebackup(viper.GetViper(), backup, dataStream, &wgRestoreStart, &wgRestoreDone)
+// chownRestored gives files that are written after the restore to the restore-owner (if set)
+func chownRestored(paths ...string) error {
+	owner := viper.GetString("restore-owner")
+	if owner == "" {
+		return nil
+	}
+	uid, gid, err := lookupOwner(owner)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err = os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Wait for getBasebackup to start
-	wgRestoreStart.Wait()
+// restoreBasebackup restores the backup and its tablespaces
+// A delta restore compares the existing files with the index of the backup (and of its parents) first
+func restoreBasebackup(backupDestination string, backupName string, opts restoreOptions) (err error) {
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	b, err := backups.Find(backupName)
+	if err != nil {
+		return err
+	}
+	chain, metas, err := backupChain(&backups, b)
+	if err != nil {
+		return err
+	}
+	if len(chain) > 1 && metas[len(metas)-1].Method == backup.MethodPgBasebackup {
+		if opts.Delta {
+			return errors.New("Delta restore of backups that are combined with pg_combinebackup is not supported")
+		}
+		for i, meta := range metas {
+			if meta.Method != backup.MethodPgBasebackup {
+				return fmt.Errorf("%s in the chain of %s was not taken with pg_basebackup, it can not be combined", chain[i].Name, b.Name)
+			}
+		}
+		return restoreCombined(chain, backupDestination, opts)
+	}
 
-	// Start untar
-	if err := untarCmd.Start(); err != nil {
-		log.Fatal("untarCmd failed on startup, ", err)
+	var delta *deltaChain
+	if opts.Delta {
+		if delta, err = loadDeltaChain(chain, opts.TrustMtime); err != nil {
+			return err
+		}
+	}
+	if len(chain) > 1 {
+		return restoreChain(chain, backupDestination, opts, delta)
+	}
+	skip, err := delta.destination(backupDestination, "", 0)
+	if err != nil {
+		return err
 	}
-	log.Info("Untar started")
+	if err = extractBackup(b, backupDestination, skip, opts); err != nil {
+		return err
+	}
+	return restoreTablespaces(b, backupDestination, opts, delta, 0)
+}
 
-	// Start WAL inflation
-	if err := inflateCmd.Start(); err != nil {
-		log.Fatal("zstd failed on startup, ", err)
+// restoreChain restores the full backup of the chain and applies the incremental and differential backups on top in order.
+// Everything that is not in the last backup is removed at the end
+func restoreChain(chain []*backup.Backup, backupDestination string, opts restoreOptions, delta *deltaChain) (err error) {
+	names := make([]string, len(chain))
+	for i, b := range chain {
+		names[i] = b.Name
 	}
-	log.Debug("Inflation started")
+	log.Info("Restore the chain ", strings.Join(names, " -> "))
+	for i, b := range chain {
+		step := opts
+		step.Incremental = i > 0
+		step.Prune = i == len(chain)-1
+		log.Infof("Restore %s (%d of %d)", b.Name, i+1, len(chain))
+		skip, err := delta.destination(backupDestination, "", i)
+		if err != nil {
+			return err
+		}
+		if err = extractBackup(b, backupDestination, skip, step); err != nil {
+			return err
+		}
+		if err = restoreTablespaces(b, backupDestination, step, delta, i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if encrypt {
-		log.Debug("Start decryption go-routine")
-		if err := gpgCmd.Start(); err != nil {
-			log.Fatal("gpg failed on startup, ", err)
+// extractBackup extracts the backup (or a tablespace of it) with its chunks into dir and verifies the checksums
+// Files for which skip (if set) returns true are up to date and not written.
+// With opts.Incremental the incremental files are applied to the files in dir, opts.Prune removes what is not in the backup
+func extractBackup(b *backup.Backup, dir string, skip func(string) bool, opts restoreOptions) (err error) {
+	uid, gid := -1, -1
+	if owner := viper.GetString("restore-owner"); owner != "" {
+		if uid, gid, err = lookupOwner(owner); err != nil {
+			return err
 		}
-		log.Debug("gpg started")
+	}
+	var restored map[string]bool
+	if opts.Prune {
+		restored = make(map[string]bool)
 	}
 
-	// Wait for output watchers to finish
-	// If the Cmd.Wait() is called while another process is reading
-	// from Stdout / Stderr this is a race condition.
-	// So we are waiting for the watchers first
-	<-inflateDone
-	<-untarDone
+	// The backup itself is extracted last, so its directories get their modes and modification times at the end
+	var files, bytes int64
+	for _, object := range append(b.ChunkBackups(), b) {
+		extractor := util.NewExtractor(dir)
+		extractor.UID, extractor.GID = uid, gid
+		extractor.Skip = skip
+		if opts.Incremental {
+			extractor.PatchSuffix = backup.IncrementalSuffix
+			extractor.Patch = func(file *os.File, r io.Reader) error {
+				return backup.ApplyIncremental(file, r)
+			}
+		}
+		if opts.Prune {
+			extractor.Include = func(name string) bool {
+				for name = strings.TrimSuffix(name, backup.IncrementalSuffix); name != "."; name = filepath.Dir(name) {
+					restored[name] = true
+				}
+				return true
+			}
+		}
+		extractor.Progress = func(objectFiles int64, objectBytes int64) {
+			log.Infof("Restored %d file(s), %s", files+objectFiles, humanize.Bytes(uint64(bytes+objectBytes)))
+		}
+		if err = extractObject(object, extractor); err != nil {
+			return err
+		}
+		files += extractor.Files()
+		bytes += extractor.Bytes()
+	}
+	if opts.Prune {
+		return pruneRestored(dir, restored)
+	}
+	return nil
+}
 
-	// Wait for compression to finish
-	err = inflateCmd.Wait()
+// extractObject extracts one object of a backup with the extractor and verifies its checksums
+func extractObject(b *backup.Backup, extractor *util.Extractor) (err error) {
+	reader, err := openBackup(b)
 	if err != nil {
-		log.Fatal("inflateCmd failed after startup, ", err)
+		return err
 	}
+	log.Info("Extraction of ", b.Name, " started")
+	extractErr := extractor.Extract(reader)
 
-	// WAIT! If there is still data in the output pipe it can be lost!
-	// Wait for backup to finish
-	err = untarCmd.Wait()
+	// The rest after the end of the archive is read to complete the checksums
+	closeErr := reader.Close()
+
+	// The restored data is only usable if it matches the checksums
+	verified, err := reader.Verify()
 	if err != nil {
-		log.Fatal("untarCmd failed after startup, ", err)
+		return err
+	}
+	if extractErr != nil {
+		return extractErr
 	}
-	log.Debug("untarCmd done")
+	if closeErr != nil {
+		return closeErr
+	}
+	extractor.Progress(extractor.Files(), extractor.Bytes())
+	if !verified {
+		log.Warn("No checksums stored for ", b.Name, ", restored data can not be verified")
+	} else {
+		log.Info("Checksums of ", b.Name, " verified")
+	}
+	return nil
+}
 
-	// Tell the backup source that the chain is finished
-	wgRestoreDone.Done()
-	return err
+// lookupOwner returns the ids of owner, given as "user" or "user:group"
+func lookupOwner(owner string) (uid int, gid int, err error) {
+	parts := strings.SplitN(owner, ":", 2)
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		return -1, -1, err
+	}
+	groupID := u.Gid
+	if len(parts) == 2 {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			return -1, -1, err
+		}
+		groupID = g.Gid
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return -1, -1, err
+	}
+	if gid, err = strconv.Atoi(groupID); err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
 }
 
 func init() {
 	RootCmd.AddCommand(restoreCmd)
 	restoreCmd.PersistentFlags().StringP("backup", "B", "", "The backup to restore")
 	restoreCmd.PersistentFlags().String("restore-to", "/var/lib/postgresql/pgGlaskugel-restore", "The destination to restore to")
-	restoreCmd.PersistentFlags().Bool("write-recovery-conf", true, "Automatic create a recovery.conf to replay WAL from archive")
+	restoreCmd.PersistentFlags().Bool("write-recovery-conf", true, "Automatic write the recovery settings (recovery.conf or recovery.signal) to replay WAL from archive")
 	restoreCmd.PersistentFlags().Bool("force-restore", false, "Force the deletion of existing data (danger zone)!")
+	restoreCmd.PersistentFlags().Bool("delta", false, "Restore into existing data, only files that differ from the backup are written, files that are not in the backup are removed")
+	restoreCmd.PersistentFlags().Bool("delta-trust-mtime", false, "Keep files with the same size and modification time without comparing the checksum in a delta restore")
+	restoreCmd.PersistentFlags().StringSlice("tablespace-map", nil, "Restore a tablespace to another location, given as OID=/new/path or /old/path=/new/path (can be repeated)")
+	restoreCmd.PersistentFlags().Bool("standby", false, "Configure the restored cluster as standby of the primary given with --primary-conninfo")
+	restoreCmd.PersistentFlags().String("primary-conninfo", "", "Connection string to the primary for the standby (primary_conninfo)")
+	restoreCmd.PersistentFlags().String("slot", "", "Replication slot on the primary for the standby (primary_slot_name)")
+	restoreCmd.PersistentFlags().Bool("create-slot", false, "Create the replication slot on the primary if it does not exist")
+	restoreCmd.PersistentFlags().String("restore-owner", "", "Owner of the restored files as user or user:group, the owner from the backup is kept if empty (only as root)")
 
 	// Bind flags to viper
-	viper.BindPFlag("backup", restoreCmd.PersistentFlags().Lookup("backup"))
-	viper.BindPFlag("restore-to", restoreCmd.PersistentFlags().Lookup("restore-to"))
-	viper.BindPFlag("write-recovery-conf", restoreCmd.PersistentFlags().Lookup("write-recovery-conf"))
-	viper.BindPFlag("force-restore", restoreCmd.PersistentFlags().Lookup("force-restore"))
+	bindSetting("backup", restoreCmd.PersistentFlags().Lookup("backup"))
+	bindSetting("restore-to", restoreCmd.PersistentFlags().Lookup("restore-to"))
+	bindSetting("write-recovery-conf", restoreCmd.PersistentFlags().Lookup("write-recovery-conf"))
+	bindSetting("force-restore", restoreCmd.PersistentFlags().Lookup("force-restore"))
+	bindSetting("delta", restoreCmd.PersistentFlags().Lookup("delta"))
+	bindSetting("delta-trust-mtime", restoreCmd.PersistentFlags().Lookup("delta-trust-mtime"))
+	bindSetting("tablespace-map", restoreCmd.PersistentFlags().Lookup("tablespace-map"))
+	bindSetting("standby", restoreCmd.PersistentFlags().Lookup("standby"))
+	bindSetting("primary-conninfo", restoreCmd.PersistentFlags().Lookup("primary-conninfo"))
+	bindSetting("slot", restoreCmd.PersistentFlags().Lookup("slot"))
+	bindSetting("create-slot", restoreCmd.PersistentFlags().Lookup("create-slot"))
+	bindSetting("restore-owner", restoreCmd.PersistentFlags().Lookup("restore-owner"))
 }
@@ -0,0 +1,375 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/storage"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+const (
+	// Name of the pg_hba.conf that is used by the test instance
+	restoreTestHba = "pgglaskugel_hba.conf"
+	// How often the test instance is asked if it accepts connections
+	restoreTestPoll = time.Second
+	// Time the test instance gets for a fast shutdown
+	restoreTestShutdownTimeout = time.Minute
+)
+
+// restoreTestCmd represents the restore-test command
+var restoreTestCmd = &cobra.Command{
+	Use:   "restore-test [BACKUP]",
+	Short: "Restores a backup into a temporary PostgreSQL instance and tests it",
+	Long: `Restores the given or the latest backup into a scratch directory and starts a local postgres on a free port.
+	WAL files are fetched from the archive until recovery reaches consistency, then the queries in
+	restore_test_queries are run. Afterwards the instance is shut down and the scratch directory is removed.
+	The report shows the time of every step, restore and recovery together are the time to recover (RTO).
+	The exit code is 1 if the test failed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			log.Fatal("Too many arguments: ", args)
+		}
+		backupName := ""
+		if len(args) == 1 {
+			backupName = args[0]
+		}
+		report := runRestoreTest(backupName)
+		fmt.Print(report.String())
+		if !report.Passed() {
+			log.Fatal("Restore test of ", report.Backup, " failed")
+		}
+		printDone()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(restoreTestCmd)
+	restoreTestCmd.PersistentFlags().String("restore_test_dir", "", "Directory for the scratch directories, the temporary directory of the system if empty")
+	restoreTestCmd.PersistentFlags().Int("restore_test_port", 0, "Port of the test instance, a free port is used if 0")
+	restoreTestCmd.PersistentFlags().String("restore_test_user", "postgres", "Database user for the sanity queries")
+	restoreTestCmd.PersistentFlags().String("restore_test_database", "postgres", "Database for the sanity queries")
+	restoreTestCmd.PersistentFlags().StringSlice("restore_test_queries", []string{"SELECT 1"}, "SQL sanity queries that have to succeed")
+	restoreTestCmd.PersistentFlags().String("restore_test_recovery_target", "immediate", "recovery_target of the test instance, empty to replay all archived WAL")
+	restoreTestCmd.PersistentFlags().Duration("restore_test_timeout", 30*time.Minute, "Maximal time to reach consistency")
+	restoreTestCmd.PersistentFlags().Bool("restore_test_keep", false, "Keep the scratch directory if the test failed")
+
+	// Bind flags to viper
+	bindSetting("restore_test_dir", restoreTestCmd.PersistentFlags().Lookup("restore_test_dir"))
+	bindSetting("restore_test_port", restoreTestCmd.PersistentFlags().Lookup("restore_test_port"))
+	bindSetting("restore_test_user", restoreTestCmd.PersistentFlags().Lookup("restore_test_user"))
+	bindSetting("restore_test_database", restoreTestCmd.PersistentFlags().Lookup("restore_test_database"))
+	bindSetting("restore_test_queries", restoreTestCmd.PersistentFlags().Lookup("restore_test_queries"))
+	bindSetting("restore_test_recovery_target", restoreTestCmd.PersistentFlags().Lookup("restore_test_recovery_target"))
+	bindSetting("restore_test_timeout", restoreTestCmd.PersistentFlags().Lookup("restore_test_timeout"))
+	bindSetting("restore_test_keep", restoreTestCmd.PersistentFlags().Lookup("restore_test_keep"))
+}
+
+// restoreTestStep is one step of a restore test
+type restoreTestStep struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// restoreTestReport is the result of a restore test
+type restoreTestReport struct {
+	Backup string
+	Steps  []restoreTestStep
+}
+
+// run runs fn as step and returns its error
+func (r *restoreTestReport) run(name string, fn func() error) error {
+	log.Info("Restore test: ", name)
+	start := time.Now()
+	err := fn()
+	r.Steps = append(r.Steps, restoreTestStep{Name: name, Duration: time.Since(start), Err: err})
+	if err != nil {
+		log.Error("Restore test: ", name, " failed: ", err)
+	}
+	return err
+}
+
+// Passed returns true if all steps succeeded
+func (r *restoreTestReport) Passed() bool {
+	if len(r.Steps) == 0 {
+		return false
+	}
+	for _, step := range r.Steps {
+		if step.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// rto returns the time until the restored instance was usable
+func (r *restoreTestReport) rto() (rto time.Duration) {
+	for _, step := range r.Steps {
+		if step.Name == "restore" || step.Name == "recovery" {
+			rto += step.Duration
+		}
+	}
+	return rto
+}
+
+// String returns the report as table
+func (r *restoreTestReport) String() string {
+	buf := new(bytes.Buffer)
+	result := "FAILED"
+	if r.Passed() {
+		result = "PASSED"
+	}
+	fmt.Fprintf(buf, "Restore test of %s: %s\n", r.Backup, result)
+	w := tabwriter.NewWriter(buf, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(w, "STEP\tDURATION\tRESULT")
+	var total time.Duration
+	for _, step := range r.Steps {
+		state := "OK"
+		if step.Err != nil {
+			state = step.Err.Error()
+		}
+		total += step.Duration
+		fmt.Fprintf(w, "%s\t%s\t%s\n", step.Name, step.Duration-step.Duration%time.Millisecond, state)
+	}
+	w.Flush()
+	fmt.Fprintf(buf, "Total: %s, time to recover (restore + recovery): %s\n",
+		total-total%time.Millisecond, r.rto()-r.rto()%time.Millisecond)
+	return buf.String()
+}
+
+// runRestoreTest restores the backup (the latest if backupName is empty) into a scratch directory,
+// starts a test instance, runs the sanity queries and cleans up
+func runRestoreTest(backupName string) (report restoreTestReport) {
+	if backupName == "" {
+		backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+		if backups.Len() == 0 {
+			report.run("restore", func() error { return errors.New("No backups found") })
+			return report
+		}
+		backupName = backups.NewestBackup().Name
+	}
+	report.Backup = backupName
+
+	scratch, err := ioutil.TempDir(viper.GetString("restore_test_dir"), "pgglaskugel-restore-test-")
+	if err != nil {
+		report.run("restore", func() error { return err })
+		return report
+	}
+	defer func() {
+		if !report.Passed() && viper.GetBool("restore_test_keep") {
+			log.Warn("Keeping scratch directory ", scratch)
+			return
+		}
+		if err := os.RemoveAll(scratch); err != nil {
+			log.Warn("Can not remove scratch directory: ", err)
+		}
+	}()
+	pgData := filepath.Join(scratch, "data")
+	// The tablespaces must not overwrite the ones of the original cluster
+	opts := restoreOptions{Tablespaces: tablespaceMapping{baseDir: filepath.Join(scratch, "tablespaces")}}
+
+	if report.run("restore", func() error { return restoreBackup(backupName, pgData, opts) }) != nil {
+		return report
+	}
+
+	port := viper.GetInt("restore_test_port")
+	var postgres *exec.Cmd
+	var exited chan error
+	err = report.run("start", func() (err error) {
+		if port == 0 {
+			if port, err = freePort(); err != nil {
+				return err
+			}
+		}
+		if err = prepareTestInstance(pgData); err != nil {
+			return err
+		}
+		postgres, exited, err = startTestInstance(pgData, scratch, port)
+		return err
+	})
+	if err != nil {
+		return report
+	}
+	defer report.run("shutdown", func() error { return stopTestInstance(postgres, exited) })
+
+	connection := fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable connect_timeout=10",
+		scratch, port, viper.GetString("restore_test_user"), viper.GetString("restore_test_database"))
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		report.run("recovery", func() error { return err })
+		return report
+	}
+	defer db.Close()
+
+	if report.run("recovery", func() error { return waitForConsistency(db, exited) }) != nil {
+		return report
+	}
+
+	for i, query := range viper.GetStringSlice("restore_test_queries") {
+		report.run("query "+strconv.Itoa(i+1), func() error { return runSanityQuery(db, query) })
+	}
+	return report
+}
+
+// freePort returns a TCP port that is not in use
+func freePort() (port int, err error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// prepareTestInstance writes the recovery settings and the configuration files the test instance needs
+func prepareTestInstance(pgData string) (err error) {
+	settings := map[string]string{
+		"restore_command": restoreCommand(),
+	}
+	if target := viper.GetString("restore_test_recovery_target"); target != "" {
+		settings["recovery_target"] = target
+		settings["recovery_target_action"] = "promote"
+	}
+	if err = writeRecoverySettings(pgData, settings, false); err != nil {
+		return err
+	}
+
+	// The configuration may live outside of the data directory (e.g. on Debian), postgres needs one
+	conf := filepath.Join(pgData, "postgresql.conf")
+	if exists, _ := util.Exists(conf); !exists {
+		if err = ioutil.WriteFile(conf, nil, 0600); err != nil {
+			return err
+		}
+	}
+
+	// Only local connections through the socket in the scratch directory are possible
+	hba := "# Created by " + myExecutable + " for the restore test\nlocal all all trust\n"
+	return ioutil.WriteFile(filepath.Join(pgData, restoreTestHba), []byte(hba), 0600)
+}
+
+// startTestInstance starts postgres, it only listens on a socket in the scratch directory.
+// Archiving is turned off so the test instance never writes to the archive
+func startTestInstance(pgData string, socketDir string, port int) (postgres *exec.Cmd, exited chan error, err error) {
+	postgres = exec.Command(viper.GetString("path_to_postgres"),
+		"-D", pgData,
+		"-p", strconv.Itoa(port),
+		"-c", "listen_addresses=",
+		"-c", "unix_socket_directories="+socketDir,
+		"-c", "hba_file="+filepath.Join(pgData, restoreTestHba),
+		"-c", "archive_mode=off",
+		"-c", "hot_standby=on",
+		"-c", "logging_collector=off",
+	)
+	stderr, err := postgres.StderrPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderrDone := make(chan struct{})
+	go util.WatchOutput(stderr, log.Info, stderrDone)
+	if err = postgres.Start(); err != nil {
+		return nil, nil, errors.New("postgres failed on startup, " + err.Error())
+	}
+	log.Info("Test instance started on port ", port, ", pid ", postgres.Process.Pid)
+
+	exited = make(chan error, 1)
+	go func() {
+		<-stderrDone
+		exited <- postgres.Wait()
+	}()
+	return postgres, exited, nil
+}
+
+// waitForConsistency waits until the test instance accepts connections, this is the case
+// when recovery reached a consistent state
+func waitForConsistency(db *sql.DB, exited chan error) error {
+	timeout := time.After(viper.GetDuration("restore_test_timeout"))
+	for {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		log.Debug("Test instance does not accept connections yet: ", err)
+		select {
+		case err := <-exited:
+			exited <- err
+			return fmt.Errorf("postgres exited during recovery: %v", err)
+		case <-timeout:
+			return errors.New("Timeout, test instance did not reach consistency")
+		case <-time.After(restoreTestPoll):
+		}
+	}
+}
+
+// runSanityQuery runs the query and reads all rows
+func runSanityQuery(db *sql.DB, query string) error {
+	log.Debug("Sanity query: ", query)
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	log.Infof("Sanity query returned %d row(s): %s", count, query)
+	return nil
+}
+
+// stopTestInstance makes a fast shutdown of the test instance, it is killed if it does not stop in time
+func stopTestInstance(postgres *exec.Cmd, exited chan error) error {
+	select {
+	case err := <-exited:
+		return fmt.Errorf("postgres exited unexpectedly: %v", err)
+	default:
+	}
+	if err := postgres.Process.Signal(syscall.SIGINT); err != nil {
+		return err
+	}
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(restoreTestShutdownTimeout):
+		postgres.Process.Kill()
+		<-exited
+		return errors.New("Test instance did not shut down in time and was killed")
+	}
+}
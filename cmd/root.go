@@ -23,6 +23,7 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -30,12 +31,13 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -86,26 +88,29 @@ var (
 	myExecutable string
 
 	// Vars for configuration
-	cfgFile    string
+	cfgFile string
+	// configData is the content of the config file in use, a failed reload goes back to it
+	configData []byte
 	archiveDir string
 	backupDir  string
 	walDir     string
 
 	// Minimal and maximal PostgreSQL version (numeric)
 	pgMinVersion           = 90500
-	pgMaxVersion           = 90699
-	supportedMajorVersions = [...]string{"9.5", "9.6"}
+	pgMaxVersion           = 179999
+	supportedMajorVersions = [...]string{"9.5", "9.6", "10", "11", "12", "13", "14", "15", "16", "17"}
 
 	// sub folders
 	subDirBasebackup = "/basebackup/"
 	subDirWal        = "/wal/"
 
 	// commands
-	cmdTar        = "tar"
-	cmdBasebackup = "pg_basebackup"
-	cmdZstd       = "zstd"
-	cmdZstdcat    = "zstdcat"
-	cmdGpg        = "gpg"
+	cmdTar           = "tar"
+	cmdBasebackup    = "pg_basebackup"
+	cmdZstd          = "zstd"
+	cmdZstdcat       = "zstdcat"
+	cmdGpg           = "gpg"
+	cmdCombinebackup = "pg_combinebackup"
 
 	baseBackupTools = []string{
 		cmdTar,
@@ -133,47 +138,50 @@ var (
 )
 
 // storeStream is an interface for functions that store a stream in an storage backend
-type storeStream func(*io.Reader, string)
-
-// This is just to check for commands where we don't need to create/check a pid-file
-func checkContainswhitelist(args []string) bool {
-	whiteList := []string{"archive", "genman", "help", "ls", "lswal",
-		"status", "tutor", "version"}
-
-	for _, arg := range args {
-		for _, white := range whiteList {
-			if white == arg {
-				return true
-			}
-		}
-	}
-	return false
-}
+// The stream has to be read until the end, a read error means the data is not complete.
+// The last argument returns the checksum of the original data once the stream is read completely
+type storeStream func(*io.Reader, string, func() string) error
 
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// Every command takes the locks it needs itself, see locks.go
 func Execute() {
-	if len(os.Args) > 1 && checkContainswhitelist(os.Args) {
-		if err := RootCmd.Execute(); err != nil {
-			fmt.Println(err)
-			os.Exit(-1)
-		}
-	} else {
-		pidfile := viper.GetString("pidpath")
-		log.Debugf("pidfile is %s", pidfile)
-		if err := util.WritePidFile(pidfile); err != nil {
-			log.Error(err)
-			os.Exit(1)
-		} else {
-			defer util.DeletePidFile(pidfile)
-			if err := RootCmd.Execute(); err != nil {
-				fmt.Println(err)
-				os.Exit(-1)
-			}
+	if err := runRoot(); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+}
+
+// interruptContext returns a context that is cancelled on SIGINT or SIGTERM, so running
+// processes are stopped and partial data is discarded instead of the program just dying.
+// stop restores the default handling of the signals
+func interruptContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warn("Received ", sig, ", cancel running operation")
+			cancel()
+		case <-done:
 		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
 	}
 }
 
+// runRoot executes the root command and persists the collected metrics
+func runRoot() (err error) {
+	err = RootCmd.Execute()
+	writeMetricsTextfile()
+	return err
+}
+
 func init() {
 	// Measure time from here
 	startTime = time.Now()
@@ -192,9 +200,24 @@ func init() {
 	}
 
 	cobra.OnInitialize(initConfig)
+	RootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		if _, ok := cmd.Annotations[annotationLongRunning]; ok {
+			startMetricsServer()
+		}
+		// No command may read or write a repository it does not understand.
+		// Commands that run for every cluster section open the repository of each
+		if needsRepository(cmd) && !iteratesClusters(cmd) {
+			if err := openRepository(writesRepository(cmd)); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
 	// Set the default values for the globally used flags
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "Config file")
+	RootCmd.PersistentFlags().String("cluster", "", "Use the settings of this cluster section of the config file")
 	RootCmd.PersistentFlags().String("cluster_name", hostname, "Name of the cluster, used in backup name")
+	RootCmd.PersistentFlags().String("system_identifier", "", "System identifier of the cluster in a shared repository, found in pgdata if not set")
 	RootCmd.PersistentFlags().StringP("pgdata", "D", "$PGDATA", "Base directory of your PostgreSQL instance aka. pg_data")
 	RootCmd.PersistentFlags().Bool("pgdata-auto", true, "Try to find pgdata if not set correctly (via SQL)")
 	RootCmd.PersistentFlags().String("archivedir", "/var/lib/postgresql/backup/pgglaskugel", "Dir where the backups should be stored")
@@ -216,51 +239,71 @@ func init() {
 	RootCmd.PersistentFlags().Bool("s3_metadata", true, "Enable sending metadada like file type, needed for compatibility")
 	RootCmd.PersistentFlags().Bool("encrypt", false, "Enable encryption for S3 and/or file storage")
 	RootCmd.PersistentFlags().StringArray("recipient", []string{"pgglaskugel"}, "The recipient for PGP encryption (key identifier)")
+	RootCmd.PersistentFlags().String("repo_format", repoFormatPlain, "Format of new backups: plain (one object per backup) or dedup (content-defined chunks stored once)")
+	RootCmd.PersistentFlags().Int("dedup_chunk_size_kb", 1024, "Average size of the chunks of deduplicated backups in KB")
 	RootCmd.PersistentFlags().String("path_to_tar", "/bin/tar", "Path to the tar command")
 	RootCmd.PersistentFlags().String("path_to_basebackup", "/usr/bin/pg_basebackup", "Path to the basebackup command")
+	RootCmd.PersistentFlags().String("path_to_combinebackup", "/usr/bin/pg_combinebackup", "Path to pg_combinebackup, used to restore incremental backups of pg_basebackup (PostgreSQL 17+)")
 	RootCmd.PersistentFlags().String("path_to_zstd", "/usr/bin/zstd", "Path to the zstd command")
 	RootCmd.PersistentFlags().String("path_to_zstdcat", "/usr/bin/zstdcat", "Path to the zstdcat command")
 	RootCmd.PersistentFlags().String("path_to_gpg", "/usr/bin/gpg", "Path to the gpg command")
+	RootCmd.PersistentFlags().String("path_to_postgres", "/usr/bin/postgres", "Path to the postgres server, used by restore-test")
 	RootCmd.PersistentFlags().Bool("no_tool_check", false, "Do not check the used tools")
 	RootCmd.PersistentFlags().String("cpuprofile", "", "Write cpu profile to given filename")
 	RootCmd.PersistentFlags().String("memprofile", "", "Write memory profile to given filename")
 	RootCmd.PersistentFlags().Bool("http_pprof", false, "Start net/http/pprof profiler")
-	RootCmd.PersistentFlags().String("pidpath", "/var/tmp/pgglaskugel/pgglaskugel.pid", "path and name for the pidfile")
+	RootCmd.PersistentFlags().String("pidpath", "/var/tmp/pgglaskugel/pgglaskugel.pid", "path and name for the pidfile, lock files are created in its directory if lock_dir is not set")
+	RootCmd.PersistentFlags().String("lock_dir", "", "Directory for the lock files of the commands on this host")
+	RootCmd.PersistentFlags().String("metrics_listen", "", "Address to expose Prometheus metrics on in long-running modes, e.g. ':9187'")
+	RootCmd.PersistentFlags().String("metrics_textfile", "", "Write Prometheus metrics to this file for the node_exporter textfile collector")
+	RootCmd.PersistentFlags().Duration("lock_ttl", 5*time.Minute, "A lock in the storage expires if it is not refreshed within this time")
+	RootCmd.PersistentFlags().Duration("lock_wait", 0, "How long to wait for a lock in the storage held by someone else")
 
 	// Bind flags to viper
 	// Try to find better suiting values over the viper configuration files
-	viper.BindPFlag("cluster_name", RootCmd.PersistentFlags().Lookup("cluster_name"))
-	viper.BindPFlag("pgdata", RootCmd.PersistentFlags().Lookup("pgdata"))
-	viper.BindPFlag("pgdata-auto", RootCmd.PersistentFlags().Lookup("pgdata-auto"))
-	viper.BindPFlag("archivedir", RootCmd.PersistentFlags().Lookup("archivedir"))
-	viper.BindPFlag("debug", RootCmd.PersistentFlags().Lookup("debug"))
-	viper.BindPFlag("json", RootCmd.PersistentFlags().Lookup("json"))
-	viper.BindPFlag("connection", RootCmd.PersistentFlags().Lookup("connection"))
-	viper.BindPFlag("jobs", RootCmd.PersistentFlags().Lookup("jobs"))
-	viper.BindPFlag("backup_to", RootCmd.PersistentFlags().Lookup("backup_to"))
-	viper.BindPFlag("archive_to", RootCmd.PersistentFlags().Lookup("archive_to"))
-	viper.BindPFlag("s3_endpoint", RootCmd.PersistentFlags().Lookup("s3_endpoint"))
-	viper.BindPFlag("s3_bucket_backup", RootCmd.PersistentFlags().Lookup("s3_bucket_backup"))
-	viper.BindPFlag("s3_bucket_wal", RootCmd.PersistentFlags().Lookup("s3_bucket_wal"))
-	viper.BindPFlag("s3_access_key", RootCmd.PersistentFlags().Lookup("s3_access_key"))
-	viper.BindPFlag("s3_secret_key", RootCmd.PersistentFlags().Lookup("s3_secret_key"))
-	viper.BindPFlag("s3_location", RootCmd.PersistentFlags().Lookup("s3_location"))
-	viper.BindPFlag("s3_ssl", RootCmd.PersistentFlags().Lookup("s3_ssl"))
-	viper.BindPFlag("s3_protocol_version", RootCmd.PersistentFlags().Lookup("s3_protocol_version"))
-	viper.BindPFlag("s3_part_size_mb", RootCmd.PersistentFlags().Lookup("s3_part_size_mb"))
-	viper.BindPFlag("s3_metadata", RootCmd.PersistentFlags().Lookup("s3_metadata"))
-	viper.BindPFlag("encrypt", RootCmd.PersistentFlags().Lookup("encrypt"))
-	viper.BindPFlag("recipient", RootCmd.PersistentFlags().Lookup("recipient"))
-	viper.BindPFlag("path_to_tar", RootCmd.PersistentFlags().Lookup("path_to_tar"))
-	viper.BindPFlag("path_to_basebackup", RootCmd.PersistentFlags().Lookup("path_to_basebackup"))
-	viper.BindPFlag("path_to_zstd", RootCmd.PersistentFlags().Lookup("path_to_zstd"))
-	viper.BindPFlag("path_to_zstdcat", RootCmd.PersistentFlags().Lookup("path_to_zstdcat"))
-	viper.BindPFlag("path_to_gpg", RootCmd.PersistentFlags().Lookup("path_to_gpg"))
-	viper.BindPFlag("no_tool_check", RootCmd.PersistentFlags().Lookup("no_tool_check"))
-	viper.BindPFlag("cpuprofile", RootCmd.PersistentFlags().Lookup("cpuprofile"))
-	viper.BindPFlag("memprofile", RootCmd.PersistentFlags().Lookup("memprofile"))
-	viper.BindPFlag("http_pprof", RootCmd.PersistentFlags().Lookup("http_pprof"))
-	viper.BindPFlag("pidpath", RootCmd.PersistentFlags().Lookup("pidpath"))
+	bindSetting("cluster", RootCmd.PersistentFlags().Lookup("cluster"))
+	bindSetting("cluster_name", RootCmd.PersistentFlags().Lookup("cluster_name"))
+	bindSetting("system_identifier", RootCmd.PersistentFlags().Lookup("system_identifier"))
+	bindSetting("pgdata", RootCmd.PersistentFlags().Lookup("pgdata"))
+	bindSetting("pgdata-auto", RootCmd.PersistentFlags().Lookup("pgdata-auto"))
+	bindSetting("archivedir", RootCmd.PersistentFlags().Lookup("archivedir"))
+	bindSetting("debug", RootCmd.PersistentFlags().Lookup("debug"))
+	bindSetting("json", RootCmd.PersistentFlags().Lookup("json"))
+	bindSetting("connection", RootCmd.PersistentFlags().Lookup("connection"))
+	bindSetting("jobs", RootCmd.PersistentFlags().Lookup("jobs"))
+	bindSetting("backup_to", RootCmd.PersistentFlags().Lookup("backup_to"))
+	bindSetting("archive_to", RootCmd.PersistentFlags().Lookup("archive_to"))
+	bindSetting("s3_endpoint", RootCmd.PersistentFlags().Lookup("s3_endpoint"))
+	bindSetting("s3_bucket_backup", RootCmd.PersistentFlags().Lookup("s3_bucket_backup"))
+	bindSetting("s3_bucket_wal", RootCmd.PersistentFlags().Lookup("s3_bucket_wal"))
+	bindSetting("s3_access_key", RootCmd.PersistentFlags().Lookup("s3_access_key"))
+	bindSetting("s3_secret_key", RootCmd.PersistentFlags().Lookup("s3_secret_key"))
+	bindSetting("s3_location", RootCmd.PersistentFlags().Lookup("s3_location"))
+	bindSetting("s3_ssl", RootCmd.PersistentFlags().Lookup("s3_ssl"))
+	bindSetting("s3_protocol_version", RootCmd.PersistentFlags().Lookup("s3_protocol_version"))
+	bindSetting("s3_part_size_mb", RootCmd.PersistentFlags().Lookup("s3_part_size_mb"))
+	bindSetting("s3_metadata", RootCmd.PersistentFlags().Lookup("s3_metadata"))
+	bindSetting("encrypt", RootCmd.PersistentFlags().Lookup("encrypt"))
+	bindSetting("recipient", RootCmd.PersistentFlags().Lookup("recipient"))
+	bindSetting("repo_format", RootCmd.PersistentFlags().Lookup("repo_format"))
+	bindSetting("dedup_chunk_size_kb", RootCmd.PersistentFlags().Lookup("dedup_chunk_size_kb"))
+	bindSetting("path_to_tar", RootCmd.PersistentFlags().Lookup("path_to_tar"))
+	bindSetting("path_to_basebackup", RootCmd.PersistentFlags().Lookup("path_to_basebackup"))
+	bindSetting("path_to_combinebackup", RootCmd.PersistentFlags().Lookup("path_to_combinebackup"))
+	bindSetting("path_to_zstd", RootCmd.PersistentFlags().Lookup("path_to_zstd"))
+	bindSetting("path_to_zstdcat", RootCmd.PersistentFlags().Lookup("path_to_zstdcat"))
+	bindSetting("path_to_gpg", RootCmd.PersistentFlags().Lookup("path_to_gpg"))
+	bindSetting("path_to_postgres", RootCmd.PersistentFlags().Lookup("path_to_postgres"))
+	bindSetting("no_tool_check", RootCmd.PersistentFlags().Lookup("no_tool_check"))
+	bindSetting("cpuprofile", RootCmd.PersistentFlags().Lookup("cpuprofile"))
+	bindSetting("memprofile", RootCmd.PersistentFlags().Lookup("memprofile"))
+	bindSetting("http_pprof", RootCmd.PersistentFlags().Lookup("http_pprof"))
+	bindSetting("pidpath", RootCmd.PersistentFlags().Lookup("pidpath"))
+	bindSetting("lock_dir", RootCmd.PersistentFlags().Lookup("lock_dir"))
+	bindSetting("metrics_listen", RootCmd.PersistentFlags().Lookup("metrics_listen"))
+	bindSetting("metrics_textfile", RootCmd.PersistentFlags().Lookup("metrics_textfile"))
+	bindSetting("lock_ttl", RootCmd.PersistentFlags().Lookup("lock_ttl"))
+	bindSetting("lock_wait", RootCmd.PersistentFlags().Lookup("lock_wait"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -281,6 +324,7 @@ func initConfig() {
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		log.Info("Using config file: ", viper.ConfigFileUsed())
+		configData, _ = ioutil.ReadFile(viper.ConfigFileUsed())
 	}
 
 	// Set log format to json if set
@@ -329,6 +373,23 @@ func initConfig() {
 		f.Close()
 	}
 
+	// The settings of the selected cluster section are used over the global ones
+	if err := applyClusterSection(viper.GetString("cluster")); err != nil {
+		log.Fatal(err)
+	}
+
+	// Check if needed tools are available
+	err := testTools(baseBackupTools)
+	util.Check(err)
+
+	// Check if the configured backend is supported
+	if err := storage.CheckBackend(viper.GetString("backup_to")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadSettings sets the global variables derived from the configuration
+func loadSettings() {
 	// Set clusterName
 	clusterName = viper.GetString("cluster_name")
 
@@ -358,6 +419,7 @@ func initConfig() {
 	cmdZstd = viper.GetString("path_to_zstd")
 	cmdZstdcat = viper.GetString("path_to_zstdcat")
 	cmdGpg = viper.GetString("path_to_gpg")
+	cmdCombinebackup = viper.GetString("path_to_combinebackup")
 
 	baseBackupTools = []string{
 		cmdTar,
@@ -366,15 +428,59 @@ func initConfig() {
 		cmdZstdcat,
 		cmdGpg,
 	}
+}
 
-	// Check if needed tools are available
-	err := testTools(baseBackupTools)
-	util.Check(err)
+// reloadConfig reads the configuration file again, used by long-running commands.
+// No job may run meanwhile, the settings change under it otherwise.
+// The new file is checked on its own first, if it can not be used the old one is used again
+func reloadConfig() (err error) {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return errors.New("No config file is used")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err = v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("Can not read the config file %s: %v", file, err)
+	}
+	if problems := validateConfigKeys(v, settingTypes()); len(problems) > 0 {
+		return fmt.Errorf("%d problem(s) in the config file: %s", len(problems), strings.Join(problems, "; "))
+	}
+	section := selectedSection
+	if _, ok := v.GetStringMap(clustersKey)[section]; section != "" && !ok {
+		return fmt.Errorf("There is no cluster %s in the config file anymore", section)
+	}
 
-	// Check if the configured backend is supported
+	if err = useConfig(data, section); err != nil {
+		if oldErr := useConfig(configData, section); oldErr != nil {
+			return fmt.Errorf("%v, the old config can not be used again either: %v", err, oldErr)
+		}
+		return err
+	}
+	configData = data
+	log.Info("Reloaded config file: ", file)
+	return nil
+}
+
+// useConfig uses the content of the config file with the settings of the cluster section and opens the repository
+func useConfig(data []byte, section string) error {
+	// The settings of the section are undone, not set to the global values of the old file
+	dropClusterSection()
+	if err := viper.ReadConfig(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err := applyClusterSection(section); err != nil {
+		return err
+	}
 	if err := storage.CheckBackend(viper.GetString("backup_to")); err != nil {
-		log.Fatal(err)
+		return err
 	}
+	// Only long-running commands reload, their jobs write backups
+	return openRepository(true)
 }
 
 // Global needed functions
@@ -439,12 +545,8 @@ func reloadConfiguration(db *sql.DB) (err error) {
 // getPgSetting gets the value for a given setting in the current PostgreSQL configuration
 func getPgSetting(db *sql.DB, setting string) (value string, err error) {
 	query := "SELECT setting FROM pg_settings WHERE name = $1;"
-	row := db.QueryRow(query, setting)
-	util.Check(err)
-	err = row.Scan(&value)
-	if err != nil {
-		log.Fatal("Can not get PostgreSQL setting: ", setting, " err:", err)
-		return "", err
+	if err = db.QueryRow(query, setting).Scan(&value); err != nil {
+		return "", fmt.Errorf("Can not get PostgreSQL setting %s: %v", setting, err)
 	}
 	log.Debug("Got ", value, " for ", setting, " in pg_settings")
 	return value, nil
@@ -454,10 +556,8 @@ func getPgSetting(db *sql.DB, setting string) (value string, err error) {
 func setPgSetting(db *sql.DB, setting string, value string) (err error) {
 	// TODO Bad style and risk for injection!!! But no better option ... open for suggestions!
 	query := "ALTER SYSTEM SET " + setting + " = '" + value + "';"
-	_, err = db.Query(query)
-	if err != nil {
-		log.Fatal("Can't set PostgreSQL setting: ", setting, " to: ", value, " Error: ", err)
-		return err
+	if _, err = db.Exec(query); err != nil {
+		return fmt.Errorf("Can not set PostgreSQL setting %s to %s: %v", setting, value, err)
 	}
 	log.Info("Set PostgreSQL setting: ", setting, " to: ", value)
 	return nil
@@ -542,28 +642,25 @@ func getMajorVersionFromPgData(pgData string) (pgMajorVersion string, err error)
 func checkPgVersion(db *sql.DB) (pgVersion pgVersion, err error) {
 	pgVersion.string, err = getPgSetting(db, "server_version")
 	if err != nil {
-		log.Fatal("Can not get server_version!")
 		return pgVersion, err
 	}
 
 	numString, err := getPgSetting(db, "server_version_num")
 	if err != nil {
-		log.Fatal("Can not get server_version_num!")
 		return pgVersion, err
 	}
 	pgVersion.num, err = strconv.Atoi(numString)
 	if err != nil {
-		log.Fatal("Can not parse server_version_num!")
-		return pgVersion, err
+		return pgVersion, fmt.Errorf("Can not parse server_version_num %q: %v", numString, err)
 	}
 
 	log.Debug("pgVersion ", pgVersion)
 
 	if isPgVersionSupported(pgVersion.num) != true {
-		log.Fatal("Please check for a compatible version.")
+		return pgVersion, fmt.Errorf("PostgreSQL %s is not supported, please check for a compatible version", pgVersion.string)
 	}
 
-	return pgVersion, err
+	return pgVersion, nil
 }
 
 func checkNeededParameter(parameter ...string) (err error) {
@@ -584,51 +681,83 @@ func checkNeededParameter(parameter ...string) (err error) {
 // * compresses it
 // * endcrypts it (if configured)
 // * persists it to given storage backend though storeStream function
-func compressEncryptStream(input *io.ReadCloser, name string, storageBackend storeStream, wg *sync.WaitGroup) {
-	// Tell the waiting group this process is done when function ends
-	defer wg.Done()
-
+// If ctx is cancelled or one of the processes fails, the storage backend reads an error
+// instead of the end of the stream and discards the partial data
+func compressEncryptStream(ctx context.Context, input io.Reader, name string, storageBackend storeStream) (err error) {
 	// We are using zstd for compression, add extension
-	name = name + ".zst"
+	return compressEncryptObject(ctx, input, name+".zst", storageBackend)
+}
+
+// compressEncryptObject works like compressEncryptStream but stores the object under name as it is
+func compressEncryptObject(ctx context.Context, input io.Reader, name string, storageBackend storeStream) (err error) {
+	// Stop all processes if the storage backend fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	// Are we using encryption?
 	encrypt := viper.GetBool("encrypt")
 	recipient := viper.GetStringSlice("recipient")
 
 	// This command is used to compress the backup
-	compressCmd := exec.Command(cmdZstd)
+	compressCmd := exec.CommandContext(ctx, cmdZstd)
 
 	// attach pipe to the command
 	compressStdout, err := compressCmd.StdoutPipe()
 	if err != nil {
-		log.Fatal("Can not attach pipe to backup process, ", err)
+		return errors.New("Can not attach pipe to compression process, " + err.Error())
 	}
 
 	// Watch output on stderror
 	compressDone := make(chan struct{}) // Channel to wait for WatchOutput
 	compressStderror, err := compressCmd.StderrPipe()
-	util.Check(err)
+	if err != nil {
+		return err
+	}
 	go util.WatchOutput(compressStderror, log.Info, compressDone)
 
-	// Pipe the backup in the compression
-	compressCmd.Stdin = *input
+	// Pipe the backup in the compression, the checksum of the original data is stored with the object
+	logical := util.NewHashReader(input)
+	compressCmd.Stdin = logical
 
 	// Start compression
 	if err := compressCmd.Start(); err != nil {
-		log.Fatal("zstd failed on startup, ", err)
+		return errors.New("zstd failed on startup, " + err.Error())
 	}
 	log.Info("Compression started")
 
-	// Stream which is send to storage backend
-	var dataStream io.Reader
+	// The processes of the chain, the last one is read by the storage backend
+	var chain []*util.WaitReader
+	chain = append(chain, &util.WaitReader{
+		Reader: compressStdout,
+		Wait: func() error {
+			// Wait for watch goroutine before Cmd.Wait(), race condition!
+			<-compressDone
+
+			// Wait for compression to finish
+			// If there is still data in the output pipe it can be lost!
+			log.Debug("Wait for compressCmd")
+			if err := compressCmd.Wait(); err != nil {
+				return errors.New("compression failed after startup, " + err.Error())
+			}
+			log.Debug("compressCmd done")
+			return nil
+		},
+	})
+
+	// Reap all processes of the chain, the last one first because it reads from the others
+	defer func() {
+		for i := len(chain) - 1; i >= 0; i-- {
+			if waitErr := chain[i].Close(); err == nil {
+				err = waitErr
+			}
+		}
+	}()
 
 	// Handle encryption
-	var gpgCmd *exec.Cmd
-	var gpgDone chan struct{} // Channel to wait for WatchOutput
 	if encrypt {
 		log.Debug("Encrypt data, encrypt: ", encrypt)
 		// Encrypt the compressed data
-		gpgDone = make(chan struct{})
+		gpgDone := make(chan struct{}) // Channel to wait for WatchOutput
 		gpgArgs := []string{"--encrypt", "-o", "-"}
 
 		// Add all recipients to the command
@@ -636,59 +765,55 @@ func compressEncryptStream(input *io.ReadCloser, name string, storageBackend sto
 			gpgArgs = append(gpgArgs, "--recipient", r)
 		}
 
-		gpgCmd = exec.Command(cmdGpg, gpgArgs...)
-		// Set the encryption output as input for S3
-		var err error
-		dataStream, err = gpgCmd.StdoutPipe()
+		gpgCmd := exec.CommandContext(ctx, cmdGpg, gpgArgs...)
+		// Set the encryption output as input for the storage
+		gpgStdout, err := gpgCmd.StdoutPipe()
 		if err != nil {
-			log.Fatal("Can not attach pipe to gpg process, ", err)
+			cancel()
+			return errors.New("Can not attach pipe to gpg process, " + err.Error())
 		}
-		// Attach output of WAL to stdin
-		gpgCmd.Stdin = compressStdout
+		// Attach output of the compression to stdin
+		gpgCmd.Stdin = chain[0]
 		// Watch output on stderror
 		gpgStderror, err := gpgCmd.StderrPipe()
-		util.Check(err)
+		if err != nil {
+			cancel()
+			return err
+		}
 		go util.WatchOutput(gpgStderror, log.Warn, gpgDone)
 
 		// Start encryption
 		if err := gpgCmd.Start(); err != nil {
-			log.Fatal("gpg failed on startup, ", err)
+			cancel()
+			return errors.New("gpg failed on startup, " + err.Error())
 		}
 		log.Debug("gpg started")
-	} else {
-		// Do not use encryption
-		dataStream = compressStdout
-	}
-
-	// Store the streamed data
-	storageBackend(&dataStream, name)
 
-	// Wait for watch goroutine before Cmd.Wait(), race condition!
-	<-compressDone
-
-	// Wait for compression to finish
-	// If there is still data in the output pipe it can be lost!
-	log.Debug("Wait for compressCmd")
-	err = compressCmd.Wait()
-	if err != nil {
-		log.Fatal("compression failed after startup, ", err)
+		chain = append(chain, &util.WaitReader{
+			Reader: gpgStdout,
+			Wait: func() error {
+				log.Debug("Wait for gpgCmd")
+				// Wait for output watchers to finish
+				// If the Cmd.Wait() is called while another process is reading
+				// from Stdout / Stderr this is a race condition.
+				// So we are waiting for the watchers first
+				<-gpgDone
+
+				// Wait for the command itself
+				if err := gpgCmd.Wait(); err != nil {
+					return errors.New("gpg failed after startup, " + err.Error())
+				}
+				log.Debug("Encryption done")
+				return nil
+			},
+		})
 	}
-	log.Debug("compressCmd done")
 
-	// If encryption is used wait for it to finish
-	if encrypt {
-		log.Debug("Wait for gpgCmd")
-		// Wait for output watchers to finish
-		// If the Cmd.Wait() is called while another process is reading
-		// from Stdout / Stderr this is a race condition.
-		// So we are waiting for the watchers first
-		<-gpgDone
-
-		// Wait for the command itself
-		err = gpgCmd.Wait()
-		if err != nil {
-			log.Fatal("gpg failed after startup, ", err)
-		}
-		log.Debug("Encryption done")
+	// Store the streamed data
+	var dataStream io.Reader = chain[len(chain)-1]
+	if err = storageBackend(&dataStream, name, logical.Sum); err != nil {
+		// Stop the processes, they are reaped in the deferred function
+		cancel()
 	}
+	return err
 }
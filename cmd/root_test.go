@@ -0,0 +1,151 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestPgVersionSupported(t *testing.T) {
+	tests := []struct {
+		num       int
+		major     string
+		supported bool
+	}{
+		{90400, "9.4", false},
+		{90500, "9.5", true},
+		{90624, "9.6", true},
+		{100023, "10", true},
+		{150008, "15", true},
+		{170002, "17", true},
+		{180000, "18", false},
+	}
+	for _, test := range tests {
+		if got := isPgVersionSupported(test.num); got != test.supported {
+			t.Errorf("isPgVersionSupported(%d) = %v, want %v", test.num, got, test.supported)
+		}
+		if got := isMajorVersionSupported(test.major); got != test.supported {
+			t.Errorf("isMajorVersionSupported(%q) = %v, want %v", test.major, got, test.supported)
+		}
+	}
+}
+
+// TestConfiguredBasebackup checks that the configured pg_basebackup is run, not the one in PATH
+func TestConfiguredBasebackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgglaskugel-basebackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	called := filepath.Join(dir, "called")
+	script := filepath.Join(dir, "pg_basebackup")
+	if err = ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+called+"\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := cmdBasebackup
+	defer func() { cmdBasebackup = saved }()
+	cmdBasebackup = script
+	viper.Set("staging_dir", dir)
+	defer viper.Set("staging_dir", "")
+
+	if _, err = stagedBasebackup(context.Background(), "test", []string{"--format", "tar"}, nil); err == nil {
+		t.Fatal("no error for a failing pg_basebackup")
+	}
+	args, err := ioutil.ReadFile(called)
+	if err != nil {
+		t.Fatal("the configured pg_basebackup was not run: ", err)
+	}
+	if !strings.HasPrefix(string(args), "--format tar --pgdata "+dir) {
+		t.Errorf("pg_basebackup was called with %q", args)
+	}
+}
+
+// TestReloadConfig checks that a config file that can not be used does not change the settings in use
+func TestReloadConfig(t *testing.T) {
+	dir, restore := upgradedRepository(t)
+	defer restore()
+	file := filepath.Join(dir, "config.yml")
+	write := func(config string) {
+		if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		dropClusterSection()
+		viper.SetConfigFile("")
+		viper.SetConfigType("yaml")
+		viper.ReadConfig(bytes.NewReader(nil))
+		configData = nil
+		loadSettings()
+	}()
+
+	// The settings of the test come from the config file
+	for _, key := range []string{"backup_to", "archivedir"} {
+		viper.Set(key, nil)
+	}
+	write("backup_to: file\narchivedir: " + dir + "\nretain: 5\nclusters:\n  main:\n    retain: 3\n")
+	viper.SetConfigFile(file)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	configData, _ = ioutil.ReadFile(file)
+	if err := applyClusterSection("main"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		err    bool
+		retain int
+	}{
+		{"wrong type", "backup_to: file\narchivedir: " + dir + "\nretain: many\nclusters:\n  main: {}\n", true, 3},
+		{"unknown backend", "backup_to: nope\narchivedir: " + dir + "\nretain: 7\nclusters:\n  main: {}\n", true, 3},
+		{"cluster removed", "backup_to: file\narchivedir: " + dir + "\nretain: 7\n", true, 3},
+		// The cluster section no longer sets retain, the new global value is used
+		{"valid", "backup_to: file\narchivedir: " + dir + "\nretain: 6\nclusters:\n  main: {}\n", false, 6},
+	}
+	for _, test := range tests {
+		write(test.config)
+		err := reloadConfig()
+		if test.err != (err != nil) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+		}
+		if retain := viper.GetInt("retain"); retain != test.retain {
+			t.Errorf("%s: retain is %d, expected %d", test.name, retain, test.retain)
+		}
+		if backend := viper.GetString("backup_to"); backend != "file" {
+			t.Errorf("%s: backup_to is %q", test.name, backend)
+		}
+		if selectedSection != "main" {
+			t.Errorf("%s: cluster section %q is used", test.name, selectedSection)
+		}
+	}
+}
@@ -0,0 +1,523 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+const (
+	apiPrefix = "/api/v1"
+)
+
+// apiBackup is the representation of a backup in the API
+type apiBackup struct {
+	Name             string    `json:"name"`
+	Extension        string    `json:"extension"`
+	Size             int64     `json:"size"`
+	Created          time.Time `json:"created"`
+	Sane             bool      `json:"sane"`
+	Cluster          string    `json:"cluster"`
+	StorageType      string    `json:"storage_type"`
+	StartWalLocation string    `json:"start_wal_location,omitempty"`
+}
+
+// apiWalRange is a continuous range (or gap) of WAL files in the API
+type apiWalRange struct {
+	Timeline string `json:"timeline"`
+	First    string `json:"first"`
+	Last     string `json:"last"`
+	Count    uint64 `json:"count"`
+}
+
+// apiTimeline is the coverage of the WAL archive
+type apiTimeline struct {
+	Ranges []apiWalRange `json:"ranges"`
+	Gaps   []apiWalRange `json:"gaps"`
+}
+
+// apiWal is the representation of a WAL file in the API
+type apiWal struct {
+	Name      string `json:"name"`
+	Extension string `json:"extension"`
+	Size      int64  `json:"size"`
+	Type      string `json:"type"`
+	Sane      bool   `json:"sane"`
+}
+
+// apiStatus is the status of the server and the backups
+type apiStatus struct {
+	Version      string     `json:"version"`
+	GitHash      string     `json:"git_hash"`
+	Hostname     string     `json:"hostname"`
+	ClusterName  string     `json:"cluster_name"`
+	Started      time.Time  `json:"started"`
+	Backups      int        `json:"backups"`
+	LatestBackup *apiBackup `json:"latest_backup,omitempty"`
+	RunningJob   *job       `json:"running_job,omitempty"`
+}
+
+// apiServer serves the REST API
+type apiServer struct {
+	token string
+	jobs  *jobQueue
+}
+
+var (
+	// serveCmd represents the serve command
+	serveCmd = &cobra.Command{
+		Use:   "serve",
+		Short: "Serves a REST API to manage the backups",
+		Long: `Serves an authenticated REST API (via TLS) to manage the backups.
+	Every request needs the header "Authorization: Bearer <api_token>".
+	Jobs started via the API run one after the other and take the same locks as the CLI.
+	A web interface showing the health of the backups is served on "/".
+
+	GET  ` + apiPrefix + `/status            Status of the server and the backups
+	GET  ` + apiPrefix + `/backups           List all backups
+	GET  ` + apiPrefix + `/backups/NAME      Show details of a backup
+	POST ` + apiPrefix + `/backups           Start a basebackup
+	GET  ` + apiPrefix + `/wal               List all WAL files
+	GET  ` + apiPrefix + `/timeline          Continuous ranges and gaps in the WAL archive
+	POST ` + apiPrefix + `/cleanup           Start a cleanup (enforces the retention policy), add ?dry_run=true to only show what would be deleted
+	POST ` + apiPrefix + `/restore           Start a restore {"backup": NAME, "destination": PATH, "force": false}
+	                                     into a directory below api_restore_root, force needs api_restore_force
+	GET  ` + apiPrefix + `/jobs              List all jobs
+	GET  ` + apiPrefix + `/jobs/ID           Show a job
+	GET  ` + apiPrefix + `/jobs/ID/log       Stream the log of a job`,
+		Annotations: map[string]string{annotationLongRunning: "", annotationWritesRepository: ""},
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runServer(); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+)
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+	serveCmd.PersistentFlags().String("api_listen", "127.0.0.1:8443", "Address to serve the API on")
+	serveCmd.PersistentFlags().String("api_token", "", "Token needed to access the API")
+	serveCmd.PersistentFlags().String("api_tls_cert", "", "TLS certificate file for the API")
+	serveCmd.PersistentFlags().String("api_tls_key", "", "TLS key file for the API")
+	serveCmd.PersistentFlags().Bool("api_insecure", false, "Serve the API without TLS (not recommended)")
+	serveCmd.PersistentFlags().String("api_restore_root", "", "Directory the API may restore into (below it), restores are disabled if not set")
+	serveCmd.PersistentFlags().Bool("api_restore_force", false, "Allow restores via the API to overwrite existing destinations")
+
+	// Bind flags to viper
+	bindSetting("api_listen", serveCmd.PersistentFlags().Lookup("api_listen"))
+	bindSetting("api_token", serveCmd.PersistentFlags().Lookup("api_token"))
+	bindSetting("api_tls_cert", serveCmd.PersistentFlags().Lookup("api_tls_cert"))
+	bindSetting("api_tls_key", serveCmd.PersistentFlags().Lookup("api_tls_key"))
+	bindSetting("api_insecure", serveCmd.PersistentFlags().Lookup("api_insecure"))
+	bindSetting("api_restore_root", serveCmd.PersistentFlags().Lookup("api_restore_root"))
+	bindSetting("api_restore_force", serveCmd.PersistentFlags().Lookup("api_restore_force"))
+}
+
+// runServer serves the API until it fails
+func runServer() (err error) {
+	token := viper.GetString("api_token")
+	if token == "" {
+		return errors.New("api_token is not set, the API can not be used without authentication")
+	}
+	listen := viper.GetString("api_listen")
+	cert := viper.GetString("api_tls_cert")
+	key := viper.GetString("api_tls_key")
+
+	s := &apiServer{token: token, jobs: newJobQueue()}
+	server := &http.Server{
+		Addr:      listen,
+		Handler:   s.routes(),
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+
+	if (cert == "" || key == "") && !viper.GetBool("api_insecure") {
+		return errors.New("api_tls_cert and api_tls_key are needed, set api_insecure to serve without TLS")
+	}
+
+	// Stop on SIGINT or SIGTERM, the running job is cancelled by its own signal handling
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Info("Received ", sig, ", shutting down")
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Warn("Can not shut down the API server: ", err)
+		}
+	}()
+
+	if cert == "" || key == "" {
+		log.Warn("Serving the API without TLS on http://", listen)
+		err = server.ListenAndServe()
+	} else {
+		log.Info("Serving the API on https://", listen)
+		err = server.ListenAndServeTLS(cert, key)
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	s.jobs.shutdown()
+	return nil
+}
+
+// routes returns the handler for the web interface and all API endpoints
+// The web interface contains no data, it asks for the token and uses the API
+func (s *apiServer) routes() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc(apiPrefix+"/status", s.handleStatus)
+	api.HandleFunc(apiPrefix+"/backups", s.handleBackups)
+	api.HandleFunc(apiPrefix+"/backups/", s.handleBackup)
+	api.HandleFunc(apiPrefix+"/wal", s.handleWal)
+	api.HandleFunc(apiPrefix+"/cleanup", s.handleCleanup)
+	api.HandleFunc(apiPrefix+"/restore", s.handleRestore)
+	api.HandleFunc(apiPrefix+"/jobs", s.handleJobs)
+	api.HandleFunc(apiPrefix+"/jobs/", s.handleJob)
+	api.HandleFunc(apiPrefix+"/timeline", s.handleTimeline)
+
+	mux := http.NewServeMux()
+	mux.Handle(apiPrefix+"/", s.requireToken(api))
+	mux.HandleFunc("/", handleWebUI)
+	return mux
+}
+
+// requireToken rejects all requests without the right bearer token
+func (s *apiServer) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		given := strings.TrimPrefix(auth, "Bearer ")
+		if given == auth || subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) != 1 {
+			log.Warn("Unauthorized API request from ", r.RemoteAddr, " to ", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+myName+`"`)
+			writeError(w, http.StatusUnauthorized, errors.New("Invalid or missing token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn("Can not write API response: ", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// allowMethod returns false and writes an error if the request method is not allowed
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+	return false
+}
+
+func newAPIBackup(b backup.Backup) apiBackup {
+	return apiBackup{
+		Name:        b.Name,
+		Extension:   b.Extension,
+		Size:        b.Size,
+		Created:     b.Created,
+		Sane:        b.IsSane(),
+		Cluster:     b.ClusterName(),
+		StorageType: viper.GetString("backup_to"),
+	}
+}
+
+func (s *apiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	status := apiStatus{
+		Version:     Version,
+		GitHash:     GitHash,
+		Hostname:    hostname,
+		ClusterName: clusterName,
+		Started:     startTime,
+		Backups:     backups.Len(),
+		RunningJob:  s.jobs.running(),
+	}
+	if newest := backups.NewestBackup(); newest != nil {
+		latest := newAPIBackup(*newest)
+		status.LatestBackup = &latest
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *apiServer) handleBackups(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "POST" {
+		s.submit(w, "basebackup", nil, runBasebackup)
+		return
+	}
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	list := []apiBackup{}
+	for _, b := range backups.Backup {
+		list = append(list, newAPIBackup(b))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *apiServer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, apiPrefix+"/backups/")
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	b, err := backups.Find(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	details := newAPIBackup(*b)
+	b.StorageType = viper.GetString("backup_to")
+	if details.StartWalLocation, err = storage.GetStartWalLocation(viper.GetViper(), b); err != nil {
+		log.Warn("Can not get start WAL location for ", name, ": ", err)
+	}
+	writeJSON(w, http.StatusOK, details)
+}
+
+func (s *apiServer) handleWal(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	archive, err := storage.GetWals(viper.GetViper())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	archive.SortAsc()
+	list := []apiWal{}
+	for _, wal := range archive.WalFiles {
+		list = append(list, apiWal{
+			Name:      wal.Name,
+			Extension: wal.Extension,
+			Size:      wal.Size,
+			Type:      wal.Type.String(),
+			Sane:      wal.IsSane(),
+		})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *apiServer) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	archive, err := storage.GetWals(viper.GetViper())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	timeline := apiTimeline{Ranges: []apiWalRange{}, Gaps: []apiWalRange{}}
+	for _, r := range archive.Ranges() {
+		timeline.Ranges = append(timeline.Ranges, apiWalRange(r))
+	}
+	for _, g := range archive.Gaps() {
+		timeline.Gaps = append(timeline.Gaps, apiWalRange(g))
+	}
+	writeJSON(w, http.StatusOK, timeline)
+}
+
+func (s *apiServer) handleCleanup(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	// The API call is the confirmation, there is nobody to ask
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	args := map[string]string{"dry_run": strconv.FormatBool(dryRun)}
+	s.submit(w, "cleanup", args, func() error { return runCleanup(true, dryRun) })
+}
+
+func (s *apiServer) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "POST") {
+		return
+	}
+	var req struct {
+		Backup      string `json:"backup"`
+		Destination string `json:"destination"`
+		Force       bool   `json:"force"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Backup == "" || !filepath.IsAbs(req.Destination) {
+		writeError(w, http.StatusBadRequest, errors.New("backup and an absolute destination are needed"))
+		return
+	}
+	// Restores run as the database user, the API must not overwrite the live data directory
+	if req.Force && !viper.GetBool("api_restore_force") {
+		writeError(w, http.StatusForbidden, errors.New("force is not allowed via the API, set api_restore_force to allow it"))
+		return
+	}
+	destination, err := apiRestoreDestination(req.Destination)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	args := map[string]string{"backup": req.Backup, "destination": destination}
+	s.submit(w, "restore", args, func() error {
+		return runRestore(req.Backup, destination, req.Force)
+	})
+}
+
+// apiRestoreDestination returns the destination of a restore via the API with all symlinks resolved.
+// It has to be below api_restore_root and must not be the configured data directory
+func apiRestoreDestination(destination string) (string, error) {
+	if viper.GetString("api_restore_root") == "" {
+		return "", errors.New("api_restore_root is not set, restores via the API are disabled")
+	}
+	root, err := resolvePath(viper.GetString("api_restore_root"))
+	if err != nil {
+		return "", fmt.Errorf("Can not resolve api_restore_root: %v", err)
+	}
+	resolved, err := resolvePath(destination)
+	if err != nil {
+		return "", fmt.Errorf("Can not resolve the destination: %v", err)
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("The destination %s is not below api_restore_root %s", destination, root)
+	}
+	if pgData := viper.GetString("pgdata"); pgData != "" {
+		if data, err := resolvePath(os.ExpandEnv(pgData)); err == nil && data == resolved {
+			return "", fmt.Errorf("The destination %s is the data directory of the cluster", destination)
+		}
+	}
+	return resolved, nil
+}
+
+// resolvePath returns the absolute, clean path with all symlinks resolved, the path does not need to exist.
+// The symlinks of the longest existing part are resolved, the rest is appended
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(path)
+		if !os.IsNotExist(err) || parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// submit queues a job and returns it to the client
+func (s *apiServer) submit(w http.ResponseWriter, jobType string, args map[string]string, run func() error) {
+	j, err := s.jobs.submit(jobType, args, run)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	w.Header().Set("Location", apiPrefix+"/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, j)
+}
+
+func (s *apiServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	jobs := s.jobs.list()
+	if jobs == nil {
+		jobs = []job{}
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (s *apiServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, "GET") {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix+"/jobs/")
+	id := strings.TrimSuffix(path, "/log")
+	j, ok := s.jobs.get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("Job not found: "+id))
+		return
+	}
+	if id == path {
+		writeJSON(w, http.StatusOK, j)
+		return
+	}
+	s.streamLog(w, r, id)
+}
+
+// streamLog writes the log of a job and follows it until the job is finished
+func (s *apiServer) streamLog(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	flusher, _ := w.(http.Flusher)
+	sent := 0
+	for {
+		lines, finished, _ := s.jobs.logLines(id, sent)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+		sent += len(lines)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if finished {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestAPIRestoreDestination(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Resolve the temporary directory itself, it may be a symlink (e.g. on macOS)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "restores")
+	data := filepath.Join(root, "data")
+	for _, d := range []string{root, data, filepath.Join(dir, "outside")} {
+		if err = os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink(filepath.Join(dir, "outside"), filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range map[string]string{"api_restore_root": root, "pgdata": data} {
+		old := viper.GetString(key)
+		viper.Set(key, value)
+		defer viper.Set(key, old)
+	}
+
+	tests := []struct {
+		destination string
+		resolved    string
+		ok          bool
+	}{
+		{filepath.Join(root, "new"), filepath.Join(root, "new"), true},
+		{filepath.Join(root, "new", "nested"), filepath.Join(root, "new", "nested"), true},
+		{root, "", false},
+		{dir, "", false},
+		{filepath.Join(root, "..", "outside"), "", false},
+		{filepath.Join(root, "escape"), "", false},
+		{filepath.Join(root, "escape", "new"), "", false},
+		{data, "", false},
+		{"/", "", false},
+	}
+	for _, test := range tests {
+		resolved, err := apiRestoreDestination(test.destination)
+		if test.ok != (err == nil) {
+			t.Errorf("%s: ok is %t, expected %t (%v)", test.destination, err == nil, test.ok, err)
+			continue
+		}
+		if test.ok && resolved != test.resolved {
+			t.Errorf("%s: resolved to %s, expected %s", test.destination, resolved, test.resolved)
+		}
+	}
+
+	// Without api_restore_root the API does not restore at all
+	viper.Set("api_restore_root", "")
+	if _, err = apiRestoreDestination(filepath.Join(root, "new")); err == nil {
+		t.Error("restore allowed without api_restore_root")
+	}
+}
+
+func TestAPIRestoreForce(t *testing.T) {
+	s := &apiServer{token: "secret", jobs: newJobQueue()}
+	defer s.jobs.shutdown()
+	server := httptest.NewServer(s.routes())
+	defer server.Close()
+
+	old := viper.GetBool("api_restore_force")
+	viper.Set("api_restore_force", false)
+	defer viper.Set("api_restore_force", old)
+
+	body := []byte(`{"backup": "main@2017-01-02T03:04:05Z", "destination": "/var/lib/postgresql/data", "force": true}`)
+	req, err := http.NewRequest("POST", server.URL+apiPrefix+"/restore", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("restore with force returned %d, expected %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if jobs := s.jobs.list(); len(jobs) != 0 {
+		t.Errorf("%d jobs were submitted", len(jobs))
+	}
+}
@@ -67,8 +67,14 @@ var (
 		Run: func(cmd *cobra.Command, args []string) {
 			log.Info("Run Setup")
 
+			unlock, err := lockLocal(lockClassSetup, "")
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer unlock()
+
 			// Check if needed tools are available
-			err := testTools(setupTools)
+			err = testTools(setupTools)
 			util.Check(err)
 
 			// When no archive command set, set it
@@ -78,6 +84,9 @@ var (
 				if viper.ConfigFileUsed() != "" {
 					configOption = " --config " + viper.ConfigFileUsed()
 				}
+				if selectedSection != "" {
+					configOption += " --cluster " + selectedSection
+				}
 
 				// Preset archive_command
 				viper.Set("archive_command", myExecutable+configOption+" archive %p")
@@ -134,6 +143,13 @@ var (
 			err = createDirs(archiveDir, subDirs)
 			util.Check(err)
 
+			// A new repository gets its metadata before the first WAL file is archived
+			if _, found, err := loadRepository(); err == nil && !found {
+				if err = runRepoInit(); err != nil {
+					log.Warn("Can not initialize the repository: ", err)
+				}
+			}
+
 			// Configure PostgreSQL for archiving
 			log.Info("Configure PostgreSQL for archiving.")
 			changed, _ := configurePostgreSQL(db, pgSettings)
@@ -159,6 +175,7 @@ var (
 			log.Info("PostgreSQL is configured for archiving.")
 			printDone()
 		},
+		Annotations: map[string]string{annotationNoRepository: ""},
 	}
 )
 
@@ -174,11 +191,11 @@ func init() {
 	setupCmd.PersistentFlags().Bool("check", false, "Perform only a dry run without doing changes")
 
 	// Bind flags to viper
-	viper.BindPFlag("archive_command", setupCmd.PersistentFlags().Lookup("archive_command"))
-	viper.BindPFlag("archive_mode", setupCmd.PersistentFlags().Lookup("archive_mode"))
-	viper.BindPFlag("wal_level", setupCmd.PersistentFlags().Lookup("wal_level"))
-	viper.BindPFlag("max_wal_senders", setupCmd.PersistentFlags().Lookup("max_wal_senders"))
-	viper.BindPFlag("check", setupCmd.PersistentFlags().Lookup("check"))
+	bindSetting("archive_command", setupCmd.PersistentFlags().Lookup("archive_command"))
+	bindSetting("archive_mode", setupCmd.PersistentFlags().Lookup("archive_mode"))
+	bindSetting("wal_level", setupCmd.PersistentFlags().Lookup("wal_level"))
+	bindSetting("max_wal_senders", setupCmd.PersistentFlags().Lookup("max_wal_senders"))
+	bindSetting("check", setupCmd.PersistentFlags().Lookup("check"))
 }
 
 // pgRestartDB is called when PostgreSQL needs a restart
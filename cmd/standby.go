@@ -0,0 +1,250 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+)
+
+// primaryCluster is the connection to the primary of a standby
+type primaryCluster struct {
+	conninfo string
+	db       *sql.DB
+	// systemID is the system identifier of the primary, 0 if it is unknown
+	systemID uint64
+}
+
+// connectPrimary connects to the primary and gets its system identifier
+func connectPrimary(conninfo string) (primary *primaryCluster, err error) {
+	if conninfo == "" {
+		return nil, errors.New("A standby needs --primary-conninfo")
+	}
+	db, err := sql.Open("postgres", primarySQLConnection(conninfo))
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Can not connect to the primary: %v", err)
+	}
+	primary = &primaryCluster{conninfo: conninfo, db: db}
+
+	// pg_control_system() is available since PostgreSQL 9.6
+	var id string
+	err = db.QueryRow("SELECT system_identifier::text FROM pg_control_system()").Scan(&id)
+	if err != nil {
+		log.Warn("Can not get the system identifier of the primary, it is not checked: ", err)
+		return primary, nil
+	}
+	if primary.systemID, err = strconv.ParseUint(id, 10, 64); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Invalid system identifier of the primary %q: %v", id, err)
+	}
+	log.Debug("System identifier of the primary: ", primary.systemID)
+	return primary, nil
+}
+
+// Close closes the connection to the primary
+func (p *primaryCluster) Close() {
+	p.db.Close()
+}
+
+// primarySQLConnection returns the connection string for SQL on the primary.
+// primary_conninfo has no database in most cases, then the postgres database is used
+func primarySQLConnection(conninfo string) string {
+	if strings.Contains(conninfo, "://") || strings.Contains(conninfo, "dbname=") {
+		return conninfo
+	}
+	return conninfo + " dbname=postgres"
+}
+
+// createSlot creates the physical replication slot on the primary, an existing slot is used
+func (p *primaryCluster) createSlot(slot string) (err error) {
+	var exists bool
+	err = p.db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)", slot).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Info("Replication slot ", slot, " exists on the primary")
+		return nil
+	}
+	if _, err = p.db.Exec("SELECT pg_create_physical_replication_slot($1)", slot); err != nil {
+		return fmt.Errorf("Can not create replication slot %s on the primary: %v", slot, err)
+	}
+	log.Info("Created replication slot ", slot, " on the primary")
+	return nil
+}
+
+// systemIDFromPgData reads the system identifier from the control file of the cluster in pgData.
+// It is the first field of pg_control, written in the byte order of the machine
+func systemIDFromPgData(pgData string) (id uint64, err error) {
+	raw, order, err := readPgControl(pgData)
+	if err != nil {
+		return 0, err
+	}
+	return order.Uint64(raw), nil
+}
+
+// readPgControl returns the start of global/pg_control in pgData (system identifier and pg_control_version)
+// and the byte order of the cluster. It is detected with pg_control_version (e.g. 1300), which is small in the right order
+func readPgControl(pgData string) (raw []byte, order binary.ByteOrder, err error) {
+	file, err := os.Open(filepath.Join(pgData, "global", "pg_control"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	raw = make([]byte, 12)
+	if _, err = io.ReadFull(file, raw); err != nil {
+		return nil, nil, fmt.Errorf("Can not read pg_control: %v", err)
+	}
+	order = binary.LittleEndian
+	if order.Uint32(raw[8:]) > 0xffff {
+		order = binary.BigEndian
+	}
+	return raw, order, nil
+}
+
+// configureStandby checks that the restored cluster in pgData belongs to the primary and
+// writes the standby settings, the slot is created on the primary if createSlot is set
+func configureStandby(pgData string, primary *primaryCluster, slot string, createSlot bool) (err error) {
+	if primary.systemID != 0 {
+		id, err := systemIDFromPgData(pgData)
+		if err != nil {
+			return fmt.Errorf("Can not get the system identifier of the backup: %v", err)
+		}
+		if id != primary.systemID {
+			return fmt.Errorf("Backup has system identifier %d, the primary has %d, the backup is not from this primary", id, primary.systemID)
+		}
+		log.Info("System identifier of the backup matches the primary: ", id)
+	}
+
+	settings := map[string]string{
+		"restore_command":          restoreCommand(),
+		"primary_conninfo":         primary.conninfo,
+		"recovery_target_timeline": "latest",
+	}
+	if slot != "" {
+		if createSlot {
+			if err = primary.createSlot(slot); err != nil {
+				return err
+			}
+		}
+		settings["primary_slot_name"] = slot
+	}
+	return writeRecoverySettings(pgData, settings, true)
+}
+
+// switchWal forces a WAL switch on the primary, so the current WAL segment is archived
+func (p *primaryCluster) switchWal() (err error) {
+	var inRecovery bool
+	var version int
+	err = p.db.QueryRow("SELECT pg_is_in_recovery(), current_setting('server_version_num')::int").Scan(&inRecovery, &version)
+	if err != nil {
+		return err
+	}
+	if inRecovery {
+		return errors.New("The server of primary-connection is in recovery, it can not switch the WAL")
+	}
+	query := "SELECT pg_switch_xlog()::text"
+	if version >= 100000 {
+		query = "SELECT pg_switch_wal()::text"
+	}
+	var lsn string
+	if err = p.db.QueryRow(query).Scan(&lsn); err != nil {
+		return err
+	}
+	log.Info("Switched the WAL on the primary at ", lsn)
+	return nil
+}
+
+// backupSource returns the server of the connection the backup is taken from, a hot standby is detected with pg_is_in_recovery()
+func backupSource(conString string) (source backup.Source, err error) {
+	db, err := sql.Open("postgres", conString)
+	if err != nil {
+		return source, err
+	}
+	defer db.Close()
+	var host sql.NullString
+	var port sql.NullInt64
+	err = db.QueryRow("SELECT pg_is_in_recovery(), inet_server_addr()::text, inet_server_port(), current_setting('cluster_name'), current_setting('server_version_num')::int").
+		Scan(&source.Standby, &host, &port, &source.ClusterName, &source.Version)
+	if err != nil {
+		return source, err
+	}
+	if err = checkSourceVersion(source.Version); err != nil {
+		return source, err
+	}
+	source.Host = strings.SplitN(host.String, "/", 2)[0]
+	source.Port = int(port.Int64)
+	// The server is on this host if it is connected through a unix socket
+	if source.Host == "" {
+		if source.Host, err = os.Hostname(); err != nil {
+			return source, err
+		}
+	}
+	return source, nil
+}
+
+// checkSourceVersion returns an error if no backup can be taken from a server with this version (server_version_num)
+func checkSourceVersion(version int) error {
+	if !isPgVersionSupported(version) {
+		return fmt.Errorf("Backups of PostgreSQL %d are not supported, supported are %d to %d", version, pgMinVersion, pgMaxVersion)
+	}
+	return nil
+}
+
+// prepareStandbyBackup connects to the primary of the standby (primary-connection) for the WAL switch at the end of the backup.
+// The primary has to be the primary of the same cluster. Without primary-connection nil is returned
+func prepareStandbyBackup(conString string) (primary *primaryCluster, err error) {
+	conninfo := viper.GetString("primary-connection")
+	if conninfo == "" {
+		log.Info("The last WAL segment of the backup is archived when the primary switches to the next one, set primary-connection to force it")
+		return nil, nil
+	}
+	if primary, err = connectPrimary(conninfo); err != nil {
+		return nil, err
+	}
+	if primary.systemID == 0 {
+		return primary, nil
+	}
+	id, err := clusterSystemID(conString)
+	if err == nil && id != strconv.FormatUint(primary.systemID, 10) {
+		err = fmt.Errorf("The standby has system identifier %s, the primary %d, they are not from the same cluster", id, primary.systemID)
+	}
+	if err != nil {
+		primary.Close()
+		return nil, err
+	}
+	return primary, nil
+}
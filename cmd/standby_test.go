@@ -0,0 +1,57 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import "testing"
+
+func TestCheckSourceVersion(t *testing.T) {
+	tests := []struct {
+		version int
+		ok      bool
+	}{
+		{90400, false},
+		{90500, true},
+		{120000, true},
+		{170002, true},
+		{180000, false},
+	}
+	for _, test := range tests {
+		if err := checkSourceVersion(test.version); (err == nil) != test.ok {
+			t.Errorf("checkSourceVersion(%d) = %v, supported %v expected", test.version, err, test.ok)
+		}
+	}
+}
+
+func TestPrimarySQLConnection(t *testing.T) {
+	tests := []struct {
+		conninfo string
+		want     string
+	}{
+		{"host=primary user=replication", "host=primary user=replication dbname=postgres"},
+		{"host=primary dbname=app", "host=primary dbname=app"},
+		{"postgres://primary/app", "postgres://primary/app"},
+	}
+	for _, test := range tests {
+		if got := primarySQLConnection(test.conninfo); got != test.want {
+			t.Errorf("primarySQLConnection(%q) = %q, want %q", test.conninfo, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows the state of the backups and the WAL archive",
+	Long: `Shows the number of backups, the newest backup with its age and the WAL archive with its gaps.
+	Use --all-clusters to show it for every cluster section of the config file.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := forEachConfiguredCluster(cmd, func() error {
+			status, err := clusterStatus(time.Now())
+			if err != nil {
+				return err
+			}
+			fmt.Print(status)
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		printDone()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(statusCmd)
+	addAllClustersFlag(statusCmd, "Show the status of every cluster section of the config file")
+}
+
+// clusterStatus returns the state of the backups and the WAL archive of the cluster in use
+func clusterStatus(now time.Time) (string, error) {
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	archive, err := storage.GetWals(viper.GetViper())
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintln(buf, "Cluster:", clusterName)
+	fmt.Fprintln(buf, "Backups:", backups.Len())
+	if newest := backups.NewestBackup(); newest != nil {
+		fmt.Fprintf(buf, "Newest backup: %s (%s, %s)\n", newest.Name, humanize.RelTime(newest.Created, now, "ago", "from now"), humanize.Bytes(uint64(newest.Size)))
+	}
+	fmt.Fprintln(buf, "WAL files:", len(archive.WalFiles))
+	for _, r := range archive.Ranges() {
+		fmt.Fprintf(buf, "WAL timeline %s: %s - %s (%d files)\n", r.Timeline, r.First, r.Last, r.Count)
+	}
+	for _, g := range archive.Gaps() {
+		fmt.Fprintf(buf, "WAL gap on timeline %s: %s - %s (%d files missing)\n", g.Timeline, g.First, g.Last, g.Count)
+	}
+	return buf.String(), nil
+}
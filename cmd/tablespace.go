@@ -0,0 +1,181 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+// tablespaceMapping maps the tablespaces of a backup to the locations they are restored to
+type tablespaceMapping struct {
+	byOID  map[string]string
+	byPath map[string]string
+	// baseDir is used for tablespaces without mapping, they are restored to baseDir/OID
+	// If it is empty they are restored to their original location
+	baseDir string
+}
+
+// parseTablespaceMapping parses mappings given as OID=/new/path or /old/path=/new/path
+func parseTablespaceMapping(specs []string) (m tablespaceMapping, err error) {
+	m.byOID = make(map[string]string)
+	m.byPath = make(map[string]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return m, fmt.Errorf("Invalid tablespace mapping %q, use OID=/new/path or /old/path=/new/path", spec)
+		}
+		// The symlinks in pg_tblspc need absolute paths
+		location, err := filepath.Abs(parts[1])
+		if err != nil {
+			return m, err
+		}
+		if _, err := strconv.ParseUint(parts[0], 10, 32); err == nil {
+			m.byOID[parts[0]] = location
+		} else {
+			m.byPath[filepath.Clean(parts[0])] = location
+		}
+	}
+	return m, nil
+}
+
+// location returns where the tablespace is restored to, oldPath is its location in the backup
+func (m tablespaceMapping) location(oid string, oldPath string) string {
+	if location, ok := m.byOID[oid]; ok {
+		return location
+	}
+	if oldPath != "" {
+		if location, ok := m.byPath[filepath.Clean(oldPath)]; ok {
+			return location
+		}
+	}
+	if m.baseDir != "" {
+		return filepath.Join(m.baseDir, oid)
+	}
+	return oldPath
+}
+
+// tablespaceLocations returns the locations of the tablespaces in the restored pgData,
+// from tablespace_map if there is one, from the symlinks in pg_tblspc otherwise
+func tablespaceLocations(pgData string) (locations map[string]string, hasMap bool, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(pgData, backup.TablespaceMapFile))
+	if err == nil {
+		locations, err = backup.ParseTablespaceMap(data)
+		return locations, true, err
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	locations = make(map[string]string)
+	files, err := ioutil.ReadDir(filepath.Join(pgData, backup.TablespaceDir))
+	if os.IsNotExist(err) {
+		return locations, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	for _, f := range files {
+		if f.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(pgData, backup.TablespaceDir, f.Name()))
+		if err != nil {
+			return nil, false, err
+		}
+		locations[f.Name()] = target
+	}
+	return locations, false, nil
+}
+
+// restoreTablespaces restores the tablespaces of the backup, the backup itself has to be restored to pgData already.
+// With delta the tablespaces are restored as delta (step is the position of b in the chain). The symlinks in pg_tblspc and tablespace_map point to the new locations afterwards
+func restoreTablespaces(b *backup.Backup, pgData string, opts restoreOptions, delta *deltaChain, step int) (err error) {
+	if len(b.Tablespaces) == 0 {
+		return nil
+	}
+	oldLocations, hasMap, err := tablespaceLocations(pgData)
+	if err != nil {
+		return err
+	}
+
+	locations := make(map[string]string)
+	for _, ts := range b.Tablespaces {
+		location := opts.Tablespaces.location(ts.OID, oldLocations[ts.OID])
+		if location == "" {
+			return fmt.Errorf("Location of tablespace %s is unknown, use --tablespace-map %s=/new/path", ts.OID, ts.OID)
+		}
+		if err = os.MkdirAll(location, 0700); err != nil {
+			return err
+		}
+		if empty, err := util.IsEmpty(location); (!empty || err != nil) && !opts.Force && !opts.Incremental && delta == nil {
+			return errors.New("Location of tablespace " + ts.OID + ", " + location + " is not an empty directory, you need to use force or delta")
+		}
+		if err = chownRestored(location); err != nil {
+			return err
+		}
+		skip, err := delta.destination(location, ts.OID, step)
+		if err != nil {
+			return err
+		}
+		log.Info("Going to restore tablespace ", ts.OID, " to: ", location)
+		if err = extractBackup(b.TablespaceBackup(ts), location, skip, opts); err != nil {
+			return err
+		}
+		locations[ts.OID] = location
+	}
+
+	// Point the symlinks to the new locations
+	for oid, location := range locations {
+		link := filepath.Join(pgData, backup.TablespaceDir, oid)
+		if err = os.MkdirAll(filepath.Dir(link), 0700); err != nil {
+			return err
+		}
+		if err = os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err = os.Symlink(location, link); err != nil {
+			return err
+		}
+		if oldLocations[oid] != location {
+			log.Info("Tablespace ", oid, " moved from ", oldLocations[oid], " to ", location)
+		}
+	}
+
+	// The recovery creates the symlinks from tablespace_map, so it has to match
+	if !hasMap {
+		return nil
+	}
+	tablespaceMap := filepath.Join(pgData, backup.TablespaceMapFile)
+	if err = ioutil.WriteFile(tablespaceMap, backup.MarshalTablespaceMap(locations), 0600); err != nil {
+		return err
+	}
+	return chownRestored(tablespaceMap)
+}
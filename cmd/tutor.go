@@ -29,7 +29,8 @@ var tutorCmd = &cobra.Command{
 	Short: "A small tutorial to demonstrate the usage",
 	Long: `This opens a tutorial do show the capabilities of this tool.
 	This is not a full reference but will show you how to setup an example configuration.`,
-	Run: tutor,
+	Run:         tutor,
+	Annotations: map[string]string{annotationNoRepository: ""},
 }
 
 func init() {
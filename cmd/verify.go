@@ -0,0 +1,372 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/storage"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [BACKUP]",
+	Short: "Checks that a backup can be restored",
+	Long: `Reads the backup like a restore does, but without writing anything to disk.
+	The backup is decrypted, inflated and the tar archive is parsed. The backup has to contain
+	backup_label and PG_VERSION, the checksums of the backup and of the files in the backup_manifest
+	(if there is one) have to match and the WAL files from the start WAL on have to be archived.
+	Use --all to verify every backup and --all-clusters to verify the backups of every cluster section of
+	the config file, both together verify every backup of every cluster.
+	The exit code is 1 if a backup failed the verification.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 1 {
+			log.Fatal("Too many arguments: ", args)
+		}
+		backupName := ""
+		if len(args) == 1 {
+			backupName = args[0]
+		}
+		err := forEachConfiguredCluster(cmd, func() error {
+			results, err := runVerify(backupName, viper.GetBool("verify-all"))
+			if err != nil {
+				return err
+			}
+			fmt.Print(verifySummary(results))
+			if failed := countFailed(results); failed > 0 {
+				return fmt.Errorf("%d of %d backup(s) failed the verification", failed, len(results))
+			}
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		printDone()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+	verifyCmd.PersistentFlags().Bool("all", false, "Verify all backups")
+	addAllClustersFlag(verifyCmd, "Verify the backups of every cluster section of the config file")
+
+	// Bind flags to viper
+	bindSetting("verify-all", verifyCmd.PersistentFlags().Lookup("all"))
+}
+
+// verifyResult is the result of the verification of one backup
+type verifyResult struct {
+	Backup   string
+	Files    int
+	Size     int64 // Size of the inflated data
+	Duration time.Duration
+	Problems []string
+}
+
+// fail adds a problem to the result
+func (r *verifyResult) fail(format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	log.Error(r.Backup, ": ", problem)
+	r.Problems = append(r.Problems, problem)
+}
+
+// OK returns true if no problem was found
+func (r *verifyResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// fileSums holds the size and the checksums of a file in the backup
+// pg_basebackup uses CRC32C by default, SHA256 is the common choice for stronger checksums
+type fileSums struct {
+	size   int64
+	crc32c hash.Hash32
+	sha256 hash.Hash
+}
+
+func newFileSums() *fileSums {
+	return &fileSums{crc32c: crc32.New(crc32.MakeTable(crc32.Castagnoli)), sha256: sha256.New()}
+}
+
+// Write adds data to the checksums
+func (s *fileSums) Write(p []byte) (n int, err error) {
+	s.crc32c.Write(p)
+	s.sha256.Write(p)
+	s.size += int64(len(p))
+	return len(p), nil
+}
+
+// sum returns the checksum with the given algorithm as it is written in the manifest
+func (s *fileSums) sum(algorithm string) (sum string, ok bool) {
+	switch strings.ToUpper(algorithm) {
+	case "CRC32C":
+		// PostgreSQL writes the CRC in native (little endian) byte order
+		raw := make([]byte, 4)
+		binary.LittleEndian.PutUint32(raw, s.crc32c.Sum32())
+		return hex.EncodeToString(raw), true
+	case "SHA256":
+		return hex.EncodeToString(s.sha256.Sum(nil)), true
+	}
+	return "", false
+}
+
+// runVerify verifies the named backup or all backups
+func runVerify(backupName string, all bool) (results []verifyResult, err error) {
+	if backupName == "" && !all {
+		return nil, errors.New("Backupname not set, use --all to verify all backups")
+	}
+
+	// Cleanup must not delete the backups or WAL files while they are verified
+	lock, err := acquireStorageLock(backup.LockShared, "verify")
+	if err != nil {
+		return nil, err
+	}
+	defer releaseStorageLock(lock, &err)
+
+	backups := storage.GetMyBackups(viper.GetViper(), subDirWal)
+	var toVerify []*backup.Backup
+	if all {
+		for i := range backups.Backup {
+			toVerify = append(toVerify, &backups.Backup[i])
+		}
+	} else {
+		b, err := backups.Find(backupName)
+		if err != nil {
+			return nil, err
+		}
+		toVerify = append(toVerify, b)
+	}
+	if len(toVerify) == 0 {
+		return nil, errors.New("No backups found")
+	}
+
+	archive, err := storage.GetWals(viper.GetViper())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range toVerify {
+		if err = lock.Err(); err != nil {
+			return results, err
+		}
+		results = append(results, verifyBackup(b, &archive))
+	}
+	return results, nil
+}
+
+// verifyBackup reads the backup and checks its content and the WAL files it needs
+func verifyBackup(b *backup.Backup, archive *backup.Archive) (result verifyResult) {
+	start := time.Now()
+	result.Backup = b.Name
+	defer func() { result.Duration = time.Since(start) }()
+	log.Info("Verify backup ", b.Name)
+
+	files := make(map[string]*fileSums)
+	var label, manifest []byte
+	objects, oids := backupObjects(b)
+	for i, object := range objects {
+		if object == b {
+			label, manifest = verifyTar(b, "", files, &result)
+			continue
+		}
+		// The manifest lists the files of the tablespaces below pg_tblspc
+		prefix := ""
+		if oids[i] != "" {
+			prefix = path.Join(backup.TablespaceDir, oids[i])
+		}
+		verifyTar(object, prefix, files, &result)
+	}
+
+	if files["PG_VERSION"] == nil {
+		result.fail("PG_VERSION is missing")
+	}
+	if label == nil {
+		result.fail("backup_label is missing")
+	} else {
+		verifyWalChain(b, label, archive, &result)
+	}
+
+	if manifest == nil {
+		log.Info(b.Name, ": no ", backup.ManifestFile, ", the checksums of the files are not checked")
+	} else {
+		verifyManifest(manifest, files, &result)
+	}
+
+	if result.OK() {
+		log.Info("Backup ", b.Name, " is OK")
+	}
+	return result
+}
+
+// verifyTar reads every file of the tar archive of the backup (or a tablespace of it) and adds its checksums to files,
+// the names get the given prefix. The content is only kept for backup_label and the manifest
+func verifyTar(b *backup.Backup, prefix string, files map[string]*fileSums, result *verifyResult) (label []byte, manifest []byte) {
+	reader, err := openBackup(b)
+	if err != nil {
+		result.fail("Can not read %s: %v", b.Name, err)
+		return nil, nil
+	}
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			result.fail("Invalid tar archive: %v", err)
+			break
+		}
+		result.Files++
+		name := path.Join(prefix, path.Clean(strings.TrimPrefix(header.Name, "./")))
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		sums := newFileSums()
+		var content bytes.Buffer
+		var target io.Writer = sums
+		if name == "backup_label" || name == backup.ManifestFile {
+			target = io.MultiWriter(sums, &content)
+		}
+		if _, err = io.Copy(target, tarReader); err != nil {
+			result.fail("Can not read %s: %v", name, err)
+			break
+		}
+		result.Size += sums.size
+		files[name] = sums
+		switch name {
+		case "backup_label":
+			label = content.Bytes()
+		case backup.ManifestFile:
+			manifest = content.Bytes()
+		}
+	}
+
+	// Read the rest and wait for the processes, afterwards the checksums are complete
+	if err = reader.Close(); err != nil {
+		result.fail("%v", err)
+	}
+	verified, err := reader.Verify()
+	if err != nil {
+		result.fail("%v", err)
+	} else if !verified {
+		log.Warn(b.Name, ": no checksums stored, only the content is checked")
+	}
+	return label, manifest
+}
+
+// verifyWalChain checks that the WAL files from the start WAL on are archived without gaps
+func verifyWalChain(b *backup.Backup, label []byte, archive *backup.Archive, result *verifyResult) {
+	if _, err := backup.ParseBackupLabel(b, label); err != nil {
+		result.fail("Invalid backup_label: %v", err)
+		return
+	}
+	chain, gaps, err := archive.Chain(b.StartWalLocation)
+	if err != nil {
+		result.fail("%v", err)
+		return
+	}
+	log.Infof("%s: %d WAL file(s) from %s to %s are archived", b.Name, chain.Count, chain.First, chain.Last)
+	for _, gap := range gaps {
+		result.fail("%d WAL file(s) from %s to %s are missing", gap.Count, gap.First, gap.Last)
+	}
+}
+
+// verifyManifest compares the files of the backup with the manifest
+func verifyManifest(data []byte, files map[string]*fileSums, result *verifyResult) {
+	manifest, err := backup.ParseManifest(data)
+	if err != nil {
+		result.fail("%v", err)
+		return
+	}
+	checked := 0
+	for _, f := range manifest.Files {
+		name := f.Name()
+		sums, ok := files[name]
+		if !ok {
+			result.fail("%s is listed in the manifest but missing", name)
+			continue
+		}
+		if sums.size != f.Size {
+			result.fail("%s has size %d, expected %d", name, sums.size, f.Size)
+			continue
+		}
+		if f.Algorithm == "" || strings.ToUpper(f.Algorithm) == "NONE" {
+			continue
+		}
+		sum, ok := sums.sum(f.Algorithm)
+		if !ok {
+			log.Debug("Checksum algorithm ", f.Algorithm, " is not supported, only the size of ", name, " is checked")
+			continue
+		}
+		if sum != f.Checksum {
+			result.fail("%s has %s checksum %s, expected %s", name, f.Algorithm, sum, f.Checksum)
+			continue
+		}
+		checked++
+	}
+	log.Infof("%s: %d of %d file(s) in the manifest have matching checksums", result.Backup, checked, len(manifest.Files))
+}
+
+// countFailed returns the number of backups that failed the verification
+func countFailed(results []verifyResult) (failed int) {
+	for _, r := range results {
+		if !r.OK() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// verifySummary returns an overview of the results
+func verifySummary(results []verifyResult) string {
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(w, "BACKUP\tRESULT\tFILES\tSIZE\tDURATION\tPROBLEMS")
+	for _, r := range results {
+		state := "OK"
+		if !r.OK() {
+			state = "FAILED"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d\n", r.Backup, state, r.Files,
+			humanize.Bytes(uint64(r.Size)), r.Duration-r.Duration%time.Millisecond, len(r.Problems))
+	}
+	w.Flush()
+	return buf.String()
+}
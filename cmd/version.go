@@ -34,6 +34,7 @@ var versionCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		log.Info("pgglaskugel version " + Version + ", git hash " + GitHash)
 	},
+	Annotations: map[string]string{annotationNoRepository: ""},
 }
 
 func init() {
@@ -0,0 +1,337 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"net/http"
+)
+
+// The web interface is compiled into the binary, it only talks to the API
+
+// handleWebUI serves the static files of the web interface
+func handleWebUI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		allowMethod(w, r, "GET", "HEAD")
+		return
+	}
+
+	var content, contentType string
+	switch r.URL.Path {
+	case "/", "/index.html":
+		content, contentType = webUIIndex, "text/html; charset=utf-8"
+	case "/app.js":
+		content, contentType = webUIScript, "application/javascript; charset=utf-8"
+	case "/style.css":
+		content, contentType = webUIStyle, "text/css; charset=utf-8"
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(content))
+}
+
+const webUIIndex = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>pgGlaskugel</title>
+<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+<header>
+  <h1>pgGlaskugel</h1>
+  <span id="info"></span>
+  <button id="logout" class="link">Logout</button>
+</header>
+
+<form id="login" hidden>
+  <label for="token">API token</label>
+  <input id="token" type="password" autocomplete="current-password" required>
+  <button type="submit">Login</button>
+  <p id="login-error" class="error"></p>
+</form>
+
+<main id="main" hidden>
+  <section>
+    <h2>Actions</h2>
+    <button id="start-backup">Start backup</button>
+    <button id="start-cleanup">Cleanup (dry run)</button>
+    <span id="action-result"></span>
+  </section>
+
+  <section>
+    <h2>Backups</h2>
+    <div id="backups"></div>
+  </section>
+
+  <section>
+    <h2>WAL archive</h2>
+    <div id="timeline"></div>
+    <ul id="gaps"></ul>
+  </section>
+
+  <section>
+    <h2>Jobs</h2>
+    <table id="jobs">
+      <thead><tr><th>ID</th><th>Type</th><th>State</th><th>Created</th><th>Duration</th><th>Error</th><th></th></tr></thead>
+      <tbody></tbody>
+    </table>
+    <pre id="log" hidden></pre>
+  </section>
+</main>
+<script src="/app.js"></script>
+</body>
+</html>
+`
+
+const webUIStyle = `body { font-family: sans-serif; margin: 0; color: #222; background: #f6f6f6; }
+header { display: flex; align-items: center; gap: 1em; padding: 0.5em 1em; background: #336791; color: #fff; }
+header h1 { font-size: 1.3em; margin: 0; }
+header #info { flex: 1; }
+main, form { padding: 0 1em 1em 1em; }
+section { background: #fff; margin: 1em 0; padding: 0.5em 1em 1em 1em; border-radius: 4px; }
+h2 { font-size: 1.1em; }
+h3 { font-size: 1em; margin-bottom: 0.3em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.2em 0.5em; border-bottom: 1px solid #ddd; }
+button { margin-right: 0.5em; }
+button.link { background: none; border: none; color: inherit; text-decoration: underline; cursor: pointer; }
+.ok { color: #2a7d2a; }
+.error, .failed { color: #b00020; }
+.running, .queued { color: #a06000; }
+.bar { position: relative; height: 1.5em; background: #eee; margin-bottom: 0.3em; }
+.bar div { position: absolute; top: 0; bottom: 0; min-width: 2px; }
+.bar .range { background: #2a7d2a; }
+.bar .gap { background: #b00020; }
+pre { background: #222; color: #eee; padding: 0.5em; max-height: 30em; overflow: auto; }
+`
+
+const webUIScript = `"use strict";
+
+var tokenKey = "pgglaskugel-token";
+var api = "/api/v1";
+
+function $(id) { return document.getElementById(id); }
+
+function el(tag, text, cls) {
+  var e = document.createElement(tag);
+  if (text !== undefined && text !== null) { e.textContent = text; }
+  if (cls) { e.className = cls; }
+  return e;
+}
+
+function request(method, path) {
+  return fetch(api + path, {
+    method: method,
+    headers: { "Authorization": "Bearer " + sessionStorage.getItem(tokenKey) }
+  }).then(function (resp) {
+    if (resp.status === 401) {
+      showLogin("Invalid token");
+      throw new Error("unauthorized");
+    }
+    return resp;
+  });
+}
+
+function getJSON(path) {
+  return request("GET", path).then(function (resp) { return resp.json(); });
+}
+
+function bytes(n) {
+  var units = ["B", "kB", "MB", "GB", "TB", "PB"];
+  var i = 0;
+  while (n >= 1000 && i < units.length - 1) { n /= 1000; i++; }
+  return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function age(date) {
+  var s = (Date.now() - new Date(date).getTime()) / 1000;
+  if (s < 3600) { return Math.floor(s / 60) + " min"; }
+  if (s < 172800) { return Math.floor(s / 3600) + " h"; }
+  return Math.floor(s / 86400) + " days";
+}
+
+// Position of a WAL file in its timeline, with 16MB segments
+function segment(name) {
+  return parseInt(name.substr(8, 8), 16) * 256 + parseInt(name.substr(16, 8), 16);
+}
+
+function showLogin(message) {
+  $("main").hidden = true;
+  $("login").hidden = false;
+  $("login-error").textContent = message || "";
+}
+
+function renderStatus(status) {
+  var text = status.cluster_name + " on " + status.hostname + " (pgGlaskugel " + status.version + ")";
+  if (status.running_job) { text += " - running: " + status.running_job.type; }
+  $("info").textContent = text;
+}
+
+function renderBackups(backups) {
+  var clusters = {};
+  backups.forEach(function (b) { (clusters[b.cluster] = clusters[b.cluster] || []).push(b); });
+  var root = $("backups");
+  root.textContent = "";
+  if (!backups.length) { root.appendChild(el("p", "No backups found!", "error")); }
+  Object.keys(clusters).sort().forEach(function (cluster) {
+    var list = clusters[cluster];
+    var newest = list.reduce(function (a, b) { return a.created > b.created ? a : b; });
+    root.appendChild(el("h3", (cluster || "unknown cluster") + " - last backup " + age(newest.created) + " ago"));
+    var table = el("table");
+    var head = el("tr");
+    ["Name", "Size", "Age", "Sane"].forEach(function (h) { head.appendChild(el("th", h)); });
+    table.appendChild(head);
+    list.forEach(function (b) {
+      var row = el("tr");
+      row.appendChild(el("td", b.name + b.extension));
+      row.appendChild(el("td", bytes(b.size)));
+      row.appendChild(el("td", age(b.created)));
+      row.appendChild(el("td", b.sane ? "yes" : "NO", b.sane ? "ok" : "error"));
+      table.appendChild(row);
+    });
+    root.appendChild(table);
+  });
+}
+
+function renderTimeline(timeline) {
+  var root = $("timeline");
+  var gaps = $("gaps");
+  root.textContent = "";
+  gaps.textContent = "";
+  var timelines = {};
+  timeline.ranges.forEach(function (r) { (timelines[r.timeline] = timelines[r.timeline] || []).push(["range", r]); });
+  timeline.gaps.forEach(function (g) { timelines[g.timeline].push(["gap", g]); });
+  if (!timeline.ranges.length) { root.appendChild(el("p", "No WAL files archived!", "error")); }
+  Object.keys(timelines).sort().forEach(function (tl) {
+    var parts = timelines[tl];
+    var min = Math.min.apply(null, parts.map(function (p) { return segment(p[1].first); }));
+    var max = Math.max.apply(null, parts.map(function (p) { return segment(p[1].last); }));
+    var span = Math.max(max - min + 1, 1);
+    root.appendChild(el("div", "Timeline " + tl));
+    var bar = el("div", null, "bar");
+    parts.forEach(function (p) {
+      var part = el("div", null, p[0]);
+      part.style.left = ((segment(p[1].first) - min) / span * 100) + "%";
+      part.style.width = (p[1].count / span * 100) + "%";
+      part.title = p[1].first + " - " + p[1].last + " (" + p[1].count + " files)";
+      bar.appendChild(part);
+    });
+    root.appendChild(bar);
+  });
+  timeline.gaps.forEach(function (g) {
+    gaps.appendChild(el("li", "Missing " + g.count + " WAL files: " + g.first + " - " + g.last, "error"));
+  });
+  if (timeline.ranges.length && !timeline.gaps.length) {
+    gaps.appendChild(el("li", "No gaps in the WAL archive", "ok"));
+  }
+}
+
+function duration(job) {
+  if (!job.started) { return ""; }
+  var end = job.finished ? new Date(job.finished) : new Date();
+  return Math.round((end - new Date(job.started)) / 1000) + " s";
+}
+
+function renderJobs(jobs) {
+  var body = $("jobs").querySelector("tbody");
+  body.textContent = "";
+  jobs.forEach(function (job) {
+    var row = el("tr");
+    row.appendChild(el("td", job.id));
+    row.appendChild(el("td", job.type + (job.args && job.args.dry_run === "true" ? " (dry run)" : "")));
+    row.appendChild(el("td", job.state, job.state));
+    row.appendChild(el("td", new Date(job.created).toLocaleString()));
+    row.appendChild(el("td", duration(job)));
+    row.appendChild(el("td", job.error, "error"));
+    var cell = el("td");
+    var button = el("button", "Log", "link");
+    button.onclick = function () { showLog(job.id); };
+    cell.appendChild(button);
+    row.appendChild(cell);
+    body.appendChild(row);
+  });
+}
+
+// showLog streams the log of a job until it is finished
+function showLog(id) {
+  var log = $("log");
+  log.hidden = false;
+  log.textContent = "";
+  request("GET", "/jobs/" + id + "/log").then(function (resp) {
+    var reader = resp.body.getReader();
+    var decoder = new TextDecoder();
+    function read() {
+      return reader.read().then(function (chunk) {
+        if (chunk.done) { refresh(); return; }
+        log.textContent += decoder.decode(chunk.value, { stream: true });
+        log.scrollTop = log.scrollHeight;
+        return read();
+      });
+    }
+    return read();
+  }).catch(function (err) { log.textContent += err; });
+}
+
+function start(path) {
+  request("POST", path).then(function (resp) {
+    return resp.json().then(function (job) {
+      if (!resp.ok) { throw new Error(job.error); }
+      $("action-result").textContent = "Started job " + job.id;
+      showLog(job.id);
+      refresh();
+    });
+  }).catch(function (err) { $("action-result").textContent = err.message; });
+}
+
+function refresh() {
+  if (!sessionStorage.getItem(tokenKey)) { showLogin(); return; }
+  Promise.all([getJSON("/status"), getJSON("/backups"), getJSON("/timeline"), getJSON("/jobs")])
+    .then(function (r) {
+      $("login").hidden = true;
+      $("main").hidden = false;
+      renderStatus(r[0]);
+      renderBackups(r[1]);
+      renderTimeline(r[2]);
+      renderJobs(r[3]);
+    }).catch(function (err) { $("info").textContent = "Update failed: " + err.message; });
+}
+
+$("login").onsubmit = function (e) {
+  e.preventDefault();
+  sessionStorage.setItem(tokenKey, $("token").value);
+  $("token").value = "";
+  refresh();
+};
+$("logout").onclick = function () { sessionStorage.removeItem(tokenKey); showLogin(); };
+$("start-backup").onclick = function () { start("/backups"); };
+$("start-cleanup").onclick = function () { start("/cleanup?dry_run=true"); };
+
+refresh();
+setInterval(refresh, 30000);
+`
@@ -0,0 +1,326 @@
+// Package metrics - Prometheus metrics
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeSummary   = "summary"
+	typeHistogram = "histogram"
+)
+
+// DefBuckets are the default upper bounds (in seconds) of the buckets of a duration histogram
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+var (
+	// All registered metric families, in order of registration
+	registry   []*family
+	registryMu sync.Mutex
+)
+
+// family is a metric with all its label combinations
+type family struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	buckets    []float64 // upper bounds, only used by histogram
+
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+// sample holds the value for one label combination
+type sample struct {
+	value   float64  // value for counter and gauge, sum for summary and histogram
+	count   uint64   // number of observations, only used by summary and histogram
+	buckets []uint64 // observations per bucket (cumulative), only used by histogram
+}
+
+// line is one rendered sample in the Prometheus text format
+type line struct {
+	key   string // metric name with labels
+	value float64
+}
+
+// Counter is a metric that only goes up
+type Counter struct{ f *family }
+
+// Gauge is a metric that can go up and down
+type Gauge struct{ f *family }
+
+// Summary tracks the count and the sum of observations
+type Summary struct{ f *family }
+
+// Histogram tracks the count and the sum of observations and counts them in buckets
+type Histogram struct{ f *family }
+
+func newFamily(name string, help string, metricType string, labelNames []string) *family {
+	f := &family{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		samples:    make(map[string]*sample),
+	}
+	registryMu.Lock()
+	registry = append(registry, f)
+	registryMu.Unlock()
+	return f
+}
+
+// NewCounter creates and registers a new counter
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{newFamily(name, help, typeCounter, labelNames)}
+}
+
+// NewGauge creates and registers a new gauge
+func NewGauge(name string, help string, labelNames ...string) *Gauge {
+	return &Gauge{newFamily(name, help, typeGauge, labelNames)}
+}
+
+// NewSummary creates and registers a new summary (without quantiles)
+func NewSummary(name string, help string, labelNames ...string) *Summary {
+	return &Summary{newFamily(name, help, typeSummary, labelNames)}
+}
+
+// NewHistogram creates and registers a new histogram with the given bucket upper bounds,
+// the +Inf bucket is added implicitly
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	f := newFamily(name, help, typeHistogram, labelNames)
+	f.buckets = append([]float64(nil), buckets...)
+	sort.Float64s(f.buckets)
+	return &Histogram{f}
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter, v must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	c.f.update(labelValues, func(s *sample) { s.value += v })
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.update(labelValues, func(s *sample) { s.value = v })
+}
+
+// SetToCurrentTime sets the gauge to the current unix time
+func (g *Gauge) SetToCurrentTime(labelValues ...string) {
+	g.Set(float64(time.Now().UnixNano())/1e9, labelValues...)
+}
+
+// Observe adds a single observation to the summary
+func (s *Summary) Observe(v float64, labelValues ...string) {
+	s.f.update(labelValues, func(s *sample) {
+		s.value += v
+		s.count++
+	})
+}
+
+// ObserveSince adds the seconds passed since start to the summary
+func (s *Summary) ObserveSince(start time.Time, labelValues ...string) {
+	s.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// Observe adds a single observation to the histogram
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.update(labelValues, func(s *sample) {
+		s.value += v
+		s.count++
+		for i, upper := range h.f.buckets {
+			if v <= upper {
+				s.buckets[i]++
+			}
+		}
+	})
+}
+
+// ObserveSince adds the seconds passed since start to the histogram
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (f *family) newSample() *sample {
+	return &sample{buckets: make([]uint64, len(f.buckets))}
+}
+
+func (f *family) update(labelValues []string, change func(s *sample)) {
+	key := f.labels(labelValues)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.samples[key]
+	if !ok {
+		s = f.newSample()
+		f.samples[key] = s
+	}
+	change(s)
+}
+
+// labels renders the label set, missing values are left empty
+func (f *family) labels(labelValues []string) string {
+	if len(f.labelNames) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(f.labelNames))
+	for i, name := range f.labelNames {
+		value := ""
+		if i < len(labelValues) {
+			value = labelValues[i]
+		}
+		pairs[i] = name + `="` + escapeLabel(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func escapeHelp(help string) string {
+	help = strings.Replace(help, `\`, `\\`, -1)
+	return strings.Replace(help, "\n", `\n`, -1)
+}
+
+// withLabel adds one label to a rendered label set
+func withLabel(labels string, name string, value string) string {
+	pair := name + `="` + escapeLabel(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+// lines returns all samples of the family, sorted by labels
+func (f *family) lines() (lines []line) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.samples))
+	for key := range f.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Counters and summaries without labels are always exported, even if
+	// nothing happened yet. Gauges are only exported when they were set.
+	if len(keys) == 0 && len(f.labelNames) == 0 && f.metricType != typeGauge {
+		f.samples[""] = f.newSample()
+		keys = append(keys, "")
+	}
+
+	for _, key := range keys {
+		s := f.samples[key]
+		if f.metricType == typeHistogram {
+			for i, upper := range f.buckets {
+				lines = append(lines, line{f.name + "_bucket" + withLabel(key, "le", formatValue(upper)), float64(s.buckets[i])})
+			}
+			lines = append(lines, line{f.name + "_bucket" + withLabel(key, "le", formatValue(math.Inf(1))), float64(s.count)})
+		}
+		if f.metricType == typeSummary || f.metricType == typeHistogram {
+			lines = append(lines, line{f.name + "_sum" + key, s.value})
+			lines = append(lines, line{f.name + "_count" + key, float64(s.count)})
+			continue
+		}
+		lines = append(lines, line{f.name + key, s.value})
+	}
+	return lines
+}
+
+// cumulative returns true if values of this family add up over time
+func (f *family) cumulative() bool {
+	return f.metricType != typeGauge
+}
+
+// owns returns true if the given metric name (without labels) belongs to the family
+func (f *family) owns(metricName string) bool {
+	switch f.metricType {
+	case typeSummary:
+		return metricName == f.name+"_sum" || metricName == f.name+"_count"
+	case typeHistogram:
+		return metricName == f.name+"_bucket" || metricName == f.name+"_sum" || metricName == f.name+"_count"
+	}
+	return metricName == f.name
+}
+
+func writeFamily(w io.Writer, f *family, lines []line) {
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.metricType)
+	for _, l := range lines {
+		fmt.Fprintf(w, "%s %s\n", l.key, formatValue(l.value))
+	}
+}
+
+// formatValue renders a float as expected by Prometheus, e.g. +Inf, -Inf and NaN
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func families() []*family {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	fs := make([]*family, len(registry))
+	copy(fs, registry)
+	sort.Slice(fs, func(i, j int) bool { return fs[i].name < fs[j].name })
+	return fs
+}
+
+// WriteText writes all metrics in the Prometheus text format to w
+func WriteText(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	for _, f := range families() {
+		writeFamily(buf, f, f.lines())
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Handler returns a http.Handler that exposes all metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteText(w)
+	})
+}
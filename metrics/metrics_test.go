@@ -0,0 +1,152 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// familyText returns the rendered lines of one family from the text output
+func familyText(t *testing.T, name string) string {
+	buf := new(bytes.Buffer)
+	if err := WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+	var text []string
+	for _, l := range strings.SplitAfter(buf.String(), "\n") {
+		fields := strings.Fields(strings.TrimPrefix(l, "# "))
+		if strings.HasPrefix(l, "# ") && len(fields) > 1 && fields[1] == name {
+			text = append(text, l)
+			continue
+		}
+		if strings.HasPrefix(metricName(strings.SplitN(l, " ", 2)[0]), name) {
+			text = append(text, l)
+		}
+	}
+	return strings.Join(text, "")
+}
+
+func TestWriteTextCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "Help with \\ and\nnewline.", "path")
+	c.Inc(`C:\dir "quoted"` + "\nline")
+	c.Add(2, "b")
+	c.Add(-1, "b")
+
+	expected := `# HELP test_counter_total Help with \\ and\nnewline.
+# TYPE test_counter_total counter
+test_counter_total{path="C:\\dir \"quoted\"\nline"} 1
+test_counter_total{path="b"} 2
+`
+	if text := familyText(t, "test_counter_total"); text != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", text, expected)
+	}
+}
+
+func TestWriteTextGauge(t *testing.T) {
+	g := NewGauge("test_gauge", "A gauge.")
+	if text := familyText(t, "test_gauge"); text != "" {
+		t.Errorf("unset gauge is exported:\n%s", text)
+	}
+	g.Set(math.Inf(-1))
+	expected := "# HELP test_gauge A gauge.\n# TYPE test_gauge gauge\ntest_gauge -Inf\n"
+	if text := familyText(t, "test_gauge"); text != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", text, expected)
+	}
+}
+
+func TestWriteTextHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "A histogram.", []float64{1, 0.5})
+	if text := familyText(t, "test_duration_seconds"); !strings.Contains(text, "test_duration_seconds_bucket{le=\"+Inf\"} 0\n") {
+		t.Errorf("empty histogram is not exported:\n%s", text)
+	}
+	h.Observe(0.5)
+	h.Observe(0.75)
+	h.Observe(3)
+
+	expected := `# HELP test_duration_seconds A histogram.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.5"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 4.25
+test_duration_seconds_count 3
+`
+	if text := familyText(t, "test_duration_seconds"); text != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", text, expected)
+	}
+
+	labeled := NewHistogram("test_labeled_seconds", "A histogram with labels.", []float64{1}, "job")
+	labeled.Observe(2, "x")
+	expected = `# HELP test_labeled_seconds A histogram with labels.
+# TYPE test_labeled_seconds histogram
+test_labeled_seconds_bucket{job="x",le="1"} 0
+test_labeled_seconds_bucket{job="x",le="+Inf"} 1
+test_labeled_seconds_sum{job="x"} 2
+test_labeled_seconds_count{job="x"} 1
+`
+	if text := familyText(t, "test_labeled_seconds"); text != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", text, expected)
+	}
+}
+
+func TestWriteTextfileMerges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgglaskugel-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pgglaskugel.prom")
+
+	h := NewHistogram("test_merge_seconds", "Merged histogram.", []float64{1})
+	g := NewGauge("test_merge_gauge", "Merged gauge.")
+	h.Observe(0.5)
+	g.Set(1)
+	if err := WriteTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+	// A second process with the same observations, simulated by writing again
+	g.Set(2)
+	if err := WriteTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := readTextfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]float64{
+		`test_merge_seconds_bucket{le="1"}`:    2,
+		`test_merge_seconds_bucket{le="+Inf"}`: 2,
+		"test_merge_seconds_sum":               1,
+		"test_merge_seconds_count":             2,
+		"test_merge_gauge":                     2,
+	} {
+		if samples[key] != value {
+			t.Errorf("%s is %v, expected %v", key, samples[key], value)
+		}
+	}
+}
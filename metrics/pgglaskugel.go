@@ -0,0 +1,72 @@
+// Package metrics - pgglaskugel metrics
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package metrics
+
+// All metrics exported by pgglaskugel
+var (
+	// BasebackupLastSuccess is the time of the last successful basebackup
+	BasebackupLastSuccess = NewGauge("pgglaskugel_basebackup_last_success_timestamp_seconds",
+		"Unix time of the last successful basebackup.")
+	// BasebackupDuration is the duration of the last successful basebackup
+	BasebackupDuration = NewGauge("pgglaskugel_basebackup_duration_seconds",
+		"Duration of the last successful basebackup.")
+	// BasebackupSize is the stored size of the last successful basebackup
+	BasebackupSize = NewGauge("pgglaskugel_basebackup_size_bytes",
+		"Stored (compressed and encrypted) size of the last successful basebackup.")
+	// BasebackupFailures counts failed basebackups
+	BasebackupFailures = NewCounter("pgglaskugel_basebackup_failures_total",
+		"Number of failed basebackups.")
+
+	// WalArchived counts archived WAL files
+	WalArchived = NewCounter("pgglaskugel_wal_archived_total",
+		"Number of archived WAL files.")
+	// WalArchiveDuration tracks the time needed per archive call
+	WalArchiveDuration = NewHistogram("pgglaskugel_wal_archive_duration_seconds",
+		"Time needed per call of archive, failed calls included.", DefBuckets)
+	// WalArchiveFailures counts failed archive calls
+	WalArchiveFailures = NewCounter("pgglaskugel_wal_archive_failures_total",
+		"Number of failed calls of archive.")
+	// WalArchiveFailedFiles counts WAL files that could not be archived
+	WalArchiveFailedFiles = NewCounter("pgglaskugel_wal_archive_failed_files_total",
+		"Number of WAL files that could not be archived.")
+
+	// WalFetchDuration tracks the time needed to fetch a WAL file
+	WalFetchDuration = NewHistogram("pgglaskugel_wal_fetch_duration_seconds",
+		"Time needed to fetch a WAL file, failed calls included.", DefBuckets)
+	// WalFetchFailures counts failed fetch calls
+	WalFetchFailures = NewCounter("pgglaskugel_wal_fetch_failures_total",
+		"Number of failed calls of fetch, this includes WAL files not found in the archive.")
+
+	// StorageUsed is the space used in the storage backends
+	StorageUsed = NewGauge("pgglaskugel_storage_used_bytes",
+		"Bytes used in the storage backend, as seen by the last listing.", "backend", "type")
+
+	// RetentionDeleted counts objects deleted by the retention policy
+	RetentionDeleted = NewCounter("pgglaskugel_retention_deleted_total",
+		"Number of objects deleted by the retention policy.", "type")
+
+	// JobRuns counts the runs of jobs started by the daemon
+	JobRuns = NewCounter("pgglaskugel_job_runs_total",
+		"Number of job runs by job and result.", "job", "result")
+	// JobLastSuccess is the time of the last successful run per job
+	JobLastSuccess = NewGauge("pgglaskugel_job_last_success_timestamp_seconds",
+		"Unix time of the last successful run of a job.", "job")
+)
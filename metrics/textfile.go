@@ -0,0 +1,138 @@
+// Package metrics - textfile collector output
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// WriteTextfile writes all metrics to path, to be picked up by the
+// textfile collector of the node_exporter.
+// Every call of pgglaskugel is a new process, so the values already in the
+// file are merged with the ones of this process:
+// * counters and summaries are added up
+// * gauges are replaced if they were set by this process
+// The file is replaced atomically and concurrent writers are serialized.
+func WriteTextfile(path string) (err error) {
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	previous, err := readTextfile(path)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	for _, f := range families() {
+		writeFamily(buf, f, mergeLines(f, f.lines(), previous))
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".pgglaskugel-metrics")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = buf.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// mergeLines merges the samples of this process with the previous ones
+func mergeLines(f *family, current []line, previous map[string]float64) (merged []line) {
+	seen := make(map[string]bool)
+	for _, l := range current {
+		seen[l.key] = true
+		if old, ok := previous[l.key]; ok && f.cumulative() {
+			l.value += old
+		}
+		merged = append(merged, l)
+	}
+	// Keep everything from the file this process did not touch
+	for key, value := range previous {
+		if seen[key] || !f.owns(metricName(key)) {
+			continue
+		}
+		merged = append(merged, line{key, value})
+	}
+	return merged
+}
+
+// metricName returns the metric name without labels
+func metricName(key string) string {
+	if i := strings.Index(key, "{"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// readTextfile reads the samples of an existing metrics file
+func readTextfile(path string) (samples map[string]float64, err error) {
+	samples = make(map[string]float64)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return samples, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// The value is separated by the last space, labels can contain spaces
+		i := strings.LastIndex(text, " ")
+		if i < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(text[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		samples[text[:i]] = value
+	}
+	return samples, scanner.Err()
+}
@@ -21,7 +21,9 @@
 package file
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -38,6 +40,11 @@ import (
 	"github.com/xxorde/pgglaskugel/util"
 )
 
+const (
+	// partialPrefix marks files that are still written (or were left by a crash), they are hidden
+	partialPrefix = "."
+)
+
 // Localbackend defines a struct to use the file-methods
 type Localbackend struct {
 }
@@ -47,7 +54,11 @@ func (b Localbackend) GetBackups(viper *viper.Viper, subDirWal string) (bp backu
 	log.Debug("Get backups from folder: ", viper.GetString("backupdir"))
 	backupDir := viper.GetString("backupdir")
 	files, _ := ioutil.ReadDir(backupDir)
+	var parts []backup.Backup
 	for _, f := range files {
+		if hidden(f.Name()) || f.IsDir() {
+			continue
+		}
 		var newBackup backup.Backup
 		var err error
 		path := filepath.Join(backupDir, f.Name())
@@ -72,6 +83,12 @@ func (b Localbackend) GetBackups(viper *viper.Viper, subDirWal string) (bp backu
 		}
 		newBackup.Size = fi.Size()
 
+		// Parts of backups (tablespaces, chunks, index, metadata, manifest) are attached to their backup afterwards
+		if backup.IsBackupPart(newBackup.Name) {
+			parts = append(parts, newBackup)
+			continue
+		}
+
 		// Remove anything before the '@'
 		reg := regexp.MustCompile(`.*@`)
 		backupTimeRaw := reg.ReplaceAllString(newBackup.Name, "${1}")
@@ -83,6 +100,11 @@ func (b Localbackend) GetBackups(viper *viper.Viper, subDirWal string) (bp backu
 		newBackup.Backups = &bp
 		bp.Backup = append(bp.Backup, newBackup)
 	}
+	for _, part := range parts {
+		if !bp.AddPart(part) {
+			log.Warn("Part of a backup without the backup: ", part.Path)
+		}
+	}
 	// Sort backups
 	bp.Sort()
 	return bp
@@ -96,10 +118,17 @@ func (b Localbackend) GetWals(viper *viper.Viper) (a backup.Archive, err error)
 	bn := viper.GetString("backup_to")
 	// WAL files are load sequential from file system.
 	files, err := ioutil.ReadDir(a.Path)
+	if os.IsNotExist(err) {
+		// No WAL file of the cluster was archived yet
+		return a, nil
+	}
 	if err != nil {
 		return a, err
 	}
 	for _, f := range files {
+		if hidden(f.Name()) {
+			continue
+		}
 		size := f.Size()
 		err = a.Add(f.Name(), bn, size)
 		if err != nil {
@@ -110,44 +139,221 @@ func (b Localbackend) GetWals(viper *viper.Viper) (a backup.Archive, err error)
 	return a, nil
 }
 
+// hidden returns true for files that are not backups or WAL files: partial files and checksum files
+func hidden(name string) bool {
+	return strings.HasPrefix(name, partialPrefix) || strings.HasSuffix(name, backup.ChecksumSuffix)
+}
+
+// streamDir returns the directory for the given stream-type
+func streamDir(viper *viper.Viper, backuptype string) (dir string, err error) {
+	switch backuptype {
+	case "basebackup":
+		return viper.GetString("backupdir"), nil
+	case "archive":
+		return viper.GetString("waldir"), nil
+	}
+	return "", fmt.Errorf("unknown stream-type: %s", backuptype)
+}
+
+// streamSubDir returns the directory for the given stream-type below the archivedir or the prefix of a cluster
+func streamSubDir(backuptype string) (dir string, err error) {
+	switch backuptype {
+	case "basebackup":
+		return "basebackup", nil
+	case "archive":
+		return "wal", nil
+	}
+	return "", fmt.Errorf("unknown stream-type: %s", backuptype)
+}
+
 // WriteStream handles a stream and writes it to a local file
-func (b Localbackend) WriteStream(viper *viper.Viper, input *io.Reader, name string, backuptype string) {
-	var backuppath string
-	if backuptype == "basebackup" {
-		backuppath = filepath.Join(viper.GetString("backupdir"), name)
-	} else if backuptype == "archive" {
-		backuppath = filepath.Join(viper.GetString("waldir"), name)
-	} else {
-		log.Fatalf(" unknown stream-type: %s\n", backuptype)
-	}
-	file, err := os.OpenFile(backuppath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+// The data is written to a hidden temporary file that is only renamed to its name if the
+// stream was read completely, partial files are removed.
+// The checksums are written to a checksum file next to it after the data was committed,
+// so a checksum file never describes data that is not durable yet
+func (b Localbackend) WriteStream(viper *viper.Viper, input *io.Reader, name string, backuptype string, logicalSum func() string) (err error) {
+	dir, err := streamDir(viper, backuptype)
 	if err != nil {
-		log.Fatal("Can not create output file, ", err)
+		return err
 	}
-	defer file.Close()
+	backuppath := filepath.Join(dir, name)
 
-	log.Debug("Start writing to file")
-	written, err := io.Copy(file, *input)
+	// The directories of a cluster are created with its first object
+	if err = os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	file, err := createTemp(dir, name, 0660)
 	if err != nil {
-		log.Fatalf("writeStreamToFile: Error while writing to %s, written %d, error: %v", backuppath, written, err)
+		return fmt.Errorf("Can not create output file, %v", err)
 	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			if os.Remove(file.Name()) == nil {
+				log.Warn("Removed partial file ", file.Name())
+			}
+		}
+	}()
 
+	log.Debug("Start writing to file ", file.Name())
+	stored := util.NewHashReader(*input)
+	written, err := io.Copy(file, stored)
+	if err != nil {
+		return fmt.Errorf("writeStreamToFile: Error while writing to %s, written %d, error: %v", backuppath, written, err)
+	}
+
+	sums := backup.Checksums{Stored: stored.Sum()}
+	if logicalSum != nil {
+		sums.Logical = logicalSum()
+	}
+
+	// The checksums of an object that is replaced do not match the new data
+	removeChecksums(backuppath)
 	log.Infof("%d bytes were written, waiting for file.Sync()", written)
-	log.Debug("Wait for file.Sync()", backuppath)
-	file.Sync()
-	log.Debug("Done waiting for file.Sync()", backuppath)
+	if err = commitFile(file, backuppath); err != nil {
+		return err
+	}
+	if err = writeChecksums(backuppath, sums); err != nil {
+		// Without checksums the object can not be verified, it is written again by the caller
+		os.Remove(backuppath)
+		return fmt.Errorf("Can not write checksums for %s: %v", backuppath, err)
+	}
+	return nil
+}
+
+// writeChecksums writes the checksum file for the file at path
+func writeChecksums(path string, sums backup.Checksums) (err error) {
+	file, err := createTemp(filepath.Dir(path), filepath.Base(path)+backup.ChecksumSuffix, 0660)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(sums.Marshal(filepath.Base(path))); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err = commitFile(file, path+backup.ChecksumSuffix); err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// readChecksums reads the checksum file for the file at path, files without one have empty checksums
+func readChecksums(path string) (sums backup.Checksums, err error) {
+	data, err := ioutil.ReadFile(path + backup.ChecksumSuffix)
+	if os.IsNotExist(err) {
+		return sums, nil
+	}
+	if err != nil {
+		return sums, err
+	}
+	sums, err = backup.ParseChecksums(data)
+	if err != nil {
+		return sums, fmt.Errorf("Invalid checksum file for %s: %v", path, err)
+	}
+	return sums, nil
+}
+
+// removeChecksums removes the checksum file for the file at path if there is one
+func removeChecksums(path string) {
+	err := os.Remove(path + backup.ChecksumSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn(err)
+	}
+}
+
+// GetChecksums returns the checksums from the checksum file of an object
+func (b Localbackend) GetChecksums(viper *viper.Viper, name string, backuptype string) (sums backup.Checksums, err error) {
+	dir, err := streamDir(viper, backuptype)
+	if err != nil {
+		return sums, err
+	}
+	return readChecksums(filepath.Join(dir, name))
+}
+
+// createTemp creates a hidden temporary file in dir, it becomes visible as name with commitFile
+func createTemp(dir string, name string, perm os.FileMode) (file *os.File, err error) {
+	file, err = ioutil.TempFile(dir, partialPrefix+name+".")
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Chmod(perm); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// commitFile makes a completely written temporary file durable and atomically visible as path.
+// The file is synced and renamed, afterwards the directory is synced so the rename survives a crash
+func commitFile(file *os.File, path string) (err error) {
+	log.Debug("Wait for file.Sync() ", path)
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("Can not sync %s: %v", file.Name(), err)
+	}
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("Can not close %s: %v", file.Name(), err)
+	}
+	if err = os.Rename(file.Name(), path); err != nil {
+		return err
+	}
+	if err = util.SyncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("Can not sync directory of %s: %v", path, err)
+	}
+	log.Debug("Done syncing ", path)
+	return nil
 }
 
 // Fetch uses the shell command zstd to recover WAL files
+// The stored and the recovered data are checked against the checksums of the WAL file
 func (b Localbackend) Fetch(viper *viper.Viper) (err error) {
 	walTarget := viper.GetString("waltarget")
 	walName := viper.GetString("walname")
-	walSource := filepath.Join(viper.GetString("archivedir"), "/wal/", walName+".zst")
+	walSource := filepath.Join(viper.GetString("waldir"), walName+".zst")
+
+	sums, err := readChecksums(walSource)
+	if err != nil {
+		return err
+	}
+	if sums.Empty() {
+		log.Debug("No checksums stored for ", walSource, ", skip verification")
+		return inflateWal(viper, walSource, walTarget)
+	}
+
+	// Do not inflate corrupt data
+	stored, err := util.HashFile(walSource)
+	if err != nil {
+		return err
+	}
+	if err = sums.Verify(walSource, stored, ""); err != nil {
+		return err
+	}
+
+	if err = inflateWal(viper, walSource, walTarget); err != nil {
+		return err
+	}
+	logical, err := util.HashFile(walTarget)
+	if err != nil {
+		return err
+	}
+	if err = sums.Verify(walSource, stored, logical); err != nil {
+		// Do not leave a corrupt WAL file behind for the recovery
+		os.Remove(walTarget)
+		return err
+	}
+	log.Debug("Checksums of ", walSource, " verified")
+	return nil
+}
+
+// inflateWal decrypts (if configured) and inflates walSource to walTarget
+func inflateWal(viper *viper.Viper, walSource string, walTarget string) (err error) {
 	encrypt := viper.GetBool("encrypt")
 	cmdZstd := viper.GetString("path_to_zstd")
 	cmdGpg := viper.GetString("path_to_gpg")
 
-	log.Debug("fetchFromFile, walTarget: ", walTarget, ", walName: ", walName, ", walSource: ", walSource)
+	log.Debug("fetchFromFile, walTarget: ", walTarget, ", walSource: ", walSource)
 
 	// If encryption is not used the restore is easy
 	if encrypt == false {
@@ -166,19 +372,27 @@ func (b Localbackend) Fetch(viper *viper.Viper) (err error) {
 	var gpgStout io.ReadCloser
 	gpgStout, err = gpgCmd.StdoutPipe()
 	if err != nil {
-		log.Fatal("Can not attach pipe to gpg process, ", err)
+		return errors.New("Can not attach pipe to gpg process, " + err.Error())
 	}
 
 	// Watch output on stderror
 	gpgStderror, err := gpgCmd.StderrPipe()
-	util.Check(err)
+	if err != nil {
+		return err
+	}
 	go util.WatchOutput(gpgStderror, log.Info, nil)
 
 	// Start decryption
 	if err := gpgCmd.Start(); err != nil {
-		log.Fatal("gpg failed on startup, ", err)
+		return errors.New("gpg failed on startup, " + err.Error())
 	}
 	log.Debug("gpg started")
+	// gpg is reaped on every path, it would be left as zombie otherwise
+	defer func() {
+		if waitErr := gpgCmd.Wait(); waitErr != nil && err == nil {
+			err = errors.New("gpg failed after startup, " + waitErr.Error())
+		}
+	}()
 
 	// command to inflate the data stream
 	inflateCmd := exec.Command(cmdZstd, "-d", "-o", walTarget)
@@ -187,7 +401,10 @@ func (b Localbackend) Fetch(viper *viper.Viper) (err error) {
 	inflateDone := make(chan struct{}) // Channel to wait for WatchOutput
 
 	inflateStderror, err := inflateCmd.StderrPipe()
-	util.Check(err)
+	if err != nil {
+		gpgCmd.Process.Kill()
+		return err
+	}
 	go util.WatchOutput(inflateStderror, log.Info, inflateDone)
 
 	// Assign inflationInput as Stdin for the inflate command
@@ -195,7 +412,8 @@ func (b Localbackend) Fetch(viper *viper.Viper) (err error) {
 
 	// Start WAL inflation
 	if err := inflateCmd.Start(); err != nil {
-		log.Fatal("zstd failed on startup, ", err)
+		gpgCmd.Process.Kill()
+		return errors.New("zstd failed on startup, " + err.Error())
 	}
 	log.Debug("Inflation started")
 
@@ -203,17 +421,21 @@ func (b Localbackend) Fetch(viper *viper.Viper) (err error) {
 	<-inflateDone
 
 	// If there is still data in the output pipe it can be lost!
-	err = inflateCmd.Wait()
-	util.CheckCustom(err, "Inflation failed after startup")
-
-	return err
+	if err = inflateCmd.Wait(); err != nil {
+		return errors.New("Inflation failed after startup, " + err.Error())
+	}
+	return nil
 }
 
 //GetBasebackup Gets backups from file
-func (b Localbackend) GetBasebackup(viper *viper.Viper, backup *backup.Backup, backupStream *io.Reader, wgStart *sync.WaitGroup, wgDone *sync.WaitGroup) {
+// If the backup can not be opened wgStart is done and the error is returned without waiting for wgDone
+func (b Localbackend) GetBasebackup(viper *viper.Viper, backup *backup.Backup, backupStream *io.Reader, wgStart *sync.WaitGroup, wgDone *sync.WaitGroup) (err error) {
 	log.Debug("getFromFile")
 	file, err := os.Open(backup.Path)
-	util.Check(err)
+	if err != nil {
+		wgStart.Done()
+		return err
+	}
 	defer file.Close()
 
 	// Set file as backupStream
@@ -226,7 +448,7 @@ func (b Localbackend) GetBasebackup(viper *viper.Viper, backup *backup.Backup, b
 	log.Debug("getFromFile waits for the rest of the chain to finish")
 	wgDone.Wait()
 	log.Debug("getFromFile done")
-
+	return nil
 }
 
 // DeleteAll deletes all backups in the struct
@@ -236,10 +458,19 @@ func (b Localbackend) DeleteAll(viper *viper.Viper, backups *backup.Backups) (co
 	// We delete all backups, but start with the oldest just in case
 	for i := len(backups.Backup) - 1; i >= 0; i-- {
 		backup := backups.Backup[i]
+		// The parts are useless without the backup, delete them first
+		for _, part := range backup.Parts() {
+			if err = os.Remove(part.Path); err != nil {
+				log.Warn(err)
+			} else {
+				removeChecksums(part.Path)
+			}
+		}
 		err = os.Remove(backup.Path)
 		if err != nil {
 			log.Warn(err)
 		} else {
+			removeChecksums(backup.Path)
 			count++
 		}
 
@@ -265,7 +496,7 @@ func (b Localbackend) GetStartWalLocation(viper *viper.Viper, bp *backup.Backup)
 	files, _ := ioutil.ReadDir(bp.Backups.WalPath)
 	// find all backup labels
 	for _, f := range files {
-		if f.Size() > backup.MaxBackupLabelSize {
+		if f.Size() > backup.MaxBackupLabelSize || hidden(f.Name()) {
 			// size is to big for backup label
 			continue
 		}
@@ -304,61 +535,11 @@ func (b Localbackend) GetStartWalLocation(viper *viper.Viper, bp *backup.Backup)
 				}
 			} else {
 				// Encryption is used so we have to decrypt
-				log.Debug("Label file will be decrypted")
-
-				// Read and decrypt the compressed data
-				gpgCmd := exec.Command(cmdGpg, "--decrypt", "-o", "-", labelFile)
-				// Set the decryption output as input for inflation
-				var gpgStout io.ReadCloser
-				gpgStout, err = gpgCmd.StdoutPipe()
+				backupLabel, err = decryptLabel(cmdGpg, cmdZstd, labelFile)
 				if err != nil {
-					log.Fatal("Can not attach pipe to gpg process, ", err)
-				}
-
-				// Watch output on stderror
-				gpgStderror, err := gpgCmd.StderrPipe()
-				util.Check(err)
-				go util.WatchOutput(gpgStderror, log.Info, nil)
-
-				// Start decryption
-				if err := gpgCmd.Start(); err != nil {
-					log.Fatal("gpg failed on startup, ", err)
-				}
-				log.Debug("gpg started")
-
-				// command to inflate the data stream
-				inflateCmd := exec.Command(cmdZstd, "-d", "--stdout")
-
-				// Watch output on stderror
-				inflateDone := make(chan struct{}) // Channel to wait for WatchOutput
-
-				inflateStderror, err := inflateCmd.StderrPipe()
-				util.Check(err)
-				go util.WatchOutput(inflateStderror, log.Info, inflateDone)
-
-				// Assign inflationInput as Stdin for the inflate command
-				inflateCmd.Stdin = gpgStout
-
-				// Expose inflateCmd output as output
-				inflateStout, err := inflateCmd.StdoutPipe()
-				util.Check(err)
-
-				// Start WAL inflation
-				log.Debug("Going to start inflation...")
-				if err := inflateCmd.Start(); err != nil {
-					log.Fatal("zstd failed on startup, ", err)
+					log.Warn("Can not decrypt ", labelFile, ", ", err)
+					continue
 				}
-				log.Debug("Inflation started")
-
-				// Write data to variable backupLabel
-				backupLabel = util.StreamToByte(inflateStout)
-
-				// Wait for watch goroutine before Cmd.Wait(), race condition!
-				<-inflateDone
-
-				// If there is still data in the output pipe it can be lost!
-				err = inflateCmd.Wait()
-				util.CheckCustom(err, "Inflation failed after startup")
 			}
 			log.Debugf("backupLabel: %s,\nsize: %d", backupLabel, len(backupLabel))
 
@@ -375,11 +556,223 @@ func (b Localbackend) GetStartWalLocation(viper *viper.Viper, bp *backup.Backup)
 	return "", errors.New("START WAL LOCATION not found")
 }
 
+// decryptLabel decrypts and inflates an encrypted backup label file
+func decryptLabel(cmdGpg string, cmdZstd string, labelFile string) (backupLabel []byte, err error) {
+	log.Debug("Label file will be decrypted")
+
+	// Read and decrypt the compressed data
+	gpgCmd := exec.Command(cmdGpg, "--decrypt", "-o", "-", labelFile)
+	// Command to inflate the data stream
+	inflateCmd := exec.Command(cmdZstd, "-d", "--stdout")
+	// Set the decryption output as input for inflation
+	if inflateCmd.Stdin, err = gpgCmd.StdoutPipe(); err != nil {
+		return nil, errors.New("Can not attach pipe to gpg process, " + err.Error())
+	}
+	gpgStderror, err := gpgCmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	inflateStderror, err := inflateCmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	inflateStout, err := inflateCmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Start decryption
+	go util.WatchOutput(gpgStderror, log.Info, nil)
+	if err = gpgCmd.Start(); err != nil {
+		return nil, errors.New("gpg failed on startup, " + err.Error())
+	}
+	log.Debug("gpg started")
+
+	// Start inflation
+	inflateDone := make(chan struct{}) // Channel to wait for WatchOutput
+	go util.WatchOutput(inflateStderror, log.Info, inflateDone)
+	if err = inflateCmd.Start(); err != nil {
+		gpgCmd.Process.Kill()
+		gpgCmd.Wait()
+		return nil, errors.New("zstd failed on startup, " + err.Error())
+	}
+	log.Debug("Inflation started")
+
+	backupLabel, err = ioutil.ReadAll(inflateStout)
+
+	// Wait for watch goroutine before Cmd.Wait(), race condition!
+	<-inflateDone
+	if waitErr := inflateCmd.Wait(); waitErr != nil && err == nil {
+		err = errors.New("Inflation failed after startup, " + waitErr.Error())
+	}
+	if waitErr := gpgCmd.Wait(); waitErr != nil && err == nil {
+		err = errors.New("gpg failed after startup, " + waitErr.Error())
+	}
+	return backupLabel, err
+}
+
 // DeleteWal deletes the given WAL-file
 func (b Localbackend) DeleteWal(viper *viper.Viper, w *backup.Wal) (err error) {
-	err = os.Remove(filepath.Join(w.Archive.Path, w.Name+w.Extension))
+	path := filepath.Join(w.Archive.Path, w.Name+w.Extension)
+	err = os.Remove(path)
 	if err != nil {
 		log.Warn(err)
+		return err
+	}
+	removeChecksums(path)
+	return nil
+}
+
+// lockDir returns the directory that holds the lock objects of the named lock
+func lockDir(viper *viper.Viper, name string) string {
+	return filepath.Join(viper.GetString("archivedir"), backup.LockPrefix, name)
+}
+
+// WriteLock writes or refreshes the lock file of a holder
+// The file is written under a temporary name and renamed, so readers never see a partial lock
+func (b Localbackend) WriteLock(viper *viper.Viper, lock backup.Lock) (err error) {
+	dir := lockDir(viper, lock.Name)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	tmp, err := createTemp(dir, lock.ID, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = commitFile(tmp, filepath.Join(viper.GetString("archivedir"), backup.LockPrefix, lock.Key())); err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// GetLocks returns all lock files of the named lock
+func (b Localbackend) GetLocks(viper *viper.Viper, name string) (locks []backup.Lock, err error) {
+	dir := lockDir(viper, name)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if os.IsNotExist(err) {
+			// Released in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var lock backup.Lock
+		if err := json.Unmarshal(data, &lock); err != nil {
+			log.Warn("Ignoring invalid lock file ", f.Name(), ": ", err)
+			continue
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+// DeleteLock removes the lock file of a holder
+func (b Localbackend) DeleteLock(viper *viper.Viper, lock backup.Lock) (err error) {
+	err = os.Remove(filepath.Join(viper.GetString("archivedir"), backup.LockPrefix, lock.Key()))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// objectPath returns the path of an object of the repository, the key is relative to the archivedir
+func objectPath(viper *viper.Viper, key string) string {
+	return filepath.Join(viper.GetString("archivedir"), filepath.FromSlash(key))
+}
+
+// WriteObject writes an object of the repository, it is written under a temporary name and renamed
+func (b Localbackend) WriteObject(viper *viper.Viper, key string, data []byte) (err error) {
+	path := objectPath(viper, key)
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := createTemp(filepath.Dir(path), filepath.Base(path), 0660)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = commitFile(tmp, path); err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// ReadObject reads an object of the repository
+func (b Localbackend) ReadObject(viper *viper.Viper, key string) (data []byte, err error) {
+	return ioutil.ReadFile(objectPath(viper, key))
+}
+
+// ListObjects returns all objects of the repository below prefix, partial files are left out
+func (b Localbackend) ListObjects(viper *viper.Viper, prefix string) (objects []backup.Object, err error) {
+	root := viper.GetString("archivedir")
+	err = filepath.Walk(objectPath(viper, prefix), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || hidden(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, backup.Object{Key: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	return objects, err
+}
+
+// DeleteObject removes an object of the repository
+func (b Localbackend) DeleteObject(viper *viper.Viper, key string) (err error) {
+	err = os.Remove(objectPath(viper, key))
+	if os.IsNotExist(err) {
+		return nil
 	}
 	return err
 }
+
+// MoveToCluster moves a file from the directories in the archivedir to the directories of the cluster prefix,
+// the checksum file is moved first
+func (b Localbackend) MoveToCluster(viper *viper.Viper, name string, backuptype string, prefix string) (err error) {
+	subDir, err := streamSubDir(backuptype)
+	if err != nil {
+		return err
+	}
+	from := filepath.Join(viper.GetString("archivedir"), subDir, name)
+	to := filepath.Join(objectPath(viper, prefix), subDir, name)
+	if err = os.MkdirAll(filepath.Dir(to), 0770); err != nil {
+		return err
+	}
+	err = os.Rename(from+backup.ChecksumSuffix, to+backup.ChecksumSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(from, to)
+}
@@ -0,0 +1,134 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package file
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/util"
+)
+
+const testWal = "000000010000000000000001"
+
+func newTestViper(t *testing.T) (v *viper.Viper, cleanup func()) {
+	dir, err := ioutil.TempDir("", "pgglaskugel-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v = viper.New()
+	v.Set("archivedir", dir)
+	v.Set("waldir", filepath.Join(dir, "wal"))
+	v.Set("backupdir", filepath.Join(dir, "basebackup"))
+	v.Set("walname", testWal)
+	v.Set("waltarget", filepath.Join(dir, "restored"))
+	return v, func() { os.RemoveAll(dir) }
+}
+
+func writeTestWal(t *testing.T, v *viper.Viper, data string) string {
+	var input io.Reader = strings.NewReader(data)
+	if err := (Localbackend{}).WriteStream(v, &input, testWal+".zst", "archive", func() string { return "" }); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(v.GetString("waldir"), testWal+".zst")
+}
+
+func TestWriteStreamChecksums(t *testing.T) {
+	v, cleanup := newTestViper(t)
+	defer cleanup()
+
+	path := writeTestWal(t, v, "old content")
+	path = writeTestWal(t, v, "new content")
+	sums, err := readChecksums(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := util.HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums.Stored != stored {
+		t.Errorf("checksum file has %s, the data has %s", sums.Stored, stored)
+	}
+
+	files, err := ioutil.ReadDir(v.GetString("waldir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), partialPrefix) {
+			t.Error("partial file left: ", f.Name())
+		}
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestWriteStreamFailure(t *testing.T) {
+	v, cleanup := newTestViper(t)
+	defer cleanup()
+
+	var input io.Reader = io.MultiReader(strings.NewReader("partial"), failingReader{})
+	if err := (Localbackend{}).WriteStream(v, &input, testWal+".zst", "archive", nil); err == nil {
+		t.Fatal("no error for a failing stream")
+	}
+	files, err := ioutil.ReadDir(v.GetString("waldir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("%d files are left after a failed stream", len(files))
+	}
+}
+
+func TestFetchCorruptData(t *testing.T) {
+	v, cleanup := newTestViper(t)
+	defer cleanup()
+
+	// The checksum file is intact, only the data is damaged
+	path := writeTestWal(t, v, "compressed WAL file")
+	if err := ioutil.WriteFile(path, []byte("compressed WAL filE"), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	err := (Localbackend{}).Fetch(v)
+	corrupt, ok := err.(*backup.CorruptObjectError)
+	if !ok {
+		t.Fatalf("got %v, a corrupt object error expected", err)
+	}
+	if corrupt.Kind != "stored" || corrupt.Name != path {
+		t.Errorf("unexpected error: %v", corrupt)
+	}
+	if _, err := os.Stat(v.GetString("waltarget")); !os.IsNotExist(err) {
+		t.Error("corrupt data was restored")
+	}
+}
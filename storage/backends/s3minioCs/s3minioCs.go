@@ -25,10 +25,14 @@ import (
 	"bytes"
 	"crypto/md5"
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"hash"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
 	"os/exec"
@@ -49,6 +53,10 @@ import (
 const (
 	maxPartsCount             = 10000
 	maxMultipartPutObjectSize = 1024 * 1024 * 1024 * 640
+
+	// User metadata that holds the checksums of an object
+	metaSha256        = "Sha256"
+	metaLogicalSha256 = "Logical-Sha256"
 )
 
 var (
@@ -128,15 +136,18 @@ type S3backend struct {
 func (b S3backend) GetWals(viper *viper.Viper) (a backup.Archive, err error) {
 	log.Debug("Get backups from S3")
 	// Initialize minio client object.
-	a.MinioClient = b.getS3Connection(viper)
+	if a.MinioClient, err = b.getS3Connection(viper); err != nil {
+		return a, err
+	}
 	a.Bucket = viper.GetString("s3_bucket_wal")
 	bn := viper.GetString("backup_to")
 	// Create a done channel to control 'ListObjects' go routine.
 	doneCh := make(chan struct{})
 	defer close(doneCh)
 
+	prefix := viper.GetString("cluster_prefix")
 	isRecursive := true
-	objectCh := a.MinioClient.ListObjects(a.Bucket, "", isRecursive, doneCh)
+	objectCh := a.MinioClient.ListObjects(a.Bucket, prefix, isRecursive, doneCh)
 	for object := range objectCh {
 		if object.Err != nil {
 			return a, err
@@ -145,8 +156,12 @@ func (b S3backend) GetWals(viper *viper.Viper) (a backup.Archive, err error) {
 		if object.Err != nil {
 			return a, err
 		}
+		// Without a cluster prefix the WAL files of the clusters are not listed
+		if prefix == "" && strings.HasPrefix(object.Key, backup.ClusterPrefix+"/") {
+			continue
+		}
 
-		err = a.Add(object.Key, bn, object.Size)
+		err = a.Add(strings.TrimPrefix(object.Key, prefix), bn, object.Size)
 		if err != nil {
 			return a, err
 		}
@@ -159,15 +174,21 @@ func (b S3backend) GetWals(viper *viper.Viper) (a backup.Archive, err error) {
 func (b S3backend) GetBackups(viper *viper.Viper, subDirWal string) (backups backup.Backups) {
 	log.Debug("Get backups from S3")
 	// Initialize minio client object.
-	minioClient := b.getS3Connection(viper)
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		log.Error(err)
+		return backups
+	}
 	backups.WalPath = viper.GetString("s3_bucket_wal")
 	bucket := viper.GetString("s3_bucket_backup")
 	// Create a done channel to control 'ListObjects' go routine.
 	doneCh := make(chan struct{})
 	defer close(doneCh)
 
+	prefix := viper.GetString("cluster_prefix")
 	isRecursive := true
-	objectCh := minioClient.ListObjects(bucket, "", isRecursive, doneCh)
+	objectCh := minioClient.ListObjects(bucket, prefix, isRecursive, doneCh)
+	var parts []backup.Backup
 	for object := range objectCh {
 		var newBackup backup.Backup
 		var err error
@@ -176,13 +197,28 @@ func (b S3backend) GetBackups(viper *viper.Viper, subDirWal string) (backups bac
 		}
 		log.Debug(object)
 
+		// Lock objects, the chunks of deduplicated backups and the repository metadata are stored in the same bucket
+		if strings.HasPrefix(object.Key, backup.LockPrefix+"/") || strings.HasPrefix(object.Key, backup.DedupPrefix+"/") || object.Key == backup.RepositoryObject {
+			continue
+		}
+		// Without a cluster prefix the backups of the clusters are not listed
+		if prefix == "" && strings.HasPrefix(object.Key, backup.ClusterPrefix+"/") {
+			continue
+		}
+
 		newBackup.Path = bucket
 		newBackup.Extension = filepath.Ext(object.Key)
 
-		// Get Name without suffix
-		newBackup.Name = strings.TrimSuffix(object.Key, newBackup.Extension)
+		// Get Name without suffix and cluster prefix
+		newBackup.Name = strings.TrimPrefix(strings.TrimSuffix(object.Key, newBackup.Extension), prefix)
 		newBackup.Size = object.Size
 
+		// Parts of backups (tablespaces, chunks, index, metadata, manifest) are attached to their backup afterwards
+		if backup.IsBackupPart(newBackup.Name) {
+			parts = append(parts, newBackup)
+			continue
+		}
+
 		// Get the time from backup name
 		backupTimeRaw := extractTimeFromBackup.ReplaceAllString(newBackup.Name, "${1}")
 		newBackup.Created, err = time.Parse(backup.BackupTimeFormat, backupTimeRaw)
@@ -193,6 +229,11 @@ func (b S3backend) GetBackups(viper *viper.Viper, subDirWal string) (backups bac
 		newBackup.Backups = &backups
 		backups.Backup = append(backups.Backup, newBackup)
 	}
+	for _, part := range parts {
+		if !backups.AddPart(part) {
+			log.Warn("Part of a backup without the backup: ", part.Name+part.Extension)
+		}
+	}
 	// Sort backups
 	backups.Sort()
 	return backups
@@ -200,7 +241,8 @@ func (b S3backend) GetBackups(viper *viper.Viper, subDirWal string) (backups bac
 }
 
 // GetConnection returns an S3-Connection Handler
-func (b S3backend) getS3Connection(viper *viper.Viper) (minioClient minio.Client) {
+// An invalid endpoint is returned as error
+func (b S3backend) getS3Connection(viper *viper.Viper) (minioClient minio.Client, err error) {
 	endpoint := viper.GetString("s3_endpoint")
 	accessKeyID := viper.GetString("s3_access_key")
 	secretAccessKey := viper.GetString("s3_secret_key")
@@ -208,7 +250,6 @@ func (b S3backend) getS3Connection(viper *viper.Viper) (minioClient minio.Client
 	version := viper.GetInt("s3_protocol_version")
 
 	var client *minio.Client
-	var err error
 
 	// Initialize minio client object.
 	switch version {
@@ -223,25 +264,41 @@ func (b S3backend) getS3Connection(viper *viper.Viper) (minioClient minio.Client
 		client, err = minio.New(endpoint, accessKeyID, secretAccessKey, ssl)
 	}
 	if err != nil {
-		log.Fatal(err)
+		return minioClient, fmt.Errorf("Can not connect to S3 endpoint %s: %v", endpoint, err)
 	}
 
 	client.SetAppInfo(viper.GetString("myname"), viper.GetString("version"))
 	log.Debug("minioClient: ", minioClient)
 
-	return *client
+	return *client, nil
+}
+
+// streamBucket returns the bucket for the given stream-type
+func streamBucket(viper *viper.Viper, backuptype string) (bucket string, err error) {
+	switch backuptype {
+	case "basebackup":
+		return viper.GetString("s3_bucket_backup"), nil
+	case "archive":
+		return viper.GetString("s3_bucket_wal"), nil
+	}
+	return "", fmt.Errorf("unknown stream-type: %s", backuptype)
+}
+
+// objectKey returns the key of an object of the current cluster, it is below the prefix of the cluster
+func objectKey(viper *viper.Viper, name string) string {
+	return viper.GetString("cluster_prefix") + name
 }
 
 // WriteStream handles a stream and writes it to S3 storage
-func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string, backuptype string) {
-	var bucket string
-	if backuptype == "basebackup" {
-		bucket = viper.GetString("s3_bucket_backup")
-	} else if backuptype == "archive" {
-		bucket = viper.GetString("s3_bucket_wal")
-	} else {
-		log.Fatalf(" unknown stream-type: %s\n", backuptype)
+// The object is uploaded as multipart upload, it only becomes visible when the upload is completed.
+// If the stream can not be read completely the upload is aborted.
+// The checksums are added as user metadata, if metadata is disabled they are not stored
+func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string, backuptype string, logicalSum func() string) (err error) {
+	bucket, err := streamBucket(viper, backuptype)
+	if err != nil {
+		return err
 	}
+	name = objectKey(viper, name)
 	location := viper.GetString("s3_location")
 	encrypt := viper.GetBool("encrypt")
 	contentType := "zstd"
@@ -263,12 +320,15 @@ func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string
 	}
 
 	// Initialize minio client object.
-	minioClient := b.getS3Connection(viper)
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return err
+	}
 
 	// Test if bucket is there
 	exists, err := minioClient.BucketExists(bucket)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if exists {
 		log.Debugf("Bucket already exists, we are using it: %s", bucket)
@@ -277,7 +337,7 @@ func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string
 		err = minioClient.MakeBucket(bucket, location)
 		if err != nil {
 			log.Debug("minioClient.MakeBucket(bucket, location) failed")
-			log.Fatal(err)
+			return err
 		}
 		log.Infof("Bucket %s created.", bucket)
 	}
@@ -295,15 +355,28 @@ func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string
 	// Get the upload id of a previously partially uploaded object or initiate a new multipart upload
 	uploadID, err := c.NewMultipartUpload(bucket, name, metaData)
 	if err != nil {
-		log.Fatal("NewMultipartUpload failed", err)
+		return fmt.Errorf("NewMultipartUpload failed, %v", err)
 	}
 
+	// Abort the upload on every error, so no incomplete upload is left behind
+	completed := false
+	defer func() {
+		if err == nil || completed {
+			return
+		}
+		if abortErr := c.AbortMultipartUpload(bucket, name, uploadID); abortErr != nil {
+			log.Error("Can not abort multipart upload of ", name, ": ", abortErr)
+			return
+		}
+		log.Warn("Aborted multipart upload of ", name)
+	}()
+
 	size := int64(-1)
 
 	// Calculate the optimal parts info for a given size.
 	totalPartsCount, partSize, _, err := optimalPartInfo(size, minPartSize)
 	if err != nil {
-		log.Fatal("optimalPartInfo failed", err)
+		return fmt.Errorf("optimalPartInfo failed, %v", err)
 	}
 
 	// Initialize parts uploaded map.
@@ -315,6 +388,9 @@ func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string
 	// Initialize a temporary buffer.
 	tmpBuffer := new(bytes.Buffer)
 
+	// Checksum of the whole object
+	stored := util.NewHashReader(*input)
+
 	for partNumber <= totalPartsCount {
 		// Choose hash algorithms to be calculated by hashCopyN, avoid sha256
 		// with non-v4 signature request or HTTPS connection
@@ -324,9 +400,10 @@ func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string
 		hashAlgos["sha256"] = sha256.New()
 
 		// Calculates hash sums while copying partSize bytes into tmpBuffer.
-		prtSize, rErr := hashCopyN(hashAlgos, hashSums, tmpBuffer, *input, partSize)
+		prtSize, rErr := hashCopyN(hashAlgos, hashSums, tmpBuffer, stored, partSize)
 		if rErr != nil && rErr != io.EOF {
-			log.Fatal("io.EOF failed", err)
+			err = fmt.Errorf("Reading the stream failed after %d bytes, %v", totalUploadedSize, rErr)
+			return err
 		}
 
 		// Proceed to upload the part.
@@ -336,7 +413,7 @@ func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string
 		if err != nil {
 			// Reset the temporary buffer upon any error.
 			tmpBuffer.Reset()
-			log.Fatal("PutObjectPart failed, written ", totalUploadedSize, err)
+			return fmt.Errorf("PutObjectPart failed, written %d, %v", totalUploadedSize, err)
 		}
 
 		// Save successfully uploaded part metadata.
@@ -361,7 +438,7 @@ func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string
 	// Verify if we uploaded all the data.
 	if size > 0 {
 		if totalUploadedSize != size {
-			log.Fatal("totalUploadedSize", totalUploadedSize, "io.ErrUnexpectedEOF", io.ErrUnexpectedEOF)
+			return fmt.Errorf("totalUploadedSize %d, %v", totalUploadedSize, io.ErrUnexpectedEOF)
 		}
 	}
 
@@ -370,7 +447,7 @@ func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string
 	for i := 1; i < partNumber; i++ {
 		part, ok := partsInfo[i]
 		if !ok {
-			log.Fatalf("PartsInfo failed, missing part number %d", i)
+			return fmt.Errorf("PartsInfo failed, missing part number %d", i)
 		}
 		complMultipartUpload.Parts = append(complMultipartUpload.Parts,
 			minio.CompletePart{
@@ -383,18 +460,80 @@ func (b S3backend) WriteStream(viper *viper.Viper, input *io.Reader, name string
 	sort.Sort(completedParts(complMultipartUpload.Parts))
 	err = c.CompleteMultipartUpload(bucket, name, uploadID, complMultipartUpload.Parts)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
+	completed = true
 	log.Infof("Written %d bytes to %s in bucket %s.", totalUploadedSize, name, bucket)
+
+	if metaData == nil {
+		log.Debug("Not storing checksums without metadata")
+		return nil
+	}
+	sums := backup.Checksums{Stored: stored.Sum()}
+	if logicalSum != nil {
+		sums.Logical = logicalSum()
+	}
+	if err = storeChecksums(minioClient, bucket, name, contentType, sums); err != nil {
+		// An object without its checksums must not look complete
+		if rmErr := minioClient.RemoveObject(bucket, name); rmErr != nil {
+			log.Error("Can not remove ", name, " without checksums: ", rmErr)
+		}
+		return fmt.Errorf("Can not store checksums of %s, %v", name, err)
+	}
+	return nil
+}
+
+// storeChecksums adds the checksums as user metadata to an uploaded object.
+// Metadata can not be changed, so the object is copied onto itself with the new metadata
+func storeChecksums(minioClient minio.Client, bucket string, name string, contentType string, sums backup.Checksums) error {
+	userMeta := map[string]string{
+		"Content-Type":    contentType,
+		metaSha256:        sums.Stored,
+		metaLogicalSha256: sums.Logical,
+	}
+	dst, err := minio.NewDestinationInfo(bucket, name, nil, userMeta)
+	if err != nil {
+		return err
+	}
+	src := minio.NewSourceInfo(bucket, name, nil)
+	return minioClient.ComposeObject(dst, []minio.SourceInfo{src})
+}
+
+// GetChecksums returns the checksums from the user metadata of an object
+func (b S3backend) GetChecksums(viper *viper.Viper, name string, backuptype string) (sums backup.Checksums, err error) {
+	bucket, err := streamBucket(viper, backuptype)
+	if err != nil {
+		return sums, err
+	}
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return sums, err
+	}
+	stat, err := minioClient.StatObject(bucket, objectKey(viper, name))
+	if err != nil {
+		return sums, err
+	}
+	return checksumsFromMeta(stat), nil
 }
 
+// checksumsFromMeta reads the checksums from the user metadata
+func checksumsFromMeta(stat minio.ObjectInfo) backup.Checksums {
+	return backup.Checksums{
+		Stored:  stat.Metadata.Get("X-Amz-Meta-" + metaSha256),
+		Logical: stat.Metadata.Get("X-Amz-Meta-" + metaLogicalSha256),
+	}
+}
+
+// readStream decrypts (if needed) and inflates an object, the stored data is also written to stored (if set)
 func (b S3backend) readStream(viper *viper.Viper, name string, bucket string,
-	output *io.Reader, start, wait chan bool) error {
+	output *io.Reader, start, wait chan bool, stored io.Writer) error {
 	encrypt := viper.GetBool("encrypt")
 
 	// Initialize minio client object.
-	minioClient := b.getS3Connection(viper)
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return err
+	}
 	cmdZstd := viper.GetString("path_to_zstd")
 	cmdGpg := viper.GetString("path_to_gpg")
 
@@ -402,65 +541,84 @@ func (b S3backend) readStream(viper *viper.Viper, name string, bucket string,
 	// Test if bucket is there
 	exists, err := minioClient.BucketExists(bucket)
 	if err != nil {
-		log.Fatal("Can not test for S3 bucket", err)
+		return fmt.Errorf("Can not test for S3 bucket %s: %v", bucket, err)
 	}
 	if !exists {
-		log.Fatal("Bucket to fetch from does not exists,", bucket)
+		return errors.New("Bucket to fetch from does not exists, " + bucket)
 	}
 
 	object, err := minioClient.GetObject(bucket, name)
 	if err != nil {
-		log.Error("Can not get object file from S3, ", name)
-		log.Fatal(err)
+		return fmt.Errorf("Can not get object %s from S3: %v", name, err)
 	}
 	defer object.Close()
 
 	// Test if the object is accessible
 	stat, err := object.Stat()
 	if err != nil {
-		log.Error("Can not get stats for object from S3, does object exists?")
-		log.Fatal(err)
+		return fmt.Errorf("Can not get stats for object %s from S3, does object exists? %v", name, err)
 	}
 	if stat.Size <= 0 {
-		log.Fatal("Object has size <= 0")
+		return errors.New("Object has size <= 0: " + name)
+	}
+
+	var source io.Reader = object
+	if stored != nil {
+		source = io.TeeReader(object, stored)
 	}
 
+	var gpgCmd *exec.Cmd
 	var gpgStout io.ReadCloser
 	if encrypt || stat.ContentType == "pgp" {
 		log.Debug("content type: ", stat.ContentType)
 		// We need to decrypt the wal file
 
 		// Decrypt the compressed data
-		gpgCmd := exec.Command(cmdGpg, "--decrypt", "-o", "-")
+		gpgCmd = exec.Command(cmdGpg, "--decrypt", "-o", "-")
 		// Set the decryption output as input for inflation
 		gpgStout, err = gpgCmd.StdoutPipe()
 		if err != nil {
-			log.Fatal("Can not attach pipe to gpg process, ", err)
+			return errors.New("Can not attach pipe to gpg process, " + err.Error())
 		}
 		// Attach output of WAL to stdin
-		gpgCmd.Stdin = object
+		gpgCmd.Stdin = source
 		// Watch output on stderror
 		gpgStderror, err := gpgCmd.StderrPipe()
-		util.Check(err)
+		if err != nil {
+			return err
+		}
 		go util.WatchOutput(gpgStderror, log.Warn, nil)
 
 		// Start decryption
 		if err := gpgCmd.Start(); err != nil {
-			log.Fatal("gpg failed on startup, ", err)
+			return errors.New("gpg failed on startup, " + err.Error())
 		}
 		log.Debug("gpg started")
 	}
+	// gpg is killed if the inflation can not be started
+	killGpg := func() {
+		if gpgCmd != nil {
+			gpgCmd.Process.Kill()
+			gpgCmd.Wait()
+		}
+	}
 
 	// command to inflate the data stream
 	inflateCmd := exec.Command(cmdZstd, "-d", "--stdout")
 
 	// Expose output as output
-	*output, err = inflateCmd.StdoutPipe()
+	if *output, err = inflateCmd.StdoutPipe(); err != nil {
+		killGpg()
+		return err
+	}
 
 	// Watch output on stderror
 	inflateDone := make(chan struct{}) // Channel to wait for WatchOutput
 	inflateStderror, err := inflateCmd.StderrPipe()
-	util.Check(err)
+	if err != nil {
+		killGpg()
+		return err
+	}
 	go util.WatchOutput(inflateStderror, log.Warn, inflateDone)
 
 	// Assign inflationInput as Stdin for the inflate command
@@ -469,12 +627,13 @@ func (b S3backend) readStream(viper *viper.Viper, name string, bucket string,
 		inflateCmd.Stdin = gpgStout
 	} else {
 		// If gpgStout is not defined use raw WAL
-		inflateCmd.Stdin = object
+		inflateCmd.Stdin = source
 	}
 
 	// Start inflation
 	if err := inflateCmd.Start(); err != nil {
-		log.Fatal("zstd failed on startup, ", err)
+		killGpg()
+		return errors.New("zstd failed on startup, " + err.Error())
 	}
 	log.Debug("Inflation started")
 
@@ -492,8 +651,17 @@ func (b S3backend) readStream(viper *viper.Viper, name string, bucket string,
 	<-inflateDone
 
 	// If there is still data in the output pipe it can be lost!
-	err = inflateCmd.Wait()
-	util.CheckCustom(err, "Inflation failed after startup, ")
+	if err = inflateCmd.Wait(); err != nil {
+		killGpg()
+		return errors.New("Inflation failed after startup, " + err.Error())
+	}
+
+	// gpg has to be reaped too, it is still reading the stored data
+	if gpgCmd != nil {
+		if err = gpgCmd.Wait(); err != nil {
+			return errors.New("gpg failed after startup, " + err.Error())
+		}
+	}
 
 	log.Debug("readStream(viper *viper.Viper, name string, bucket string, output *io.Reader) done")
 
@@ -501,15 +669,23 @@ func (b S3backend) readStream(viper *viper.Viper, name string, bucket string,
 }
 
 // Fetch recover from a S3 compatible object store
+// The stored and the recovered data are checked against the checksums of the WAL object
 func (b S3backend) Fetch(viper *viper.Viper) (err error) {
 	walBucket := viper.GetString("s3_bucket_wal")
 	walName := viper.GetString("walname")
 	walSource := walName + ".zst"
 	walTarget := viper.GetString("waltarget")
 
+	sums, err := b.GetChecksums(viper, walSource, "archive")
+	if err != nil {
+		return err
+	}
+
 	// Open output file
 	walFile, err := os.Create(walTarget)
-	util.Check(err)
+	if err != nil {
+		return err
+	}
 	defer walFile.Close()
 
 	// Create writer for the walFile
@@ -521,69 +697,111 @@ func (b S3backend) Fetch(viper *viper.Viper) (err error) {
 	waitForStart := make(chan bool)
 	tellToStop := make(chan bool)
 
-	// Start to read file
-	go b.readStream(viper, walSource, walBucket, &walStream, waitForStart, tellToStop)
+	stored := sha256.New()
+	logical := sha256.New()
+	readDone := make(chan error, 1)
 
-	// Wait for readStream to start up before io.Copy
-	<-waitForStart
+	// Start to read file
+	go func() {
+		readDone <- b.readStream(viper, objectKey(viper, walSource), walBucket, &walStream, waitForStart, tellToStop, stored)
+	}()
+
+	// Wait for readStream to start up before io.Copy, it fails before if the object can not be read
+	select {
+	case <-waitForStart:
+	case err = <-readDone:
+		return err
+	}
 
 	// Write walStream in walFile
 	log.Debug("io.Copy(writer, walStream)")
-	written, err := io.Copy(writer, walStream)
-	writer.Flush()
-	log.Debugf("io.Copy(writer, walStream) written: %d, err: %s", written, err)
+	written, err := io.Copy(io.MultiWriter(writer, logical), walStream)
+	if flushErr := writer.Flush(); err == nil {
+		err = flushErr
+	}
+	log.Debugf("io.Copy(writer, walStream) written: %d, err: %v", written, err)
 
 	// Tell readStream to fish after io.Copy
 	tellToStop <- true
+	if readErr := <-readDone; err == nil {
+		err = readErr
+	}
+	if err != nil {
+		return err
+	}
 
-	return err
+	if sums.Empty() {
+		log.Debug("No checksums stored for ", walSource, ", skip verification")
+		return nil
+	}
+	err = sums.Verify(walSource, hex.EncodeToString(stored.Sum(nil)), hex.EncodeToString(logical.Sum(nil)))
+	if err != nil {
+		// Do not leave a corrupt WAL file behind for the recovery
+		walFile.Close()
+		os.Remove(walTarget)
+		return err
+	}
+	log.Debug("Checksums of ", walSource, " verified")
+	return nil
 }
 
 // GetBasebackup gets things from S3
+// If the backup can not be opened wgStart is done and the error is returned without waiting for wgDone
 func (b S3backend) GetBasebackup(viper *viper.Viper, backup *backup.Backup,
-	backupStream *io.Reader, wgStart *sync.WaitGroup, wgDone *sync.WaitGroup) {
+	backupStream *io.Reader, wgStart *sync.WaitGroup, wgDone *sync.WaitGroup) (err error) {
 	log.Debug("getFromS3")
 	bucket := viper.GetString("s3_bucket_backup")
+	// The reader is told about every error before the backup is streamed
+	started := false
+	defer func() {
+		if !started {
+			wgStart.Done()
+		}
+	}()
 
 	// Initialize minio client object.
-	minioClient := b.getS3Connection(viper)
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return err
+	}
 
 	// Test if bucket is there
 	exists, err := minioClient.BucketExists(bucket)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("Can not test for S3 bucket %s: %v", bucket, err)
 	}
 	if !exists {
-		log.Fatal("Bucket to restore from does not exists")
+		return errors.New("Bucket to restore from does not exists, " + bucket)
 	}
 
-	backupSource := backup.Name + backup.Extension
+	backupSource := objectKey(viper, backup.Name+backup.Extension)
 	backupObject, err := minioClient.GetObject(bucket, backupSource)
 	if err != nil {
-		log.Fatal(err)
-		return
+		return err
 	}
 	defer backupObject.Close()
 
 	// Test if the object is accessible
 	stat, err := backupObject.Stat()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	if stat.Size <= 0 {
-		log.Fatal("Backup object has size <= 0")
+		return errors.New("Backup object has size <= 0: " + backupSource)
 	}
 
 	// Assign backupObject as input to the restore stack
 	*backupStream = backupObject
 
 	// Tell the chain that backupStream can access data now
+	started = true
 	wgStart.Done()
 
 	// Wait for the rest of the chain to finish
 	log.Debug("getFromS3 waits for the rest of the chain to finish")
 	wgDone.Wait()
 	log.Debug("getFromS3 done")
+	return nil
 }
 
 // DeleteAll deletes all backups in the struct
@@ -591,13 +809,22 @@ func (b S3backend) DeleteAll(viper *viper.Viper, backups *backup.Backups) (count
 	// Sort backups
 	backups.SortDesc()
 	// Initialize minio client object.
-	minioClient := b.getS3Connection(viper)
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return 0, err
+	}
 
 	// We delete all backups, but start with the oldest just in case
 	for i := len(backups.Backup) - 1; i >= 0; i-- {
 		backup := backups.Backup[i]
+		// The parts are useless without the backup, delete them first
+		for _, part := range backup.Parts() {
+			if err = minioClient.RemoveObject(part.Path, objectKey(viper, part.Name+part.Extension)); err != nil {
+				log.Warn("Error deleting part of backup: ", part.Name+part.Extension, " from ", part.Path, " err:", err)
+			}
+		}
 		log.Debug("minioClient.RemoveObject(", backup.Path, ", ", backup.Name+backup.Extension, ")")
-		err = minioClient.RemoveObject(backup.Path, backup.Name+backup.Extension)
+		err = minioClient.RemoveObject(backup.Path, objectKey(viper, backup.Name+backup.Extension))
 		if err != nil {
 			log.Warn("Error deleting backup: ", backup.Name+backup.Extension, " from ", backup.Path, " err:", err)
 		} else {
@@ -613,7 +840,10 @@ func (b S3backend) DeleteAll(viper *viper.Viper, backups *backup.Backups) (count
 // Every older WAL file is not required to use this backup
 func (b S3backend) GetStartWalLocation(viper *viper.Viper, bp *backup.Backup) (startWalLocation string, err error) {
 	// Initialize minio client object.
-	minioClient := b.getS3Connection(viper)
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return "", err
+	}
 	// Escape the name so we can use it in a regular expression
 	searchName := regexp.QuoteMeta(bp.Name)
 	// Regex to identify the right file
@@ -626,8 +856,9 @@ func (b S3backend) GetStartWalLocation(viper *viper.Viper, bp *backup.Backup) (s
 	doneCh := make(chan struct{})
 	defer close(doneCh)
 
+	prefix := viper.GetString("cluster_prefix")
 	isRecursive := true
-	objectCh := minioClient.ListObjects(bp.Backups.WalPath, "", isRecursive, doneCh)
+	objectCh := minioClient.ListObjects(bp.Backups.WalPath, prefix, isRecursive, doneCh)
 	for object := range objectCh {
 		if object.Err != nil {
 			log.Error(object.Err)
@@ -641,7 +872,7 @@ func (b S3backend) GetStartWalLocation(viper *viper.Viper, bp *backup.Backup) (s
 			continue
 		}
 
-		if backup.RegBackupLabelFile.MatchString(object.Key) {
+		if backup.RegBackupLabelFile.MatchString(strings.TrimPrefix(object.Key, prefix)) {
 			log.Debug(object.Key, " => seems to be a backup label, by size and name")
 
 			// Create reader for the data stream
@@ -650,12 +881,22 @@ func (b S3backend) GetStartWalLocation(viper *viper.Viper, bp *backup.Backup) (s
 			waitForStart := make(chan bool)
 			tellToStop := make(chan bool)
 
+			readDone := make(chan error, 1)
+
 			// Start to read file
-			go b.readStream(viper, object.Key, bp.Backups.WalPath, &walStream, waitForStart, tellToStop)
+			go func(key string) {
+				readDone <- b.readStream(viper, key, bp.Backups.WalPath, &walStream, waitForStart, tellToStop, nil)
+			}(object.Key)
 
 			// Wait for readStream to start up before io.Copy
 			log.Debug("<-waitForStart")
-			<-waitForStart
+			select {
+			case <-waitForStart:
+			case err := <-readDone:
+				// if we can not read the object we continue with next
+				log.Warn("Can not read ", object.Key, ", ", err)
+				continue
+			}
 
 			// Create buffer write backup label to it
 			plain := util.StreamToByte(walStream)
@@ -664,6 +905,10 @@ func (b S3backend) GetStartWalLocation(viper *viper.Viper, bp *backup.Backup) (s
 			// Tell readStream to fish after io.Copy
 			log.Debug("tellToStop <- true")
 			tellToStop <- true
+			if err := <-readDone; err != nil {
+				log.Warn("Can not read ", object.Key, ", ", err)
+				continue
+			}
 
 			if len(regLabel.Find(plain)) > 1 {
 				log.Debug("Found matching backup label")
@@ -681,10 +926,192 @@ func (b S3backend) GetStartWalLocation(viper *viper.Viper, bp *backup.Backup) (s
 
 // DeleteWal deletes the given WAL-file
 func (b S3backend) DeleteWal(viper *viper.Viper, w *backup.Wal) (err error) {
-	minioClient := b.getS3Connection(viper)
-	err = minioClient.RemoveObject(w.Archive.Bucket, w.Name+w.Extension)
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return err
+	}
+	err = minioClient.RemoveObject(w.Archive.Bucket, objectKey(viper, w.Name+w.Extension))
 	if err != nil {
 		log.Warn(err)
 	}
 	return err
 }
+
+// lockKey returns the name of the lock object in the backup bucket,
+// locks are shared by all clusters of the repository (see backup.LockPrefix)
+func lockKey(lock backup.Lock) string {
+	return backup.LockPrefix + "/" + lock.Key()
+}
+
+// WriteLock writes or refreshes the lock object of a holder in the backup bucket
+// An object is only visible after it was uploaded completely
+func (b S3backend) WriteLock(viper *viper.Viper, lock backup.Lock) (err error) {
+	bucket := viper.GetString("s3_bucket_backup")
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return err
+	}
+
+	exists, err := minioClient.BucketExists(bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err = minioClient.MakeBucket(bucket, viper.GetString("s3_location")); err != nil {
+			return err
+		}
+		log.Infof("Bucket %s created.", bucket)
+	}
+
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	_, err = minioClient.PutObject(bucket, lockKey(lock), bytes.NewReader(data), "application/json")
+	return err
+}
+
+// GetLocks returns all lock objects of the named lock
+func (b S3backend) GetLocks(viper *viper.Viper, name string) (locks []backup.Lock, err error) {
+	bucket := viper.GetString("s3_bucket_backup")
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := minioClient.BucketExists(bucket)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	objectCh := minioClient.ListObjects(bucket, backup.LockPrefix+"/"+name+"/", true, doneCh)
+	for object := range objectCh {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		if filepath.Ext(object.Key) != ".json" {
+			continue
+		}
+		data, err := b.readObject(minioClient, bucket, object.Key)
+		if err != nil {
+			if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+				// Released in the meantime
+				continue
+			}
+			return nil, err
+		}
+		var lock backup.Lock
+		if err := json.Unmarshal(data, &lock); err != nil {
+			log.Warn("Ignoring invalid lock object ", object.Key, ": ", err)
+			continue
+		}
+		locks = append(locks, lock)
+	}
+	return locks, nil
+}
+
+// DeleteLock removes the lock object of a holder
+func (b S3backend) DeleteLock(viper *viper.Viper, lock backup.Lock) (err error) {
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return err
+	}
+	return minioClient.RemoveObject(viper.GetString("s3_bucket_backup"), lockKey(lock))
+}
+
+// readObject reads a small object completely
+func (b S3backend) readObject(minioClient minio.Client, bucket string, name string) (data []byte, err error) {
+	object, err := minioClient.GetObject(bucket, name)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return ioutil.ReadAll(object)
+}
+
+// WriteObject writes an object of the repository into the backup bucket
+func (b S3backend) WriteObject(viper *viper.Viper, key string, data []byte) (err error) {
+	bucket := viper.GetString("s3_bucket_backup")
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return err
+	}
+
+	exists, err := minioClient.BucketExists(bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err = minioClient.MakeBucket(bucket, viper.GetString("s3_location")); err != nil {
+			return err
+		}
+		log.Infof("Bucket %s created.", bucket)
+	}
+	_, err = minioClient.PutObject(bucket, key, bytes.NewReader(data), "application/octet-stream")
+	return err
+}
+
+// ReadObject reads an object of the repository from the backup bucket
+func (b S3backend) ReadObject(viper *viper.Viper, key string) (data []byte, err error) {
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return nil, err
+	}
+	return b.readObject(minioClient, viper.GetString("s3_bucket_backup"), key)
+}
+
+// ListObjects returns all objects of the repository in the backup bucket below prefix
+func (b S3backend) ListObjects(viper *viper.Viper, prefix string) (objects []backup.Object, err error) {
+	bucket := viper.GetString("s3_bucket_backup")
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := minioClient.BucketExists(bucket)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	for object := range minioClient.ListObjects(bucket, prefix, true, doneCh) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		objects = append(objects, backup.Object{Key: object.Key, Size: object.Size})
+	}
+	return objects, nil
+}
+
+// DeleteObject removes an object of the repository from the backup bucket
+func (b S3backend) DeleteObject(viper *viper.Viper, key string) (err error) {
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return err
+	}
+	return minioClient.RemoveObject(viper.GetString("s3_bucket_backup"), key)
+}
+
+// MoveToCluster copies an object of the bucket below the prefix of a cluster and removes the original,
+// the copy keeps the metadata with the checksums
+func (b S3backend) MoveToCluster(viper *viper.Viper, name string, backuptype string, prefix string) (err error) {
+	bucket, err := streamBucket(viper, backuptype)
+	if err != nil {
+		return err
+	}
+	minioClient, err := b.getS3Connection(viper)
+	if err != nil {
+		return err
+	}
+	dst, err := minio.NewDestinationInfo(bucket, prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err = minioClient.CopyObject(dst, minio.NewSourceInfo(bucket, name, nil)); err != nil {
+		return err
+	}
+	return minioClient.RemoveObject(bucket, name)
+}
@@ -0,0 +1,305 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+)
+
+const (
+	// minLockTTL is the shortest time a lock is valid without heartbeat
+	minLockTTL = 10 * time.Second
+)
+
+// LockConflictError is returned if a lock is held by someone else
+type LockConflictError struct {
+	Holders []backup.Lock
+}
+
+func (e *LockConflictError) Error() string {
+	holders := make([]string, 0, len(e.Holders))
+	for _, h := range e.Holders {
+		holders = append(holders, h.String())
+	}
+	return "Lock is held by someone else: " + strings.Join(holders, ", ")
+}
+
+// HeldLock is a lock in the storage held by this process
+// It is refreshed in the background until it is released.
+// If it can not be refreshed in time or another holder removed it, it is lost
+// and the context of the lock is cancelled
+type HeldLock struct {
+	lock   backup.Lock
+	viper  *viper.Viper
+	stop   chan struct{}
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	lost error
+}
+
+// WriteLock writes or refreshes the lock object of a holder
+func WriteLock(viper *viper.Viper, lock backup.Lock) (err error) {
+	bn := viper.GetString("backup_to")
+	return backends[bn].WriteLock(viper, lock)
+}
+
+// GetLocks returns all lock objects for the named lock
+func GetLocks(viper *viper.Viper, name string) (locks []backup.Lock, err error) {
+	bn := viper.GetString("backup_to")
+	return backends[bn].GetLocks(viper, name)
+}
+
+// DeleteLock removes the lock object of a holder
+func DeleteLock(viper *viper.Viper, lock backup.Lock) (err error) {
+	bn := viper.GetString("backup_to")
+	return backends[bn].DeleteLock(viper, lock)
+}
+
+// AcquireLock takes the named lock in the given mode, the owner describes who holds the lock
+// Conflicting locks are retried until lock_wait is over
+func AcquireLock(viper *viper.Viper, name string, mode backup.LockMode, owner string) (held *HeldLock, err error) {
+	return AcquireLockWait(viper, name, mode, owner, viper.GetDuration("lock_wait"))
+}
+
+// AcquireLockWait is AcquireLock, conflicting locks are retried until wait is over
+func AcquireLockWait(viper *viper.Viper, name string, mode backup.LockMode, owner string, wait time.Duration) (held *HeldLock, err error) {
+	ttl := viper.GetDuration("lock_ttl")
+	if ttl < minLockTTL {
+		ttl = minLockTTL
+	}
+	deadline := time.Now().Add(wait)
+
+	id, err := newLockID()
+	if err != nil {
+		return nil, err
+	}
+	lock := backup.Lock{
+		Name:  name,
+		ID:    id,
+		Owner: owner,
+		Mode:  mode,
+	}
+
+	for {
+		err = tryLock(viper, &lock, ttl)
+		if err == nil {
+			break
+		}
+		if _, conflict := err.(*LockConflictError); !conflict || time.Now().After(deadline) {
+			return nil, err
+		}
+		// Wait a random time, so two waiting holders do not collide again
+		delay, _ := rand.Int(rand.Reader, big.NewInt(int64(4*time.Second)))
+		log.Info(err, ", retrying")
+		time.Sleep(time.Second + time.Duration(delay.Int64()))
+	}
+	log.Debug("Acquired ", lock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	held = &HeldLock{
+		lock:   lock,
+		viper:  viper,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go held.heartbeat(ttl)
+	return held, nil
+}
+
+// newLockID returns a random ID for a lock object
+func newLockID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// tryLock writes the lock object and checks for conflicting holders afterwards
+// Writing before checking makes sure two holders can not both miss each other:
+// the holder that lists second always sees the first one. There is no tie-break,
+// a holder that sees any live conflicting holder backs off, no matter who was first.
+// If two holders list after both wrote, both back off and retry after a random delay.
+// This needs a storage that lists a written object right away (read-after-write),
+// the local file system and S3 (since 2020) as well as MinIO do.
+func tryLock(viper *viper.Viper, lock *backup.Lock, ttl time.Duration) (err error) {
+	now := time.Now()
+	lock.Created = now
+	lock.Expires = now.Add(ttl)
+	if err = WriteLock(viper, *lock); err != nil {
+		return fmt.Errorf("Can not write lock %s: %v", lock.Name, err)
+	}
+
+	holders, err := GetLocks(viper, lock.Name)
+	if err != nil {
+		DeleteLock(viper, *lock)
+		return fmt.Errorf("Can not get holders of lock %s: %v", lock.Name, err)
+	}
+
+	var conflicts []backup.Lock
+	for _, h := range holders {
+		if h.ID == lock.ID {
+			continue
+		}
+		if h.Expired(now) {
+			log.Warn("Removing stale ", h)
+			if err := DeleteLock(viper, h); err != nil {
+				log.Warn("Can not remove stale lock: ", err)
+			}
+			continue
+		}
+		if lock.ConflictsWith(h) {
+			conflicts = append(conflicts, h)
+		}
+	}
+	if len(conflicts) > 0 {
+		if err = DeleteLock(viper, *lock); err != nil {
+			log.Warn("Can not remove own lock: ", err)
+		}
+		return &LockConflictError{Holders: conflicts}
+	}
+	return nil
+}
+
+// heartbeat refreshes the lock until it is released or lost
+func (h *HeldLock) heartbeat(ttl time.Duration) {
+	defer close(h.done)
+	interval := ttl / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			if err := h.refresh(ttl, interval); err != nil {
+				log.Error(err)
+				h.mu.Lock()
+				h.lost = err
+				h.mu.Unlock()
+				h.cancel()
+				return
+			}
+		}
+	}
+}
+
+// errLockRemoved is returned by renew if another holder removed the lock object
+var errLockRemoved = errors.New("removed by another holder")
+
+// refresh extends the lock, it returns an error if the lock is lost
+// A failed refresh is retried with the next beat, unless the lock expires before
+func (h *HeldLock) refresh(ttl time.Duration, interval time.Duration) error {
+	refreshed, err := h.renew(ttl)
+	if err == nil {
+		old := h.lock
+		h.lock = refreshed
+		if err = DeleteLock(h.viper, old); err != nil {
+			log.Warn("Can not remove the old object of the ", h.lock.Name, " lock: ", err)
+		}
+		return nil
+	}
+	if err == errLockRemoved {
+		return fmt.Errorf("The %s lock was %v", h.lock.Name, err)
+	}
+	if time.Now().Add(interval).After(h.lock.Expires) {
+		return fmt.Errorf("The %s lock expires before it can be refreshed: %v", h.lock.Name, err)
+	}
+	log.Warn("Can not refresh ", h.lock.Name, " lock: ", err)
+	return nil
+}
+
+// renew writes the lock again under a new ID and returns it, the old object is still there.
+// The storages can not write conditionally, so the old object is not overwritten: another holder
+// could remove it as stale between checking it and writing it, the write would then bring back the lock
+// without a conflict check. Like in tryLock the new object is written first and the holders are listed
+// afterwards. If the old object is still listed, no other holder can have taken a conflicting lock:
+// it would have seen the old object or, after removing it, the new one and backed off.
+// Conflicting holders listed next to the old object are such newcomers that back off
+func (h *HeldLock) renew(ttl time.Duration) (refreshed backup.Lock, err error) {
+	refreshed = h.lock
+	if refreshed.ID, err = newLockID(); err != nil {
+		return refreshed, err
+	}
+	refreshed.Expires = time.Now().Add(ttl)
+	if err = WriteLock(h.viper, refreshed); err != nil {
+		return refreshed, err
+	}
+	holders, err := GetLocks(h.viper, h.lock.Name)
+	found := false
+	for _, holder := range holders {
+		if holder.ID == h.lock.ID {
+			found = true
+		} else if holder.ID != refreshed.ID && refreshed.ConflictsWith(holder) && !holder.Expired(time.Now()) {
+			log.Debug("Conflicting holder of the ", h.lock.Name, " lock is backing off: ", holder)
+		}
+	}
+	if err == nil && !found {
+		err = errLockRemoved
+	}
+	if err != nil {
+		if deleteErr := DeleteLock(h.viper, refreshed); deleteErr != nil {
+			log.Warn("Can not remove the new object of the ", h.lock.Name, " lock: ", deleteErr)
+		}
+	}
+	return refreshed, err
+}
+
+// Context returns a context that is cancelled when the lock is lost or released
+func (h *HeldLock) Context() context.Context {
+	return h.ctx
+}
+
+// Err returns why the lock was lost, it is nil as long as the lock is held
+func (h *HeldLock) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lost
+}
+
+// Release stops the heartbeat and removes the lock
+func (h *HeldLock) Release() (err error) {
+	close(h.stop)
+	<-h.done
+	h.cancel()
+	if err = DeleteLock(h.viper, h.lock); err != nil {
+		return fmt.Errorf("Can not release lock %s: %v", h.lock.Name, err)
+	}
+	log.Debug("Released ", h.lock.Name, " lock")
+	return nil
+}
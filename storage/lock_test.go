@@ -0,0 +1,231 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/xxorde/pgglaskugel/backup"
+)
+
+// newLockViper returns a configuration with the file backend in a temporary directory
+func newLockViper(t *testing.T) (v *viper.Viper, cleanup func()) {
+	dir, err := ioutil.TempDir("", "pgglaskugel-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v = viper.New()
+	v.Set("backup_to", "file")
+	v.Set("archivedir", dir)
+	v.Set("lock_ttl", minLockTTL)
+	v.Set("lock_wait", time.Duration(0))
+	return v, func() { os.RemoveAll(dir) }
+}
+
+// writeHolder writes the lock object of another holder that is still alive
+func writeHolder(t *testing.T, v *viper.Viper, id string, mode backup.LockMode, expires time.Time) backup.Lock {
+	lock := backup.Lock{Name: "archive", ID: id, Owner: id, Mode: mode, Created: time.Now(), Expires: expires}
+	if err := WriteLock(v, lock); err != nil {
+		t.Fatal(err)
+	}
+	return lock
+}
+
+func holderIDs(t *testing.T, v *viper.Viper) map[string]bool {
+	holders, err := GetLocks(v, "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for _, h := range holders {
+		ids[h.ID] = true
+	}
+	return ids
+}
+
+func TestTryLock(t *testing.T) {
+	live := time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		mode     backup.LockMode
+		others   []backup.Lock
+		conflict bool
+		left     []string
+	}{
+		{"free", backup.LockExclusive, nil, false, []string{"me"}},
+		{"shared with shared", backup.LockShared,
+			[]backup.Lock{{ID: "a", Mode: backup.LockShared, Expires: live}}, false, []string{"me", "a"}},
+		{"exclusive with shared", backup.LockExclusive,
+			[]backup.Lock{{ID: "a", Mode: backup.LockShared, Expires: live}}, true, []string{"a"}},
+		{"shared with exclusive", backup.LockShared,
+			[]backup.Lock{{ID: "a", Mode: backup.LockExclusive, Expires: live}}, true, []string{"a"}},
+		// A stale holder is removed and does not conflict
+		{"stale exclusive", backup.LockExclusive,
+			[]backup.Lock{{ID: "a", Mode: backup.LockExclusive, Expires: time.Now().Add(-time.Second)}}, false, []string{"me"}},
+	}
+	for _, test := range tests {
+		v, cleanup := newLockViper(t)
+		for _, o := range test.others {
+			writeHolder(t, v, o.ID, o.Mode, o.Expires)
+		}
+		lock := backup.Lock{Name: "archive", ID: "me", Mode: test.mode}
+		err := tryLock(v, &lock, minLockTTL)
+		if _, conflict := err.(*LockConflictError); conflict != test.conflict {
+			t.Errorf("%s: got %v, conflict %v expected", test.name, err, test.conflict)
+		}
+		ids := holderIDs(t, v)
+		if len(ids) != len(test.left) {
+			t.Errorf("%s: holders left %v, want %v", test.name, ids, test.left)
+		}
+		for _, id := range test.left {
+			if !ids[id] {
+				t.Errorf("%s: holder %s is missing, left %v", test.name, id, ids)
+			}
+		}
+		cleanup()
+	}
+}
+
+// TestTryLockTieBreak checks the rule documented on tryLock: the holder that lists
+// second sees the first one, if both list after both wrote, both back off
+func TestTryLockTieBreak(t *testing.T) {
+	v, cleanup := newLockViper(t)
+	defer cleanup()
+
+	first := backup.Lock{Name: "archive", ID: "first", Mode: backup.LockExclusive}
+	if err := tryLock(v, &first, minLockTTL); err != nil {
+		t.Fatal(err)
+	}
+	second := backup.Lock{Name: "archive", ID: "second", Mode: backup.LockExclusive}
+	if _, ok := tryLock(v, &second, minLockTTL).(*LockConflictError); !ok {
+		t.Fatal("the second holder did not see the first one")
+	}
+	if err := DeleteLock(v, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both wrote before either listed: the pending object of the other one is a conflict for both
+	a := writeHolder(t, v, "a", backup.LockExclusive, time.Now().Add(minLockTTL))
+	b := backup.Lock{Name: "archive", ID: "b", Mode: backup.LockExclusive}
+	if _, ok := tryLock(v, &b, minLockTTL).(*LockConflictError); !ok {
+		t.Error("b did not back off")
+	}
+	writeHolder(t, v, "b", backup.LockExclusive, time.Now().Add(minLockTTL))
+	if _, ok := tryLock(v, &a, minLockTTL).(*LockConflictError); !ok {
+		t.Error("a did not back off")
+	}
+	if ids := holderIDs(t, v); ids["a"] {
+		t.Error("a did not remove its lock object after backing off")
+	}
+}
+
+func TestLostLock(t *testing.T) {
+	v, cleanup := newLockViper(t)
+	defer cleanup()
+
+	held, err := AcquireLock(v, "archive", backup.LockShared, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = held.Err(); err != nil {
+		t.Fatal("lock is lost right after acquiring it: ", err)
+	}
+
+	// Another holder removed the lock, it must not be written again by the heartbeat
+	if err = DeleteLock(v, held.lock); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-held.Context().Done():
+	case <-time.After(2 * minLockTTL):
+		t.Fatal("context was not cancelled after the lock was removed")
+	}
+	if held.Err() == nil {
+		t.Error("Err is nil for a lost lock")
+	}
+	if ids := holderIDs(t, v); len(ids) != 0 {
+		t.Errorf("the lost lock was written again: %v", ids)
+	}
+	if err = held.Release(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRefreshKeepsLock(t *testing.T) {
+	v, cleanup := newLockViper(t)
+	defer cleanup()
+
+	held, err := AcquireLock(v, "archive", backup.LockExclusive, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := held.lock.Expires
+	time.Sleep(10 * time.Millisecond)
+	if err = held.refresh(minLockTTL, minLockTTL/3); err != nil {
+		t.Fatal(err)
+	}
+	if !held.lock.Expires.After(expires) {
+		t.Error("refresh did not extend the lock")
+	}
+	// The lock is written under a new ID, the old object is removed
+	if ids := holderIDs(t, v); len(ids) != 1 || !ids[held.lock.ID] {
+		t.Errorf("lock objects after the refresh: %v, expected only %s", ids, held.lock.ID)
+	}
+	if err = held.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if held.Context().Err() == nil {
+		t.Error("context is not cancelled after release")
+	}
+	if held.Err() != nil {
+		t.Error("a released lock is reported as lost: ", held.Err())
+	}
+}
+
+// TestRefreshAfterStaleRemoval checks that a lock another holder removed as stale and took over
+// is lost and not written again next to the new holder
+func TestRefreshAfterStaleRemoval(t *testing.T) {
+	v, cleanup := newLockViper(t)
+	defer cleanup()
+
+	held, err := AcquireLock(v, "archive", backup.LockExclusive, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release()
+
+	// The heartbeat was late, another holder removed the lock and took it
+	if err = DeleteLock(v, held.lock); err != nil {
+		t.Fatal(err)
+	}
+	other := writeHolder(t, v, "other", backup.LockExclusive, time.Now().Add(time.Hour))
+
+	if err = held.refresh(minLockTTL, minLockTTL/3); err == nil {
+		t.Fatal("the lock was refreshed after another holder took it")
+	}
+	if ids := holderIDs(t, v); len(ids) != 1 || !ids[other.ID] {
+		t.Errorf("lock objects %v, expected only the new holder %s", ids, other.ID)
+	}
+}
@@ -32,13 +32,18 @@ import (
 type Backend interface {
 
 	// Writes a datastream to the given backend
-	WriteStream(viper *viper.Viper, input *io.Reader, name string, backuptype string)
+	// If reading the stream fails the partial data is discarded and never becomes visible.
+	// The sha256 sum of the stored data and logicalSum are kept with the object
+	WriteStream(viper *viper.Viper, input *io.Reader, name string, backuptype string, logicalSum func() string) (err error)
+
+	// Returns the checksums stored with an object, they are empty for objects without checksums
+	GetChecksums(viper *viper.Viper, name string, backuptype string) (sums backup.Checksums, err error)
 
 	// Returns the data from the given backend
 	Fetch(viper *viper.Viper) error
 
 	// Returns a specific basebackup
-	GetBasebackup(viper *viper.Viper, backup *backup.Backup, backupStream *io.Reader, wgStart *sync.WaitGroup, wgDone *sync.WaitGroup)
+	GetBasebackup(viper *viper.Viper, backup *backup.Backup, backupStream *io.Reader, wgStart *sync.WaitGroup, wgDone *sync.WaitGroup) (err error)
 
 	// Returns all found basebackups
 	GetBackups(viper *viper.Viper, subDirWal string) (bp backup.Backups)
@@ -53,4 +58,24 @@ type Backend interface {
 
 	// Returns the first WAL-file name for a backup
 	GetStartWalLocation(viper *viper.Viper, backup *backup.Backup) (startWalLocation string, err error)
+
+	// WriteObject writes an object of the repository (e.g. a chunk of a deduplicated backup) under key,
+	// it only becomes visible when it is written completely
+	WriteObject(viper *viper.Viper, key string, data []byte) (err error)
+	// ReadObject reads an object of the repository completely
+	ReadObject(viper *viper.Viper, key string) (data []byte, err error)
+	// ListObjects returns all objects of the repository with keys below prefix
+	ListObjects(viper *viper.Viper, prefix string) (objects []backup.Object, err error)
+	// DeleteObject removes an object of the repository
+	DeleteObject(viper *viper.Viper, key string) (err error)
+	// MoveToCluster moves an object of the backups (backuptype basebackup) or of the WAL archive (archive) with its
+	// checksums from the layout without cluster prefixes (repository format version 1) below the prefix of a cluster
+	MoveToCluster(viper *viper.Viper, name string, backuptype string, prefix string) (err error)
+
+	// WriteLock writes or refreshes the lock object of a holder
+	WriteLock(viper *viper.Viper, lock backup.Lock) (err error)
+	// GetLocks returns all lock objects for the named lock
+	GetLocks(viper *viper.Viper, name string) (locks []backup.Lock, err error)
+	// DeleteLock removes the lock object of a holder
+	DeleteLock(viper *viper.Viper, lock backup.Lock) (err error)
 }
@@ -27,6 +27,7 @@ import (
 
 	"github.com/spf13/viper"
 	"github.com/xxorde/pgglaskugel/backup"
+	"github.com/xxorde/pgglaskugel/metrics"
 	"github.com/xxorde/pgglaskugel/storage/backends/file"
 	"github.com/xxorde/pgglaskugel/storage/backends/s3minioCs"
 
@@ -45,19 +46,47 @@ var (
 // GetMyBackups does something
 func GetMyBackups(viper *viper.Viper, subDirWal string) (backups backup.Backups) {
 	bn := viper.GetString("backup_to")
-	return backends[bn].GetBackups(viper, subDirWal)
+	backups = backends[bn].GetBackups(viper, subDirWal)
+
+	var used int64
+	for _, b := range backups.Backup {
+		used += b.Size
+		for _, part := range b.Parts() {
+			used += part.Size
+		}
+	}
+	metrics.StorageUsed.Set(float64(used), bn, "basebackup")
+	return backups
 }
 
 // GetWals returns all Wal-Files for a Backup
 func GetWals(viper *viper.Viper) (archive backup.Archive, err error) {
 	bn := viper.GetString("backup_to")
-	return backends[bn].GetWals(viper)
+	archive, err = backends[bn].GetWals(viper)
+	if err != nil {
+		return archive, err
+	}
+
+	var used int64
+	for _, w := range archive.WalFiles {
+		used += w.Size
+	}
+	metrics.StorageUsed.Set(float64(used), bn, "wal")
+	return archive, nil
 }
 
 // WriteStream writes the stream to the configured archive_to
-func WriteStream(viper *viper.Viper, input *io.Reader, name string, backuptype string) {
+// The data only becomes visible if the stream was read without error
+// logicalSum returns the checksum of the data before compression and encryption
+func WriteStream(viper *viper.Viper, input *io.Reader, name string, backuptype string, logicalSum func() string) (err error) {
 	bn := viper.GetString("backup_to")
-	backends[bn].WriteStream(viper, input, name, backuptype)
+	return backends[bn].WriteStream(viper, input, name, backuptype, logicalSum)
+}
+
+// GetChecksums returns the checksums stored with the object
+func GetChecksums(viper *viper.Viper, name string, backuptype string) (sums backup.Checksums, err error) {
+	bn := viper.GetString("backup_to")
+	return backends[bn].GetChecksums(viper, name, backuptype)
 }
 
 // Fetch fetches
@@ -67,9 +96,9 @@ func Fetch(viper *viper.Viper) error {
 }
 
 // GetBasebackup gets basebackups
-func GetBasebackup(viper *viper.Viper, bp *backup.Backup, backupStream *io.Reader, wgStart *sync.WaitGroup, wgDone *sync.WaitGroup) {
+func GetBasebackup(viper *viper.Viper, bp *backup.Backup, backupStream *io.Reader, wgStart *sync.WaitGroup, wgDone *sync.WaitGroup) (err error) {
 	bn := viper.GetString("backup_to")
-	backends[bn].GetBasebackup(viper, bp, backupStream, wgStart, wgDone)
+	return backends[bn].GetBasebackup(viper, bp, backupStream, wgStart, wgDone)
 }
 
 // DeleteAll deletes all backups in the struct
@@ -91,6 +120,36 @@ func DeleteWal(viper *viper.Viper, w *backup.Wal) (err error) {
 	return backends[bn].DeleteWal(viper, w)
 }
 
+// WriteObject writes an object of the repository under key
+func WriteObject(viper *viper.Viper, key string, data []byte) (err error) {
+	bn := viper.GetString("backup_to")
+	return backends[bn].WriteObject(viper, key, data)
+}
+
+// ReadObject reads an object of the repository
+func ReadObject(viper *viper.Viper, key string) (data []byte, err error) {
+	bn := viper.GetString("backup_to")
+	return backends[bn].ReadObject(viper, key)
+}
+
+// ListObjects returns all objects of the repository with keys below prefix
+func ListObjects(viper *viper.Viper, prefix string) (objects []backup.Object, err error) {
+	bn := viper.GetString("backup_to")
+	return backends[bn].ListObjects(viper, prefix)
+}
+
+// DeleteObject removes an object of the repository
+func DeleteObject(viper *viper.Viper, key string) (err error) {
+	bn := viper.GetString("backup_to")
+	return backends[bn].DeleteObject(viper, key)
+}
+
+// MoveToCluster moves an object of the layout without cluster prefixes below the prefix of a cluster
+func MoveToCluster(viper *viper.Viper, name string, backuptype string, prefix string) (err error) {
+	bn := viper.GetString("backup_to")
+	return backends[bn].MoveToCluster(viper, name, backuptype, prefix)
+}
+
 /*
 	Not Interface functions below
 */
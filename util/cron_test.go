@@ -0,0 +1,155 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+// bits returns the bit set of the values
+func bits(values ...int) (b uint64) {
+	for _, v := range values {
+		b |= 1 << uint(v)
+	}
+	return b
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field string
+		min   int
+		max   int
+		names map[string]int
+		want  uint64
+	}{
+		{"*", 0, 6, nil, bits(0, 1, 2, 3, 4, 5, 6)},
+		{"5", 0, 59, nil, bits(5)},
+		{"1-5", 0, 7, nil, bits(1, 2, 3, 4, 5)},
+		{"1,3,5", 0, 7, nil, bits(1, 3, 5)},
+		{"*/15", 0, 59, nil, bits(0, 15, 30, 45)},
+		{"10-30/10", 0, 59, nil, bits(10, 20, 30)},
+		{"5/20", 0, 59, nil, bits(5, 25, 45)},
+		{"1-3,10,20-22", 1, 31, nil, bits(1, 2, 3, 10, 20, 21, 22)},
+		{"mon-fri", 0, 7, cronDays, bits(1, 2, 3, 4, 5)},
+		{"jan,MAR,dec", 1, 12, cronMonths, bits(1, 3, 12)},
+	}
+	for _, test := range tests {
+		got, err := parseCronField(test.field, test.min, test.max, test.names)
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", test.field, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseCronField(%q) = %b, want %b", test.field, got, test.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"foo * * * *",
+		"* * * foo *",
+	} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("ParseCron(%q) did not fail", spec)
+		}
+	}
+}
+
+func TestParseCronSunday(t *testing.T) {
+	for _, spec := range []string{"0 0 * * 0", "0 0 * * 7", "0 0 * * sun"} {
+		s, err := ParseCron(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.dow&1 == 0 {
+			t.Errorf("ParseCron(%q) does not match sunday", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	date := func(value string) time.Time {
+		d, err := time.Parse("2006-01-02 15:04", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		// The next full minute, never the given time itself
+		{"* * * * *", "2024-05-10 10:20", "2024-05-10 10:21"},
+		{"*/15 * * * *", "2024-05-10 10:20", "2024-05-10 10:30"},
+		{"30 2 * * *", "2024-05-10 02:30", "2024-05-11 02:30"},
+		// Across the end of a month and of a year
+		{"0 0 1 * *", "2024-01-31 23:59", "2024-02-01 00:00"},
+		{"0 0 1 1 *", "2023-12-31 12:00", "2024-01-01 00:00"},
+		{"@yearly", "2024-06-15 00:00", "2025-01-01 00:00"},
+		{"59 23 31 * *", "2024-04-01 00:00", "2024-05-31 23:59"},
+		// Leap day
+		{"0 12 29 2 *", "2023-03-01 00:00", "2024-02-29 12:00"},
+		// Working days, friday to monday
+		{"30 2 * * 1-5", "2024-09-06 03:00", "2024-09-09 02:30"},
+		// Day of month and day of week restricted: either matches (friday or the 13th)
+		{"0 0 13 * 5", "2024-09-01 00:00", "2024-09-06 00:00"},
+		{"0 0 13 * 5", "2024-09-07 00:00", "2024-09-13 00:00"},
+		{"0 0 13 * 5", "2024-09-13 00:00", "2024-09-20 00:00"},
+		{"0 0 13 * 5", "2024-10-12 00:00", "2024-10-13 00:00"},
+		// Only one of them restricted: it has to match
+		{"0 0 * * 1", "2024-09-01 00:00", "2024-09-02 00:00"},
+		{"0 0 13 * *", "2024-09-14 00:00", "2024-10-13 00:00"},
+	}
+	for _, test := range tests {
+		s, err := ParseCron(test.spec)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", test.spec, err)
+			continue
+		}
+		if got := s.Next(date(test.from)); !got.Equal(date(test.want)) {
+			t.Errorf("%q.Next(%s) = %s, want %s", test.spec, test.from, got.Format("2006-01-02 15:04"), test.want)
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	s, err := ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next := s.Next(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)); !next.IsZero() {
+		t.Errorf("Next of February 31st = %s, want the zero time", next)
+	}
+}
@@ -23,11 +23,16 @@ package util
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"strings"
+	"sync/atomic"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -117,3 +122,114 @@ func StreamToByte(stream io.Reader) []byte {
 	buf.ReadFrom(stream)
 	return buf.Bytes()
 }
+
+// CountingReader counts the bytes read through it
+type CountingReader struct {
+	Reader io.Reader
+	count  int64
+}
+
+// Read reads from the underlying reader and counts the bytes
+func (c *CountingReader) Read(p []byte) (n int, err error) {
+	n, err = c.Reader.Read(p)
+	atomic.AddInt64(&c.count, int64(n))
+	return n, err
+}
+
+// Count returns the number of bytes read so far
+func (c *CountingReader) Count() int64 {
+	return atomic.LoadInt64(&c.count)
+}
+
+// HashReader computes the sha256 sum of the data read through it
+type HashReader struct {
+	Reader io.Reader
+	hash   hash.Hash
+}
+
+// NewHashReader returns a HashReader that reads from r
+func NewHashReader(r io.Reader) *HashReader {
+	return &HashReader{Reader: r, hash: sha256.New()}
+}
+
+// Read reads from the underlying reader and adds the data to the sum
+func (h *HashReader) Read(p []byte) (n int, err error) {
+	n, err = h.Reader.Read(p)
+	h.hash.Write(p[:n])
+	return n, err
+}
+
+// Sum returns the hex encoded sha256 sum of the data read so far
+func (h *HashReader) Sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+// HashFile returns the hex encoded sha256 sum of the file
+func HashFile(path string) (sum string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := NewHashReader(file)
+	if _, err = io.Copy(ioutil.Discard, h); err != nil {
+		return "", err
+	}
+	return h.Sum(), nil
+}
+
+// WaitReader reads the output of a process and calls Wait at the end of the output.
+// If Wait fails its error is returned instead of io.EOF, so a consumer does not
+// mistake the output of a failed process for complete data.
+type WaitReader struct {
+	Reader io.Reader
+	Wait   func() error
+	done   bool
+	err    error
+}
+
+// Read reads from the underlying reader, at the end the result of Wait is returned
+func (w *WaitReader) Read(p []byte) (n int, err error) {
+	if w.done {
+		return 0, w.err
+	}
+	n, err = w.Reader.Read(p)
+	if err == io.EOF {
+		w.finish()
+		err = w.err
+	}
+	return n, err
+}
+
+// Close calls Wait if it was not called yet, e.g. because the reader was not read
+// until the end. It returns the error of Wait
+func (w *WaitReader) Close() error {
+	if !w.done {
+		w.finish()
+	}
+	if w.err == io.EOF {
+		return nil
+	}
+	return w.err
+}
+
+func (w *WaitReader) finish() {
+	w.done = true
+	w.err = io.EOF
+	if err := w.Wait(); err != nil {
+		w.err = err
+	}
+}
+
+// SyncDir flushes the directory to disk, so created, renamed or removed entries survive a crash
+func SyncDir(dir string) (err error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
@@ -25,6 +25,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -102,15 +103,20 @@ func checkpid(pidfile string) (*os.File, error) {
 
 	// if the file exists, compare the stored pid with the actual and give a reply
 	actualpid := os.Getpid()
-	file, err := os.Open(pidfile)
+	file, err := os.OpenFile(pidfile, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error opening pidfile %s: %s", pidfile, err)
+	}
 	syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
 
 	pidcontent, err := ioutil.ReadAll(file)
 	if err != nil {
+		closepidfile(file)
 		return nil, err
 	}
 	storedpid, err := strconv.Atoi(string(bytes.TrimSpace(pidcontent)))
 	if err != nil {
+		closepidfile(file)
 		DeletePidFile(pidfile)
 		return createpidfile(pidfile)
 
@@ -118,6 +124,7 @@ func checkpid(pidfile string) (*os.File, error) {
 
 	// if the actual pid differs from the stored pid, look if its an old entry or still active via /proc
 	if actualpid != storedpid {
+		closepidfile(file)
 		procfile := fmt.Sprintf("/proc/%d/cmdline", storedpid)
 		if _, err := os.Stat(procfile); err == nil {
 			pf, err := os.Open(procfile)
@@ -133,5 +140,33 @@ func checkpid(pidfile string) (*os.File, error) {
 		DeletePidFile(pidfile)
 		return createpidfile(pidfile)
 	}
+
+	// The pidfile is already ours, it is written again from the start
+	if err = file.Truncate(0); err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		closepidfile(file)
+		return nil, err
+	}
 	return file, nil
 }
+
+// PidFileHolder returns the pid stored in the pidfile and if that process is still running.
+// The command line of a running process is read from /proc
+func PidFileHolder(pidfile string) (pid int, running bool, cmdline string, err error) {
+	pidcontent, err := ioutil.ReadFile(pidfile)
+	if err != nil {
+		return 0, false, "", err
+	}
+	pid, err = strconv.Atoi(string(bytes.TrimSpace(pidcontent)))
+	if err != nil {
+		return 0, false, "", fmt.Errorf("pidfile %s does not contain a pid: %s", pidfile, err)
+	}
+	cfoutput, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		// The process is not active anymore, the pidfile is stale
+		return pid, false, "", nil
+	}
+	return pid, true, formatcmdline(cfoutput), nil
+}
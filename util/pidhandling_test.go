@@ -0,0 +1,76 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWritePidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgglaskugel-pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	own := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		name    string
+		content string // "" means there is no pidfile
+		fail    bool
+	}{
+		{"missing", "", false},
+		{"own pid", own, false},
+		{"own pid with newline", own + "\n", false},
+		{"garbage", "no pid", false},
+		{"stale pid", "2147483647", false},
+		{"running pid", "1", true},
+	}
+	for _, test := range tests {
+		pidfile := filepath.Join(dir, "test.pid")
+		os.Remove(pidfile)
+		if test.content != "" {
+			if err := ioutil.WriteFile(pidfile, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := WritePidFile(pidfile)
+		if (err != nil) != test.fail {
+			t.Errorf("%s: got error %v, failure expected %v", test.name, err, test.fail)
+			continue
+		}
+		content, err := ioutil.ReadFile(pidfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := own
+		if test.fail {
+			want = test.content
+		}
+		if string(content) != want {
+			t.Errorf("%s: pidfile contains %q, want %q", test.name, content, want)
+		}
+	}
+}
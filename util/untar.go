@@ -0,0 +1,311 @@
+// Package util - untar module
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package util
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Extractor extracts a tar archive into a directory.
+// Modes, modification times and symlinks are kept, nothing is written outside of the directory
+type Extractor struct {
+	// Dir is the destination directory
+	Dir string
+	// UID and GID of the extracted files, -1 keeps the owner from the archive (only possible as root)
+	UID int
+	GID int
+	// Progress is called every ProgressInterval with the number of files and bytes extracted so far
+	Progress         func(files int64, bytes int64)
+	ProgressInterval time.Duration
+	// Skip is called with the cleaned name of every regular file, if it returns true the file
+	// on disk is up to date and only its mode, owner and modification time are set
+	Skip func(name string) bool
+	// Include is called with the cleaned name of every entry, entries for which it returns false are not extracted
+	Include func(name string) bool
+	// Limit ends the extraction after this number of entries, the rest of the archive is not read. 0 extracts all
+	Limit int64
+	// Patch is called for regular files with a name ending in PatchSuffix, it changes the existing file
+	// (the name without suffix) with the content from r instead of replacing it
+	PatchSuffix string
+	Patch       func(file *os.File, r io.Reader) error
+
+	files    int64
+	bytes    int64
+	symlinks map[string]bool
+	dirs     []extractedDir
+}
+
+// extractedDir is a directory that gets its modification time at the end
+type extractedDir struct {
+	path    string
+	modTime time.Time
+}
+
+// NewExtractor returns an Extractor for the directory dir
+func NewExtractor(dir string) *Extractor {
+	return &Extractor{Dir: dir, UID: -1, GID: -1, ProgressInterval: 10 * time.Second}
+}
+
+// Files returns the number of extracted files
+func (e *Extractor) Files() int64 {
+	return e.files
+}
+
+// Bytes returns the number of extracted bytes
+func (e *Extractor) Bytes() int64 {
+	return e.bytes
+}
+
+// Extract extracts the tar archive from r, every file is synced before Extract returns
+func (e *Extractor) Extract(r io.Reader) (err error) {
+	dir, err := filepath.Abs(e.Dir)
+	if err != nil {
+		return err
+	}
+	e.symlinks = make(map[string]bool)
+	lastProgress := time.Now()
+
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid tar archive: %v", err)
+		}
+		name, err := e.checkName(header.Name)
+		if err != nil {
+			return err
+		}
+		if e.Include != nil && !e.Include(name) {
+			continue
+		}
+		target := filepath.Join(dir, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.extractDir(target, header)
+		case tar.TypeReg, tar.TypeRegA:
+			if e.Skip != nil && e.Skip(name) {
+				err = e.keepFile(target, header)
+			} else if e.Patch != nil && e.PatchSuffix != "" && strings.HasSuffix(name, e.PatchSuffix) {
+				err = e.patchFile(strings.TrimSuffix(target, e.PatchSuffix), header, tarReader)
+			} else {
+				err = e.extractFile(target, header, tarReader)
+			}
+		case tar.TypeSymlink:
+			err = e.extractSymlink(target, header)
+			e.symlinks[name] = true
+		case tar.TypeLink:
+			var linkName string
+			if linkName, err = e.checkName(header.Linkname); err == nil {
+				err = e.extractLink(target, filepath.Join(dir, linkName))
+			}
+		default:
+			log.Warnf("Skipping %s, unsupported type %q", header.Name, header.Typeflag)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		e.files++
+		if e.Progress != nil && time.Since(lastProgress) >= e.ProgressInterval {
+			e.Progress(e.files, e.bytes)
+			lastProgress = time.Now()
+		}
+		if e.Limit > 0 && e.files >= e.Limit {
+			break
+		}
+	}
+
+	// Directories are finished last, extracting files changes their modification time
+	for i := len(e.dirs) - 1; i >= 0; i-- {
+		if err = SyncDir(e.dirs[i].path); err != nil {
+			return err
+		}
+		if err = os.Chtimes(e.dirs[i].path, e.dirs[i].modTime, e.dirs[i].modTime); err != nil {
+			return err
+		}
+	}
+	if e.files == 0 {
+		// Nothing was extracted, dir may not even exist
+		return nil
+	}
+	return SyncDir(dir)
+}
+
+// checkName returns the cleaned name of an entry.
+// Absolute names, names outside of the directory and names below a symlink from the archive are rejected
+func (e *Extractor) checkName(name string) (clean string, err error) {
+	clean = filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("Refusing to extract %s, it is outside of the destination", name)
+	}
+	for parent := filepath.Dir(clean); parent != "."; parent = filepath.Dir(parent) {
+		if e.symlinks[parent] {
+			return "", fmt.Errorf("Refusing to extract %s, it is below the symlink %s", name, parent)
+		}
+	}
+	return clean, nil
+}
+
+// removeSymlink removes an existing symlink at target, so it is replaced instead of followed
+func removeSymlink(target string) error {
+	fi, err := os.Lstat(target)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(target)
+}
+
+// chown sets the owner of path
+func (e *Extractor) chown(path string, header *tar.Header) error {
+	uid, gid := e.UID, e.GID
+	if uid < 0 {
+		if os.Geteuid() != 0 {
+			return nil
+		}
+		uid, gid = header.Uid, header.Gid
+	}
+	return os.Lchown(path, uid, gid)
+}
+
+func (e *Extractor) extractDir(target string, header *tar.Header) (err error) {
+	mode := os.FileMode(header.Mode).Perm()
+	if err = os.MkdirAll(target, mode); err != nil {
+		return err
+	}
+	if err = os.Chmod(target, mode); err != nil {
+		return err
+	}
+	e.dirs = append(e.dirs, extractedDir{path: target, modTime: header.ModTime})
+	return e.chown(target, header)
+}
+
+func (e *Extractor) extractFile(target string, header *tar.Header, r io.Reader) (err error) {
+	mode := os.FileMode(header.Mode).Perm()
+	if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	if err = removeSymlink(target); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(file, r)
+	e.bytes += written
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Can not extract %s: %v", header.Name, err)
+	}
+	if err = file.Chmod(mode); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("Can not sync %s: %v", target, err)
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = e.chown(target, header); err != nil {
+		return err
+	}
+	return os.Chtimes(target, header.ModTime, header.ModTime)
+}
+
+// patchFile changes the existing file at target with Patch (it is created if it does not exist)
+// and sets mode, owner and modification time from the archive
+func (e *Extractor) patchFile(target string, header *tar.Header, r io.Reader) (err error) {
+	mode := os.FileMode(header.Mode).Perm()
+	if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	if err = removeSymlink(target); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return err
+	}
+	counter := &CountingReader{Reader: r}
+	err = e.Patch(file, counter)
+	e.bytes += counter.Count()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Can not apply %s: %v", header.Name, err)
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("Can not sync %s: %v", target, err)
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return e.keepFile(target, header)
+}
+
+// keepFile keeps the content of an existing file and sets mode, owner and modification time from the archive
+func (e *Extractor) keepFile(target string, header *tar.Header) (err error) {
+	if err = os.Chmod(target, os.FileMode(header.Mode).Perm()); err != nil {
+		return err
+	}
+	if err = e.chown(target, header); err != nil {
+		return err
+	}
+	return os.Chtimes(target, header.ModTime, header.ModTime)
+}
+
+func (e *Extractor) extractSymlink(target string, header *tar.Header) (err error) {
+	if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	if err = removeSymlink(target); err != nil {
+		return err
+	}
+	if err = os.Symlink(header.Linkname, target); err != nil {
+		return err
+	}
+	return e.chown(target, header)
+}
+
+func (e *Extractor) extractLink(target string, linkTarget string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+	if err = os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(linkTarget, target)
+}
@@ -0,0 +1,213 @@
+// Copyright © 2017 Alexander Sosna <alexander@xxor.de>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTar returns a tar archive with the given headers, regular files get their name as content
+func testTar(t *testing.T, headers ...tar.Header) io.Reader {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, h := range headers {
+		h := h
+		if h.Mode == 0 {
+			h.Mode = 0600
+		}
+		if h.Typeflag == tar.TypeReg {
+			h.Size = int64(len(h.Name))
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(h.Name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// testDirs returns an empty destination and a directory next to it that must stay empty
+func testDirs(t *testing.T) (dir string, outside string, cleanup func()) {
+	base, err := ioutil.TempDir("", "pgglaskugel-untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, outside = filepath.Join(base, "dest"), filepath.Join(base, "outside")
+	for _, d := range []string{dir, outside} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, outside, func() { os.RemoveAll(base) }
+}
+
+func TestExtract(t *testing.T) {
+	dir, _, cleanup := testDirs(t)
+	defer cleanup()
+
+	modTime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	e := NewExtractor(dir)
+	err := e.Extract(testTar(t,
+		tar.Header{Name: "./base/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: modTime},
+		tar.Header{Name: "./base/1", Typeflag: tar.TypeReg, Mode: 0640, ModTime: modTime},
+		tar.Header{Name: "base/link", Typeflag: tar.TypeSymlink, Linkname: "1"},
+		tar.Header{Name: "base/hard", Typeflag: tar.TypeLink, Linkname: "./base/1"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Files() != 4 || e.Bytes() != int64(len("./base/1")) {
+		t.Errorf("%d files and %d bytes extracted", e.Files(), e.Bytes())
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "base", "link"))
+	if err != nil || string(content) != "./base/1" {
+		t.Errorf("content is %q (%v)", content, err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "base", "hard"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 || !fi.ModTime().Equal(modTime) {
+		t.Errorf("mode is %v and modification time %v", fi.Mode(), fi.ModTime())
+	}
+	if fi, err = os.Stat(filepath.Join(dir, "base")); err != nil || !fi.ModTime().Equal(modTime) {
+		t.Errorf("modification time of the directory is %v (%v)", fi.ModTime(), err)
+	}
+}
+
+func TestExtractRejectsTraversal(t *testing.T) {
+	tests := [][]tar.Header{
+		{{Name: "../evil", Typeflag: tar.TypeReg}},
+		{{Name: "a/../../evil", Typeflag: tar.TypeReg}},
+		{{Name: "/evil", Typeflag: tar.TypeReg}},
+		{{Name: "../evil", Typeflag: tar.TypeDir}},
+		{{Name: "../evil", Typeflag: tar.TypeSymlink, Linkname: "x"}},
+		{{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../outside/file"}},
+		// A symlink of the archive can point anywhere, but nothing is extracted through it
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside"}, {Name: "link/evil", Typeflag: tar.TypeReg}},
+		{{Name: "a/link", Typeflag: tar.TypeSymlink, Linkname: "../../outside"}, {Name: "a/link/b/evil", Typeflag: tar.TypeDir}},
+		{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside"}, {Name: "hard", Typeflag: tar.TypeLink, Linkname: "link/file"}},
+	}
+	for _, headers := range tests {
+		dir, outside, cleanup := testDirs(t)
+		if err := ioutil.WriteFile(filepath.Join(outside, "file"), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		err := NewExtractor(dir).Extract(testTar(t, headers...))
+		if err == nil || !strings.HasPrefix(err.Error(), "Refusing to extract") {
+			t.Errorf("%s: error is %v", headers[len(headers)-1].Name, err)
+		}
+		if entries, _ := ioutil.ReadDir(outside); len(entries) != 1 {
+			t.Errorf("%s: something was written to %s", headers[len(headers)-1].Name, outside)
+		}
+		if entries, _ := ioutil.ReadDir(filepath.Dir(dir)); len(entries) != 2 {
+			t.Errorf("%s: something was written next to %s", headers[len(headers)-1].Name, dir)
+		}
+		cleanup()
+	}
+}
+
+func TestExtractReplacesSymlinks(t *testing.T) {
+	dir, outside, cleanup := testDirs(t)
+	defer cleanup()
+
+	// Symlinks already in the destination are replaced, not followed
+	victim := filepath.Join(outside, "file")
+	if err := ioutil.WriteFile(victim, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"file", "link"} {
+		if err := os.Symlink(victim, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := NewExtractor(dir).Extract(testTar(t,
+		tar.Header{Name: "file", Typeflag: tar.TypeReg},
+		tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := ioutil.ReadFile(victim); string(content) != "keep" {
+		t.Errorf("file outside of the destination was changed to %q", content)
+	}
+	if fi, err := os.Lstat(filepath.Join(dir, "file")); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("file was not replaced by a regular file (%v)", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "link")); err != nil || target != "file" {
+		t.Errorf("link points to %q (%v)", target, err)
+	}
+}
+
+func TestExtractSkipAndPatch(t *testing.T) {
+	dir, _, cleanup := testDirs(t)
+	defer cleanup()
+	for _, name := range []string{"kept", "patched"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("old"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e := NewExtractor(dir)
+	e.Skip = func(name string) bool { return name == "kept" }
+	e.PatchSuffix = ".patch"
+	e.Patch = func(file *os.File, r io.Reader) error {
+		_, err := io.Copy(file, io.MultiReader(strings.NewReader("new+"), r))
+		return err
+	}
+	err := e.Extract(testTar(t,
+		tar.Header{Name: "kept", Typeflag: tar.TypeReg, Mode: 0644},
+		tar.Header{Name: "patched.patch", Typeflag: tar.TypeReg},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{"kept": "old", "patched": "new+patched.patch"} {
+		if content, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(content) != expected {
+			t.Errorf("%s is %q, expected %q", name, content, expected)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "kept")); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("mode of the skipped file was not set (%v)", err)
+	}
+	if exists, _ := Exists(filepath.Join(dir, "patched.patch")); exists {
+		t.Error("patch was extracted as a file")
+	}
+}